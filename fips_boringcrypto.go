@@ -0,0 +1,23 @@
+// +build boringcrypto
+
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+// Built with the boringcrypto Go toolchain (make build-fips), every TLS connection of the process, including those of
+// the trainer, LCM and etcd clients, is restricted to FIPS 140-2 validated crypto
+import _ "crypto/tls/fipsonly"
@@ -0,0 +1,267 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+//Package jmclient ... is the Go client of the APIs of the job monitor, for the trainer, the CLI and the UI backend.
+//It has no dependencies on the job monitor itself, so importing it doesn't pull in kubernetes or etcd
+package jmclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+//Job ... a job monitored by a job monitor
+type Job struct {
+	TrainingID       string    `json:"training_id"`
+	UserID           string    `json:"user_id"`
+	JobName          string    `json:"job_name"`
+	Framework        string    `json:"framework,omitempty"`
+	FrameworkVersion string    `json:"framework_version,omitempty"`
+	Status           string    `json:"status"`
+	MonitoredSince   time.Time `json:"monitored_since"`
+	Attempt          int       `json:"attempt"`
+	MaxAttempts      int       `json:"max_attempts,omitempty"`
+}
+
+//JobFilter ... restricts the jobs listed, zero values don't filter
+type JobFilter struct {
+	UserID    string
+	Status    string
+	Framework string
+	MinAge    time.Duration
+	MaxAge    time.Duration
+}
+
+//JobState ... what the job monitor believed the state of a job was at a point in time
+type JobState struct {
+	TrainingID      string         `json:"training_id"`
+	At              time.Time      `json:"at"`
+	Status          string         `json:"status"`
+	StatusSince     time.Time      `json:"status_since"`
+	Teardown        string         `json:"teardown,omitempty"`
+	TeardownSince   time.Time      `json:"teardown_since"`
+	LearnerStatuses map[int]string `json:"learner_statuses,omitempty"`
+	Events          []AuditEvent   `json:"events,omitempty"`
+	// the audit trail of the job ran out of budget, so the state may be behind
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+//AuditEvent ... an event of the audit trail of a job
+type AuditEvent struct {
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+//ResyncResult ... what a resync did for a job, see Client.Resync
+type ResyncResult struct {
+	TrainingID    string `json:"training_id"`
+	Status        string `json:"status,omitempty"`
+	TrainerStatus string `json:"trainer_status,omitempty"`
+	// the number of updates sent to the trainer, 0 if it was in sync already
+	Pushed int    `json:"pushed"`
+	Error  string `json:"error,omitempty"`
+}
+
+//JobView ... what the job monitor currently holds for a job next to what the trainer shows for it, see Client.View
+type JobView struct {
+	Job
+	AuthoritativeStatus string   `json:"authoritative_status"`
+	ErrorCode           string   `json:"error_code,omitempty"`
+	StatusMessage       string   `json:"status_message,omitempty"`
+	Reasons             []string `json:"reasons,omitempty"`
+	// empty with TrainerError set if the job monitor couldn't ask the trainer
+	TrainerStatus string `json:"trainer_status,omitempty"`
+	TrainerError  string `json:"trainer_error,omitempty"`
+	// the trainer shows another status than the job monitor holds, Client.ResyncJob brings it in line
+	Diverged bool            `json:"diverged"`
+	Teardown string          `json:"teardown,omitempty"`
+	Terminal bool            `json:"terminal"`
+	Leading  bool            `json:"leading"`
+	Learners []LearnerStatus `json:"learners,omitempty"`
+}
+
+//LearnerStatus ... the latest status a learner of a job reported, with the node of its pod
+type LearnerStatus struct {
+	Learner   int    `json:"learner"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
+
+//Client ... talks to the APIs of a job monitor
+type Client struct {
+	// e.g. http://jobmonitor-training-abc:8090
+	BaseURL string
+	// bearer token, if the job monitor requires one
+	Token string
+	// how long a call is retried on connection errors and 5xx answers, 0 means no retries
+	MaxRetryTime time.Duration
+	HTTPClient   *http.Client
+}
+
+//New ... creates a client of the job monitor at baseURL, retrying calls for up to a minute
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		Token:        token,
+		MaxRetryTime: time.Minute,
+		HTTPClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+//Error ... an error answer of the job monitor
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("job monitor answered %d: %s", e.StatusCode, e.Message)
+}
+
+//ListJobs ... lists a page of the monitored jobs matching filter, pass the returned page token to get the next page.
+//The page token is empty on the last page
+func (c *Client) ListJobs(ctx context.Context, filter JobFilter, pageToken string, pageSize int) ([]Job, string, error) {
+	query := url.Values{}
+	for param, value := range map[string]string{"user": filter.UserID, "status": filter.Status, "framework": filter.Framework, "page_token": pageToken} {
+		if value != "" {
+			query.Set(param, value)
+		}
+	}
+	if filter.MinAge > 0 {
+		query.Set("min_age", filter.MinAge.String())
+	}
+	if filter.MaxAge > 0 {
+		query.Set("max_age", filter.MaxAge.String())
+	}
+	if pageSize > 0 {
+		query.Set("page_size", strconv.Itoa(pageSize))
+	}
+
+	var page struct {
+		Jobs          []Job  `json:"jobs"`
+		NextPageToken string `json:"next_page_token"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/jobs?"+query.Encode(), &page); err != nil {
+		return nil, "", err
+	}
+	return page.Jobs, page.NextPageToken, nil
+}
+
+//DescribeAt ... reconstructs what the job monitor believed the state of the job was at the given time
+func (c *Client) DescribeAt(ctx context.Context, trainingID string, at time.Time) (*JobState, error) {
+	query := url.Values{"at": []string{at.UTC().Format(time.RFC3339)}}
+	state := &JobState{}
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(trainingID)+"/state?"+query.Encode(), state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+//Resync ... has the job monitor send the trainer the statuses of its jobs again, going back history, e.g. after the
+//trainer was restored from a backup. 0 means the default of the job monitor
+func (c *Client) Resync(ctx context.Context, history time.Duration) ([]ResyncResult, error) {
+	path := "/jobs/resync"
+	if history > 0 {
+		path += "?" + url.Values{"history": []string{history.String()}}.Encode()
+	}
+	var results struct {
+		Jobs []ResyncResult `json:"jobs"`
+	}
+	if err := c.do(ctx, http.MethodPost, path, &results); err != nil {
+		return nil, err
+	}
+	return results.Jobs, nil
+}
+
+//View ... the current view the job monitor has of a job, and the status the trainer has for it
+func (c *Client) View(ctx context.Context, trainingID string) (*JobView, error) {
+	view := &JobView{}
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(trainingID)+"/view", view); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+//ResyncJob ... like Resync, for a single job
+func (c *Client) ResyncJob(ctx context.Context, trainingID string, history time.Duration) (*ResyncResult, error) {
+	path := "/jobs/" + url.PathEscape(trainingID) + "/resync"
+	if history > 0 {
+		path += "?" + url.Values{"history": []string{history.String()}}.Encode()
+	}
+	result := &ResyncResult{}
+	if err := c.do(ctx, http.MethodPost, path, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Kill ... has the job monitor halt a job early, the reason ends up in the status message of the job
+func (c *Client) Kill(ctx context.Context, trainingID string, reason string) error {
+	query := url.Values{"reason": []string{reason}}
+	return c.do(ctx, http.MethodPost, "/jobs/"+url.PathEscape(trainingID)+"/kill?"+query.Encode(), nil)
+}
+
+//do calls the job monitor and decodes its JSON answer into result, retrying connection errors, 429 and 5xx answers
+func (c *Client) do(ctx context.Context, method string, path string, result interface{}) error {
+	retry := backoff.NewExponentialBackOff()
+	retry.MaxElapsedTime = c.MaxRetryTime
+	var policy backoff.BackOff = backoff.WithContext(retry, ctx)
+	if c.MaxRetryTime <= 0 {
+		policy = &backoff.StopBackOff{}
+	}
+
+	return backoff.Retry(func() error {
+		req, err := http.NewRequest(method, c.BaseURL+path, nil)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req = req.WithContext(ctx)
+		if c.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+		resp, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			message, _ := ioutil.ReadAll(resp.Body)
+			apiErr := &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				return apiErr
+			}
+			return backoff.Permanent(apiErr)
+		}
+		if result == nil {
+			return nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			return backoff.Permanent(err)
+		}
+		return nil
+	}, policy)
+}
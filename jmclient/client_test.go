@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jmclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListJobsRetriesAndAuthenticates(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "u1", r.URL.Query().Get("user"))
+		assert.Equal(t, "1h0m0s", r.URL.Query().Get("min_age"))
+		w.Write([]byte(`{"jobs": [{"training_id": "training-1", "status": "PROCESSING"}], "next_page_token": "training-1"}`))
+	}))
+	defer server.Close()
+
+	c := New(server.URL, "secret")
+	c.MaxRetryTime = 5 * time.Second
+	jobs, next, err := c.ListJobs(context.Background(), JobFilter{UserID: "u1", MinAge: time.Hour}, "", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "PROCESSING", jobs[0].Status)
+	assert.Equal(t, "training-1", next)
+}
+
+func TestListJobsDoesNotRetryClientErrors(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	_, _, err := New(server.URL, "wrong").ListJobs(context.Background(), JobFilter{}, "", 0)
+	assert.Equal(t, 1, calls)
+	if assert.IsType(t, &Error{}, err) {
+		assert.Equal(t, http.StatusUnauthorized, err.(*Error).StatusCode)
+	}
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+//JobView ... what the job monitor currently holds for a job next to what the trainer shows for it, for operators to
+//tell whether the two diverged
+type JobView struct {
+	JobInfo
+	// the status the job monitor holds authoritative, see authoritativeStatus
+	AuthoritativeStatus string       `json:"authoritative_status"`
+	ErrorCode           string       `json:"error_code,omitempty"`
+	StatusMessage       string       `json:"status_message,omitempty"`
+	Reasons             []ReasonCode `json:"reasons,omitempty"`
+	// the status of the job in the trainer, empty with TrainerError set if the trainer couldn't be asked
+	TrainerStatus string `json:"trainer_status,omitempty"`
+	TrainerError  string `json:"trainer_error,omitempty"`
+	// the trainer shows another status than the job monitor holds, a resync brings it in line
+	Diverged bool                 `json:"diverged"`
+	Teardown string               `json:"teardown,omitempty"`
+	Terminal bool                 `json:"terminal"`
+	Leading  bool                 `json:"leading"`
+	Learners []learnerStatusEntry `json:"learners,omitempty"`
+}
+
+//View ... the current view the job monitor has of the job, and the status the trainer has for it
+func (jm *JobMonitor) View(logr *logger.LocLoggingEntry) (*JobView, error) {
+	current, reasons, err := jm.authoritativeStatus(logr)
+	if err != nil {
+		return nil, err
+	}
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil {
+		return nil, err
+	}
+	_, terminal := jm.terminalLatch()
+	view := &JobView{
+		JobInfo:             jm.info(),
+		AuthoritativeStatus: current.Status.String(),
+		ErrorCode:           current.ErrorCode,
+		StatusMessage:       current.StatusMessage,
+		Reasons:             reasons,
+		Terminal:            terminal,
+		Leading:             jm.leading(),
+		Learners:            jm.learnerStatusEntries(jm.learnerPods(logr)),
+	}
+	if rec != nil {
+		view.Teardown = rec.State
+	}
+	if job, err := getTrainingJob(jm.lifecycle.Trainer, jm.TrainingID, jm.UserID, logr); err == nil {
+		view.TrainerStatus = job.GetTrainingStatus().GetStatus().String()
+		view.Diverged = view.TrainerStatus != view.AuthoritativeStatus
+	} else {
+		view.TrainerError = err.Error()
+	}
+	return view, nil
+}
+
+//AdminKill ... ends the job early on behalf of an operator: it gets a HALTED final status with errCodeAdminHalt and the
+//given reason, and is then torn down like any other halted job. A job which is terminal already is left alone
+func (jm *JobMonitor) AdminKill(reason string, logr *logger.LocLoggingEntry) error {
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("a reason is required to kill a job")
+	}
+	if status, terminal := jm.terminalLatch(); terminal {
+		return fmt.Errorf("training %s is %s already", jm.TrainingID, status)
+	}
+	logr.Warnf("(AdminKill) killing %s on behalf of an administrator: %s", jm.TrainingID, reason)
+	go jm.haltByAdministrator("killed by an administrator: "+reason, reason, logr)
+	return nil
+}
+
+//JobViewHandler ... serves View of the monitored jobs as JSON, e.g. GET /jobs/<training id>/view
+func JobViewHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jm, ok := adminJob(w, r, http.MethodGet)
+		if !ok {
+			return
+		}
+		view, err := jm.View(jm.componentLogger(nil, componentAPI))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(view)
+	})
+}
+
+//JobResyncHandler ... serves Resync of a single monitored job as JSON, e.g. POST /jobs/<training id>/resync?history=6h
+func JobResyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jm, ok := adminJob(w, r, http.MethodPost)
+		if !ok {
+			return
+		}
+		history := viper.GetDuration(resyncHistoryKey)
+		if value := r.URL.Query().Get("history"); value != "" {
+			var err error
+			if history, err = time.ParseDuration(value); err != nil || history < 0 {
+				http.Error(w, fmt.Sprintf("invalid history %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+		result := jm.Resync(history, jm.componentLogger(nil, componentAPI))
+		w.Header().Set("Content-Type", "application/json")
+		if result.Error == errNotLeader.Error() {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
+
+//JobKillHandler ... serves AdminKill of the monitored jobs, e.g. POST /jobs/<training id>/kill?reason=diverged+from+etcd
+func JobKillHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jm, ok := adminJob(w, r, http.MethodPost)
+		if !ok {
+			return
+		}
+		reason := r.URL.Query().Get("reason")
+		if strings.TrimSpace(reason) == "" {
+			http.Error(w, "a reason is required to kill a job", http.StatusBadRequest)
+			return
+		}
+		if err := jm.AdminKill(reason, jm.componentLogger(nil, componentAPI)); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+//adminJob finds the monitored job of /jobs/<id>/<resource>, answering the request itself if the method is not the
+//given one or the job is not monitored here
+func adminJob(w http.ResponseWriter, r *http.Request, method string) (*JobMonitor, bool) {
+	if r.Method != method {
+		http.Error(w, "use "+method, http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	id := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")[0]
+	monitoredJobsMu.RLock()
+	jm, ok := monitoredJobs[id]
+	monitoredJobsMu.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("training %s is not monitored here", id), http.StatusNotFound)
+	}
+	return jm, ok
+}
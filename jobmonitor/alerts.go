@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+)
+
+// the Events API v2 endpoint incidents are triggered through unless jobmonitor.alerts.pagerduty.url says otherwise
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// how long the alerts of a failed job are retried, they go out before the kill takes the job monitor down
+const alertRetryTime = 30 * time.Second
+
+//failureAlert ... what ops is told about a failed job
+type failureAlert struct {
+	TrainingID    string               `json:"training_id"`
+	UserID        string               `json:"user_id"`
+	JobName       string               `json:"job_name,omitempty"`
+	Namespace     string               `json:"namespace"`
+	Attempt       int                  `json:"attempt"`
+	ErrorCode     string               `json:"error_code,omitempty"`
+	StatusMessage string               `json:"status_message,omitempty"`
+	Reasons       []ReasonCode         `json:"reasons,omitempty"`
+	Learners      []learnerStatusEntry `json:"learners,omitempty"`
+}
+
+func (a failureAlert) summary() string {
+	return fmt.Sprintf("training %s of user %s failed with %s: %s", a.TrainingID, a.UserID, a.ErrorCode, a.StatusMessage)
+}
+
+//text is the alert as a Slack message
+func (a failureAlert) text() string {
+	lines := []string{fmt.Sprintf(":rotating_light: Training `%s` (job %s, user %s, namespace %s, attempt %d) *FAILED*",
+		a.TrainingID, a.JobName, a.UserID, a.Namespace, a.Attempt)}
+	lines = append(lines, fmt.Sprintf("Error code %s: %s", a.ErrorCode, a.StatusMessage))
+	if len(a.Reasons) > 0 {
+		reasons := make([]string, len(a.Reasons))
+		for i, r := range a.Reasons {
+			reasons[i] = string(r)
+		}
+		lines = append(lines, "Reasons: "+strings.Join(reasons, ", "))
+	}
+	for _, l := range a.Learners {
+		line := fmt.Sprintf("• learner %d: %s", l.Learner, l.Status)
+		if l.Node != "" {
+			line += " on " + l.Node
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+//alertFilter ... the failures ops wants to be alerted about, empty lists match everything
+type alertFilter struct {
+	errorCodes []string
+	users      []string
+	namespaces []string
+}
+
+func alertFilterFromConfig() alertFilter {
+	return alertFilter{
+		errorCodes: viper.GetStringSlice(alertErrorCodesKey),
+		users:      viper.GetStringSlice(alertUsersKey),
+		namespaces: viper.GetStringSlice(alertNamespacesKey),
+	}
+}
+
+func (f alertFilter) matches(a failureAlert) bool {
+	in := func(values []string, value string) bool {
+		if len(values) == 0 {
+			return true
+		}
+		for _, v := range values {
+			if strings.TrimSpace(v) == value {
+				return true
+			}
+		}
+		return false
+	}
+	return in(f.errorCodes, a.ErrorCode) && in(f.users, a.UserID) && in(f.namespaces, a.Namespace)
+}
+
+//alertOnFailure posts a message to the Slack webhook of jobmonitor.alerts.slack.webhook_url and triggers a PagerDuty
+//incident through the integration of jobmonitor.alerts.pagerduty.routing_key, whichever are set, if the final status in
+//rec is FAILED and passes the filters of jobmonitor.alerts. It runs once the trainer took the final status, without
+//holding up the teardown. The teardown record notes that the alert went out before it is sent, so a job monitor
+//restarting midway doesn't send it again, and the incident is deduplicated by training and attempt on top
+func (jm *JobMonitor) alertOnFailure(rec *teardownRecord, logr *logger.LocLoggingEntry) {
+	slackURL, routingKey := viper.GetString(alertSlackWebhookKey), viper.GetString(alertPagerDutyRoutingKey)
+	if rec.Status != grpc_trainer_v2.Status_FAILED.String() || (slackURL == "" && routingKey == "") {
+		return
+	}
+	alert := failureAlert{TrainingID: jm.TrainingID, UserID: jm.UserID, JobName: jm.JobName, Namespace: config.GetLearnerNamespace(),
+		Attempt: jm.Attempt(), ErrorCode: rec.ErrorCode, StatusMessage: rec.StatusMessage, Reasons: rec.Reasons,
+		Learners: jm.learnerStatusEntries(jm.learnerPods(logr))}
+	if !alertFilterFromConfig().matches(alert) {
+		return
+	}
+	if !jm.claimAlert(logr) {
+		return
+	}
+
+	send := func(target string, post func() error) {
+		retry := jm.exponentialBackoff(alertRetryTime, backoff.DefaultMaxInterval)
+		if err := retryNotify(jm.timeSource(), post, retry, nil); err != nil {
+			logr.WithError(err).Errorf("(alertOnFailure) failed to alert %s about the failure of %s", target, jm.TrainingID)
+			return
+		}
+		logr.Infof("(alertOnFailure) alerted %s about the failure of %s", target, jm.TrainingID)
+	}
+	if slackURL != "" {
+		send("slack", func() error { return postAlert(slackURL, map[string]string{"text": alert.text()}) })
+	}
+	if routingKey != "" {
+		event := map[string]interface{}{
+			"routing_key":  routingKey,
+			"event_action": "trigger",
+			"dedup_key":    fmt.Sprintf("%s/%d", alert.TrainingID, alert.Attempt),
+			"payload": map[string]interface{}{
+				"summary":        alert.summary(),
+				"source":         alert.Namespace + "/" + alert.TrainingID,
+				"severity":       "error",
+				"component":      "job-monitor",
+				"class":          alert.ErrorCode,
+				"custom_details": alert,
+			},
+		}
+		send("pagerduty", func() error { return postAlert(viper.GetString(alertPagerDutyURLKey), event) })
+	}
+}
+
+//claimAlert records in the teardown record that the failure alert of the job goes out, it returns false if it went out
+//already or that can't be recorded. The teardown moving on meanwhile makes it try again
+func (jm *JobMonitor) claimAlert(logr *logger.LocLoggingEntry) bool {
+	for attempt := 0; attempt < 3; attempt++ {
+		rec, old, err := jm.loadTeardown(logr)
+		if err != nil || rec == nil {
+			logr.WithError(err).Warnf("(alertOnFailure) failed to read the teardown record of %s, not alerting", jm.TrainingID)
+			return false
+		}
+		if rec.Alerted {
+			return false
+		}
+		rec.Alerted = true
+		swapped, err := jm.EtcdClient.CompareAndSwap(teardownPath(jm.TrainingID), rec.encode(), old, logr)
+		if err != nil {
+			logr.WithError(err).Warnf("(alertOnFailure) failed to record the failure alert of %s, not alerting", jm.TrainingID)
+			return false
+		}
+		if swapped {
+			return true
+		}
+	}
+	logr.Warnf("(alertOnFailure) the teardown record of %s keeps changing, not alerting", jm.TrainingID)
+	return false
+}
+
+func postAlert(url string, body interface{}) error {
+	value, err := json.Marshal(body)
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	client, err := httpClient()
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(value))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("rejected by %s (%s): %s", url, resp.Status, strings.TrimSpace(string(reason)))
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return backoff.Permanent(err)
+		}
+	}
+	return err
+}
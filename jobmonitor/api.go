@@ -0,0 +1,102 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+//APIAddr ... the address the APIs of the job monitor are served on, empty if they are not served
+func APIAddr() string {
+	return viper.GetString(apiAddrKey)
+}
+
+//ServeAPI ... serves the APIs of the job monitor on addr:
+//  GET /jobs                the monitored jobs, see JobsHandler
+//  GET /jobs/<id>/state     the state of a job at a point in time, see JobStateHandler
+//  GET /jobs/<id>/outcome   the outcome notifications of a job, see OutcomeDeliveryHandler
+//  GET /jobs/<id>/view      the current view of a job next to the status the trainer has, see JobViewHandler
+//  POST /jobs/<id>/resync   sends the trainer the statuses of a job again, see JobResyncHandler
+//  POST /jobs/<id>/kill     halts a job early, see JobKillHandler
+//  POST /jobs/halt          halts the jobs of a user, tenant or label, see HaltJobsHandler
+//  POST /jobs/resync        sends the trainer the statuses of the monitored jobs again, see ResyncHandler
+//If jobmonitor.api.token is set, requests have to carry it as a bearer token. Without a token the endpoints which
+//resync, kill or halt jobs refuse all requests, only the read-only ones are served
+func ServeAPI(addr string, logr *logger.LocLoggingEntry) {
+	mux := http.NewServeMux()
+	mux.Handle("/jobs", requireAPIToken(JobsHandler()))
+	mux.Handle("/jobs/halt", requireAPIToken(refuseWithoutAPIToken(HaltJobsHandler(), logr)))
+	mux.Handle("/jobs/resync", requireAPIToken(refuseWithoutAPIToken(ResyncHandler(), logr)))
+	mux.Handle("/jobs/", requireAPIToken(jobResourceHandler(map[string]http.Handler{
+		"state":   JobStateHandler(),
+		"outcome": OutcomeDeliveryHandler(),
+		"view":    JobViewHandler(),
+		"resync":  refuseWithoutAPIToken(JobResyncHandler(), logr),
+		"kill":    refuseWithoutAPIToken(JobKillHandler(), logr),
+	})))
+
+	logr.Infof("serving the job monitor APIs on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logr.WithError(err).Errorf("failed to serve the job monitor APIs on %s", addr)
+		}
+	}()
+}
+
+func requireAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := viper.GetString(apiTokenKey)
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//refuseWithoutAPIToken refuses the requests to an endpoint which changes jobs if no jobmonitor.api.token is set, so
+//that an API served without a token can't be used to kill or halt jobs by anyone who reaches it
+func refuseWithoutAPIToken(next http.Handler, logr *logger.LocLoggingEntry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if viper.GetString(apiTokenKey) == "" {
+			logr.Warnf("refused %s %s from %s, %s is not set", r.Method, r.URL.Path, r.RemoteAddr, apiTokenKey)
+			http.Error(w, "forbidden, the job monitor has no API token configured", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//jobResourceHandler passes /jobs/<id>/<resource> on to the handler of the resource
+func jobResourceHandler(resources map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+		if handler, ok := resources[path[len(path)-1]]; ok && len(path) == 2 {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+}
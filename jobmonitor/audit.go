@@ -0,0 +1,252 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/spf13/viper"
+)
+
+const zkAudit = "audit"
+
+// kinds of the audit events
+const (
+	auditLateWrite        = "late_write"
+	auditTransition       = "transition"
+	auditTeardown         = "teardown"
+	auditFinalStatus      = "final_status"
+	auditRequeue          = "requeue"
+	auditLeader           = "leader"
+	auditAuxiliary        = "auxiliary"
+	auditStaleUpdate      = "stale_update"
+	auditNodeFailure      = "node_failure"
+	auditAdminHalt        = "admin_halt"
+	auditResync           = "resync"
+	auditHalfOpen         = "half_open"
+	auditUserHalt         = "user_halt"
+	auditPause            = "pause"
+	auditResume           = "resume"
+	auditLearnerRestart   = "learner_restart"
+	auditToleratedFailure = "tolerated_failure"
+	auditResize           = "resize"
+	auditEarlyStop        = "early_stop"
+)
+
+// how often the pending audit events of a job are written out
+const auditFlushInterval = 30 * time.Second
+
+// how many later keys a batch tries when the key of its first event is taken already
+const auditKeyAttempts = 16
+
+//the audit trail of a job is kept as <training id>/audit/<unix nanos of the first event>, each value a base64 encoded,
+//gzip compressed JSON array of events. Base64 keeps the values text, as the etcd values are everywhere else, so they
+//survive the string based coordinator and the JSON of a state export
+func auditPath(trainingID string) string {
+	return trainingID + "/" + zkAudit + "/"
+}
+
+type auditEvent struct {
+	At     int64  `json:"at"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+	// the status the event moved the job to, or for teardown events the state of the teardown
+	Status string `json:"status,omitempty"`
+}
+
+//auditTrail ... collects the audit events of a job and writes them in compressed batches, so that capturing the
+//history of a high churn job does not multiply the etcd traffic of the job. Each job monitor gets a budget of compressed
+//bytes, events beyond it are counted but dropped. The batches are written by one flush at a time, a full batch asks
+//keepFlushingAudit for it through flushNow. The budget holds for the training: what the job monitors before a restart or
+//requeue wrote counts, read from etcd by the first flush
+type auditTrail struct {
+	mu       sync.Mutex
+	pending  []auditEvent
+	loaded   bool
+	written  int
+	dropped  int
+	flushing sync.Mutex
+	flushNow chan struct{}
+}
+
+//audit records an event of the job, it's written out with the next batch
+func (jm *JobMonitor) audit(logr *logger.LocLoggingEntry, kind string, format string, args ...interface{}) {
+	jm.recordAudit(logr, auditEvent{At: jm.timeSource().Now().UnixNano(), Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+//auditStatus records an event which moved the job to status
+func (jm *JobMonitor) auditStatus(logr *logger.LocLoggingEntry, kind string, status string, format string, args ...interface{}) {
+	jm.recordAudit(logr, auditEvent{At: jm.timeSource().Now().UnixNano(), Kind: kind, Detail: fmt.Sprintf(format, args...), Status: status})
+}
+
+func (jm *JobMonitor) recordAudit(logr *logger.LocLoggingEntry, event auditEvent) {
+	jm.auditTrail.mu.Lock()
+	jm.auditTrail.pending = append(jm.auditTrail.pending, event)
+	full := len(jm.auditTrail.pending) >= viper.GetInt(auditBatchSizeKey)
+	jm.auditTrail.mu.Unlock()
+	if full {
+		select {
+		case jm.auditTrail.flushNow <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//keepFlushingAudit writes the pending audit events out every auditFlushInterval
+func (jm *JobMonitor) keepFlushingAudit(logr *logger.LocLoggingEntry) {
+	ticker := jm.timeSource().NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-jm.Done():
+			jm.flushAudit(logr)
+			return
+		case <-ticker.C():
+			jm.flushAudit(logr)
+		case <-jm.auditTrail.flushNow:
+			jm.flushAudit(logr)
+		}
+	}
+}
+
+//flushAudit writes the pending audit events of the job as one compressed batch. The batch is taken out of the pending
+//events so that the events recorded meanwhile don't wait for etcd, and put back in front of them if it can't be written.
+//A batch whose key is taken, by the job monitor of the job before a restart, goes to the next free one
+func (jm *JobMonitor) flushAudit(logr *logger.LocLoggingEntry) {
+	jm.auditTrail.flushing.Lock()
+	defer jm.auditTrail.flushing.Unlock()
+	jm.auditTrail.mu.Lock()
+	batch := jm.auditTrail.pending
+	jm.auditTrail.pending = nil
+	loaded := jm.auditTrail.loaded
+	jm.auditTrail.mu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	requeue := func() {
+		jm.auditTrail.mu.Lock()
+		jm.auditTrail.pending = append(batch, jm.auditTrail.pending...)
+		jm.auditTrail.mu.Unlock()
+	}
+	if !loaded {
+		written, err := jm.writtenAuditBytes(logr)
+		if err != nil {
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			logr.WithError(err).Warnf("(audit) failed to read the audit trail of %s, keeping its events for the next batch", jm.TrainingID)
+			requeue()
+			return
+		}
+		jm.auditTrail.mu.Lock()
+		jm.auditTrail.written, jm.auditTrail.loaded = written, true
+		jm.auditTrail.mu.Unlock()
+	}
+
+	encoded, err := encodeAuditBatch(batch)
+	if err != nil {
+		logr.WithError(err).Warnf("(audit) failed to encode %d audit events of %s", len(batch), jm.TrainingID)
+		return
+	}
+
+	jm.auditTrail.mu.Lock()
+	written := jm.auditTrail.written
+	jm.auditTrail.mu.Unlock()
+	if budget := viper.GetInt(auditBudgetKey); written+len(encoded) > budget {
+		jm.auditTrail.mu.Lock()
+		if jm.auditTrail.dropped == 0 {
+			logr.Warnf("(audit) audit trail of %s reached its budget of %d bytes, dropping further events", jm.TrainingID, budget)
+		}
+		jm.auditTrail.dropped += len(batch)
+		jm.auditTrail.mu.Unlock()
+		jm.metrics.droppedAuditEventCounter.Add(float64(len(batch)))
+		return
+	}
+
+	for i := int64(0); i < auditKeyAttempts; i++ {
+		key := fmt.Sprintf("%s%019d", auditPath(jm.TrainingID), batch[0].At+i)
+		created, err := jm.EtcdClient.PutIfKeyMissing(key, encoded, logr)
+		if err != nil {
+			// keep the events, they go out with the next batch
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			logr.WithError(err).Warnf("(audit) failed to write %d audit events of %s", len(batch), jm.TrainingID)
+			requeue()
+			return
+		}
+		if created {
+			jm.auditTrail.mu.Lock()
+			jm.auditTrail.written += len(encoded)
+			jm.auditTrail.mu.Unlock()
+			return
+		}
+	}
+	logr.Warnf("(audit) found no free key for %d audit events of %s, keeping them for the next batch", len(batch), jm.TrainingID)
+	requeue()
+}
+
+//writtenAuditBytes sums up the size of the audit batches of the job in etcd
+func (jm *JobMonitor) writtenAuditBytes(logr *logger.LocLoggingEntry) (int, error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	response, err := etcd.Get(ctx, auditPath(jm.TrainingID), clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for _, kv := range response.Kvs {
+		written += len(kv.Value)
+	}
+	return written, nil
+}
+
+func encodeAuditBatch(batch []auditEvent) (string, error) {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(zw).Encode(batch); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(compressed.Bytes()), nil
+}
+
+func decodeAuditBatch(value []byte) ([]auditEvent, error) {
+	compressed, err := base64.StdEncoding.DecodeString(string(value))
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var batch []auditEvent
+	err = json.NewDecoder(zr).Decode(&batch)
+	return batch, err
+}
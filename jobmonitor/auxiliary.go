@@ -0,0 +1,257 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/spf13/viper"
+
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const zkAuxiliary = "auxiliary"
+
+const errCodeAuxiliaryFailed = "AUXILIARY_FAILED"
+
+// grpc metadata key carrying the health of the auxiliary services of the job, e.g. "tensorboard=running,ps=failed"
+const auxiliaryHeader = "auxiliary-services"
+
+// health of an auxiliary service, from the best to the worst
+const (
+	auxiliaryCompleted = "completed"
+	auxiliaryRunning   = "running"
+	auxiliaryPending   = "pending"
+	auxiliaryMissing   = "missing"
+	auxiliaryFailed    = "failed"
+)
+
+var auxiliarySeverity = map[string]int{auxiliaryCompleted: 0, auxiliaryRunning: 1, auxiliaryPending: 2, auxiliaryMissing: 3, auxiliaryFailed: 4}
+
+// waiting reasons of a container which won't get better by waiting
+var auxiliaryFailedWaiting = map[string]bool{"CrashLoopBackOff": true, "ImagePullBackOff": true, "ErrImagePull": true}
+
+//auxiliaryService ... a service the LCM deploys along with the learners of a job, e.g. tensorboard or parameter
+//servers. Its pods are selected with the label selector Selector, "{training_id}" standing for the training id
+type auxiliaryService struct {
+	Name     string
+	Selector string
+}
+
+//auxiliaryHealth is the value of the etcd key of an auxiliary service, see auxiliaryServicePath
+type auxiliaryHealth struct {
+	State     string `json:"state"`
+	Pod       string `json:"pod,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+//auxiliaryServices ... the latest health of the auxiliary services of a job, by name
+type auxiliaryServices struct {
+	mu     sync.Mutex
+	health map[string]auxiliaryHealth
+}
+
+//the health of an auxiliary service is kept apart from the statuses of the learners, as <training id>/auxiliary/<name>
+func auxiliaryServicePath(trainingID string, name string) string {
+	return trainingID + "/" + zkAuxiliary + "/" + name
+}
+
+//configuredAuxiliaryServices parses jobmonitor.auxiliary.services, whose entries are either the value of the service
+//label of the pods, e.g. "tensorboard", or name=selector for pods labeled otherwise
+func configuredAuxiliaryServices() []auxiliaryService {
+	var services []auxiliaryService
+	for _, entry := range viper.GetStringSlice(auxiliaryServicesKey) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		service := auxiliaryService{Name: entry, Selector: "training_id=={training_id},service==" + entry}
+		if i := strings.Index(entry, "="); i > 0 {
+			service = auxiliaryService{Name: entry[:i], Selector: entry[i+1:]}
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+func (s auxiliaryService) selector(trainingID string) string {
+	return strings.Replace(s.Selector, "{training_id}", trainingID, -1)
+}
+
+//critical tells whether a failure of the service fails the job, see jobmonitor.auxiliary.critical. Other auxiliary
+//services are reported, but don't change the outcome of the training
+func (s auxiliaryService) critical() bool {
+	for _, name := range viper.GetStringSlice(auxiliaryCriticalKey) {
+		if name == s.Name {
+			return true
+		}
+	}
+	return false
+}
+
+//isAuxiliaryPod tells whether the pod of the training belongs to an auxiliary service rather than to the training
+//itself, that is whether the selector of one of the services selects it
+func isAuxiliaryPod(pod v1core.Pod, trainingID string, services []auxiliaryService) bool {
+	for _, s := range services {
+		selector, err := labels.Parse(s.selector(trainingID))
+		if err == nil && selector.Matches(labels.Set(pod.ObjectMeta.Labels)) {
+			return true
+		}
+	}
+	return false
+}
+
+//auxiliaryPodsHealth sums the pods of an auxiliary service up to the health of their worst pod
+func auxiliaryPodsHealth(pods []v1core.Pod) auxiliaryHealth {
+	if len(pods) == 0 {
+		return auxiliaryHealth{State: auxiliaryMissing}
+	}
+	worst := auxiliaryHealth{State: auxiliaryCompleted}
+	for _, pod := range pods {
+		health := auxiliaryHealth{Pod: pod.ObjectMeta.Name, Message: pod.Status.Message}
+		switch pod.Status.Phase {
+		case v1core.PodSucceeded:
+			health.State = auxiliaryCompleted
+		case v1core.PodFailed:
+			health.State = auxiliaryFailed
+		case v1core.PodRunning:
+			health.State = auxiliaryRunning
+		default:
+			health.State = auxiliaryPending
+		}
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			if waiting := containerStatus.State.Waiting; waiting != nil && auxiliaryFailedWaiting[waiting.Reason] {
+				health.State = auxiliaryFailed
+				health.Message = fmt.Sprintf("container %s: %s %s", containerStatus.Name, waiting.Reason, waiting.Message)
+			}
+		}
+		if auxiliarySeverity[health.State] > auxiliarySeverity[worst.State] {
+			worst = health
+		}
+	}
+	return worst
+}
+
+//auxiliaryPods lists the pods of an auxiliary service of the job
+func (jm *JobMonitor) auxiliaryPods(s auxiliaryService) ([]v1core.Pod, error) {
+	pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: s.selector(jm.TrainingID)})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+//monitorAuxiliaryServices checks the health of the auxiliary services of the job every learner poll interval, until
+//the job monitor stops
+func (jm *JobMonitor) monitorAuxiliaryServices(services []auxiliaryService, logr *logger.LocLoggingEntry) {
+	ticker := jm.timeSource().NewTicker(jm.learnerPollInterval())
+	defer ticker.Stop()
+	for {
+		for _, s := range services {
+			jm.checkAuxiliaryService(s, logr)
+		}
+		select {
+		case <-jm.context().Done():
+			return
+		case <-ticker.C():
+		}
+	}
+}
+
+//checkAuxiliaryService records the health of an auxiliary service in etcd when it changed. A failure is reported, and
+//fails the job if the service is critical
+func (jm *JobMonitor) checkAuxiliaryService(s auxiliaryService, logr *logger.LocLoggingEntry) {
+	pods, err := jm.auxiliaryPods(s)
+	if err != nil {
+		logr.WithError(err).Warnf("(checkAuxiliaryService) failed to list the pods of the auxiliary service %s of %s", s.Name, jm.TrainingID)
+		return
+	}
+	health := auxiliaryPodsHealth(pods)
+	health.Timestamp = client.CurrentTimestampAsString()
+
+	a := &jm.auxiliary
+	a.mu.Lock()
+	if a.health == nil {
+		a.health = make(map[string]auxiliaryHealth)
+	}
+	previous, seen := a.health[s.Name]
+	a.health[s.Name] = health
+	a.mu.Unlock()
+	if seen && previous.State == health.State {
+		return
+	}
+
+	value, _ := json.Marshal(health)
+	if err := jm.EtcdClient.Put(auxiliaryServicePath(jm.TrainingID, s.Name), string(value), logr); err != nil {
+		logr.WithError(err).Warnf("(checkAuxiliaryService) failed to record the health of the auxiliary service %s of %s", s.Name, jm.TrainingID)
+	}
+	if health.State != auxiliaryFailed {
+		logr.Infof("(checkAuxiliaryService) auxiliary service %s of %s is %s", s.Name, jm.TrainingID, health.State)
+		return
+	}
+
+	jm.metrics.failedAuxiliaryCounter.Add(1)
+	message := fmt.Sprintf("auxiliary service %s failed (pod %s): %s", s.Name, health.Pod, health.Message)
+	jm.audit(logr, auditAuxiliary, "%s", message)
+	if _, terminal := jm.terminalLatch(); !s.critical() || terminal {
+		logr.Warnf("(checkAuxiliaryService) %s of %s, the training goes on", message, jm.TrainingID)
+		return
+	}
+	logr.Errorf("(checkAuxiliaryService) %s of %s, failing the job", message, jm.TrainingID)
+	jm.sendFinalStatus(failedStatusUpdate(errCodeAuxiliaryFailed, message), []ReasonCode{ReasonAuxiliaryFailed}, logr)
+	jm.killDeployedJob(logr)
+}
+
+//auxiliarySummary is the latest health of the auxiliary services of the job, e.g. "ps=failed,tensorboard=running",
+//empty if the job has none
+func (jm *JobMonitor) auxiliarySummary() string {
+	a := &jm.auxiliary
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	summaries := make([]string, 0, len(a.health))
+	for name, health := range a.health {
+		summaries = append(summaries, name+"="+health.State)
+	}
+	sort.Strings(summaries)
+	return strings.Join(summaries, ",")
+}
+
+//auxiliaryPodsRemaining tells whether pods of an auxiliary service are left, their selector doesn't need to carry the
+//training id label
+func (jm *JobMonitor) auxiliaryPodsRemaining(logr *logger.LocLoggingEntry) bool {
+	for _, s := range configuredAuxiliaryServices() {
+		pods, err := jm.auxiliaryPods(s)
+		if err != nil {
+			logr.WithError(err).Warnf("failed to list the pods of the auxiliary service %s of training %s while verifying teardown", s.Name, jm.TrainingID)
+			return true
+		}
+		if len(pods) > 0 {
+			return true
+		}
+	}
+	return false
+}
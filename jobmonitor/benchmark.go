@@ -0,0 +1,348 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+	"google.golang.org/grpc"
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+//BenchmarkConfig ... the load RunBenchmark puts on the job monitor
+type BenchmarkConfig struct {
+	// simulated jobs, each monitored by a job monitor of its own as in production
+	Jobs int
+	// simulated learners of each job
+	Learners int
+	// statuses each learner writes: DOWNLOADING, PROCESSING until the last two, STORING and COMPLETED. At least 4
+	Statuses int
+	// time between two statuses of a learner
+	Interval time.Duration
+	// how long the job monitors get to see the jobs through after the last status was written, 5 minutes if 0
+	Timeout time.Duration
+	// the etcd the statuses are written to and watched in, the one of the global configuration if not set
+	Etcd coord.Config
+	// keep etcd in memory instead, so that the job monitor is measured without etcd
+	InMemory bool
+}
+
+//BenchmarkReport ... what RunBenchmark measured
+type BenchmarkReport struct {
+	Jobs            int           `json:"jobs"`
+	Learners        int           `json:"learners"`
+	Duration        time.Duration `json:"duration"`
+	StatusesWritten int64         `json:"statuses_written"`
+	// jobs the trainer got a COMPLETED update of before the timeout
+	JobsCompleted int `json:"jobs_completed"`
+	// calls to etcd through the coordinators of the job monitors, the watches are not counted
+	EtcdOps          int64   `json:"etcd_ops"`
+	EtcdOpsPerSecond float64 `json:"etcd_ops_per_second"`
+	// calls the trainer would have received
+	TrainerUpdates int64 `json:"trainer_updates"`
+	TrainerGets    int64 `json:"trainer_gets"`
+	// from the timestamp of a status to its update of the trainer going out
+	LatencyP50 time.Duration `json:"latency_p50"`
+	LatencyP95 time.Duration `json:"latency_p95"`
+	LatencyP99 time.Duration `json:"latency_p99"`
+	LatencyMax time.Duration `json:"latency_max"`
+}
+
+func (r *BenchmarkReport) String() string {
+	return fmt.Sprintf("%d jobs of %d learners in %v: %d statuses written, %d jobs completed, %d etcd ops (%.1f/s), "+
+		"%d trainer updates and %d trainer gets, update latency p50 %v p95 %v p99 %v max %v", r.Jobs, r.Learners,
+		r.Duration-r.Duration%time.Millisecond, r.StatusesWritten, r.JobsCompleted, r.EtcdOps, r.EtcdOpsPerSecond,
+		r.TrainerUpdates, r.TrainerGets, r.LatencyP50, r.LatencyP95, r.LatencyP99, r.LatencyMax)
+}
+
+//benchmarkTrainer ... the trainer client of the job monitors of a benchmark: it counts the calls instead of making them.
+//The job monitor only updates and gets jobs, the other calls are not implemented
+type benchmarkTrainer struct {
+	grpc_trainer_v2.TrainerClient
+	updates, gets int64
+	mu            sync.Mutex
+	latencies     []time.Duration
+	completed     map[string]bool
+}
+
+func (t *benchmarkTrainer) UpdateTrainingJob(ctx context.Context, req *grpc_trainer_v2.UpdateRequest, opts ...grpc.CallOption) (*grpc_trainer_v2.UpdateResponse, error) {
+	atomic.AddInt64(&t.updates, 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if written, ok := parseStatusTimestamp(req.Timestamp); ok {
+		t.latencies = append(t.latencies, time.Since(written))
+	}
+	if req.Status == grpc_trainer_v2.Status_COMPLETED {
+		t.completed[req.TrainingId] = true
+	}
+	return &grpc_trainer_v2.UpdateResponse{}, nil
+}
+
+func (t *benchmarkTrainer) GetTrainingJob(ctx context.Context, req *grpc_trainer_v2.GetRequest, opts ...grpc.CallOption) (*grpc_trainer_v2.GetResponse, error) {
+	atomic.AddInt64(&t.gets, 1)
+	return &grpc_trainer_v2.GetResponse{Job: &grpc_trainer_v2.Job{TrainingId: req.TrainingId, UserId: req.UserId}}, nil
+}
+
+//countedCoordinator ... counts the calls to etcd made through a coordinator
+type countedCoordinator struct {
+	coord.Coordinator
+	ops *int64
+}
+
+func (c countedCoordinator) Put(key string, value string, logr *logger.LocLoggingEntry) error {
+	atomic.AddInt64(c.ops, 1)
+	return c.Coordinator.Put(key, value, logr)
+}
+
+func (c countedCoordinator) PutIfKeyMissing(key string, value string, logr *logger.LocLoggingEntry) (bool, error) {
+	atomic.AddInt64(c.ops, 1)
+	return c.Coordinator.PutIfKeyMissing(key, value, logr)
+}
+
+func (c countedCoordinator) CompareAndSwap(key string, value string, prevValue string, logr *logger.LocLoggingEntry) (bool, error) {
+	atomic.AddInt64(c.ops, 1)
+	return c.Coordinator.CompareAndSwap(key, value, prevValue, logr)
+}
+
+func (c countedCoordinator) Get(key string, logr *logger.LocLoggingEntry) ([]coord.EtcdKVGetResponse, error) {
+	atomic.AddInt64(c.ops, 1)
+	return c.Coordinator.Get(key, logr)
+}
+
+func (c countedCoordinator) sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	atomic.AddInt64(c.ops, 1)
+	return readSequence(c.Coordinator, prefix, logr)
+}
+
+//benchmarkStatuses are the statuses a simulated learner writes, see BenchmarkConfig.Statuses
+func benchmarkStatuses(n int) []grpc_trainer_v2.Status {
+	if n < 4 {
+		n = 4
+	}
+	statuses := []grpc_trainer_v2.Status{grpc_trainer_v2.Status_DOWNLOADING}
+	for len(statuses) < n-2 {
+		statuses = append(statuses, grpc_trainer_v2.Status_PROCESSING)
+	}
+	return append(statuses, grpc_trainer_v2.Status_STORING, grpc_trainer_v2.Status_COMPLETED)
+}
+
+//percentile returns the p-th percentile of the sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+//benchmarkPods are the running pods of a simulated job: its learners, the helper and the job monitor
+func benchmarkPods(trainingID string, learners int) []runtime.Object {
+	pod := func(name string, labels map[string]string) runtime.Object {
+		labels["training_id"] = trainingID
+		return &v1core.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: config.GetLearnerNamespace(), Labels: labels},
+			Status:     v1core.PodStatus{Phase: v1core.PodRunning},
+		}
+	}
+	pods := []runtime.Object{pod("lhelper-"+trainingID, map[string]string{}), pod("jobmonitor-"+trainingID, map[string]string{})}
+	for i := 1; i <= learners; i++ {
+		pods = append(pods, pod(fmt.Sprintf("learner-%s-%d", trainingID, i-1), map[string]string{"service": learnerServiceLabel}))
+	}
+	return pods
+}
+
+//RunBenchmark ... puts the load of cfg.Jobs simulated jobs with cfg.Learners simulated learners each on the job
+//monitor and measures what it takes: the latency of the trainer updates, the etcd calls per second and the number of
+//trainer calls, so that a change making the job monitor scale worse is noticed before it reaches production. Each job
+//gets a job monitor of its own, backed by a fake kubernetes whose pods are deleted when the job is killed, and by an
+//in-memory etcd if cfg.InMemory is set. The trainer is not called, the job monitors are given a client which
+//only counts the calls. The keys of the simulated jobs are removed afterwards
+func RunBenchmark(cfg BenchmarkConfig, logr *logger.LocLoggingEntry) (*BenchmarkReport, error) {
+	if cfg.Jobs <= 0 || cfg.Learners <= 0 {
+		return nil, fmt.Errorf("a benchmark needs at least one job and one learner, not %d and %d", cfg.Jobs, cfg.Learners)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Minute
+	}
+	trainer := &benchmarkTrainer{completed: make(map[string]bool)}
+
+	var memory *memoryEtcd
+	var etcd *etcdClient
+	if cfg.InMemory {
+		memory = newMemoryEtcd()
+		etcd = memory.client()
+	} else {
+		if len(cfg.Etcd.Endpoints) == 0 {
+			cfg.Etcd = defaultCoordinatorConfig()
+		}
+		var err error
+		if etcd, err = newEtcdClient(cfg.Etcd, logr); err != nil {
+			return nil, err
+		}
+	}
+	defer etcd.Close()
+
+	run := fmt.Sprintf("benchmark-%d", time.Now().UnixNano())
+	var ops int64
+	var jobs []*JobMonitor
+	defer func() {
+		for _, jm := range jobs {
+			ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+			jm.Stop(ctx, logr)
+			etcd.Delete(ctx, jobBasePath(jm.TrainingID), clientv3.WithPrefix())
+			cancel()
+			jm.unregister()
+		}
+	}()
+	for n := 1; n <= cfg.Jobs; n++ {
+		trainingID := fmt.Sprintf("%s-%d", run, n)
+		k8s := fake.NewSimpleClientset(benchmarkPods(trainingID, cfg.Learners)...)
+		jobCfg := withProcessConfig(Config{
+			TrainingID:  trainingID,
+			UserID:      run,
+			JobName:     trainingID,
+			NumLearners: cfg.Learners,
+			Etcd:        cfg.Etcd,
+			K8sClient:   k8s,
+			Killer:      benchmarkKiller(k8s),
+			Lifecycle:   LifecycleClients{Trainer: trainer},
+		})
+		var jobCoordinator coord.Coordinator
+		if memory != nil {
+			jobCoordinator, jobCfg.etcd = memory.coordinator(), memory.client()
+		} else {
+			var err error
+			if jobCoordinator, err = coordinator(cfg.Etcd, logr); err != nil {
+				return nil, err
+			}
+		}
+		jobCfg.Coordinator = countedCoordinator{jobCoordinator, &ops}
+		jm, err := New(jobCfg, logr)
+		if err != nil {
+			jobCoordinator.Close(logr)
+			return nil, err
+		}
+		jobs = append(jobs, jm)
+	}
+
+	logr.Infof("(RunBenchmark) monitoring %d jobs of %d learners", cfg.Jobs, cfg.Learners)
+	// the real throughput is measured, so the benchmark runs on the wall clock
+	start := time.Now()
+	for _, jm := range jobs {
+		jm.ManageDistributedJob(jm.componentLogger(logr, componentStatus))
+	}
+	var written int64
+	var writers sync.WaitGroup
+	for _, jm := range jobs {
+		for learner := 1; learner <= cfg.Learners; learner++ {
+			writers.Add(1)
+			go func(trainingID string, learner int) {
+				defer writers.Done()
+				for seq, status := range benchmarkStatuses(cfg.Statuses) {
+					time.Sleep(cfg.Interval)
+					value := fmt.Sprintf(`{"status": "%s", "timestamp": "%d"}`, status, time.Now().UnixNano()/int64(time.Millisecond))
+					ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+					_, err := etcd.Put(ctx, fmt.Sprintf("%s%020d", indvidualJobStatusPath(trainingID, learner), seq+1), value)
+					cancel()
+					if err != nil {
+						logr.WithError(err).Warnf("(RunBenchmark) learner %d of %s failed to write %s", learner, trainingID, status)
+						continue
+					}
+					atomic.AddInt64(&written, 1)
+				}
+			}(jm.TrainingID, learner)
+		}
+	}
+	writers.Wait()
+
+	timeout := time.After(cfg.Timeout)
+	for _, jm := range jobs {
+		select {
+		case <-jm.Done():
+			continue
+		case <-timeout:
+		}
+		logr.Warnf("(RunBenchmark) not all jobs were seen through within %v", cfg.Timeout)
+		break
+	}
+	duration := time.Since(start)
+
+	trainer.mu.Lock()
+	defer trainer.mu.Unlock()
+	latencies := trainer.latencies
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	report := &BenchmarkReport{
+		Jobs:             cfg.Jobs,
+		Learners:         cfg.Learners,
+		Duration:         duration,
+		StatusesWritten:  atomic.LoadInt64(&written),
+		JobsCompleted:    len(trainer.completed),
+		EtcdOps:          atomic.LoadInt64(&ops),
+		EtcdOpsPerSecond: float64(atomic.LoadInt64(&ops)) / duration.Seconds(),
+		TrainerUpdates:   atomic.LoadInt64(&trainer.updates),
+		TrainerGets:      atomic.LoadInt64(&trainer.gets),
+		LatencyP50:       percentile(latencies, 0.5),
+		LatencyP95:       percentile(latencies, 0.95),
+		LatencyP99:       percentile(latencies, 0.99),
+	}
+	if len(latencies) > 0 {
+		report.LatencyMax = latencies[len(latencies)-1]
+	}
+	return report, nil
+}
+
+//benchmarkKiller kills a simulated job by deleting its pods
+func benchmarkKiller(k8s kubernetes.Interface) JobKiller {
+	return func(trainingID string, userID string, jobName string, logr *logger.LocLoggingEntry) error {
+		pods := k8s.Core().Pods(config.GetLearnerNamespace())
+		list, err := pods.List(metav1.ListOptions{LabelSelector: "training_id==" + trainingID})
+		if err != nil {
+			return err
+		}
+		var failed []string
+		for _, pod := range list.Items {
+			if err := pods.Delete(pod.ObjectMeta.Name, &metav1.DeleteOptions{}); err != nil {
+				failed = append(failed, pod.ObjectMeta.Name)
+			}
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("failed to delete the pods %s", strings.Join(failed, ", "))
+		}
+		return nil
+	}
+}
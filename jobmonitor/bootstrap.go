@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+)
+
+//bootstrapFromTrainer fills the job parameters of cfg in from the job spec the trainer has for the training, so the
+//job monitor does not depend on the LCM passing matching parameters and a job can be adopted by its training id alone.
+//Where the trainer and cfg disagree the trainer wins
+func bootstrapFromTrainer(cfg *Config, logr *logger.LocLoggingEntry) error {
+	var job *grpc_trainer_v2.Job
+	err := backoff.RetryNotify(func() error {
+		var err error
+		job, err = getTrainingJob(cfg.Lifecycle.Trainer, cfg.TrainingID, cfg.UserID, logr)
+		return err
+	}, etdInteractionBackoff(viper.GetDuration(bootstrapTimeoutKey), 10*time.Second), func(err error, t time.Duration) {
+		logr.WithError(err).Warnf("(bootstrapFromTrainer) failed to get the job spec of %s from the trainer, retrying in %v", cfg.TrainingID, t)
+	})
+	if err != nil {
+		return fmt.Errorf("could not get the job spec of %s from the trainer: %v", cfg.TrainingID, err)
+	}
+	if job == nil {
+		return fmt.Errorf("the trainer has no job spec for %s", cfg.TrainingID)
+	}
+
+	learners := int(job.GetTraining().GetResources().GetLearners())
+	if learners <= 0 {
+		return fmt.Errorf("the job spec of %s has no learners", cfg.TrainingID)
+	}
+	framework := job.GetModelDefinition().GetFramework()
+	nativeDistribution := false
+	for _, name := range viper.GetStringSlice(bootstrapNativeFrameworksKey) {
+		if strings.EqualFold(strings.TrimSpace(name), framework.GetName()) {
+			nativeDistribution = true
+		}
+	}
+
+	warnOnMismatch := func(what string, given interface{}, spec interface{}, unset bool) {
+		if !unset && fmt.Sprint(given) != fmt.Sprint(spec) {
+			logr.Warnf("(bootstrapFromTrainer) %s of %s was given as %v, but the job spec has %v, using the job spec", what, cfg.TrainingID, given, spec)
+		}
+	}
+	warnOnMismatch("number of learners", cfg.NumLearners, learners, cfg.NumLearners == 0)
+	warnOnMismatch("job name", cfg.JobName, job.GetJobId(), cfg.JobName == "" || job.GetJobId() == "")
+	warnOnMismatch("framework", cfg.Framework, framework.GetName(), cfg.Framework == "")
+	warnOnMismatch("framework version", cfg.FrameworkVersion, framework.GetVersion(), cfg.FrameworkVersion == "")
+
+	cfg.NumLearners = learners
+	if job.GetJobId() != "" {
+		cfg.JobName = job.GetJobId()
+	}
+	cfg.Framework = framework.GetName()
+	cfg.FrameworkVersion = framework.GetVersion()
+	cfg.UseNativeDistribution = nativeDistribution
+	logr.Infof("(bootstrapFromTrainer) job %s: %d learners, job name %s, framework %s %s, native distribution %v", cfg.TrainingID,
+		cfg.NumLearners, cfg.JobName, cfg.Framework, cfg.FrameworkVersion, cfg.UseNativeDistribution)
+	return nil
+}
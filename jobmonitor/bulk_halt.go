@@ -0,0 +1,174 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/spf13/viper"
+)
+
+// job label carrying the tenant a job belongs to
+const tenantLabel = "tenant"
+
+// error code of jobs halted by an administrator
+const errCodeAdminHalt = "ADMIN_HALT"
+
+//HaltSelector ... selects the monitored jobs HaltJobs halts, a job has to match all the given criteria
+type HaltSelector struct {
+	UserID string
+	Tenant string
+	Labels map[string]string
+}
+
+func (s HaltSelector) empty() bool {
+	return s.UserID == "" && s.Tenant == "" && len(s.Labels) == 0
+}
+
+func (s HaltSelector) matches(jm *JobMonitor) bool {
+	if (s.UserID != "" && s.UserID != jm.UserID) || (s.Tenant != "" && s.Tenant != jm.Labels[tenantLabel]) {
+		return false
+	}
+	for k, v := range s.Labels {
+		if jm.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s HaltSelector) String() string {
+	var criteria []string
+	if s.UserID != "" {
+		criteria = append(criteria, "user="+s.UserID)
+	}
+	if s.Tenant != "" {
+		criteria = append(criteria, "tenant="+s.Tenant)
+	}
+	labels := make([]string, 0, len(s.Labels))
+	for k, v := range s.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(append(criteria, labels...), ",")
+}
+
+//HaltJobs ... halts the monitored jobs which match selector and aren't terminal yet, e.g. to evacuate a tenant from the
+//cluster during an incident. Each job gets a HALTED final status with errCodeAdminHalt and the given reason, and is
+//then torn down like any other halted job. To not overwhelm the trainer and the LCM, at most
+//jobmonitor.admin.halt.rate jobs are halted per second; the halts run in the background, HaltJobs returns the
+//training ids of the jobs it is going to halt. An empty selector is refused rather than halting every job
+func HaltJobs(selector HaltSelector, reason string, logr *logger.LocLoggingEntry) ([]string, error) {
+	if selector.empty() {
+		return nil, fmt.Errorf("refusing to halt all the monitored jobs, select them by user, tenant or label")
+	}
+	if strings.TrimSpace(reason) == "" {
+		return nil, fmt.Errorf("a reason is required to halt jobs")
+	}
+
+	monitoredJobsMu.RLock()
+	var jobs []*JobMonitor
+	for _, jm := range monitoredJobs {
+		if _, terminal := jm.terminalLatch(); !terminal && selector.matches(jm) {
+			jobs = append(jobs, jm)
+		}
+	}
+	monitoredJobsMu.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].TrainingID < jobs[j].TrainingID })
+
+	ids := make([]string, 0, len(jobs))
+	for _, jm := range jobs {
+		ids = append(ids, jm.TrainingID)
+	}
+	logr.Warnf("(HaltJobs) halting the %d jobs matching %s: %s", len(jobs), selector, reason)
+
+	interval := time.Duration(0)
+	if rate := viper.GetFloat64(adminHaltRateKey); rate > 0 {
+		interval = time.Duration(float64(time.Second) / rate)
+	}
+	go func() {
+		for i, jm := range jobs {
+			if i > 0 {
+				jm.timeSource().Sleep(interval)
+			}
+			go jm.adminHalt(selector, reason, jm.componentLogger(logr, componentAPI))
+		}
+	}()
+	return ids, nil
+}
+
+//adminHalt halts the job on behalf of HaltJobs
+func (jm *JobMonitor) adminHalt(selector HaltSelector, reason string, logr *logger.LocLoggingEntry) {
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	logr.Warnf("(adminHalt) halting %s, it matches %s", jm.TrainingID, selector)
+	jm.haltByAdministrator(fmt.Sprintf("halted by an administrator, selected by %s: %s", selector, reason), reason, logr)
+}
+
+//haltByAdministrator sends the HALTED final status of a job an administrator halted or killed, and tears it down
+func (jm *JobMonitor) haltByAdministrator(detail string, reason string, logr *logger.LocLoggingEntry) {
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	message := "the job was halted by an administrator: " + reason
+	jm.audit(logr, auditAdminHalt, "%s", detail)
+	jm.sendFinalStatus(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_HALTED, Timestamp: client.CurrentTimestampAsString(),
+		ErrorCode: errCodeAdminHalt, StatusMessage: message}, []ReasonCode{ReasonAdminHalt}, logr)
+	jm.killDeployedJob(logr)
+}
+
+//HaltJobsHandler ... serves HaltJobs, e.g. POST /jobs/halt?tenant=acme&label=project=p1&reason=evacuating+zone+a. The
+//label parameter may be given several times
+func HaltJobsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		selector := HaltSelector{UserID: query.Get("user"), Tenant: query.Get("tenant"), Labels: make(map[string]string)}
+		for _, label := range query["label"] {
+			kv := strings.SplitN(label, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				http.Error(w, "invalid label "+label+", expected key=value", http.StatusBadRequest)
+				return
+			}
+			selector.Labels[kv[0]] = kv[1]
+		}
+
+		logr := logger.LocLogger(jobLogEntry("", "").WithField(logkeyComponent, componentAPI))
+		ids, err := HaltJobs(selector, query.Get("reason"), logr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			Halting []string `json:"halting"`
+		}{ids})
+	})
+}
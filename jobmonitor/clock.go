@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+//Clock ... the time source of the job monitor: its sleeps, tickers and timeouts all go through it, so that the terminal
+//waits and timeouts can be tested without waiting for them (see FakeClock)
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+//Ticker ... a time.Ticker of a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+//RealClock ... the wall clock, used unless Config.Clock is set
+func RealClock() Clock {
+	return realClock{}
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+//exponentialBackoff is etdInteractionBackoff measuring the elapsed time on the clock of the job monitor, for retries
+//done with retryNotify
+func (jm *JobMonitor) exponentialBackoff(maxElapsedTime, maxInterval time.Duration) *backoff.ExponentialBackOff {
+	back := etdInteractionBackoff(maxElapsedTime, maxInterval)
+	back.Clock = jm.timeSource()
+	back.Reset()
+	return back
+}
+
+//timeSource is the clock of the job monitor, also for job monitors which weren't created through New
+func (jm *JobMonitor) timeSource() Clock {
+	if jm.clock == nil {
+		return realClock{}
+	}
+	return jm.clock
+}
+
+//retryNotify is backoff.RetryNotify waiting on clock between the attempts. The elapsed time of an ExponentialBackOff
+//is only measured on clock if its Clock is set to it, see JobMonitor.exponentialBackoff
+func retryNotify(clock Clock, operation backoff.Operation, b backoff.BackOff, notify backoff.Notify) error {
+	ctx := context.Background()
+	if cb, ok := b.(backoff.BackOffContext); ok {
+		ctx = cb.Context()
+	}
+	b.Reset()
+	for {
+		err := operation()
+		if err == nil {
+			return nil
+		}
+		if permanent, ok := err.(*backoff.PermanentError); ok {
+			return permanent.Err
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return err
+		}
+		if notify != nil {
+			notify(err, next)
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-clock.After(next):
+		}
+	}
+}
+
+//FakeClock ... a Clock which only moves when told to, for tests. Sleeps, timers and tickers fire as Advance moves the
+//time past them
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+//fakeWaiter is a pending sleep, timer or ticker of a FakeClock, period is 0 unless it is a ticker
+type fakeWaiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+//NewFakeClock ... a FakeClock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+//Now ... the time of the clock
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+//Sleep ... blocks until Advance moved the clock by d
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+//After ... a channel receiving the time once Advance moved the clock by d
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0).c
+}
+
+//NewTicker ... a ticker ticking every d the clock is advanced by. Like a time.Ticker it drops the ticks which aren't
+//received in time
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return &fakeTicker{c.add(d, d), c}
+}
+
+func (c *FakeClock) add(d time.Duration, period time.Duration) *fakeWaiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+//Advance ... moves the clock forward by d, firing the sleeps, timers and tickers which are due in the order they are
+//due
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		next := -1
+		for i, w := range c.waiters {
+			if !w.at.After(end) && (next < 0 || w.at.Before(c.waiters[next].at)) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+		w := c.waiters[next]
+		c.now = w.at
+		select {
+		case w.c <- w.at:
+		default:
+		}
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = append(c.waiters[:next], c.waiters[next+1:]...)
+		}
+	}
+	c.now = end
+}
+
+//Waiters ... the number of sleeps, timers and tickers waiting on the clock, so that a test can wait for the code under
+//test to block before advancing the clock
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (c *FakeClock) remove(w *fakeWaiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, waiting := range c.waiters {
+		if waiting == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	w     *fakeWaiter
+	clock *FakeClock
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.w.c }
+func (t *fakeTicker) Stop()               { t.clock.remove(t.w) }
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fakeClockStart = time.Date(2018, 11, 2, 2, 14, 0, 0, time.UTC)
+
+func waitForWaiters(clock *FakeClock, n int) {
+	for clock.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	ticker := clock.NewTicker(time.Minute)
+	after := clock.After(90 * time.Second)
+
+	clock.Advance(59 * time.Second)
+	assert.Len(t, ticker.C(), 0)
+	clock.Advance(time.Second)
+	assert.Equal(t, fakeClockStart.Add(time.Minute), <-ticker.C())
+	assert.Len(t, after, 0)
+
+	// ticks which aren't received are dropped, like those of a time.Ticker
+	clock.Advance(5 * time.Minute)
+	assert.Equal(t, fakeClockStart.Add(90*time.Second), <-after)
+	assert.Equal(t, fakeClockStart.Add(2*time.Minute), <-ticker.C())
+	assert.Len(t, ticker.C(), 0)
+	assert.Equal(t, fakeClockStart.Add(6*time.Minute), clock.Now())
+
+	ticker.Stop()
+	assert.Equal(t, 0, clock.Waiters())
+}
+
+func TestWaitForPodChangeTimesOut(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{clock: clock}
+
+	done := make(chan bool)
+	go func() {
+		stopped, watchClosed := jm.waitForPodChange(nil, clock.Now().Add(10*time.Second))
+		done <- stopped || watchClosed
+	}()
+	waitForWaiters(clock, 1)
+	// the deadline comes before podCheckInterval
+	clock.Advance(10 * time.Second)
+	assert.False(t, <-done)
+}
+
+func TestObserveLearnerWrites(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{clock: clock, metrics: newJobMonitorMetrics(Config{TrainingID: "training-clock"})}
+
+	_, ok := jm.observeLearnerWrites(1, 500)
+	assert.False(t, ok, "the first observation only sets the baseline")
+	clock.Advance(2 * time.Minute)
+	rate, ok := jm.observeLearnerWrites(1, 30)
+	assert.True(t, ok)
+	assert.Equal(t, 15.0, rate)
+}
+
+func TestObserveLearnerWritesInQuickSuccession(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{clock: clock, metrics: newJobMonitorMetrics(Config{TrainingID: "training-clock"})}
+
+	jm.observeLearnerWrites(1, 0)
+	clock.Advance(500 * time.Millisecond)
+	rate, _ := jm.observeLearnerWrites(1, 2)
+	assert.Equal(t, 2.0, rate, "two statuses half a second apart are not a rate of 240 per minute")
+	clock.Advance(500 * time.Millisecond)
+	rate, _ = jm.observeLearnerWrites(1, 1)
+	assert.Equal(t, 3.0, rate)
+
+	// the writes which left the window don't count anymore
+	clock.Advance(time.Minute)
+	rate, _ = jm.observeLearnerWrites(1, 1)
+	assert.Equal(t, 1.0, rate)
+}
+
+func TestRetryNotifyOnClock(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{clock: clock}
+
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- retryNotify(clock, func() error {
+			attempts++
+			return errors.New("unavailable")
+		}, jm.exponentialBackoff(2*time.Minute, 30*time.Second), nil)
+	}()
+	for {
+		select {
+		case err := <-done:
+			assert.EqualError(t, err, "unavailable")
+			assert.True(t, attempts > 1)
+			assert.False(t, clock.Now().Before(fakeClockStart.Add(2*time.Minute)), "the retries give up once the clock passed the max elapsed time")
+			return
+		default:
+		}
+		if clock.Waiters() > 0 {
+			clock.Advance(30 * time.Second)
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
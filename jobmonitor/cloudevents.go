@@ -0,0 +1,147 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// the source of the CloudEvents of the job monitor, and the prefix of their types: a transition to FAILED has the type
+// org.ffdl.training.status.failed
+const (
+	cloudEventSource     = "/ffdl/job-monitor"
+	cloudEventTypePrefix = "org.ffdl.training.status."
+)
+
+// header carrying the HMAC-SHA256 of the body of a CloudEvent, keyed with jobmonitor.events.cloudevents.secret, as
+// sha256=<hex>
+const cloudEventSignatureHeader = "X-Signature-256"
+
+//cloudEvent ... the structured mode JSON of a CloudEvents 1.0 event, carrying a TransitionEvent
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            TransitionEvent `json:"data"`
+}
+
+//cloudEventType is the CloudEvents type of the transition of a job to status
+func cloudEventType(status string) string {
+	return cloudEventTypePrefix + strings.ToLower(status)
+}
+
+//newCloudEvent wraps the transition in a CloudEvent. The id stays the same across the retries of the event so that
+//receivers can drop the duplicates
+func newCloudEvent(event TransitionEvent) cloudEvent {
+	return cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              fmt.Sprintf("%s/%d/%s/%d", event.TrainingID, event.Attempt, event.NewStatus, event.Timestamp.UnixNano()),
+		Source:          cloudEventSource,
+		Type:            cloudEventType(event.NewStatus),
+		Subject:         event.TrainingID,
+		Time:            event.Timestamp.UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            event,
+	}
+}
+
+//cloudEventSink ... an HTTP endpoint, e.g. a Knative broker or an Argo Events webhook source, the transitions are
+//POSTed to as CloudEvents. A sink with types only gets the events of those types
+type cloudEventSink struct {
+	url    string
+	types  map[string]bool
+	secret string
+}
+
+//configuredCloudEventSinks parses jobmonitor.events.cloudevents.sinks, whose entries are the URL of a sink, optionally
+//followed by a space and the comma separated types of the events it gets, e.g.
+//"http://broker-ingress/ffdl/default org.ffdl.training.status.completed,org.ffdl.training.status.failed"
+func configuredCloudEventSinks() []cloudEventSink {
+	var sinks []cloudEventSink
+	for _, entry := range viper.GetStringSlice(cloudEventSinksKey) {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		sink := cloudEventSink{url: fields[0], secret: viper.GetString(cloudEventSecretKey)}
+		if len(fields) > 1 {
+			sink.types = make(map[string]bool)
+			for _, t := range strings.Split(fields[1], ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					sink.types[t] = true
+				}
+			}
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks
+}
+
+func (s cloudEventSink) Publish(event TransitionEvent) error {
+	ce := newCloudEvent(event)
+	if s.types != nil && !s.types[ce.Type] {
+		return nil
+	}
+	body, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	if s.secret != "" {
+		req.Header.Set(cloudEventSignatureHeader, "sha256="+signCloudEvent(body, s.secret))
+	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("rejected by %s (%s): %s", s.url, resp.Status, strings.TrimSpace(string(reason)))
+	}
+	return nil
+}
+
+//signCloudEvent is the hex HMAC-SHA256 of body keyed with secret
+func signCloudEvent(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
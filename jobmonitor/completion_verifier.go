@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+// error code of jobs which reported COMPLETED but did not pass the completion verification
+const errCodeCompletionUnverified = "COMPLETION_UNVERIFIED"
+
+//CompletionVerifier ... is asked before a job is accepted as COMPLETED, so that an organization can codify what done
+//means for them (e.g. a model artifact and an evaluation metric are present). A non nil error turns the job into FAILED
+type CompletionVerifier interface {
+	Verify(jm *JobMonitor, logr *logger.LocLoggingEntry) error
+}
+
+//CompletionVerifierFactory ... creates the verifier for a job, reading its settings from the (per job) config of jm
+type CompletionVerifierFactory func(jm *JobMonitor) (CompletionVerifier, error)
+
+var (
+	completionVerifiers = map[string]CompletionVerifierFactory{
+		"none":              func(jm *JobMonitor) (CompletionVerifier, error) { return noVerification{}, nil },
+		"object-store":      newObjectStoreVerifier,
+		"metrics-threshold": newMetricsThresholdVerifier,
+		"webhook":           newWebhookVerifier,
+	}
+	completionVerifiersMu sync.RWMutex
+)
+
+//RegisterCompletionVerifier ... makes a custom verifier available under name, jobs select it through the
+//jobmonitor.completion.verifiers config
+func RegisterCompletionVerifier(name string, factory CompletionVerifierFactory) {
+	completionVerifiersMu.Lock()
+	defer completionVerifiersMu.Unlock()
+	completionVerifiers[name] = factory
+}
+
+//verifyCompletion runs all verifiers configured for the job, all of them have to accept the completion
+func (jm *JobMonitor) verifyCompletion(logr *logger.LocLoggingEntry) error {
+	for _, name := range strings.Split(jm.configString(completionVerifiersKey), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		completionVerifiersMu.RLock()
+		factory, ok := completionVerifiers[name]
+		completionVerifiersMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown completion verifier %s", name)
+		}
+		verifier, err := factory(jm)
+		if err != nil {
+			return fmt.Errorf("completion verifier %s: %v", name, err)
+		}
+		if err := verifier.Verify(jm, logr); err != nil {
+			return fmt.Errorf("completion verifier %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+type noVerification struct{}
+
+func (noVerification) Verify(jm *JobMonitor, logr *logger.LocLoggingEntry) error {
+	return nil
+}
+
+//expandJobURL fills in the {training_id} and {user_id} placeholders of a configured url
+func expandJobURL(url string, jm *JobMonitor) string {
+	return strings.NewReplacer("{training_id}", jm.TrainingID, "{user_id}", jm.UserID).Replace(url)
+}
+
+//objectStoreVerifier checks that the model artifact of the job exists, through a HEAD request on its url
+type objectStoreVerifier struct {
+	url string
+}
+
+func newObjectStoreVerifier(jm *JobMonitor) (CompletionVerifier, error) {
+	url := jm.configString(completionObjectURLKey)
+	if url == "" {
+		return nil, fmt.Errorf("%s is not set", completionObjectURLKey)
+	}
+	return &objectStoreVerifier{url: expandJobURL(url, jm)}, nil
+}
+
+func (v *objectStoreVerifier) Verify(jm *JobMonitor, logr *logger.LocLoggingEntry) error {
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Head(v.url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("model artifact %s not found (%s)", v.url, resp.Status)
+	}
+	return nil
+}
+
+//metricsThresholdVerifier checks that a learner reported an evaluation metric within the configured bounds in its
+//summary metrics
+type metricsThresholdVerifier struct {
+	metric   string
+	min, max *float64
+}
+
+func newMetricsThresholdVerifier(jm *JobMonitor) (CompletionVerifier, error) {
+	v := &metricsThresholdVerifier{metric: jm.configString(completionMetricKey)}
+	if v.metric == "" {
+		return nil, fmt.Errorf("%s is not set", completionMetricKey)
+	}
+	for key, bound := range map[string]**float64{completionMetricMinKey: &v.min, completionMetricMaxKey: &v.max} {
+		value := jm.configString(key)
+		if value == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %v", key, value, err)
+		}
+		*bound = &f
+	}
+	return v, nil
+}
+
+func (v *metricsThresholdVerifier) Verify(jm *JobMonitor, logr *logger.LocLoggingEntry) error {
+	found := false
+	for _, i := range jm.learnerNumbers() {
+		response, err := jm.EtcdClient.Get(learnerSummaryMetricsPath(jm.TrainingID, i), logr)
+		if err != nil || len(response) == 0 {
+			continue
+		}
+		value, ok := summaryMetric(response[0].Value, v.metric)
+		if !ok {
+			continue
+		}
+		found = true
+		if (v.min == nil || value >= *v.min) && (v.max == nil || value <= *v.max) {
+			return nil
+		}
+		logr.Infof("learner %d of %s reported %s %g, outside of the required bounds", i, jm.TrainingID, v.metric, value)
+	}
+	if !found {
+		return fmt.Errorf("no learner reported the metric %s", v.metric)
+	}
+	return fmt.Errorf("no learner reported %s within the required bounds", v.metric)
+}
+
+//summaryMetric looks up a numeric metric like "accuracy" or "values.accuracy" in the JSON summary metrics of a learner
+func summaryMetric(summary string, metric string) (float64, bool) {
+	var current interface{}
+	if err := json.Unmarshal([]byte(summary), &current); err != nil {
+		return 0, false
+	}
+	for _, field := range strings.Split(metric, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		current = fields[field]
+	}
+	value, ok := current.(float64)
+	return value, ok
+}
+
+//webhookVerifier leaves the decision to a custom service, any 2xx answer accepts the completion
+type webhookVerifier struct {
+	url string
+}
+
+func newWebhookVerifier(jm *JobMonitor) (CompletionVerifier, error) {
+	url := jm.configString(completionWebhookURLKey)
+	if url == "" {
+		return nil, fmt.Errorf("%s is not set", completionWebhookURLKey)
+	}
+	return &webhookVerifier{url: expandJobURL(url, jm)}, nil
+}
+
+func (v *webhookVerifier) Verify(jm *JobMonitor, logr *logger.LocLoggingEntry) error {
+	body, err := json.Marshal(map[string]string{"training_id": jm.TrainingID, "user_id": jm.UserID, "job_name": jm.JobName})
+	if err != nil {
+		return err
+	}
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(v.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("rejected by %s (%s): %s", v.url, resp.Status, strings.TrimSpace(string(reason)))
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// config keys of the job monitor
+const (
+	// default window by which the kill of a FAILED job is deferred for opted in users
+	deferTeardownWindowKey = "jobmonitor.teardown.defer.window"
+	// hard cap for any teardown deferral, no matter who asked for it
+	deferTeardownMaxKey = "jobmonitor.teardown.defer.max"
+	// users whose FAILED jobs are always kept around for debugging
+	deferTeardownUsersKey = "jobmonitor.teardown.defer.users"
+	// max number of terminal processings (final trainer update, LCM kill) running at the same time in this process
+	terminalConcurrencyKey = "jobmonitor.terminal.concurrency"
+	// the label of the training spec carrying the priority of a job, whether the terminal jobs are torn down by
+	// priority under resource pressure, and how long the verification of their teardown may be put off for higher
+	// priority jobs, see priorityTeardown
+	priorityLabelKey       = "jobmonitor.priority.label"
+	priorityTeardownKey    = "jobmonitor.teardown.priority.enabled"
+	priorityMaxDeferralKey = "jobmonitor.teardown.priority.max_deferral"
+	// delivery semantics of trainer status updates, at-least-once (default) or at-most-once
+	trainerDeliveryKey = "jobmonitor.trainer.delivery"
+	// how long an update delivered at least once is retried before it is given up
+	trainerRetryMaxElapsedKey = "jobmonitor.trainer.retry.max_elapsed"
+	// whether the trainer is asked for the status of the job before a non-terminal update, see staleUpdate
+	staleGuardKey = "jobmonitor.trainer.stale_guard"
+	// additional pod checks (30s apart) granted to a job for rescheduling an evicted learner pod
+	evictionRetriesKey = "jobmonitor.eviction.retries"
+	// max extra time before teardown a learner can ask for with a grace request
+	graceRequestMaxKey = "jobmonitor.grace.max"
+	// interval at which the status of the scorer of a batch-scoring job is polled
+	scoringPollIntervalKey = "jobmonitor.scoring.poll.interval"
+	// status names written by learners mapped to the internal statuses, on top of the trainer status names
+	statusInboundKey = "jobmonitor.status.inbound"
+	// internal statuses mapped to the statuses reported to the status service
+	statusOutboundKey = "jobmonitor.status.outbound"
+	// the statuses a job may move to, each with the statuses it may move there from, see transitionGraph. Either
+	// inline or in a YAML or JSON file, e.g. mounted from a ConfigMap
+	transitionsKey     = "jobmonitor.status.transitions"
+	transitionsFileKey = "jobmonitor.status.transitions_file"
+	// fraction (0..1] of the routine learner updates which get logged, transitions and errors are always logged
+	updateLogSampleRateKey = "jobmonitor.log.updates.sample.rate"
+	// rolling windows over which the ratio of jobs failed by the platform is exported
+	sloWindowsKey = "jobmonitor.slo.windows"
+	// error codes counted as platform failures on top of the built in ones
+	sloPlatformErrorCodesKey = "jobmonitor.slo.platform.error_codes"
+	// what to do if the learners found in etcd or k8s don't match the spec, trust-spec (default), trust-etcd or fail
+	learnerMismatchKey = "jobmonitor.learners.mismatch"
+	// transport of the metrics, statsd (default), pushgateway or http
+	metricsTransportKey = "jobmonitor.metrics.transport"
+	// url of the Pushgateway or HTTP collector for the HTTP based metrics transports
+	metricsURLKey = "jobmonitor.metrics.url"
+	// address a Prometheus /metrics endpoint is served on (e.g. :9102) alongside statsd, not served if empty
+	prometheusAddrKey = "jobmonitor.metrics.prometheus.addr"
+	// comma separated completion verifiers a job has to pass to be COMPLETED: none (default), object-store,
+	// metrics-threshold, webhook or custom ones
+	completionVerifiersKey = "jobmonitor.completion.verifiers"
+	// url of the model artifact checked by the object-store verifier, {training_id} and {user_id} get filled in
+	completionObjectURLKey = "jobmonitor.completion.object_store.url"
+	// summary metric checked by the metrics-threshold verifier, e.g. values.accuracy, and its bounds
+	completionMetricKey    = "jobmonitor.completion.metric.name"
+	completionMetricMinKey = "jobmonitor.completion.metric.min"
+	completionMetricMaxKey = "jobmonitor.completion.metric.max"
+	// url the webhook verifier posts the job to
+	completionWebhookURLKey = "jobmonitor.completion.webhook.url"
+	// url the final status of a job is posted to, {training_id} and {user_id} get filled in, and for how long its
+	// delivery is retried, see recordOutcome
+	outcomeWebhookURLKey     = "jobmonitor.outcome.webhook.url"
+	outcomeWebhookHorizonKey = "jobmonitor.outcome.webhook.horizon"
+	// whether a job with a learner on a failed node is failed (fail) or the learner rescheduled (reschedule), how long a
+	// node has to be NotReady to count as failed, and how many learners of a job are rescheduled before it is failed
+	nodeFailureActionKey         = "jobmonitor.nodes.failure.action"
+	nodeFailureGraceKey          = "jobmonitor.nodes.failure.grace"
+	nodeFailureMaxReschedulesKey = "jobmonitor.nodes.failure.max_reschedules"
+	// the locale status messages are localized into unless the job has a locale label, and the templates of the
+	// localized messages by locale and error code, see localize
+	messageLocaleKey  = "jobmonitor.messages.locale"
+	messageCatalogKey = "jobmonitor.messages.catalog"
+	// how long a job may run before it is halted, 0 for no limit, see enforceMaxRuntime
+	maxRuntimeKey = "jobmonitor.job.max_runtime"
+	// the annotation the learner pods of a job get when its user asks for it to halt, and how long the learners
+	// then have to store their results and stop before the job is halted anyhow, see haltGracefully
+	haltAnnotationKey = "jobmonitor.halt.annotation"
+	haltTimeoutKey    = "jobmonitor.halt.timeout"
+	// how many jobs per second HaltJobs halts at most, 0 for no limit
+	adminHaltRateKey = "jobmonitor.admin.halt.rate"
+	// how long a learner may stay in a phase, 0 for no limit, and whether a learner exceeding it is only reported
+	// (alert) or fails the job (fail), see detectStuckPhases
+	phaseTimeoutDownloadingKey = "jobmonitor.learners.phase_timeout.downloading"
+	phaseTimeoutProcessingKey  = "jobmonitor.learners.phase_timeout.processing"
+	phaseTimeoutStoringKey     = "jobmonitor.learners.phase_timeout.storing"
+	phaseTimeoutActionKey      = "jobmonitor.learners.phase_timeout.action"
+	// how many times the failed learners of a job are restarted before the job fails, 0 to fail it right away, and
+	// the backoff before the first restart, doubling with every further one, see restartFailedLearner
+	learnerRestartMaxKey     = "jobmonitor.learners.restart.max"
+	learnerRestartBackoffKey = "jobmonitor.learners.restart.backoff"
+	// whether one failed learner fails the job (gang), or the job completes as long as the number (e.g. 3) or
+	// percentage (e.g. 75%) of its learners in min_completed complete (tolerant), see tolerateLearnerStatus
+	learnerFailurePolicyKey = "jobmonitor.learners.failure_policy"
+	learnerMinCompletedKey  = "jobmonitor.learners.min_completed"
+	// whether learners join and leave the job while it runs, see resizeElasticLearners
+	elasticLearnersKey = "jobmonitor.learners.elastic"
+	// how often the summary metrics of the learners are forwarded to the trainer, 0 to not forward them, and which
+	// ones, as <metric>[:mean|min|max], see forwardSummaryMetrics
+	metricsForwardIntervalKey = "jobmonitor.metrics.forward.interval"
+	metricsForwardNamesKey    = "jobmonitor.metrics.forward.names"
+	// the rules a job is stopped early by, e.g. nan(values.loss);plateau(values.val_loss,5), see checkEarlyStopping
+	earlyStoppingRulesKey = "jobmonitor.early_stopping.rules"
+	// how many of the last log lines of the learners of a failed job its final status gets, 0 for none, and the
+	// container of the learner pods they are read from, see withLearnerLogs
+	logTailLinesKey     = "jobmonitor.logs.tail.lines"
+	logTailContainerKey = "jobmonitor.logs.tail.container"
+	// how long the heartbeat key of a learner may be gone before the learner is declared dead, 0 to not watch the
+	// heartbeats, and whether a dead learner is only reported (alert) or fails the job (fail), see watchHeartbeats
+	heartbeatTimeoutKey = "jobmonitor.learners.heartbeat.timeout"
+	heartbeatActionKey  = "jobmonitor.learners.heartbeat.action"
+	// how long the pod of a learner etcd has running may be gone before the job fails, and how long the pod of a
+	// learner may run without the learner writing a status before it is flagged, 0 to not check, see
+	// detectHalfOpenLearners
+	lostLearnerThresholdKey    = "jobmonitor.learners.lost.threshold"
+	unwiredLearnerThresholdKey = "jobmonitor.learners.unwired.threshold"
+	// the OTLP/HTTP traces endpoint of an OpenTelemetry collector the spans are exported to, e.g.
+	// http://otel-collector:4318/v1/traces, no tracing if empty, and the share of the traces which are sampled
+	tracingEndpointKey   = "jobmonitor.tracing.endpoint"
+	tracingSampleRateKey = "jobmonitor.tracing.sample_rate"
+	// how far back a resync sends the statuses of a job again unless asked otherwise, see Resync
+	resyncHistoryKey = "jobmonitor.resync.history"
+	// the Confluent REST proxy in front of the Kafka cluster, e.g. http://kafka-rest:8082, and the topic the accepted
+	// transitions of the jobs are published to, no events unless both are set, see publishTransition
+	eventsRESTProxyURLKey   = "jobmonitor.events.rest_proxy.url"
+	eventsRESTProxyTopicKey = "jobmonitor.events.rest_proxy.topic"
+	// the HTTP endpoints the transitions are POSTed to as CloudEvents, see configuredCloudEventSinks, and the secret
+	// the events are signed with, unsigned if empty
+	cloudEventSinksKey  = "jobmonitor.events.cloudevents.sinks"
+	cloudEventSecretKey = "jobmonitor.events.cloudevents.secret"
+	// where failed jobs are alerted about: a Slack incoming webhook and the routing key of a PagerDuty Events API v2
+	// integration, either or both, and the error codes, users and learner namespaces alerted about, all of them if
+	// empty, see alertOnFailure
+	alertSlackWebhookKey     = "jobmonitor.alerts.slack.webhook_url"
+	alertPagerDutyRoutingKey = "jobmonitor.alerts.pagerduty.routing_key"
+	alertPagerDutyURLKey     = "jobmonitor.alerts.pagerduty.url"
+	alertErrorCodesKey       = "jobmonitor.alerts.error_codes"
+	alertUsersKey            = "jobmonitor.alerts.users"
+	alertNamespacesKey       = "jobmonitor.alerts.namespaces"
+	// restrict TLS to FIPS 140-2 approved versions, cipher suites and curves
+	tlsFIPSKey = "jobmonitor.tls.fips"
+	// lowest TLS version accepted, 1.0, 1.1 or 1.2
+	tlsMinVersionKey = "jobmonitor.tls.min_version"
+	// allowed cipher suites by their Go names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, all by default
+	tlsCipherSuitesKey = "jobmonitor.tls.cipher_suites"
+	// learners failing within this window of each other are checked for a common zone
+	failureCorrelationWindowKey = "jobmonitor.failures.correlation.window"
+	// time given to the other learners to fail as well before the failures are correlated again, in the background
+	failureCorrelationSettleKey = "jobmonitor.failures.correlation.settle"
+	// statuses per minute a learner may write before its stream is quarantined, 0 disables the protection
+	runawayWriteRateKey = "jobmonitor.learners.write_rate.max"
+	// how long a job monitor bootstrapping from the trainer waits for the trainer to answer
+	bootstrapTimeoutKey = "jobmonitor.bootstrap.timeout"
+	// frameworks whose learners coordinate themselves (native distribution) when bootstrapping from the trainer
+	bootstrapNativeFrameworksKey = "jobmonitor.bootstrap.native_frameworks"
+	// planned maintenance windows as start/end in RFC 3339, more can be declared in the etcd key jobmonitor/maintenance
+	maintenanceWindowsKey = "jobmonitor.maintenance.windows"
+	// audit events written to etcd in one compressed batch, and the compressed bytes of audit trail a training may have
+	auditBatchSizeKey = "jobmonitor.audit.batch.size"
+	auditBudgetKey    = "jobmonitor.audit.budget"
+	// Info and Debug lines logged per training per hour before they are replaced by summaries, 0 disables the budget
+	logBudgetKey = "jobmonitor.log.budget.per_hour"
+	// address the APIs of the job monitor are served on (e.g. :8090), and the bearer token they require
+	apiAddrKey  = "jobmonitor.api.addr"
+	apiTokenKey = "jobmonitor.api.token"
+	// address the gRPC query service is served on (e.g. :8091), see ServeQueryService
+	queryAddrKey = "jobmonitor.query.addr"
+	// how the learner statuses are read, poll (every jobmonitor.learners.poll.interval) or watch (as they are written)
+	learnerStatusModeKey = "jobmonitor.learners.status.mode"
+	// the timing and retry settings of the job monitor, see durationTunables and intTunables for their ranges:
+	// how often the learners are polled, how long the remaining learners get to finish after the job did, how long
+	// to wait before asking the LCM for a kill, the timeout of single requests and the pod checks a job gets to have
+	// its pods scheduled, and how long the pods of a job may fail to pull their images
+	learnerPollIntervalKey    = "jobmonitor.learners.poll.interval"
+	learnerGraceKey           = "jobmonitor.learners.grace"
+	killDelayKey              = "jobmonitor.kill.delay"
+	requestTimeoutKey         = "jobmonitor.request.timeout"
+	insuffResourcesRetriesKey = "jobmonitor.pods.insufficient_resources.retries"
+	imagePullThresholdKey     = "jobmonitor.pods.image_pull.threshold"
+	// how long the pods of a job may stay unschedulable (0 for the retries above), whether the job is failed or keeps
+	// waiting then, and whether the users are told why the job is pending, see insufficientResourcesPolicy
+	insuffResourcesMaxPendingKey = "jobmonitor.pods.insufficient_resources.max_pending"
+	insuffResourcesActionKey     = "jobmonitor.pods.insufficient_resources.action"
+	insuffResourcesNotifyKey     = "jobmonitor.pods.insufficient_resources.notify"
+	// address /healthz and /readyz are served on (e.g. :8091), and how long the trainer updates may keep failing
+	// before the job monitor is considered wedged
+	healthAddrKey          = "jobmonitor.health.addr"
+	healthTrainerMaxAgeKey = "jobmonitor.health.trainer_update.max_age"
+	// summary metrics the learners report their memory and GPU memory usage in, see sampleWatermarks
+	watermarkMemoryMetricKey    = "jobmonitor.watermarks.memory.metric"
+	watermarkGPUMemoryMetricKey = "jobmonitor.watermarks.gpu_memory.metric"
+	// whether the replicas of a job monitor elect a leader through etcd, which alone monitors the job, and how long the
+	// lease of the leader outlives it
+	leaderElectionKey    = "jobmonitor.leader_election.enabled"
+	leaderElectionTTLKey = "jobmonitor.leader_election.ttl"
+	// the auxiliary services (tensorboard, parameter servers, ...) of the jobs whose health is tracked, see
+	// configuredAuxiliaryServices, and the ones among them whose failure fails the job
+	auxiliaryServicesKey = "jobmonitor.auxiliary.services"
+	auxiliaryCriticalKey = "jobmonitor.auxiliary.critical"
+	// the etcd prefix a Controller finds its trainings under, and how many of them it monitors at once
+	controllerPrefixKey  = "jobmonitor.controller.prefix"
+	controllerMaxJobsKey = "jobmonitor.controller.max_jobs"
+	// the job classes (the class label of the jobs) monitored with the minimal profile, its learner poll interval and
+	// the fraction of the counters and timings it records
+	minimalProfileClassesKey      = "jobmonitor.profiles.minimal.classes"
+	minimalProfilePollIntervalKey = "jobmonitor.profiles.minimal.poll.interval"
+	minimalProfileSampleRateKey   = "jobmonitor.profiles.minimal.metrics.sample_rate"
+)
+
+func init() {
+	viper.SetDefault(deferTeardownWindowKey, 30*time.Minute)
+	viper.SetDefault(deferTeardownMaxKey, 2*time.Hour)
+	viper.SetDefault(deferTeardownUsersKey, []string{})
+	viper.SetDefault(terminalConcurrencyKey, 20)
+	viper.SetDefault(priorityLabelKey, "priority")
+	viper.SetDefault(priorityTeardownKey, false)
+	viper.SetDefault(priorityMaxDeferralKey, 10*time.Minute)
+	viper.SetDefault(trainerDeliveryKey, deliveryAtLeastOnce)
+	viper.SetDefault(staleGuardKey, false)
+	viper.SetDefault(insuffResourcesMaxPendingKey, time.Duration(0))
+	viper.SetDefault(insuffResourcesActionKey, insufficientResourcesFail)
+	viper.SetDefault(insuffResourcesNotifyKey, false)
+	viper.SetDefault(nodeFailureActionKey, nodeFailureFail)
+	viper.SetDefault(maxRuntimeKey, time.Duration(0))
+	viper.SetDefault(adminHaltRateKey, 5)
+	viper.SetDefault(haltAnnotationKey, "jobmonitor.ffdl/halt-requested")
+	viper.SetDefault(phaseTimeoutActionKey, phaseTimeoutAlert)
+	viper.SetDefault(learnerFailurePolicyKey, failurePolicyGang)
+	viper.SetDefault(learnerMinCompletedKey, "100%")
+	viper.SetDefault(elasticLearnersKey, false)
+	viper.SetDefault(metricsForwardNamesKey, []string{"values.loss", "values.accuracy", "iteration:min"})
+	viper.SetDefault(logTailContainerKey, "learner")
+	viper.SetDefault(resyncHistoryKey, 24*time.Hour)
+	viper.SetDefault(heartbeatActionKey, heartbeatFail)
+	viper.SetDefault(tracingSampleRateKey, 1.0)
+	viper.SetDefault(evictionRetriesKey, 20)
+	viper.SetDefault(graceRequestMaxKey, 15*time.Minute)
+	viper.SetDefault(updateLogSampleRateKey, 1.0)
+	viper.SetDefault(sloWindowsKey, []string{"1h", "24h", "168h"})
+	viper.SetDefault(sloPlatformErrorCodesKey, []string{})
+	viper.SetDefault(learnerMismatchKey, mismatchTrustSpec)
+	viper.SetDefault(metricsTransportKey, MetricsTransportStatsd)
+	viper.SetDefault(completionVerifiersKey, "none")
+	viper.SetDefault(tlsFIPSKey, false)
+	viper.SetDefault(tlsMinVersionKey, "1.2")
+	viper.SetDefault(tlsCipherSuitesKey, []string{})
+	viper.SetDefault(failureCorrelationWindowKey, 2*time.Minute)
+	viper.SetDefault(failureCorrelationSettleKey, 10*time.Second)
+	viper.SetDefault(runawayWriteRateKey, 60)
+	viper.SetDefault(bootstrapTimeoutKey, 5*time.Minute)
+	viper.SetDefault(bootstrapNativeFrameworksKey, []string{"horovod", "pytorch"})
+	viper.SetDefault(maintenanceWindowsKey, []string{})
+	viper.SetDefault(auditBatchSizeKey, 50)
+	viper.SetDefault(auditBudgetKey, 256*1024)
+	viper.SetDefault(logBudgetKey, 5000)
+	viper.SetDefault(learnerStatusModeKey, learnerStatusPoll)
+	viper.SetDefault(healthTrainerMaxAgeKey, 10*time.Minute)
+	viper.SetDefault(watermarkMemoryMetricKey, "values.memory_bytes")
+	viper.SetDefault(watermarkGPUMemoryMetricKey, "values.gpu_memory_bytes")
+	viper.SetDefault(leaderElectionKey, false)
+	viper.SetDefault(leaderElectionTTLKey, 5*time.Second)
+	viper.SetDefault(auxiliaryServicesKey, []string{})
+	viper.SetDefault(cloudEventSinksKey, []string{})
+	viper.SetDefault(alertPagerDutyURLKey, pagerDutyEventsURL)
+	viper.SetDefault(alertErrorCodesKey, []string{})
+	viper.SetDefault(alertUsersKey, []string{})
+	viper.SetDefault(alertNamespacesKey, []string{})
+	viper.SetDefault(auxiliaryCriticalKey, []string{})
+	viper.SetDefault(controllerPrefixKey, "jobmonitor/jobs/")
+	viper.SetDefault(controllerMaxJobsKey, 100)
+	viper.SetDefault(minimalProfileClassesKey, []string{})
+	viper.SetDefault(minimalProfilePollIntervalKey, 5*time.Minute)
+	viper.SetDefault(minimalProfileSampleRateKey, 0.1)
+	for key, t := range durationTunables {
+		viper.SetDefault(key, t.def)
+	}
+	for key, t := range intTunables {
+		viper.SetDefault(key, t.def)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+const (
+	// the operations Consul takes in a transaction
+	consulTxnOps = 64
+	// the longest Consul holds a blocking query
+	consulMaxWait = 10 * time.Minute
+	// under the path of the endpoints, or this one if they have none
+	consulDefaultRoot = "ffdl"
+)
+
+//consulStore ... keeps the keys in the KV store of Consul: a key is the entry root/kv/<key>, its version is in the flags
+//of the entry, and its revisions are the indexes Consul gave the entry. Every commit sets root/rev as well, so the
+//index of that entry is the revision of the store. The endpoints are Consul agents, tried in turn; the password of
+//the coordinator config is the ACL token, and with a certificate the agents are spoken to over HTTPS
+type consulStore struct {
+	agents []string
+	root   string
+	token  string
+	client *http.Client
+	// the agent the requests go to
+	current int32
+}
+
+type consulKV struct {
+	Key         string
+	Value       []byte `json:",omitempty"`
+	Flags       uint64 `json:",omitempty"`
+	Index       uint64 `json:",omitempty"`
+	CreateIndex uint64 `json:",omitempty"`
+	ModifyIndex uint64 `json:",omitempty"`
+	Verb        string `json:",omitempty"`
+}
+
+type consulTxnOp struct {
+	KV consulKV
+}
+
+type consulTxnResponse struct {
+	Results []consulTxnOp
+	Errors  []struct {
+		OpIndex int
+		What    string
+	}
+}
+
+func openConsulStore(coordConfig coord.Config, logr *logger.LocLoggingEntry) (kvStore, error) {
+	s := &consulStore{token: coordConfig.Password}
+	httpTransport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	scheme := "http"
+	if cert := coordConfig.Cert; cert != "" {
+		tlsConfig, err := transport.TLSInfo{TrustedCAFile: cert}.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := applyTLSConfig(tlsConfig); err != nil {
+			return nil, err
+		}
+		httpTransport.TLSClientConfig = tlsConfig
+		scheme = "https"
+	}
+	// no timeout, the blocking queries of the watches last as long as their context
+	s.client = &http.Client{Transport: httpTransport}
+	for _, endpoint := range coordConfig.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		s.agents = append(s.agents, scheme+"://"+u.Host)
+		if s.root == "" {
+			s.root = strings.Trim(u.Path, "/")
+		}
+	}
+	if s.root == "" {
+		s.root = consulDefaultRoot
+	}
+	// a store which was never written to has a revision still, for the watches to block on
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	resp, err := s.request(ctx, http.MethodPut, "/v1/kv/"+s.revisionKey(), url.Values{"cas": {"0"}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul refused to write %s: %s", s.revisionKey(), resp.Status)
+	}
+	return s, nil
+}
+
+func (s *consulStore) revisionKey() string {
+	return s.root + "/rev"
+}
+
+func (s *consulStore) entry(key string) string {
+	return s.root + "/kv/" + key
+}
+
+//request sends a request to the current agent, or the next ones if it can't be reached
+func (s *consulStore) request(ctx context.Context, method string, path string, query url.Values, body []byte) (*http.Response, error) {
+	var err error
+	for tried := 0; tried < len(s.agents); tried++ {
+		current := atomic.LoadInt32(&s.current)
+		u, _ := url.Parse(s.agents[int(current)%len(s.agents)])
+		u.Path, u.RawQuery = path, query.Encode()
+		var req *http.Request
+		if req, err = http.NewRequest(method, u.String(), bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+		if s.token != "" {
+			req.Header.Set("X-Consul-Token", s.token)
+		}
+		var resp *http.Response
+		if resp, err = s.client.Do(req.WithContext(ctx)); err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		atomic.CompareAndSwapInt32(&s.current, current, current+1)
+	}
+	return nil, err
+}
+
+//txn runs ops in a transaction, it returns false if Consul rolled it back
+func (s *consulStore) txn(ctx context.Context, ops []consulTxnOp) (*consulTxnResponse, bool, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ctxTimeout())
+		defer cancel()
+	}
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return nil, false, err
+	}
+	resp, err := s.request(ctx, http.MethodPut, "/v1/txn", nil, body)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return nil, false, fmt.Errorf("consul transaction failed (%s): %s", resp.Status, strings.TrimSpace(string(reason)))
+	}
+	result := &consulTxnResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		for _, e := range result.Errors {
+			if strings.Contains(e.What, "Permission denied") {
+				return nil, false, fmt.Errorf("consul transaction failed: %s", e.What)
+			}
+		}
+		return result, false, nil
+	}
+	return result, true, nil
+}
+
+//revision returns the index of the revision entry in the results of a transaction
+func (s *consulStore) revision(result *consulTxnResponse) int64 {
+	var rev int64
+	for _, r := range result.Results {
+		if r.KV.Key == s.revisionKey() && int64(r.KV.ModifyIndex) > rev {
+			rev = int64(r.KV.ModifyIndex)
+		}
+	}
+	return rev
+}
+
+//trees returns the prefixes of the entries to list for the ranges, as few as the transaction can take
+func (s *consulStore) trees(ranges []clientv3.Op) []string {
+	var prefixes []string
+	for _, r := range ranges {
+		prefixes = append(prefixes, listPrefix(r))
+	}
+	common := commonPrefix(prefixes)
+	var trees []string
+	for _, prefix := range prefixes {
+		covered := false
+		for i, tree := range trees {
+			if strings.HasPrefix(prefix, tree) {
+				covered = true
+				break
+			}
+			if strings.HasPrefix(tree, prefix) {
+				trees[i], covered = prefix, true
+				break
+			}
+		}
+		if !covered {
+			trees = append(trees, prefix)
+		}
+	}
+	if len(trees) >= consulTxnOps {
+		return []string{common}
+	}
+	return trees
+}
+
+func commonPrefix(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	prefix := keys[0]
+	for _, key := range keys[1:] {
+		n := 0
+		for n < len(prefix) && n < len(key) && prefix[n] == key[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return prefix
+}
+
+func (s *consulStore) read(ctx context.Context, ranges []clientv3.Op) ([]*mvccpb.KeyValue, int64, error) {
+	ops := []consulTxnOp{{KV: consulKV{Verb: "get-tree", Key: s.revisionKey()}}}
+	for _, tree := range s.trees(ranges) {
+		ops = append(ops, consulTxnOp{KV: consulKV{Verb: "get-tree", Key: s.entry(tree)}})
+	}
+	result, ok, err := s.txn(ctx, ops)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("consul failed to read %d trees: %v", len(ops), result.Errors)
+	}
+	rev := s.revision(result)
+	var kvs []*mvccpb.KeyValue
+	seen := make(map[string]bool)
+	for _, r := range result.Results {
+		if !strings.HasPrefix(r.KV.Key, s.entry("")) {
+			continue
+		}
+		key := strings.TrimPrefix(r.KV.Key, s.entry(""))
+		if seen[key] || !inRanges([]byte(key), ranges) {
+			continue
+		}
+		seen[key] = true
+		version := int64(r.KV.Flags)
+		if version == 0 {
+			// written by something else than the job monitor
+			version = 1
+		}
+		kvs = append(kvs, &mvccpb.KeyValue{Key: []byte(key), Value: r.KV.Value, Version: version,
+			CreateRevision: int64(r.KV.CreateIndex), ModRevision: int64(r.KV.ModifyIndex)})
+	}
+	sortKeyValues(kvs)
+	return kvs, rev, nil
+}
+
+func (s *consulStore) commit(ctx context.Context, c storeCommit) (int64, bool, error) {
+	var conditional, deletes []consulTxnOp
+	for key, kv := range c.expected {
+		if kv == nil {
+			conditional = append(conditional, consulTxnOp{KV: consulKV{Verb: "check-not-exists", Key: s.entry(key)}})
+		} else {
+			conditional = append(conditional, consulTxnOp{KV: consulKV{Verb: "check-index", Key: s.entry(key), Index: uint64(kv.ModRevision)}})
+		}
+	}
+	for _, put := range c.puts {
+		// a cas on the index read keeps the version in the flags exact, index 0 creating the entry only if it is missing
+		op := consulKV{Verb: "cas", Key: s.entry(string(put.kv.Key)), Value: put.kv.Value, Flags: uint64(put.kv.Version)}
+		if put.prev != nil {
+			op.Index = uint64(put.prev.ModRevision)
+		}
+		conditional = append(conditional, consulTxnOp{KV: op})
+	}
+	for _, kv := range c.deletes {
+		deletes = append(deletes, consulTxnOp{KV: consulKV{Verb: "delete", Key: s.entry(string(kv.Key))}})
+	}
+	bump := consulTxnOp{KV: consulKV{Verb: "set", Key: s.revisionKey()}}
+	if len(conditional)+len(deletes) < consulTxnOps {
+		result, ok, err := s.txn(ctx, append(append(conditional, deletes...), bump))
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		return s.revision(result), true, nil
+	}
+	if len(conditional) > 0 {
+		return 0, false, fmt.Errorf("a transaction on %d keys is more than consul takes", len(conditional)+len(deletes))
+	}
+	// the keys of a range deleted on its own can be deleted a few at a time
+	var rev int64
+	for len(deletes) > 0 {
+		n := len(deletes)
+		if n > consulTxnOps-1 {
+			n = consulTxnOps - 1
+		}
+		result, ok, err := s.txn(ctx, append(deletes[:n:n], bump))
+		if err != nil || !ok {
+			return 0, false, err
+		}
+		rev, deletes = s.revision(result), deletes[n:]
+	}
+	return rev, true, nil
+}
+
+//wait runs a blocking query on the entries of the range, which Consul answers once their index is past rev
+func (s *consulStore) wait(ctx context.Context, op clientv3.Op, rev int64) error {
+	wait := waitTimeout(ctx, consulMaxWait)
+	query := url.Values{"recurse": {"true"}, "index": {strconv.FormatInt(rev, 10)}, "wait": {fmt.Sprintf("%dms", wait/time.Millisecond)}}
+	resp, err := s.request(ctx, http.MethodGet, "/v1/kv/"+s.entry(listPrefix(op)), query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("consul failed to watch %s: %s", listPrefix(op), resp.Status)
+	}
+	return nil
+}
+
+func (s *consulStore) close() error {
+	s.client.Transport.(*http.Transport).CloseIdleConnections()
+	return nil
+}
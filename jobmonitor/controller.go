@@ -0,0 +1,391 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/cenkalti/backoff"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the controllers running in this process, a process which runs one is ready without monitoring any training
+var runningControllers int32
+
+//ControlledJob ... the value of the key of a training under jobmonitor.controller.prefix, which tells a controller to
+//monitor the training. It carries what the environment of a job monitor pod carries. Without num_learners the spec of
+//the job is taken from the trainer
+type ControlledJob struct {
+	UserID                string            `json:"user_id"`
+	JobName               string            `json:"job_name,omitempty"`
+	JobKind               string            `json:"job_kind,omitempty"`
+	NumLearners           int               `json:"num_learners,omitempty"`
+	UseNativeDistribution bool              `json:"use_native_distribution,omitempty"`
+	Labels                map[string]string `json:"labels,omitempty"`
+	Framework             string            `json:"framework,omitempty"`
+	FrameworkVersion      string            `json:"framework_version,omitempty"`
+	ResumesFrom           string            `json:"resumes_from,omitempty"`
+	Attempt               int               `json:"attempt,omitempty"`
+	MaxAttempts           int               `json:"max_attempts,omitempty"`
+	Profile               string            `json:"profile,omitempty"`
+}
+
+//ControllerConfig ... the connections a Controller shares between the job monitors of its trainings
+type ControllerConfig struct {
+	// connection settings of etcd, the global ones if not set
+	Etcd coord.Config
+	// optional, connected from Etcd if not set
+	Coordinator coord.Coordinator
+	// optional, connected from the in-cluster kubernetes config if not set
+	K8sClient kubernetes.Interface
+	// optional, metrics are discarded if not set
+	Metrics MetricsProvider
+	// optional, the kills go to the grpc API of the LCM if not set
+	Killer JobKiller
+	// optional, how many trainings are monitored at once, jobmonitor.controller.max_jobs if not set. The trainings
+	// beyond that wait for one of the monitored ones to finish
+	MaxJobs int
+}
+
+//Controller ... monitors many trainings in one process, instead of a job monitor pod per training. It watches the
+//keys under jobmonitor.controller.prefix: a training is monitored from its key being put until its workload is gone
+//or its key is deleted, by a JobMonitor of its own
+type Controller struct {
+	cfg    ControllerConfig
+	prefix string
+	etcd   *etcdClient
+	slots  chan struct{}
+	mu     sync.Mutex
+	jobs   map[string]*controlledJob
+	wg     sync.WaitGroup
+}
+
+//controlledJob is a training of the controller, cancel stops its job monitor
+type controlledJob struct {
+	spec     ControlledJob
+	revision int64
+	cancel   context.CancelFunc
+	// set once the key of the training is deleted, a put of the key starts a new job monitor from then on
+	removed bool
+	// closed once the job monitor is stopped
+	done chan struct{}
+	// the job monitor of the training this one waits for to be stopped, if the key was put again meanwhile
+	previous <-chan struct{}
+}
+
+//NewController ... connects the controller, the connections which aren't given in cfg are taken from the global
+//configuration
+func NewController(cfg ControllerConfig, logr *logger.LocLoggingEntry) (*Controller, error) {
+	if len(cfg.Etcd.Endpoints) == 0 {
+		cfg.Etcd = defaultCoordinatorConfig()
+	}
+	if cfg.MaxJobs <= 0 {
+		cfg.MaxJobs = viper.GetInt(controllerMaxJobsKey)
+	}
+	if cfg.Coordinator == nil {
+		var err error
+		if cfg.Coordinator, err = coordinator(cfg.Etcd, logr); err != nil {
+			return nil, err
+		}
+	}
+	etcd, err := newEtcdClient(cfg.Etcd, logr)
+	if err != nil {
+		return nil, err
+	}
+	prefix := viper.GetString(controllerPrefixKey)
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Controller{cfg: cfg, prefix: prefix, etcd: etcd, slots: make(chan struct{}, cfg.MaxJobs), jobs: make(map[string]*controlledJob)}, nil
+}
+
+//Run ... monitors the trainings under the prefix until ctx is done, then stops their job monitors and returns
+func (c *Controller) Run(ctx context.Context, logr *logger.LocLoggingEntry) {
+	logr.Infof("(Controller) monitoring the trainings under %s, at most %d at once", c.prefix, c.cfg.MaxJobs)
+	atomic.AddInt32(&runningControllers, 1)
+	defer atomic.AddInt32(&runningControllers, -1)
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = 0
+	retryBackoff.MaxInterval = 30 * time.Second
+	backoff.RetryNotify(func() error {
+		return c.sync(ctx, logr)
+	}, backoff.WithContext(retryBackoff, ctx), func(err error, t time.Duration) {
+		logr.WithError(err).Warnf("(Controller) lost the watch of %s, listing the trainings again in %v", c.prefix, t)
+	})
+
+	c.mu.Lock()
+	for _, job := range c.jobs {
+		job.cancel()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+	c.etcd.Close()
+	c.cfg.Coordinator.Close(logr)
+}
+
+//sync lists the trainings under the prefix, then follows the changes to them until the watch fails or ctx is done
+func (c *Controller) sync(ctx context.Context, logr *logger.LocLoggingEntry) error {
+	listCtx, cancel := context.WithTimeout(ctx, ctxTimeout())
+	response, err := c.etcd.Get(listCtx, c.prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool)
+	for _, kv := range response.Kvs {
+		trainingID := strings.TrimPrefix(string(kv.Key), c.prefix)
+		listed[trainingID] = true
+		c.put(ctx, trainingID, kv.Value, kv.ModRevision, logr)
+	}
+	// a key deleted while the watch was down
+	c.mu.Lock()
+	for trainingID, job := range c.jobs {
+		if !listed[trainingID] {
+			job.stop()
+		}
+	}
+	c.mu.Unlock()
+
+	events := c.etcd.Watch(ctx, c.prefix, clientv3.WithPrefix(), clientv3.WithRev(response.Header.Revision+1))
+	for resp := range events {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range resp.Events {
+			trainingID := strings.TrimPrefix(string(ev.Kv.Key), c.prefix)
+			if ev.Type == clientv3.EventTypeDelete {
+				c.remove(trainingID, logr)
+				continue
+			}
+			c.put(ctx, trainingID, ev.Kv.Value, ev.Kv.ModRevision, logr)
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return fmt.Errorf("the watch of %s was closed", c.prefix)
+}
+
+//put starts monitoring a training which isn't monitored yet, or whose key was deleted. The job monitor of a training
+//put again while its previous job monitor is being stopped starts once that one is stopped
+func (c *Controller) put(ctx context.Context, trainingID string, value []byte, revision int64, logr *logger.LocLoggingEntry) {
+	if trainingID == "" || strings.Contains(trainingID, "/") {
+		return
+	}
+	var spec ControlledJob
+	if err := json.Unmarshal(value, &spec); err != nil {
+		logr.WithError(err).Errorf("(Controller) ignoring training %s, its key is not a job", trainingID)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var previous <-chan struct{}
+	if job, ok := c.jobs[trainingID]; ok {
+		if !job.removed {
+			job.revision = revision
+			return
+		}
+		logr.Infof("(Controller) the key of %s was put again, it is monitored once its previous job monitor is stopped", trainingID)
+		previous = job.done
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	job := &controlledJob{spec: spec, revision: revision, cancel: cancel, done: make(chan struct{}), previous: previous}
+	c.jobs[trainingID] = job
+	c.wg.Add(1)
+	go c.runJob(jobCtx, trainingID, job)
+}
+
+//remove stops monitoring a training whose key was deleted
+func (c *Controller) remove(trainingID string, logr *logger.LocLoggingEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if job, ok := c.jobs[trainingID]; ok && !job.removed {
+		logr.Infof("(Controller) the key of %s was deleted, it is no longer monitored", trainingID)
+		job.stop()
+	}
+}
+
+//stop stops the job monitor of a training whose key was deleted, holding the lock of the controller
+func (job *controlledJob) stop() {
+	job.removed = true
+	job.cancel()
+}
+
+//runJob monitors a training once one of the slots of the controller is free. Its key is deleted once its workload is
+//gone, unless it was put again meanwhile
+func (c *Controller) runJob(ctx context.Context, trainingID string, job *controlledJob) {
+	defer c.wg.Done()
+	defer func() {
+		// the training is no longer the one of this job monitor if its key was put again while it was stopped
+		c.mu.Lock()
+		if c.jobs[trainingID] == job {
+			delete(c.jobs, trainingID)
+		}
+		c.mu.Unlock()
+		job.cancel()
+		close(job.done)
+	}()
+	logr := logger.LocLogger(jobLogEntry(trainingID, job.spec.UserID))
+
+	if job.previous != nil {
+		select {
+		case <-job.previous:
+		case <-ctx.Done():
+			return
+		}
+	}
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return
+	}
+	defer func() { <-c.slots }()
+
+	for ctx.Err() == nil {
+		jm, err := c.newJobMonitor(ctx, trainingID, job.spec, logr)
+		if err != nil {
+			return
+		}
+		jm.ManageDistributedJob(logr)
+
+		var finished bool
+		select {
+		case <-jm.Done():
+			finished = ctx.Err() == nil && !isClosed(jm.LostLeadership())
+		case <-jm.LostLeadership():
+		case <-ctx.Done():
+		}
+		stopCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		jm.Stop(stopCtx, logr)
+		cancel()
+		jm.unregister()
+
+		if finished {
+			c.release(trainingID, job, logr)
+			return
+		}
+		// a replica which lost the leadership of the training goes back to campaigning for it
+	}
+}
+
+//newJobMonitor creates the job monitor of a training, retrying until it succeeds or ctx is done
+func (c *Controller) newJobMonitor(ctx context.Context, trainingID string, spec ControlledJob, logr *logger.LocLoggingEntry) (*JobMonitor, error) {
+	c.mu.Lock()
+	k8sClient := c.cfg.K8sClient
+	c.mu.Unlock()
+	cfg := withProcessConfig(Config{
+		TrainingID:            trainingID,
+		UserID:                spec.UserID,
+		JobName:               spec.JobName,
+		JobKind:               spec.JobKind,
+		NumLearners:           spec.NumLearners,
+		UseNativeDistribution: spec.UseNativeDistribution,
+		Labels:                spec.Labels,
+		Framework:             spec.Framework,
+		FrameworkVersion:      spec.FrameworkVersion,
+		ResumesFrom:           spec.ResumesFrom,
+		FromTrainer:           spec.NumLearners == 0,
+		Etcd:                  c.cfg.Etcd,
+		Coordinator:           sharedCoordinator{c.cfg.Coordinator},
+		etcd:                  c.etcd.share(),
+		K8sClient:             k8sClient,
+		Metrics:               c.cfg.Metrics,
+		Killer:                c.cfg.Killer,
+		Attempt:               spec.Attempt,
+		MaxAttempts:           spec.MaxAttempts,
+		Profile:               spec.Profile,
+	})
+
+	var jm *JobMonitor
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = 0
+	retryBackoff.MaxInterval = 5 * time.Minute
+	err := backoff.RetryNotify(func() error {
+		if cfg.FromTrainer {
+			if err := bootstrapFromTrainer(&cfg, logr); err != nil {
+				return err
+			}
+		}
+		var err error
+		jm, err = New(cfg, logr)
+		return err
+	}, backoff.WithContext(retryBackoff, ctx), func(err error, t time.Duration) {
+		logr.WithError(err).Warnf("(Controller) failed to create the job monitor of %s, retrying in %v", trainingID, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the shared kubernetes client is connected by the first job monitor
+	c.mu.Lock()
+	if c.cfg.K8sClient == nil {
+		c.cfg.K8sClient = jm.k8sClient
+	}
+	c.mu.Unlock()
+	return jm, nil
+}
+
+//release deletes the key of a finished training, so that a restarted controller doesn't monitor it again
+func (c *Controller) release(trainingID string, job *controlledJob, logr *logger.LocLoggingEntry) {
+	c.mu.Lock()
+	revision := job.revision
+	c.mu.Unlock()
+	key := c.prefix + trainingID
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	txn, err := c.etcd.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).Then(clientv3.OpDelete(key)).Commit()
+	if err != nil {
+		logr.WithError(err).Warnf("(Controller) failed to delete the key of the finished training %s", trainingID)
+		return
+	}
+	if !txn.Succeeded {
+		logr.Infof("(Controller) the key of %s changed while it was monitored, leaving it", trainingID)
+		return
+	}
+	logr.Infof("(Controller) %s is finished, deleted its key", trainingID)
+}
+
+func isClosed(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+//sharedCoordinator is the coordinator of the controller, or the one injected by the LCM, as seen by the job monitors,
+//which must not close it
+type sharedCoordinator struct {
+	coord.Coordinator
+}
+
+func (sharedCoordinator) Close(logr *logger.LocLoggingEntry) {}
+
+func (c sharedCoordinator) sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	return readSequence(c.Coordinator, prefix, logr)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+// the degraded modes a job monitor can run in, each has a jobmonitor.degraded gauge with the mode as its label
+const (
+	// an etcd watch of the job was dropped, e.g. during an etcd leader election, and is being re-established
+	degradedEtcdFailover = "etcd_failover"
+	// the updates of the trainer keep failing, the statuses reach the trainer once it is back (see checkTrainerUpdates)
+	degradedTrainerUpdates = "trainer_updates_failing"
+)
+
+//DegradedMode ... a mode the job monitor of a job runs degraded in, and since when
+type DegradedMode struct {
+	Mode   string    `json:"mode"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+//degradedModes ... the degraded modes the job monitor of a job is in, by mode
+type degradedModes struct {
+	mu     sync.Mutex
+	active map[string]DegradedMode
+}
+
+//enterDegradedMode notes that the job monitor runs in the given degraded mode, raising its gauge. Entering a mode the
+//job monitor is in already keeps its start
+func (jm *JobMonitor) enterDegradedMode(mode string, reason string, logr *logger.LocLoggingEntry) {
+	d := &jm.degraded
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.active[mode]; ok {
+		return
+	}
+	if d.active == nil {
+		d.active = make(map[string]DegradedMode)
+	}
+	d.active[mode] = DegradedMode{Mode: mode, Since: jm.timeSource().Now(), Reason: reason}
+	if jm.metrics != nil {
+		jm.metrics.degradedModeGauge.With("mode", mode).Set(1)
+	}
+	logr.Warnf("(degraded) the job monitor of %s runs degraded in mode %s: %s", jm.TrainingID, mode, reason)
+}
+
+//leaveDegradedMode notes that the job monitor no longer runs in the given degraded mode
+func (jm *JobMonitor) leaveDegradedMode(mode string, logr *logger.LocLoggingEntry) {
+	d := &jm.degraded
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entered, ok := d.active[mode]
+	if !ok {
+		return
+	}
+	delete(d.active, mode)
+	if jm.metrics != nil {
+		jm.metrics.degradedModeGauge.With("mode", mode).Set(0)
+	}
+	logr.Infof("(degraded) the job monitor of %s left degraded mode %s after %v", jm.TrainingID, mode, jm.timeSource().Now().Sub(entered.Since))
+}
+
+//degradedModes is the degraded modes the job monitor is in, ordered by mode
+func (jm *JobMonitor) degradedModes() []DegradedMode {
+	d := &jm.degraded
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	modes := make([]DegradedMode, 0, len(d.active))
+	for _, mode := range d.active {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool { return modes[i].Mode < modes[j].Mode })
+	return modes
+}
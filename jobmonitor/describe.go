@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+)
+
+// the most recent audit events returned along with a reconstructed state
+const describeEventsShown = 50
+
+//JobStateAt ... what the job monitor believed the state of a job was at a point in time, reconstructed from its audit
+//trail and the statuses the learners wrote to etcd
+type JobStateAt struct {
+	TrainingID string    `json:"training_id"`
+	At         time.Time `json:"at"`
+	// the overall status of the job, and since when the monitor held it
+	Status      string    `json:"status"`
+	StatusSince time.Time `json:"status_since,omitempty"`
+	// the state of the teardown, empty if none was requested yet
+	Teardown      string    `json:"teardown,omitempty"`
+	TeardownSince time.Time `json:"teardown_since,omitempty"`
+	// the last status each learner had written, by learner number
+	LearnerStatuses map[int]string `json:"learner_statuses,omitempty"`
+	// the audit events up to At, the most recent last
+	Events []AuditEvent `json:"events,omitempty"`
+	// audit events were dropped because the audit trail ran out of budget, so the state may be behind
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+//AuditEvent ... an event of the audit trail of a job
+type AuditEvent struct {
+	At     time.Time `json:"at"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail"`
+}
+
+//DescribeAt ... reconstructs what the monitor believed the state of the job was at the given time, e.g. to answer why a
+//job was shown as PROCESSING when its pods were already gone
+func (jm *JobMonitor) DescribeAt(at time.Time, logr *logger.LocLoggingEntry) (*JobStateAt, error) {
+	events, err := jm.auditEvents(logr)
+	if err != nil {
+		return nil, err
+	}
+	state := replayAudit(events, at)
+	state.TrainingID = jm.TrainingID
+	jm.auditTrail.mu.Lock()
+	state.Incomplete = jm.auditTrail.dropped > 0
+	jm.auditTrail.mu.Unlock()
+
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return nil, err
+	}
+	state.LearnerStatuses, err = learnerStatusesAt(etcd, jm.TrainingID, at, jm.monitorsLearner, logr)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+//DescribeAt ... reconstructs the state of a training without a running job monitor, see JobMonitor.DescribeAt, from
+//the audit trail and the learner statuses which are left in etcd. Whether audit events were dropped is only known to
+//the job monitor, so Incomplete is never set. It returns nil if etcd has neither for the training
+func DescribeAt(trainingID string, at time.Time, logr *logger.LocLoggingEntry) (*JobStateAt, error) {
+	etcd, err := newEtcdClient(defaultCoordinatorConfig(), logr)
+	if err != nil {
+		return nil, err
+	}
+	defer etcd.Close()
+	events, err := loadAuditEvents(etcd, trainingID, logr)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := learnerStatusesAt(etcd, trainingID, at, func(int) bool { return true }, logr)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 && len(statuses) == 0 {
+		return nil, nil
+	}
+	state := replayAudit(events, at)
+	state.TrainingID = trainingID
+	state.LearnerStatuses = statuses
+	return state, nil
+}
+
+//replayAudit applies the audit events up to at, in the order they happened
+func replayAudit(events []auditEvent, at time.Time) *JobStateAt {
+	state := &JobStateAt{At: at, Status: grpc_trainer_v2.Status_NOT_STARTED.String()}
+	for _, event := range events {
+		when := time.Unix(0, event.At)
+		if when.After(at) {
+			break
+		}
+		switch event.Kind {
+		case auditTransition, auditFinalStatus:
+			if event.Status != "" && event.Status != state.Status {
+				state.Status, state.StatusSince = event.Status, when
+			}
+		case auditTeardown:
+			state.Teardown, state.TeardownSince = event.Status, when
+		case auditRequeue:
+			state.Status, state.StatusSince = grpc_trainer_v2.Status_NOT_STARTED.String(), when
+			state.Teardown, state.TeardownSince = "", time.Time{}
+		}
+		if state.Teardown == "" && event.Kind == auditFinalStatus {
+			state.Teardown, state.TeardownSince = teardownRequested, when
+		}
+		state.Events = append(state.Events, AuditEvent{At: when, Kind: event.Kind, Detail: event.Detail})
+	}
+	if len(state.Events) > describeEventsShown {
+		state.Events = state.Events[len(state.Events)-describeEventsShown:]
+	}
+	return state
+}
+
+//auditEvents reads the audit trail of the job from etcd, including the events which weren't written out yet
+func (jm *JobMonitor) auditEvents(logr *logger.LocLoggingEntry) ([]auditEvent, error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return nil, err
+	}
+	events, err := loadAuditEvents(etcd, jm.TrainingID, logr)
+	if err != nil {
+		return nil, err
+	}
+	jm.auditTrail.mu.Lock()
+	events = append(events, jm.auditTrail.pending...)
+	jm.auditTrail.mu.Unlock()
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	return events, nil
+}
+
+//loadAuditEvents reads the audit trail of a job from etcd, in the order the events happened
+func loadAuditEvents(etcd *etcdClient, trainingID string, logr *logger.LocLoggingEntry) ([]auditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	response, err := etcd.Get(ctx, auditPath(trainingID), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var events []auditEvent
+	for _, kv := range response.Kvs {
+		batch, err := decodeAuditBatch(kv.Value)
+		if err != nil {
+			logr.WithError(err).Warnf("(describe) skipping the unreadable audit batch %s", kv.Key)
+			continue
+		}
+		events = append(events, batch...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	return events, nil
+}
+
+//learnerStatusesAt finds the last status each learner of a job for which member holds wrote before at, going by the
+//timestamps of the statuses
+func learnerStatusesAt(etcd *etcdClient, trainingID string, at time.Time, member func(learner int) bool, logr *logger.LocLoggingEntry) (map[int]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	response, err := etcd.Get(ctx, learnersPath(trainingID), clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, err
+	}
+	statuses := make(map[int]string)
+	for _, kv := range response.Kvs {
+		learner, ok := learnerOfStatusKey(trainingID, string(kv.Key))
+		if !ok || !member(learner) {
+			continue
+		}
+		update := parseStatus(string(kv.Value), logr)
+		if written, ok := parseStatusTimestamp(update.Timestamp); ok && !written.After(at) {
+			statuses[learner] = update.Status.String()
+		}
+	}
+	return statuses, nil
+}
+
+//JobStateHandler ... serves DescribeAt as JSON, e.g. GET /jobs/<training id>/state?at=2018-11-02T02:14:00Z. Jobs which
+//aren't monitored here are reconstructed from what they left in etcd
+func JobStateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+		if len(path) != 2 || path[1] != "state" {
+			http.NotFound(w, r)
+			return
+		}
+		at := time.Now()
+		if value := r.URL.Query().Get("at"); value != "" {
+			var err error
+			if at, err = time.Parse(time.RFC3339, value); err != nil {
+				http.Error(w, "invalid at: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		monitoredJobsMu.RLock()
+		jm, ok := monitoredJobs[path[0]]
+		monitoredJobsMu.RUnlock()
+		var state *JobStateAt
+		var err error
+		if ok {
+			state, err = jm.DescribeAt(at, jm.componentLogger(nil, componentAPI))
+		} else {
+			state, err = DescribeAt(path[0], at, logger.LocLogger(jobLogEntry(path[0], "").WithField(logkeyComponent, componentAPI)))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if state == nil {
+			http.Error(w, fmt.Sprintf("training %s is unknown", path[0]), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state)
+	})
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayAudit(t *testing.T) {
+	start := time.Date(2018, 11, 2, 2, 0, 0, 0, time.UTC)
+	at := func(minutes int) int64 { return start.Add(time.Duration(minutes) * time.Minute).UnixNano() }
+	events := []auditEvent{
+		{At: at(1), Kind: auditTransition, Status: "PROCESSING", Detail: "NOT_STARTED to PROCESSING"},
+		{At: at(5), Kind: auditLateWrite, Detail: "FAILED written late"},
+		{At: at(10), Kind: auditFinalStatus, Status: "COMPLETED", Detail: "COMPLETED"},
+		{At: at(11), Kind: auditTeardown, Status: teardownTrainerFinal, Detail: "teardown reached trainer_final"},
+		{At: at(20), Kind: auditTeardown, Status: teardownPodsGone, Detail: "teardown reached pods_gone"},
+	}
+
+	state := replayAudit(events, start)
+	assert.Equal(t, "NOT_STARTED", state.Status)
+	assert.Empty(t, state.Teardown)
+
+	state = replayAudit(events, start.Add(7*time.Minute))
+	assert.Equal(t, "PROCESSING", state.Status)
+	assert.Equal(t, time.Unix(0, at(1)), state.StatusSince)
+	assert.Len(t, state.Events, 2)
+
+	state = replayAudit(events, start.Add(10*time.Minute))
+	assert.Equal(t, "COMPLETED", state.Status)
+	assert.Equal(t, teardownRequested, state.Teardown)
+
+	state = replayAudit(events, start.Add(time.Hour))
+	assert.Equal(t, teardownPodsGone, state.Teardown)
+	assert.Equal(t, time.Unix(0, at(20)), state.TeardownSince)
+}
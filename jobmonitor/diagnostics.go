@@ -0,0 +1,131 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+)
+
+//HandleDiagnosticSignal ... dumps the diagnostics of the job monitor to the log whenever the process receives sig
+//(SIGUSR2 for the job monitor pod), so that a wedged monitor can be looked into without attaching a debugger. Jobs
+//with the minimal profile don't collect diagnostics
+func (jm *JobMonitor) HandleDiagnosticSignal(sig os.Signal, logr *logger.LocLoggingEntry) {
+	if jm.minimalProfile() {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+	logr = jm.componentLogger(logr, componentDiagnostics)
+	go func() {
+		for range signals {
+			logr.Warnf("(diagnostics) dump of the job monitor of %s requested\n%s", jm.TrainingID, jm.Diagnostics(logr))
+		}
+	}()
+}
+
+//Diagnostics ... returns a human readable snapshot of the state of the job monitor: teardown state, processed
+//offsets, etcd revisions, pending queues and the stacks of all goroutines
+func (jm *JobMonitor) Diagnostics(logr *logger.LocLoggingEntry) string {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "=== job monitor of %s (user %s, job %s, %s) at %s\n", jm.TrainingID, jm.UserID, jm.JobName, jm.JobKind, jm.timeSource().Now().Format(time.RFC3339))
+	fmt.Fprintf(&out, "learners: %d (spec %d), terminal learners: %d, native distribution: %v\n",
+		jm.learnerCount(), jm.NumLearners, atomic.LoadUint64(&jm.numTerminalLearners), jm.UseNativeDistribution)
+
+	jm.phaseMu.Lock()
+	fmt.Fprintf(&out, "phase: %s since %s\n", jm.phase, jm.phaseStarted.Format(time.RFC3339))
+	jm.phaseMu.Unlock()
+	if status, latched := jm.terminalLatch(); latched {
+		fmt.Fprintf(&out, "terminal latch: %s\n", status)
+	} else {
+		fmt.Fprintf(&out, "terminal latch: open\n")
+	}
+	if rec, _, err := jm.loadTeardown(logr); err != nil {
+		fmt.Fprintf(&out, "teardown: failed to read: %v\n", err)
+	} else if rec == nil {
+		fmt.Fprintf(&out, "teardown: not requested\n")
+	} else {
+		fmt.Fprintf(&out, "teardown: %s (status %s, error code %s), retrying in background: %v\n",
+			rec.State, rec.Status, rec.ErrorCode, atomic.LoadInt32(&jm.teardownRetrying) == 1)
+	}
+
+	offsets := jm.processedOffsets()
+	learners := make([]int, 0, len(offsets))
+	for learner := range offsets {
+		learners = append(learners, learner)
+	}
+	sort.Ints(learners)
+	jm.learnerStatusMu.Lock()
+	for _, learner := range learners {
+		fmt.Fprintf(&out, "learner %d: %d updates processed, status %s\n", learner, offsets[learner], jm.learnerStatuses[learner])
+	}
+	jm.learnerStatusMu.Unlock()
+	for learner, rate := range jm.quarantinedLearners() {
+		fmt.Fprintf(&out, "learner %d: quarantined, writing %.0f statuses per minute\n", learner, rate)
+	}
+
+	jm.auditTrail.mu.Lock()
+	fmt.Fprintf(&out, "audit trail: %d events pending, %d compressed bytes written, %d events dropped\n",
+		len(jm.auditTrail.pending), jm.auditTrail.written, jm.auditTrail.dropped)
+	jm.auditTrail.mu.Unlock()
+
+	inFlight, failed, others := terminalSlots.state()
+	fmt.Fprintf(&out, "terminal slots: %d in use, waiting: %d failed, %d other jobs\n", inFlight, failed, others)
+
+	jm.watchesMu.Lock()
+	now := time.Now()
+	for name, w := range jm.watches {
+		fmt.Fprintf(&out, "watch %s: at revision %d, silent for %v, %d progress notifications\n",
+			name, atomic.LoadInt64(&w.revision), w.silentFor(now), atomic.LoadUint32(&w.notifications))
+	}
+	jm.watchesMu.Unlock()
+	jm.writeEtcdRevisions(&out, logr)
+
+	buf := make([]byte, 1<<20)
+	fmt.Fprintf(&out, "=== goroutines\n%s\n", buf[:runtime.Stack(buf, true)])
+	return out.String()
+}
+
+//writeEtcdRevisions writes the revision of etcd and the mod revision of every key of the job
+func (jm *JobMonitor) writeEtcdRevisions(out *bytes.Buffer, logr *logger.LocLoggingEntry) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		fmt.Fprintf(out, "etcd: not connected: %v\n", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	response, err := etcd.Get(ctx, jobBasePath(jm.TrainingID), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		fmt.Fprintf(out, "etcd: failed to read the keys of the job: %v\n", err)
+		return
+	}
+	fmt.Fprintf(out, "etcd: revision %d\n", response.Header.Revision)
+	for _, kv := range response.Kvs {
+		fmt.Fprintf(out, "  %s: mod revision %d, version %d\n", kv.Key, kv.ModRevision, kv.Version)
+	}
+}
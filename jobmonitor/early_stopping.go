@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+// error code of jobs halted by one of their early stopping rules
+const errCodeEarlyStopped = "EARLY_STOPPED"
+
+// the kinds of early stopping rules
+const (
+	// nan(<metric>) stops the job once the metric is NaN or infinite
+	earlyStopNaN = "nan"
+	// plateau(<metric>,<evaluations>[,min|max]) stops the job once the metric didn't improve, by going down unless
+	// max is given, for that many evaluations in a row
+	earlyStopPlateau = "plateau"
+)
+
+var earlyStoppingRulePattern = regexp.MustCompile(`^(\w+)\(([^)]*)\)$`)
+
+//earlyStoppingRule ... a rule the job is halted by once its summary metrics meet it
+type earlyStoppingRule struct {
+	kind     string
+	metric   string
+	patience int
+	maximize bool
+}
+
+func (r earlyStoppingRule) String() string {
+	if r.kind == earlyStopNaN {
+		return fmt.Sprintf("%s is not a number", r.metric)
+	}
+	return fmt.Sprintf("%s did not improve in %d evaluations", r.metric, r.patience)
+}
+
+//parseEarlyStoppingRules reads the rules of a job, separated by semicolons, see earlyStopNaN and earlyStopPlateau
+func parseEarlyStoppingRules(spec string) ([]earlyStoppingRule, error) {
+	var rules []earlyStoppingRule
+	for _, text := range strings.Split(spec, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		match := earlyStoppingRulePattern.FindStringSubmatch(text)
+		if match == nil {
+			return nil, fmt.Errorf("invalid early stopping rule %q", text)
+		}
+		args := strings.Split(match[2], ",")
+		for i := range args {
+			args[i] = strings.TrimSpace(args[i])
+		}
+		rule := earlyStoppingRule{kind: match[1], metric: args[0]}
+		if rule.metric == "" {
+			return nil, fmt.Errorf("early stopping rule %q has no metric", text)
+		}
+		switch {
+		case rule.kind == earlyStopNaN && len(args) == 1:
+		case rule.kind == earlyStopPlateau && (len(args) == 2 || len(args) == 3):
+			patience, err := strconv.Atoi(args[1])
+			if err != nil || patience < 1 {
+				return nil, fmt.Errorf("early stopping rule %q needs a number of evaluations of at least 1", text)
+			}
+			rule.patience = patience
+			if len(args) == 3 {
+				if args[2] != "min" && args[2] != "max" {
+					return nil, fmt.Errorf("early stopping rule %q has to end in min or max", text)
+				}
+				rule.maximize = args[2] == "max"
+			}
+		default:
+			return nil, fmt.Errorf("unknown early stopping rule %q", text)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// NaN and infinity as Python's json module writes them, which isn't JSON
+var nonFiniteJSONPattern = regexp.MustCompile(`([:\[,]\s*)(-?Infinity|NaN)(\s*[,}\]])`)
+
+//earlyStoppingValue looks up a metric in the summary metrics of a learner like summaryMetric, but also takes NaN and
+//infinity, written bare or as strings
+func earlyStoppingValue(summary string, metric string) (float64, bool) {
+	var current interface{}
+	if err := json.Unmarshal([]byte(summary), &current); err != nil {
+		if json.Unmarshal([]byte(nonFiniteJSONPattern.ReplaceAllString(summary, `$1"$2"$3`)), &current) != nil {
+			return 0, false
+		}
+	}
+	for _, field := range strings.Split(metric, ".") {
+		fields, ok := current.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		current = fields[field]
+	}
+	switch value := current.(type) {
+	case float64:
+		return value, true
+	case string:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+//plateau ... the best value of a metric a learner reported, and how many of its evaluations since did not improve on it.
+//The last value tells a new evaluation of the metric from a summary which only changed in other metrics
+type plateau struct {
+	best, last float64
+	stale      int
+}
+
+//earlyStopping ... the plateaus of the plateau rules, by rule and learner
+type earlyStopping struct {
+	mu       sync.Mutex
+	plateaus map[[2]int]*plateau
+}
+
+//evaluate checks a new summary of the learner against the rules, returning the first rule it meets. A plateau rule only
+//counts the summaries in which its metric changed as evaluations, learners rewrite their summary whenever any of their
+//metrics changes
+func (e *earlyStopping) evaluate(rules []earlyStoppingRule, learner int, summary string) (earlyStoppingRule, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, rule := range rules {
+		value, ok := earlyStoppingValue(summary, rule.metric)
+		if !ok {
+			continue
+		}
+		finite := !math.IsNaN(value) && !math.IsInf(value, 0)
+		if rule.kind == earlyStopNaN {
+			if !finite {
+				return rule, true
+			}
+			continue
+		}
+		if !finite {
+			continue
+		}
+		if e.plateaus == nil {
+			e.plateaus = make(map[[2]int]*plateau)
+		}
+		key := [2]int{i, learner}
+		p, seen := e.plateaus[key]
+		switch {
+		case !seen:
+			e.plateaus[key] = &plateau{best: value, last: value}
+			continue
+		case value == p.last:
+			continue
+		}
+		p.last = value
+		switch {
+		case (rule.maximize && value > p.best) || (!rule.maximize && value < p.best):
+			p.best, p.stale = value, 0
+		default:
+			p.stale++
+			if p.stale >= rule.patience {
+				return rule, true
+			}
+		}
+	}
+	return earlyStoppingRule{}, false
+}
+
+//checkEarlyStopping evaluates a new summary of the learner against the early stopping rules of the job,
+//jobmonitor.early_stopping.rules, and halts the job through the LCM once one of them is met
+func (jm *JobMonitor) checkEarlyStopping(rules []earlyStoppingRule, learner int, summary string, logr *logger.LocLoggingEntry) {
+	if len(rules) == 0 {
+		return
+	}
+	rule, met := jm.earlyStopping.evaluate(rules, learner, summary)
+	if !met || !jm.leading() {
+		return
+	}
+	if _, terminal := jm.terminalLatch(); terminal || !atomic.CompareAndSwapInt32(&jm.earlyStopped, 0, 1) {
+		return
+	}
+	message := fmt.Sprintf("the job was stopped early, %s on learner %d", rule, learner)
+	logr.Infof("(checkEarlyStopping) %s: %s", jm.TrainingID, message)
+	jm.metrics.earlyStoppedJobCounter.Add(1)
+	jm.audit(logr, auditEarlyStop, "%s", message)
+	go func() {
+		jm.sendFinalStatus(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_HALTED, Timestamp: client.CurrentTimestampAsString(),
+			ErrorCode: errCodeEarlyStopped, StatusMessage: message}, []ReasonCode{ReasonEarlyStopped}, logr)
+		jm.killDeployedJob(logr)
+	}()
+}
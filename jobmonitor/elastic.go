@@ -0,0 +1,196 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+// grpc metadata key carrying the current number of learners of an elastic job with every status update
+const parallelismHeader = "parallelism"
+
+//elasticLearners ... the learners of an elastic job: the learners of its spec and the ones which joined, less the ones
+//which left
+type elasticLearners struct {
+	mu      sync.Mutex
+	members map[int]bool
+	// the learners seen in etcd. Only those can leave, a learner of the spec which didn't write anything yet is still
+	// starting
+	seen map[int]bool
+}
+
+//elastic tells whether the number of learners of the job changes while it runs, e.g. for elastic Horovod or PyTorch
+func (jm *JobMonitor) elastic() bool {
+	elastic, _ := strconv.ParseBool(jm.configString(elasticLearnersKey))
+	return elastic
+}
+
+//elasticLearnerCount is the current number of learners of an elastic job, it is false until resizeElasticLearners
+//first ran
+func (jm *JobMonitor) elasticLearnerCount() (int, bool) {
+	e := &jm.elasticity
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.members), e.members != nil
+}
+
+//learnerNumbers are the learners monitored, in order. They are 1 to learnerCount unless learners of an elastic job left
+func (jm *JobMonitor) learnerNumbers() []int {
+	e := &jm.elasticity
+	e.mu.Lock()
+	if e.members != nil {
+		numbers := make([]int, 0, len(e.members))
+		for learner := range e.members {
+			numbers = append(numbers, learner)
+		}
+		e.mu.Unlock()
+		sort.Ints(numbers)
+		return numbers
+	}
+	e.mu.Unlock()
+	numbers := make([]int, 0, jm.learnerCount())
+	for i := 1; i <= jm.learnerCount(); i++ {
+		numbers = append(numbers, i)
+	}
+	return numbers
+}
+
+//resizeElasticLearners follows the learners of an elastic job to the ones in the learners/ prefix in etcd: learners
+//which show up are monitored from their first status, and learners whose keys are gone are forgotten, along with their
+//processed offset and whether they were terminal. The trainer is told about the new number of learners
+func (jm *JobMonitor) resizeElasticLearners(logr *logger.LocLoggingEntry) {
+	present, err := jm.etcdLearners(logr)
+	if err != nil {
+		logr.WithError(err).Debugf("failed to find the learners of %s in etcd", jm.TrainingID)
+		return
+	}
+	joined, left, learners := jm.elasticity.resize(present, jm.NumLearners)
+	jm.metrics.learnerCounts.parallelism.Set(float64(learners))
+	if len(joined) == 0 && len(left) == 0 {
+		return
+	}
+
+	for _, learner := range joined {
+		jm.processedMu.Lock()
+		if _, known := jm.processed[learner]; !known {
+			jm.processed[learner] = 0
+		}
+		jm.processedMu.Unlock()
+		jm.recordLearnerStatus(learner, grpc_trainer_v2.Status_NOT_STARTED)
+	}
+	for _, learner := range left {
+		jm.forgetLearner(learner, logr)
+	}
+	message := fmt.Sprintf("the job runs with %d learners", learners)
+	if len(joined) > 0 {
+		message += fmt.Sprintf(", learners %v joined", joined)
+	}
+	if len(left) > 0 {
+		message += fmt.Sprintf(", learners %v left", left)
+	}
+	logr.Infof("(resizeElasticLearners) %s: %s", jm.TrainingID, message)
+	jm.audit(logr, auditResize, "%s", message)
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	if response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr); err == nil && len(response) > 0 {
+		jm.updateStatusInTrainer(&client.TrainingStatusUpdate{Status: parseStatus(response[0].Value, logr).Status,
+			Timestamp: client.CurrentTimestampAsString(), StatusMessage: message}, []ReasonCode{ReasonLearnersResized}, logr)
+	}
+}
+
+//resize updates the learners to the ones present in etcd, starting out from the spec learners 1 to spec. It returns
+//the learners which joined and left, in order, and the number of learners now
+func (e *elasticLearners) resize(present map[int]bool, spec int) ([]int, []int, int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.members == nil {
+		e.members, e.seen = make(map[int]bool), make(map[int]bool)
+		for i := 1; i <= spec; i++ {
+			e.members[i] = true
+		}
+	}
+	var joined, left []int
+	for learner := range present {
+		e.seen[learner] = true
+		if !e.members[learner] {
+			e.members[learner] = true
+			joined = append(joined, learner)
+		}
+	}
+	for learner := range e.members {
+		if e.seen[learner] && !present[learner] {
+			delete(e.members, learner)
+			left = append(left, learner)
+		}
+	}
+	sort.Ints(joined)
+	sort.Ints(left)
+	return joined, left, len(e.members)
+}
+
+//forgetLearner drops what the job monitor knows about a learner which left the job
+func (jm *JobMonitor) forgetLearner(learner int, logr *logger.LocLoggingEntry) {
+	jm.learnerStatusMu.Lock()
+	status, known := jm.learnerStatuses[learner]
+	delete(jm.learnerStatuses, learner)
+	delete(jm.learnerTimestamps, learner)
+	delete(jm.learnerPhases, learner)
+	jm.refreshLearnerCounts()
+	jm.learnerStatusMu.Unlock()
+	if known && isTerminalStatus(status) {
+		atomic.AddUint64(&jm.numTerminalLearners, ^uint64(0))
+	}
+	jm.heartbeats.heartbeat(learner)
+	jm.summaries.forget(learner)
+
+	jm.processedMu.Lock()
+	delete(jm.processed, learner)
+	delete(jm.persistedOffsets, learner)
+	jm.processedMu.Unlock()
+	// a learner joining under the same number later starts from a new status sequence
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if _, err := etcd.Delete(ctx, processedOffsetPath(jm.TrainingID, learner)); err != nil {
+		logr.WithError(err).Warnf("failed to remove the processed offset of learner %d of %s", learner, jm.TrainingID)
+	}
+}
+
+//monitorsLearner tells whether the statuses of the learner are monitored
+func (jm *JobMonitor) monitorsLearner(learner int) bool {
+	e := &jm.elasticity
+	e.mu.Lock()
+	if e.members != nil {
+		defer e.mu.Unlock()
+		return e.members[learner]
+	}
+	e.mu.Unlock()
+	return learner >= 1 && learner <= jm.learnerCount()
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+//JobKiller ... kills the workload of a training, by default KillDeployedJob asks the LCM over grpc
+type JobKiller func(trainingID string, userID string, jobName string, logr *logger.LocLoggingEntry) error
+
+//RunInProcess ... monitors a training inside the calling process, so that small deployments can have the LCM monitor
+//its jobs itself instead of deploying a job monitor pod per training. The kubernetes client, the coordinator and the
+//killer have to be injected, the monitor shares them with the LCM and never exits the process. The monitoring stops
+//once the workload of the job is gone, see Done, or when it is stopped, see Stop
+func RunInProcess(cfg Config, logr *logger.LocLoggingEntry) (*JobMonitor, error) {
+	if cfg.K8sClient == nil || cfg.Coordinator == nil || cfg.Killer == nil {
+		return nil, fmt.Errorf("running the job monitor of %s in process needs the kubernetes client, the coordinator and the killer", cfg.TrainingID)
+	}
+	// the coordinator stays the LCM's, stopping the monitor must not close it
+	cfg.Coordinator = sharedCoordinator{cfg.Coordinator}
+	cfg = withProcessConfig(cfg)
+	// the watches and quorum reads still need their own etcd connection
+	if len(cfg.Etcd.Endpoints) == 0 {
+		cfg.Etcd = defaultCoordinatorConfig()
+	}
+	if cfg.FromTrainer {
+		if err := bootstrapFromTrainer(&cfg, logr); err != nil {
+			return nil, err
+		}
+	}
+	jm, err := New(cfg, logr)
+	if err != nil {
+		return nil, err
+	}
+	jm.ManageDistributedJob(logr)
+	return jm, nil
+}
+
+//kill kills the workload of the job with the injected killer, or through the LCM
+func (jm *JobMonitor) kill(logr *logger.LocLoggingEntry) (err error) {
+	if !jm.leading() {
+		return errNotLeader
+	}
+	span, logr := startSpan(logr, spanKillRequest, spanKindClient, map[string]string{"training_id": jm.TrainingID})
+	defer func() { endSpan(span, err) }()
+	if jm.killer != nil {
+		return jm.killer(jm.TrainingID, jm.UserID, jm.JobName, logr)
+	}
+	return killAfterDelay(jm.timeSource(), jm.lifecycle.LCM, jm.TrainingID, jm.UserID, jm.JobName, logr)
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+//etcdClient is a plain etcd v3 client, namespaced with the same prefix as the coordinator. It is used for the things
+//the coordinator does not offer, like reading whole subtrees of a training. With the endpoints of a ZooKeeper, Consul
+//or Redis coordinator, it is served by that store, see storeBackends
+type etcdClient struct {
+	*clientv3.Client
+	// the client of a Controller as seen by its job monitors, which must not close it
+	shared bool
+}
+
+//share returns the client for a job monitor which uses it without owning it, its Close leaves the connection open
+func (e *etcdClient) share() *etcdClient {
+	return &etcdClient{Client: e.Client, shared: true}
+}
+
+//Close closes the connection, unless the client is shared
+func (e *etcdClient) Close() error {
+	if e.shared {
+		return nil
+	}
+	return e.Client.Close()
+}
+
+func newEtcdClient(coordConfig coord.Config, logr *logger.LocLoggingEntry) (*etcdClient, error) {
+	if cli, err := openStoreClient(coordConfig, logr); cli != nil || err != nil {
+		return cli, err
+	}
+	cfg := clientv3.Config{
+		Endpoints:   coordConfig.Endpoints,
+		DialTimeout: ctxTimeout(),
+		Username:    coordConfig.Username,
+		Password:    coordConfig.Password,
+	}
+	if cert := coordConfig.Cert; cert != "" {
+		tlsConfig, err := transport.TLSInfo{TrustedCAFile: cert}.ClientConfig()
+		if err != nil {
+			logr.WithError(err).Errorf("failed to load the etcd certificate from %s", cert)
+			return nil, err
+		}
+		if err := applyTLSConfig(tlsConfig); err != nil {
+			logr.WithError(err).Errorf("invalid TLS config for etcd")
+			return nil, err
+		}
+		cfg.TLS = tlsConfig
+	}
+
+	cli, err := clientv3.New(cfg)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to establish connection with etcd")
+		return nil, err
+	}
+	prefix := coordConfig.Prefix
+	cli.KV = namespace.NewKV(cli.KV, prefix)
+	cli.Watcher = namespace.NewWatcher(cli.Watcher, prefix)
+	cli.Lease = namespace.NewLease(cli.Lease, prefix)
+
+	return &etcdClient{Client: cli}, nil
+}
+
+//sequenceReader is implemented by coordinators which read a value sequence themselves instead of through a
+//coord.ValueSequence, like the in-memory one of the benchmark
+type sequenceReader interface {
+	sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error)
+}
+
+//readSequence reads all values of the sequence under prefix through c, e.g. the statuses of a learner, in order
+func readSequence(c coord.Coordinator, prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	if reader, ok := c.(sequenceReader); ok {
+		return reader.sequenceValues(prefix, logr)
+	}
+	return c.NewValueSequence(prefix, logr).GetAll(logr)
+}
+
+func (jm *JobMonitor) sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	return readSequence(jm.EtcdClient, prefix, logr)
+}
+
+//quorumGet performs a linearizable read of key. Unlike a serializable read it is served through the raft quorum and can
+//not return stale data, e.g. from a member which just lost the leadership. The value is only valid if found is true
+func (jm *JobMonitor) quorumGet(key string, logr *logger.LocLoggingEntry) (value string, found bool, err error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return "", false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	// linearizable is the default of clientv3, as opposed to clientv3.WithSerializable()
+	resp, err := etcd.Get(ctx, key)
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		return "", false, err
+	}
+	if len(resp.Kvs) == 0 {
+		return "", false, nil
+	}
+	return string(resp.Kvs[0].Value), true, nil
+}
+
+//overallStatusIsTerminal tells, based on a quorum read, whether the overall status of the job is already terminal
+func (jm *JobMonitor) overallStatusIsTerminal(logr *logger.LocLoggingEntry) bool {
+	value, found, err := jm.quorumGet(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil || !found {
+		return false
+	}
+	return isTerminalStatus(parseStatus(value, logr).Status)
+}
@@ -0,0 +1,274 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+)
+
+// events waiting to be published by a publisher, beyond it its events are dropped rather than holding up the monitoring
+const eventQueueSize = 1024
+
+const zkPublishedStatus = "published_status"
+
+//the status last published for the job is kept as <training id>/published_status once every publisher acknowledged its
+//event, so that a restarted job monitor publishes the transitions from there rather than from NOT_STARTED
+func publishedStatusPath(trainingID string) string {
+	return trainingID + "/" + zkPublishedStatus
+}
+
+//TransitionEvent ... an accepted transition of the overall status of a job, as published to the event stream
+type TransitionEvent struct {
+	TrainingID string            `json:"training_id"`
+	UserID     string            `json:"user_id"`
+	OldStatus  string            `json:"old_status"`
+	NewStatus  string            `json:"new_status"`
+	Timestamp  time.Time         `json:"timestamp"`
+	ErrorCode  string            `json:"error_code,omitempty"`
+	Attempt    int               `json:"attempt"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+//EventPublisher ... publishes the transition events of the jobs, e.g. to a message bus. Publish is called for one event
+//at a time, in the order of the transitions, and retried while it fails
+type EventPublisher interface {
+	Publish(event TransitionEvent) error
+}
+
+var (
+	eventPublishers   []EventPublisher
+	eventPublishersMu sync.RWMutex
+	events            = &eventQueues{queues: make(map[string]*eventQueue)}
+)
+
+//namedPublisher ... a publisher and the name its queue goes by, the same for the same publisher in every call of
+//configuredEventPublishers
+type namedPublisher struct {
+	name string
+	EventPublisher
+}
+
+//RegisterEventPublisher ... adds a publisher of the transition events of all the jobs monitored by the process, on top
+//of the Kafka topic of jobmonitor.events.rest_proxy.topic and the CloudEvents sinks. Like the update interceptors,
+//publishers are typically registered from the init() of site specific code
+func RegisterEventPublisher(publisher EventPublisher) {
+	eventPublishersMu.Lock()
+	defer eventPublishersMu.Unlock()
+	eventPublishers = append(eventPublishers, publisher)
+}
+
+//configuredEventPublishers are the registered publishers, the REST proxy one and the CloudEvents sinks, if configured.
+//Each of them has a queue of its own, so a sink which is down neither holds up nor causes duplicates at the others
+func configuredEventPublishers() []namedPublisher {
+	var publishers []namedPublisher
+	eventPublishersMu.RLock()
+	for i, publisher := range eventPublishers {
+		publishers = append(publishers, namedPublisher{fmt.Sprintf("registered %d", i), publisher})
+	}
+	eventPublishersMu.RUnlock()
+	if proxy, topic := viper.GetString(eventsRESTProxyURLKey), viper.GetString(eventsRESTProxyTopicKey); proxy != "" && topic != "" {
+		publisher := restProxyPublisher{url: strings.TrimSuffix(proxy, "/"), topic: topic}
+		publishers = append(publishers, namedPublisher{"rest proxy " + publisher.url + " " + topic, publisher})
+	}
+	for _, sink := range configuredCloudEventSinks() {
+		publishers = append(publishers, namedPublisher{"cloudevents " + sink.url, sink})
+	}
+	return publishers
+}
+
+//publishTransition publishes that the overall status of the job moved from old to new. The events are published in
+//the background, one after the other, so a slow event stream doesn't delay the trainer updates. The new status is
+//persisted as published once every publisher acknowledged the event
+func (jm *JobMonitor) publishTransition(old grpc_trainer_v2.Status, new grpc_trainer_v2.Status, errorCode string, logr *logger.LocLoggingEntry) {
+	atomic.StoreInt32(&jm.publishedStatus, int32(new))
+	event := TransitionEvent{
+		TrainingID: jm.TrainingID,
+		UserID:     jm.UserID,
+		OldStatus:  old.String(),
+		NewStatus:  new.String(),
+		Timestamp:  jm.timeSource().Now().UTC(),
+		ErrorCode:  errorCode,
+		Attempt:    jm.Attempt(),
+		Labels:     jm.Labels,
+	}
+	events.queue(event, func() {
+		if err := jm.EtcdClient.Put(publishedStatusPath(jm.TrainingID), new.String(), logr); err != nil {
+			logr.WithError(err).Warnf("(publishTransition) failed to persist the published status %s of %s", new, jm.TrainingID)
+		}
+	}, logr)
+}
+
+//publishFinalStatus publishes the terminal status the job monitor decided on, unless it is the status last published
+//for the job, i.e. the learners reported it
+func (jm *JobMonitor) publishFinalStatus(status grpc_trainer_v2.Status, errorCode string, logr *logger.LocLoggingEntry) {
+	if published := grpc_trainer_v2.Status(atomic.LoadInt32(&jm.publishedStatus)); published != status {
+		jm.publishTransition(published, status, errorCode, logr)
+	}
+}
+
+//loadPublishedStatus resumes the status a previous job monitor of the job published last
+func (jm *JobMonitor) loadPublishedStatus(logr *logger.LocLoggingEntry) {
+	response, err := jm.EtcdClient.Get(publishedStatusPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return
+	}
+	status, ok := statusByName(response[0].Value)
+	if !ok {
+		logr.Warnf("ignoring the invalid published status %q of %s", response[0].Value, jm.TrainingID)
+		return
+	}
+	atomic.StoreInt32(&jm.publishedStatus, int32(status))
+}
+
+//eventQueues ... the queues of the publishers, by the name of the publisher
+type eventQueues struct {
+	mu       sync.Mutex
+	queues   map[string]*eventQueue
+	inFlight sync.WaitGroup
+}
+
+//eventQueue ... hands the events to a publisher from a goroutine of its own, keeping them in order
+type eventQueue struct {
+	publisher EventPublisher
+	pending   chan *queuedEvent
+}
+
+//queuedEvent is an event on its way to the publishers, acknowledged is called once all of them published it
+type queuedEvent struct {
+	TransitionEvent
+	// the publishers which still have to publish the event, and whether one of them gave up on it
+	remaining    int32
+	failed       int32
+	acknowledged func()
+}
+
+//done notes that a publisher is done with the event, and calls acknowledged once the last one published it
+func (e *queuedEvent) done(published bool) {
+	if !published {
+		atomic.StoreInt32(&e.failed, 1)
+	}
+	if atomic.AddInt32(&e.remaining, -1) == 0 && atomic.LoadInt32(&e.failed) == 0 {
+		e.acknowledged()
+	}
+}
+
+//queue hands the event to the queue of every publisher, acknowledged is called once they all published it
+func (q *eventQueues) queue(event TransitionEvent, acknowledged func(), logr *logger.LocLoggingEntry) {
+	publishers := configuredEventPublishers()
+	if len(publishers) == 0 {
+		return
+	}
+	queued := &queuedEvent{TransitionEvent: event, remaining: int32(len(publishers)), acknowledged: acknowledged}
+	for _, publisher := range publishers {
+		q.inFlight.Add(1)
+		select {
+		case q.publisherQueue(publisher).pending <- queued:
+		default:
+			queued.done(false)
+			q.inFlight.Done()
+			logr.Warnf("(publishTransition) the event queue of %s is full, dropped the transition of %s from %s to %s", publisher.name, event.TrainingID, event.OldStatus, event.NewStatus)
+		}
+	}
+}
+
+//publisherQueue is the queue of the publisher, started with its first event
+func (q *eventQueues) publisherQueue(publisher namedPublisher) *eventQueue {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue, ok := q.queues[publisher.name]
+	if !ok {
+		queue = &eventQueue{publisher: publisher.EventPublisher, pending: make(chan *queuedEvent, eventQueueSize)}
+		q.queues[publisher.name] = queue
+		go queue.run(&q.inFlight, logger.LocLogger(jobLogEntry("", "").WithField(logkeyComponent, componentStatus)))
+	}
+	return queue
+}
+
+func (q *eventQueue) run(inFlight *sync.WaitGroup, logr *logger.LocLoggingEntry) {
+	for event := range q.pending {
+		retry := backoff.NewExponentialBackOff()
+		retry.MaxElapsedTime = time.Minute
+		err := backoff.Retry(func() error { return q.publisher.Publish(event.TransitionEvent) }, retry)
+		if err != nil {
+			logr.WithError(err).Warnf("(publishTransition) failed to publish the transition of %s from %s to %s", event.TrainingID, event.OldStatus, event.NewStatus)
+		}
+		event.done(err == nil)
+		inFlight.Done()
+	}
+}
+
+//flush waits until the queued events were published, or ctx is done
+func (q *eventQueues) flush(ctx context.Context) error {
+	published := make(chan struct{})
+	go func() {
+		q.inFlight.Wait()
+		close(published)
+	}()
+	select {
+	case <-published:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//restProxyPublisher ... produces the events to a Kafka topic through the Confluent REST proxy (v2 API) of the cluster,
+//keyed by training id so that the events of a job land in one partition, in order. The job monitor doesn't talk to
+//the brokers itself
+type restProxyPublisher struct {
+	url   string
+	topic string
+}
+
+func (p restProxyPublisher) Publish(event TransitionEvent) error {
+	type record struct {
+		Key   string          `json:"key"`
+		Value TransitionEvent `json:"value"`
+	}
+	body, err := json.Marshal(struct {
+		Records []record `json:"records"`
+	}{[]record{{event.TrainingID, event}}})
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	client, err := httpClient()
+	if err != nil {
+		return backoff.Permanent(err)
+	}
+	resp, err := client.Post(p.url+"/topics/"+url.PathEscape(p.topic), "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the REST proxy at %s answered %s", p.url, resp.Status)
+	}
+	return nil
+}
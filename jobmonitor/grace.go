@@ -0,0 +1,97 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+const zkGraceRequest = "grace_request"
+
+//a learner asks for extra time before teardown (e.g. to finish uploading a large checkpoint) by writing either a
+//plain duration ("5m") or {"duration": "5m", "reason": "uploading checkpoint"} to this key
+func learnerGraceRequestPath(trainingID string, learnerID int) string {
+	return fmt.Sprintf("%s/%s/%s%d/%s", trainingID, zkLearners, zkLearner, learnerID, zkGraceRequest)
+}
+
+type graceRequest struct {
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+func parseGraceRequest(value string) (time.Duration, string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		var req graceRequest
+		if err := json.Unmarshal([]byte(value), &req); err != nil {
+			return 0, "", err
+		}
+		d, err := time.ParseDuration(req.Duration)
+		return d, req.Reason, err
+	}
+	d, err := time.ParseDuration(value)
+	return d, "", err
+}
+
+//requestedGrace returns the longest extra grace time any learner asked for, capped by the configured maximum
+func (jm *JobMonitor) requestedGrace(logr *logger.LocLoggingEntry) time.Duration {
+	var grace time.Duration
+	for _, i := range jm.learnerNumbers() {
+		response, err := jm.EtcdClient.Get(learnerGraceRequestPath(jm.TrainingID, i), logr)
+		if err != nil || len(response) == 0 {
+			continue
+		}
+		d, reason, err := parseGraceRequest(response[0].Value)
+		if err != nil {
+			logr.WithError(err).Warnf("ignoring malformed grace request %q of learner %d", response[0].Value, i)
+			continue
+		}
+		logr.Infof("learner %d of %s asked for %v of extra grace time before teardown (%s)", i, jm.TrainingID, d, reason)
+		if d > grace {
+			grace = d
+		}
+	}
+	if max := viper.GetDuration(graceRequestMaxKey); grace > max {
+		logr.Warnf("capping the requested grace time of %v for %s to %v", grace, jm.TrainingID, max)
+		grace = max
+	}
+	return grace
+}
+
+//waitForRequestedGrace holds back the teardown for as long as the learners asked for, or until all of them are done
+func (jm *JobMonitor) waitForRequestedGrace(logr *logger.LocLoggingEntry) {
+	grace := jm.requestedGrace(logr)
+	if grace <= 0 {
+		return
+	}
+	logr.Infof("(waitForRequestedGrace) holding back teardown of %s for up to %v as requested by its learners", jm.TrainingID, grace)
+	clock := jm.timeSource()
+	deadline := clock.Now().Add(grace)
+	for clock.Now().Before(deadline) {
+		if atomic.LoadUint64(&jm.numTerminalLearners) >= uint64(jm.learnerCount()) {
+			return
+		}
+		clock.Sleep(10 * time.Second)
+	}
+}
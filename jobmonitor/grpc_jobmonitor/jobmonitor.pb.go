@@ -0,0 +1,704 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: jobmonitor.proto
+
+package grpc_jobmonitor
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import (
+	context "golang.org/x/net/context"
+	grpc "google.golang.org/grpc"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type JobStatusRequest struct {
+	TrainingId           string   `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *JobStatusRequest) Reset()         { *m = JobStatusRequest{} }
+func (m *JobStatusRequest) String() string { return proto.CompactTextString(m) }
+func (*JobStatusRequest) ProtoMessage()    {}
+func (*JobStatusRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{0}
+}
+func (m *JobStatusRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_JobStatusRequest.Unmarshal(m, b)
+}
+func (m *JobStatusRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_JobStatusRequest.Marshal(b, m, deterministic)
+}
+func (dst *JobStatusRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_JobStatusRequest.Merge(dst, src)
+}
+func (m *JobStatusRequest) XXX_Size() int {
+	return xxx_messageInfo_JobStatusRequest.Size(m)
+}
+func (m *JobStatusRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_JobStatusRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_JobStatusRequest proto.InternalMessageInfo
+
+func (m *JobStatusRequest) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+type JobStatusResponse struct {
+	TrainingId string `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	UserId     string `protobuf:"bytes,2,opt,name=user_id,json=userId,proto3" json:"user_id,omitempty"`
+	JobName    string `protobuf:"bytes,3,opt,name=job_name,json=jobName,proto3" json:"job_name,omitempty"`
+	// a grpc_trainer_v2.Status name, e.g. PROCESSING
+	Status        string `protobuf:"bytes,4,opt,name=status,proto3" json:"status,omitempty"`
+	ErrorCode     string `protobuf:"bytes,5,opt,name=error_code,json=errorCode,proto3" json:"error_code,omitempty"`
+	StatusMessage string `protobuf:"bytes,6,opt,name=status_message,json=statusMessage,proto3" json:"status_message,omitempty"`
+	// unix milliseconds, as in the statuses of the learners
+	StatusTimestamp string `protobuf:"bytes,7,opt,name=status_timestamp,json=statusTimestamp,proto3" json:"status_timestamp,omitempty"`
+	Attempt         int32  `protobuf:"varint,8,opt,name=attempt,proto3" json:"attempt,omitempty"`
+	// the job monitor decided on a terminal status
+	Terminal bool `protobuf:"varint,9,opt,name=terminal,proto3" json:"terminal,omitempty"`
+	// this job monitor is the one acting on the job, not a standby
+	Leading bool `protobuf:"varint,10,opt,name=leading,proto3" json:"leading,omitempty"`
+	// the state of the teardown of the job, empty if none was requested
+	Teardown string `protobuf:"bytes,11,opt,name=teardown,proto3" json:"teardown,omitempty"`
+	// the reason codes of the terminal status
+	Reasons              []string `protobuf:"bytes,12,rep,name=reasons,proto3" json:"reasons,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *JobStatusResponse) Reset()         { *m = JobStatusResponse{} }
+func (m *JobStatusResponse) String() string { return proto.CompactTextString(m) }
+func (*JobStatusResponse) ProtoMessage()    {}
+func (*JobStatusResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{1}
+}
+func (m *JobStatusResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_JobStatusResponse.Unmarshal(m, b)
+}
+func (m *JobStatusResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_JobStatusResponse.Marshal(b, m, deterministic)
+}
+func (dst *JobStatusResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_JobStatusResponse.Merge(dst, src)
+}
+func (m *JobStatusResponse) XXX_Size() int {
+	return xxx_messageInfo_JobStatusResponse.Size(m)
+}
+func (m *JobStatusResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_JobStatusResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_JobStatusResponse proto.InternalMessageInfo
+
+func (m *JobStatusResponse) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetUserId() string {
+	if m != nil {
+		return m.UserId
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetJobName() string {
+	if m != nil {
+		return m.JobName
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetErrorCode() string {
+	if m != nil {
+		return m.ErrorCode
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetStatusMessage() string {
+	if m != nil {
+		return m.StatusMessage
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetStatusTimestamp() string {
+	if m != nil {
+		return m.StatusTimestamp
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetAttempt() int32 {
+	if m != nil {
+		return m.Attempt
+	}
+	return 0
+}
+
+func (m *JobStatusResponse) GetTerminal() bool {
+	if m != nil {
+		return m.Terminal
+	}
+	return false
+}
+
+func (m *JobStatusResponse) GetLeading() bool {
+	if m != nil {
+		return m.Leading
+	}
+	return false
+}
+
+func (m *JobStatusResponse) GetTeardown() string {
+	if m != nil {
+		return m.Teardown
+	}
+	return ""
+}
+
+func (m *JobStatusResponse) GetReasons() []string {
+	if m != nil {
+		return m.Reasons
+	}
+	return nil
+}
+
+type LearnerStatusesRequest struct {
+	TrainingId           string   `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LearnerStatusesRequest) Reset()         { *m = LearnerStatusesRequest{} }
+func (m *LearnerStatusesRequest) String() string { return proto.CompactTextString(m) }
+func (*LearnerStatusesRequest) ProtoMessage()    {}
+func (*LearnerStatusesRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{2}
+}
+func (m *LearnerStatusesRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LearnerStatusesRequest.Unmarshal(m, b)
+}
+func (m *LearnerStatusesRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LearnerStatusesRequest.Marshal(b, m, deterministic)
+}
+func (dst *LearnerStatusesRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LearnerStatusesRequest.Merge(dst, src)
+}
+func (m *LearnerStatusesRequest) XXX_Size() int {
+	return xxx_messageInfo_LearnerStatusesRequest.Size(m)
+}
+func (m *LearnerStatusesRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_LearnerStatusesRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LearnerStatusesRequest proto.InternalMessageInfo
+
+func (m *LearnerStatusesRequest) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+type LearnerStatus struct {
+	Learner   int32  `protobuf:"varint,1,opt,name=learner,proto3" json:"learner,omitempty"`
+	Status    string `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	Timestamp string `protobuf:"bytes,3,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	// the node the pod of the learner runs on, if known
+	Node                 string   `protobuf:"bytes,4,opt,name=node,proto3" json:"node,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LearnerStatus) Reset()         { *m = LearnerStatus{} }
+func (m *LearnerStatus) String() string { return proto.CompactTextString(m) }
+func (*LearnerStatus) ProtoMessage()    {}
+func (*LearnerStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{3}
+}
+func (m *LearnerStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LearnerStatus.Unmarshal(m, b)
+}
+func (m *LearnerStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LearnerStatus.Marshal(b, m, deterministic)
+}
+func (dst *LearnerStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LearnerStatus.Merge(dst, src)
+}
+func (m *LearnerStatus) XXX_Size() int {
+	return xxx_messageInfo_LearnerStatus.Size(m)
+}
+func (m *LearnerStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_LearnerStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LearnerStatus proto.InternalMessageInfo
+
+func (m *LearnerStatus) GetLearner() int32 {
+	if m != nil {
+		return m.Learner
+	}
+	return 0
+}
+
+func (m *LearnerStatus) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *LearnerStatus) GetTimestamp() string {
+	if m != nil {
+		return m.Timestamp
+	}
+	return ""
+}
+
+func (m *LearnerStatus) GetNode() string {
+	if m != nil {
+		return m.Node
+	}
+	return ""
+}
+
+type LearnerStatusesResponse struct {
+	TrainingId           string           `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	Learners             []*LearnerStatus `protobuf:"bytes,2,rep,name=learners,proto3" json:"learners,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *LearnerStatusesResponse) Reset()         { *m = LearnerStatusesResponse{} }
+func (m *LearnerStatusesResponse) String() string { return proto.CompactTextString(m) }
+func (*LearnerStatusesResponse) ProtoMessage()    {}
+func (*LearnerStatusesResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{4}
+}
+func (m *LearnerStatusesResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LearnerStatusesResponse.Unmarshal(m, b)
+}
+func (m *LearnerStatusesResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LearnerStatusesResponse.Marshal(b, m, deterministic)
+}
+func (dst *LearnerStatusesResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LearnerStatusesResponse.Merge(dst, src)
+}
+func (m *LearnerStatusesResponse) XXX_Size() int {
+	return xxx_messageInfo_LearnerStatusesResponse.Size(m)
+}
+func (m *LearnerStatusesResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_LearnerStatusesResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LearnerStatusesResponse proto.InternalMessageInfo
+
+func (m *LearnerStatusesResponse) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+func (m *LearnerStatusesResponse) GetLearners() []*LearnerStatus {
+	if m != nil {
+		return m.Learners
+	}
+	return nil
+}
+
+type TransitionHistoryRequest struct {
+	TrainingId string `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	// only the transitions since then, in unix milliseconds, all of them if 0
+	Since                int64    `protobuf:"varint,2,opt,name=since,proto3" json:"since,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TransitionHistoryRequest) Reset()         { *m = TransitionHistoryRequest{} }
+func (m *TransitionHistoryRequest) String() string { return proto.CompactTextString(m) }
+func (*TransitionHistoryRequest) ProtoMessage()    {}
+func (*TransitionHistoryRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{5}
+}
+func (m *TransitionHistoryRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TransitionHistoryRequest.Unmarshal(m, b)
+}
+func (m *TransitionHistoryRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TransitionHistoryRequest.Marshal(b, m, deterministic)
+}
+func (dst *TransitionHistoryRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TransitionHistoryRequest.Merge(dst, src)
+}
+func (m *TransitionHistoryRequest) XXX_Size() int {
+	return xxx_messageInfo_TransitionHistoryRequest.Size(m)
+}
+func (m *TransitionHistoryRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_TransitionHistoryRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TransitionHistoryRequest proto.InternalMessageInfo
+
+func (m *TransitionHistoryRequest) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+func (m *TransitionHistoryRequest) GetSince() int64 {
+	if m != nil {
+		return m.Since
+	}
+	return 0
+}
+
+type Transition struct {
+	// unix milliseconds
+	At int64 `protobuf:"varint,1,opt,name=at,proto3" json:"at,omitempty"`
+	// transition for the statuses the learners moved the job to, final_status for the one the job monitor decided on
+	Kind                 string   `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	Status               string   `protobuf:"bytes,3,opt,name=status,proto3" json:"status,omitempty"`
+	Detail               string   `protobuf:"bytes,4,opt,name=detail,proto3" json:"detail,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Transition) Reset()         { *m = Transition{} }
+func (m *Transition) String() string { return proto.CompactTextString(m) }
+func (*Transition) ProtoMessage()    {}
+func (*Transition) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{6}
+}
+func (m *Transition) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Transition.Unmarshal(m, b)
+}
+func (m *Transition) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Transition.Marshal(b, m, deterministic)
+}
+func (dst *Transition) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Transition.Merge(dst, src)
+}
+func (m *Transition) XXX_Size() int {
+	return xxx_messageInfo_Transition.Size(m)
+}
+func (m *Transition) XXX_DiscardUnknown() {
+	xxx_messageInfo_Transition.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Transition proto.InternalMessageInfo
+
+func (m *Transition) GetAt() int64 {
+	if m != nil {
+		return m.At
+	}
+	return 0
+}
+
+func (m *Transition) GetKind() string {
+	if m != nil {
+		return m.Kind
+	}
+	return ""
+}
+
+func (m *Transition) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *Transition) GetDetail() string {
+	if m != nil {
+		return m.Detail
+	}
+	return ""
+}
+
+type TransitionHistoryResponse struct {
+	TrainingId  string        `protobuf:"bytes,1,opt,name=training_id,json=trainingId,proto3" json:"training_id,omitempty"`
+	Transitions []*Transition `protobuf:"bytes,2,rep,name=transitions,proto3" json:"transitions,omitempty"`
+	// audit events were dropped, so transitions may be missing
+	Incomplete           bool     `protobuf:"varint,3,opt,name=incomplete,proto3" json:"incomplete,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TransitionHistoryResponse) Reset()         { *m = TransitionHistoryResponse{} }
+func (m *TransitionHistoryResponse) String() string { return proto.CompactTextString(m) }
+func (*TransitionHistoryResponse) ProtoMessage()    {}
+func (*TransitionHistoryResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_jobmonitor_f06bc040acb8935b, []int{7}
+}
+func (m *TransitionHistoryResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TransitionHistoryResponse.Unmarshal(m, b)
+}
+func (m *TransitionHistoryResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TransitionHistoryResponse.Marshal(b, m, deterministic)
+}
+func (dst *TransitionHistoryResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TransitionHistoryResponse.Merge(dst, src)
+}
+func (m *TransitionHistoryResponse) XXX_Size() int {
+	return xxx_messageInfo_TransitionHistoryResponse.Size(m)
+}
+func (m *TransitionHistoryResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_TransitionHistoryResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TransitionHistoryResponse proto.InternalMessageInfo
+
+func (m *TransitionHistoryResponse) GetTrainingId() string {
+	if m != nil {
+		return m.TrainingId
+	}
+	return ""
+}
+
+func (m *TransitionHistoryResponse) GetTransitions() []*Transition {
+	if m != nil {
+		return m.Transitions
+	}
+	return nil
+}
+
+func (m *TransitionHistoryResponse) GetIncomplete() bool {
+	if m != nil {
+		return m.Incomplete
+	}
+	return false
+}
+
+func init() {
+	proto.RegisterType((*JobStatusRequest)(nil), "grpc_jobmonitor.JobStatusRequest")
+	proto.RegisterType((*JobStatusResponse)(nil), "grpc_jobmonitor.JobStatusResponse")
+	proto.RegisterType((*LearnerStatusesRequest)(nil), "grpc_jobmonitor.LearnerStatusesRequest")
+	proto.RegisterType((*LearnerStatus)(nil), "grpc_jobmonitor.LearnerStatus")
+	proto.RegisterType((*LearnerStatusesResponse)(nil), "grpc_jobmonitor.LearnerStatusesResponse")
+	proto.RegisterType((*TransitionHistoryRequest)(nil), "grpc_jobmonitor.TransitionHistoryRequest")
+	proto.RegisterType((*Transition)(nil), "grpc_jobmonitor.Transition")
+	proto.RegisterType((*TransitionHistoryResponse)(nil), "grpc_jobmonitor.TransitionHistoryResponse")
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// JobMonitorClient is the client API for JobMonitor service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type JobMonitorClient interface {
+	// the overall status of a job
+	GetJobStatus(ctx context.Context, in *JobStatusRequest, opts ...grpc.CallOption) (*JobStatusResponse, error)
+	// the latest status of each learner of a job
+	GetLearnerStatuses(ctx context.Context, in *LearnerStatusesRequest, opts ...grpc.CallOption) (*LearnerStatusesResponse, error)
+	// the statuses a job moved through, oldest first
+	GetTransitionHistory(ctx context.Context, in *TransitionHistoryRequest, opts ...grpc.CallOption) (*TransitionHistoryResponse, error)
+}
+
+type jobMonitorClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewJobMonitorClient(cc *grpc.ClientConn) JobMonitorClient {
+	return &jobMonitorClient{cc}
+}
+
+func (c *jobMonitorClient) GetJobStatus(ctx context.Context, in *JobStatusRequest, opts ...grpc.CallOption) (*JobStatusResponse, error) {
+	out := new(JobStatusResponse)
+	err := c.cc.Invoke(ctx, "/grpc_jobmonitor.JobMonitor/GetJobStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jobMonitorClient) GetLearnerStatuses(ctx context.Context, in *LearnerStatusesRequest, opts ...grpc.CallOption) (*LearnerStatusesResponse, error) {
+	out := new(LearnerStatusesResponse)
+	err := c.cc.Invoke(ctx, "/grpc_jobmonitor.JobMonitor/GetLearnerStatuses", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *jobMonitorClient) GetTransitionHistory(ctx context.Context, in *TransitionHistoryRequest, opts ...grpc.CallOption) (*TransitionHistoryResponse, error) {
+	out := new(TransitionHistoryResponse)
+	err := c.cc.Invoke(ctx, "/grpc_jobmonitor.JobMonitor/GetTransitionHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// JobMonitorServer is the server API for JobMonitor service.
+type JobMonitorServer interface {
+	// the overall status of a job
+	GetJobStatus(context.Context, *JobStatusRequest) (*JobStatusResponse, error)
+	// the latest status of each learner of a job
+	GetLearnerStatuses(context.Context, *LearnerStatusesRequest) (*LearnerStatusesResponse, error)
+	// the statuses a job moved through, oldest first
+	GetTransitionHistory(context.Context, *TransitionHistoryRequest) (*TransitionHistoryResponse, error)
+}
+
+func RegisterJobMonitorServer(s *grpc.Server, srv JobMonitorServer) {
+	s.RegisterService(&_JobMonitor_serviceDesc, srv)
+}
+
+func _JobMonitor_GetJobStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(JobStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JobMonitorServer).GetJobStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc_jobmonitor.JobMonitor/GetJobStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JobMonitorServer).GetJobStatus(ctx, req.(*JobStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _JobMonitor_GetLearnerStatuses_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LearnerStatusesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JobMonitorServer).GetLearnerStatuses(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc_jobmonitor.JobMonitor/GetLearnerStatuses",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JobMonitorServer).GetLearnerStatuses(ctx, req.(*LearnerStatusesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _JobMonitor_GetTransitionHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TransitionHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(JobMonitorServer).GetTransitionHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grpc_jobmonitor.JobMonitor/GetTransitionHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(JobMonitorServer).GetTransitionHistory(ctx, req.(*TransitionHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _JobMonitor_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "grpc_jobmonitor.JobMonitor",
+	HandlerType: (*JobMonitorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetJobStatus",
+			Handler:    _JobMonitor_GetJobStatus_Handler,
+		},
+		{
+			MethodName: "GetLearnerStatuses",
+			Handler:    _JobMonitor_GetLearnerStatuses_Handler,
+		},
+		{
+			MethodName: "GetTransitionHistory",
+			Handler:    _JobMonitor_GetTransitionHistory_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "jobmonitor.proto",
+}
+
+func init() { proto.RegisterFile("jobmonitor.proto", fileDescriptor_jobmonitor_f06bc040acb8935b) }
+
+var fileDescriptor_jobmonitor_f06bc040acb8935b = []byte{
+	// 565 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x10, 0x55, 0xec, 0x26, 0x71, 0x26, 0xfd, 0x08, 0xab, 0x2a, 0xdd, 0x06, 0x28, 0xc1, 0x12, 0x22,
+	0xe5, 0x90, 0x43, 0x7b, 0x02, 0x89, 0x13, 0x87, 0xd0, 0x8a, 0x22, 0x61, 0xca, 0x39, 0xac, 0xe3,
+	0x51, 0xb4, 0x21, 0xde, 0x35, 0xbb, 0x1b, 0x10, 0xbf, 0x85, 0x9f, 0xc2, 0x0f, 0xe3, 0x8a, 0xbc,
+	0x6b, 0xe7, 0x13, 0xa5, 0xbe, 0xf9, 0xbd, 0x79, 0xb3, 0x33, 0xfb, 0x66, 0xbc, 0xd0, 0x99, 0xc9,
+	0x38, 0x95, 0x82, 0x1b, 0xa9, 0x86, 0x99, 0x92, 0x46, 0x92, 0x93, 0xa9, 0xca, 0x26, 0xe3, 0x15,
+	0x1d, 0x5e, 0x43, 0xe7, 0x56, 0xc6, 0x9f, 0x0d, 0x33, 0x0b, 0x1d, 0xe1, 0xf7, 0x05, 0x6a, 0x43,
+	0x9e, 0x41, 0xdb, 0x28, 0xc6, 0x05, 0x17, 0xd3, 0x31, 0x4f, 0x68, 0xad, 0x5f, 0x1b, 0xb4, 0x22,
+	0x28, 0xa9, 0x9b, 0x24, 0xfc, 0xeb, 0xc1, 0xa3, 0xb5, 0x2c, 0x9d, 0x49, 0xa1, 0xf1, 0xc1, 0x34,
+	0x72, 0x06, 0xcd, 0x85, 0x46, 0x95, 0x07, 0x3d, 0x1b, 0x6c, 0xe4, 0xf0, 0x26, 0x21, 0xe7, 0x10,
+	0xcc, 0x64, 0x3c, 0x16, 0x2c, 0x45, 0xea, 0xdb, 0x48, 0x73, 0x26, 0xe3, 0x8f, 0x2c, 0x45, 0xd2,
+	0x85, 0x86, 0xb6, 0x65, 0xe8, 0x81, 0x4b, 0x71, 0x88, 0x3c, 0x05, 0x40, 0xa5, 0xa4, 0x1a, 0x4f,
+	0x64, 0x82, 0xb4, 0x6e, 0x63, 0x2d, 0xcb, 0xbc, 0x93, 0x09, 0x92, 0x17, 0x70, 0xec, 0x84, 0xe3,
+	0x14, 0xb5, 0x66, 0x53, 0xa4, 0x0d, 0x2b, 0x39, 0x72, 0xec, 0x9d, 0x23, 0xc9, 0x25, 0x74, 0x0a,
+	0x99, 0xe1, 0x29, 0x6a, 0xc3, 0xd2, 0x8c, 0x36, 0xad, 0xf0, 0xc4, 0xf1, 0xf7, 0x25, 0x4d, 0x28,
+	0x34, 0x99, 0x31, 0x98, 0x66, 0x86, 0x06, 0xfd, 0xda, 0xa0, 0x1e, 0x95, 0x90, 0xf4, 0x20, 0x30,
+	0xa8, 0x52, 0x2e, 0xd8, 0x9c, 0xb6, 0xfa, 0xb5, 0x41, 0x10, 0x2d, 0x71, 0x9e, 0x35, 0x47, 0x96,
+	0x70, 0x31, 0xa5, 0x60, 0x43, 0x25, 0x74, 0x59, 0x4c, 0x25, 0xf2, 0xa7, 0xa0, 0x6d, 0x5b, 0x72,
+	0x89, 0xf3, 0x2c, 0x85, 0x4c, 0x4b, 0xa1, 0xe9, 0x61, 0xdf, 0xcf, 0xed, 0x28, 0x60, 0xf8, 0x1a,
+	0xba, 0x1f, 0x90, 0x29, 0x81, 0xca, 0x99, 0x8f, 0xd5, 0x87, 0xa6, 0xe1, 0x68, 0x23, 0xb5, 0xe8,
+	0x2d, 0x27, 0xac, 0xba, 0x1e, 0x95, 0x70, 0xcd, 0x74, 0x6f, 0xc3, 0xf4, 0x27, 0xd0, 0x5a, 0xf9,
+	0xe4, 0x06, 0xb5, 0x22, 0x08, 0x81, 0x03, 0x91, 0x0f, 0xc3, 0x0d, 0xca, 0x7e, 0x87, 0x3f, 0xe0,
+	0x6c, 0xa7, 0xdf, 0xaa, 0xeb, 0xf2, 0x06, 0x82, 0xa2, 0xa1, 0xbc, 0x0f, 0x7f, 0xd0, 0xbe, 0xba,
+	0x18, 0x6e, 0xad, 0xef, 0x70, 0xe3, 0xf0, 0x68, 0xa9, 0x0f, 0x3f, 0x01, 0xbd, 0x57, 0x4c, 0x68,
+	0x6e, 0xb8, 0x14, 0xef, 0xb9, 0x36, 0x52, 0xfd, 0xaa, 0xea, 0x14, 0x39, 0x85, 0xba, 0xe6, 0x62,
+	0x82, 0xf6, 0xf6, 0x7e, 0xe4, 0x40, 0xf8, 0x15, 0x60, 0x75, 0x24, 0x39, 0x06, 0x8f, 0x19, 0x9b,
+	0xeb, 0x47, 0x1e, 0x33, 0xf9, 0xe5, 0xbf, 0x71, 0x51, 0x2e, 0xb6, 0xfd, 0x5e, 0xb3, 0xd1, 0xdf,
+	0xb0, 0xb1, 0x0b, 0x8d, 0x04, 0x0d, 0xe3, 0xf3, 0x72, 0xa7, 0x1d, 0x0a, 0x7f, 0xd7, 0xe0, 0xfc,
+	0x3f, 0x5d, 0x57, 0xf5, 0xeb, 0xad, 0x15, 0x14, 0xd9, 0xa5, 0x65, 0x8f, 0x77, 0x2c, 0x5b, 0x55,
+	0x88, 0xd6, 0xf5, 0xe4, 0x02, 0x80, 0x8b, 0x89, 0x4c, 0xb3, 0x39, 0x1a, 0xf7, 0x1b, 0x06, 0xd1,
+	0x1a, 0x73, 0xf5, 0xc7, 0x03, 0xb8, 0x95, 0xf1, 0x9d, 0x3b, 0x86, 0x7c, 0x81, 0xc3, 0x11, 0x9a,
+	0xe5, 0x2b, 0x40, 0x9e, 0xef, 0x14, 0xda, 0x7e, 0x57, 0x7a, 0xe1, 0x3e, 0x49, 0x71, 0xcb, 0x29,
+	0x90, 0x11, 0x9a, 0xad, 0x9d, 0x21, 0x2f, 0xf7, 0x0f, 0x7e, 0xf9, 0x17, 0xf4, 0x06, 0x0f, 0x0b,
+	0x8b, 0x42, 0x29, 0x9c, 0x8e, 0xd0, 0xec, 0xd8, 0x4d, 0x2e, 0xf7, 0x18, 0xb6, 0xb9, 0x48, 0xbd,
+	0x57, 0x55, 0xa4, 0xae, 0x5c, 0xdc, 0xb0, 0xef, 0xef, 0xf5, 0xbf, 0x01, 0x00, 0x87, 0xa4, 0x74,
+	0x39, 0x93, 0x05, 0x00, 0x00,
+}
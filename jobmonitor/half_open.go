@@ -0,0 +1,161 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// error code of jobs failed for a learner which etcd has running but whose pod is gone
+const errCodeLearnerLost = "LEARNER_LOST"
+
+//halfOpenLearners ... the learners on which etcd and kubernetes disagree, by the time the disagreement was first seen:
+//lost learners have a running status in etcd but no pod, unwired ones a running pod but never wrote a status
+type halfOpenLearners struct {
+	lost    map[int]time.Time
+	unwired map[int]time.Time
+	flagged map[int]bool
+}
+
+//observe compares the learner pods with the latest statuses of the learners at now. It returns the learners lost for
+//at least lostAfter, and the ones unwired for at least unwiredAfter, in order, each of them once. A threshold of 0
+//disables its check. Only the members of the job are compared, see monitorsLearner: the pod of a learner an elastic job
+//let go may linger, and the one of a learner which is joining may run before the job counts it
+func (h *halfOpenLearners) observe(pods []v1core.Pod, statuses map[int]grpc_trainer_v2.Status, now time.Time, lostAfter time.Duration,
+	unwiredAfter time.Duration, member func(learner int) bool) (lost []int, unwired []int) {
+	if h.lost == nil {
+		h.lost, h.unwired, h.flagged = make(map[int]time.Time), make(map[int]time.Time), make(map[int]bool)
+	}
+	present := make(map[int]bool)
+	running := make(map[int]bool)
+	for _, pod := range pods {
+		learner, ok := learnerOfPod(pod)
+		if !ok || !member(learner) || pod.ObjectMeta.DeletionTimestamp != nil || pod.Status.Phase == v1core.PodSucceeded || pod.Status.Phase == v1core.PodFailed {
+			continue
+		}
+		present[learner] = true
+		running[learner] = running[learner] || pod.Status.Phase == v1core.PodRunning
+	}
+
+	for learner, status := range statuses {
+		if !member(learner) || present[learner] || isTerminalStatus(status) {
+			delete(h.lost, learner)
+		} else if _, seen := h.lost[learner]; !seen {
+			h.lost[learner] = now
+		}
+	}
+	for learner := range h.lost {
+		if _, seen := statuses[learner]; !seen || !member(learner) {
+			delete(h.lost, learner)
+		}
+	}
+	for learner := range h.unwired {
+		if _, seen := statuses[learner]; seen || !running[learner] {
+			delete(h.unwired, learner)
+		}
+	}
+	for learner := range running {
+		if _, seen := statuses[learner]; !seen {
+			if _, since := h.unwired[learner]; !since {
+				h.unwired[learner] = now
+			}
+		}
+	}
+
+	due := func(since map[int]time.Time, after time.Duration) []int {
+		var learners []int
+		for learner, at := range since {
+			if after > 0 && now.Sub(at) >= after && !h.flagged[learner] {
+				learners = append(learners, learner)
+			}
+		}
+		sort.Ints(learners)
+		for _, learner := range learners {
+			h.flagged[learner] = true
+		}
+		return learners
+	}
+	return due(h.lost, lostAfter), due(h.unwired, unwiredAfter)
+}
+
+//detectHalfOpenLearners checks every podCheckInterval that etcd and kubernetes agree on the learners. Both kinds of
+//disagreement hang a job silently otherwise: a learner whose pod is gone for jobmonitor.learners.lost.threshold while
+//etcd still has it running never writes its terminal status, so the job is failed with errCodeLearnerLost. A learner
+//whose pod runs for jobmonitor.learners.unwired.threshold without ever writing a status points at a wiring problem,
+//e.g. a learner talking to another etcd or prefix than the job monitor; it is flagged, not failed, since the job may
+//still come through
+func (jm *JobMonitor) detectHalfOpenLearners(logr *logger.LocLoggingEntry) {
+	lostAfter, unwiredAfter := jm.configDuration(lostLearnerThresholdKey), jm.configDuration(unwiredLearnerThresholdKey)
+	if jm.k8sClient == nil || (lostAfter <= 0 && unwiredAfter <= 0) {
+		return
+	}
+	selector := fmt.Sprintf("training_id==%s,service==%s", jm.TrainingID, learnerServiceLabel)
+	var halfOpen halfOpenLearners
+	for {
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(podCheckInterval):
+		}
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if jm.paused() {
+			// the learners are gone on purpose, they are looked at afresh once the job is resumed
+			halfOpen = halfOpenLearners{}
+			continue
+		}
+		pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			// no pods is no news when kubernetes can't be asked
+			logr.WithError(err).Debugf("(detectHalfOpenLearners) failed to list the learner pods of %s", jm.TrainingID)
+			continue
+		}
+		jm.learnerStatusMu.Lock()
+		statuses := make(map[int]grpc_trainer_v2.Status, len(jm.learnerStatuses))
+		for learner, status := range jm.learnerStatuses {
+			statuses[learner] = status
+		}
+		jm.learnerStatusMu.Unlock()
+
+		lost, unwired := halfOpen.observe(pods.Items, statuses, jm.timeSource().Now(), lostAfter, unwiredAfter, jm.monitorsLearner)
+		for _, learner := range unwired {
+			message := fmt.Sprintf("the pod of learner %d runs for %v but the learner never wrote a status to %s", learner, unwiredAfter, learnersPath(jm.TrainingID))
+			logr.Errorf("(detectHalfOpenLearners) %s, check the etcd endpoints and prefix the learners of %s are given", message, jm.TrainingID)
+			jm.metrics.unwiredLearnerCounter.Add(1)
+			jm.audit(logr, auditHalfOpen, "%s", message)
+		}
+		for _, learner := range lost {
+			message := fmt.Sprintf("learner %d is %s in etcd but its pod is gone for %v", learner, statuses[learner], lostAfter)
+			logr.Errorf("(detectHalfOpenLearners) %s, failing job %s", message, jm.TrainingID)
+			jm.metrics.lostLearnerCounter.Add(1)
+			jm.audit(logr, auditHalfOpen, "%s", message)
+			jm.sendFinalStatus(failedStatusUpdate(errCodeLearnerLost, message), []ReasonCode{ReasonLearnerLost}, logr)
+			jm.killDeployedJob(logr)
+			return
+		}
+	}
+}
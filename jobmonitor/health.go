@@ -0,0 +1,186 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+// the checks behind the health endpoints
+const (
+	healthCoordinator = "coordinator"
+	healthKubernetes  = "kubernetes"
+	healthWatches     = "watches"
+	healthTrainer     = "trainer"
+)
+
+//HealthCheck ... the outcome of one check of a job monitor
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+//JobHealth ... the outcome of the checks of the job monitor of a job
+type JobHealth struct {
+	TrainingID string        `json:"training_id"`
+	Healthy    bool          `json:"healthy"`
+	Checks     []HealthCheck `json:"checks"`
+	// the degraded modes the job monitor runs in. They don't make it unhealthy, it is doing what it can
+	Degraded []DegradedMode `json:"degraded,omitempty"`
+}
+
+//HealthAddr ... the address /healthz and /readyz are served on, empty if they are not served
+func HealthAddr() string {
+	return viper.GetString(healthAddrKey)
+}
+
+//ServeHealth ... serves the probes of the job monitor pod on addr:
+//  GET /healthz    liveness: the etcd watches deliver and the trainer updates go through, a restart is the cure if not
+//  GET /readyz     readiness: the above, and etcd and kubernetes can be reached
+//They answer 200 if all the checks of all the monitored jobs pass and 503 otherwise, with the checks and the degraded
+//modes the job monitors run in (see degraded.go) as JSON. Unlike the APIs they don't require the API token, kubelet
+//probes can't send one
+func ServeHealth(addr string, logr *logger.LocLoggingEntry) {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", HealthHandler(false))
+	mux.Handle("/readyz", HealthHandler(true))
+
+	logr.Infof("serving the health endpoints on %s", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logr.WithError(err).Errorf("failed to serve the health endpoints on %s", addr)
+		}
+	}()
+}
+
+//HealthHandler ... checks the monitored jobs, the liveness checks only unless ready is set. A process which doesn't
+//monitor any job yet is alive but not ready, unless it runs a Controller
+func HealthHandler(ready bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		monitoredJobsMu.RLock()
+		jobs := make([]*JobMonitor, 0, len(monitoredJobs))
+		for _, jm := range monitoredJobs {
+			jobs = append(jobs, jm)
+		}
+		monitoredJobsMu.RUnlock()
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].TrainingID < jobs[j].TrainingID })
+
+		healthy := !ready || len(jobs) > 0 || atomic.LoadInt32(&runningControllers) > 0
+		report := make([]JobHealth, 0, len(jobs))
+		for _, jm := range jobs {
+			health := jm.Health(ready, jm.componentLogger(nil, componentAPI))
+			healthy = healthy && health.Healthy
+			report = append(report, health)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+//Health ... runs the liveness checks of the job monitor, and the readiness checks as well if ready is set
+func (jm *JobMonitor) Health(ready bool, logr *logger.LocLoggingEntry) JobHealth {
+	type check struct {
+		name string
+		run  func() error
+	}
+	checks := []check{{healthWatches, jm.checkWatches}, {healthTrainer, jm.checkTrainerUpdates}}
+	if ready {
+		checks = append(checks,
+			check{healthCoordinator, func() error { return jm.checkCoordinator(logr) }},
+			check{healthKubernetes, jm.checkKubernetes})
+	}
+
+	health := JobHealth{TrainingID: jm.TrainingID, Healthy: true, Degraded: jm.degradedModes()}
+	for _, c := range checks {
+		result := HealthCheck{Name: c.name, OK: true}
+		if err := c.run(); err != nil {
+			result.OK, result.Error = false, err.Error()
+			health.Healthy = false
+		}
+		health.Checks = append(health.Checks, result)
+	}
+	return health
+}
+
+//checkWatches fails if an etcd watch of the job went silent, see watchLiveness
+func (jm *JobMonitor) checkWatches() error {
+	jm.watchesMu.Lock()
+	defer jm.watchesMu.Unlock()
+	now := jm.timeSource().Now()
+	for name, w := range jm.watches {
+		if silence := w.silentFor(now); silence > etcdWatchSilenceThreshold {
+			return fmt.Errorf("watch %s did not receive anything from etcd for %v", name, silence-silence%time.Second)
+		}
+	}
+	return nil
+}
+
+//checkTrainerUpdates fails if the updates of the trainer keep failing for longer than
+//jobmonitor.health.trainer_update.max_age. A job monitor which has nothing to tell the trainer is fine however long it
+//stays quiet
+func (jm *JobMonitor) checkTrainerUpdates() error {
+	succeeded := atomic.LoadInt64(&jm.lastTrainerUpdate)
+	if atomic.LoadInt64(&jm.lastTrainerFailure) <= succeeded {
+		return nil
+	}
+	since := jm.created
+	if succeeded > 0 {
+		since = time.Unix(0, succeeded)
+	}
+	if age := jm.timeSource().Now().Sub(since); age > viper.GetDuration(healthTrainerMaxAgeKey) {
+		return fmt.Errorf("the trainer updates keep failing, none went through for %v", age-age%time.Second)
+	}
+	return nil
+}
+
+func (jm *JobMonitor) checkCoordinator(logr *logger.LocLoggingEntry) error {
+	if jm.EtcdClient == nil {
+		return fmt.Errorf("not connected to etcd")
+	}
+	_, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr)
+	return err
+}
+
+func (jm *JobMonitor) checkKubernetes() error {
+	if jm.k8sClient == nil {
+		return fmt.Errorf("not connected to kubernetes")
+	}
+	_, err := jm.k8sClient.Discovery().ServerVersion()
+	return err
+}
+
+//observeTrainerUpdate remembers when the last update of the trainer went through, or failed
+func (jm *JobMonitor) observeTrainerUpdate(err error) {
+	now := jm.timeSource().Now().UnixNano()
+	if err != nil {
+		atomic.StoreInt64(&jm.lastTrainerFailure, now)
+		return
+	}
+	atomic.StoreInt64(&jm.lastTrainerUpdate, now)
+}
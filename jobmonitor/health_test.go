@@ -0,0 +1,65 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckTrainerUpdates(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{TrainingID: "training-health", clock: clock, created: clock.Now()}
+	assert.NoError(t, jm.checkTrainerUpdates(), "a job monitor which didn't update the trainer yet is healthy")
+
+	jm.observeTrainerUpdate(nil)
+	clock.Advance(time.Hour)
+	assert.NoError(t, jm.checkTrainerUpdates(), "a quiet job monitor is healthy")
+
+	jm.observeTrainerUpdate(errors.New("trainer unavailable"))
+	assert.Error(t, jm.checkTrainerUpdates(), "the last update which went through is older than the max age")
+
+	jm.observeTrainerUpdate(nil)
+	clock.Advance(time.Minute)
+	jm.observeTrainerUpdate(errors.New("trainer unavailable"))
+	assert.NoError(t, jm.checkTrainerUpdates(), "failing for less than the max age")
+}
+
+func TestDegradedModes(t *testing.T) {
+	clock := NewFakeClock(fakeClockStart)
+	jm := &JobMonitor{TrainingID: "training-degraded", clock: clock, created: clock.Now()}
+	logr := logger.LocLogger(jobLogEntry(jm.TrainingID, ""))
+
+	jm.enterDegradedMode(degradedEtcdFailover, "watch learners was dropped", logr)
+	clock.Advance(time.Minute)
+	jm.enterDegradedMode(degradedEtcdFailover, "watch overall was dropped", logr)
+	jm.enterDegradedMode(degradedTrainerUpdates, "the trainer updates keep failing", logr)
+	health := jm.Health(false, logr)
+	assert.True(t, health.Healthy, "running degraded doesn't make the job monitor unhealthy")
+	if assert.Len(t, health.Degraded, 2) {
+		assert.Equal(t, degradedEtcdFailover, health.Degraded[0].Mode)
+		assert.Equal(t, fakeClockStart, health.Degraded[0].Since, "entering a mode again keeps its start")
+	}
+
+	jm.leaveDegradedMode(degradedEtcdFailover, logr)
+	jm.leaveDegradedMode(degradedEtcdFailover, logr)
+	assert.Equal(t, []DegradedMode{{Mode: degradedTrainerUpdates, Since: clock.Now(), Reason: "the trainer updates keep failing"}}, jm.degradedModes())
+}
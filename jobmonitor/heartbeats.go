@@ -0,0 +1,234 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+const zkHeartbeat = "heartbeat"
+
+// error code of jobs failed for a learner whose heartbeat stopped
+const errCodeLearnerDead = "LEARNER_DEAD"
+
+// what happens once the heartbeat of a learner stopped: it is only reported (alert), or the job fails (fail)
+const (
+	heartbeatAlert = "alert"
+	heartbeatFail  = "fail"
+)
+
+//learnerHeartbeatPath is the key a learner keeps alive with an etcd lease while its process runs, e.g.
+//<training id>/learners/learner_2/heartbeat. Once the process dies the lease expires and etcd deletes the key
+func learnerHeartbeatPath(trainingID string, learner int) string {
+	return fmt.Sprintf("%s/%s/%s%d/%s", trainingID, zkLearners, zkLearner, learner, zkHeartbeat)
+}
+
+//learnerOfHeartbeatKey returns the learner a heartbeat key belongs to, see learnerHeartbeatPath
+func learnerOfHeartbeatKey(trainingID string, key string) (int, bool) {
+	rest := strings.TrimPrefix(key, learnersPath(trainingID)+zkLearner)
+	if rest == key || !strings.HasSuffix(rest, "/"+zkHeartbeat) {
+		return 0, false
+	}
+	learner, err := strconv.Atoi(strings.TrimSuffix(rest, "/"+zkHeartbeat))
+	return learner, err == nil
+}
+
+//learnersWithoutHeartbeat returns the learners, in order, which wrote a status but have no heartbeat key among keys,
+//the keys below learnersPath: they died while nobody watched, e.g. during a restart of the job monitor. Learners
+//which don't write heartbeats at all look the same, so as long as no learner of the job has a heartbeat key none is
+//returned
+func learnersWithoutHeartbeat(trainingID string, keys []string) []int {
+	withStatus := make(map[int]bool)
+	withHeartbeat := make(map[int]bool)
+	for _, key := range keys {
+		if learner, ok := learnerOfHeartbeatKey(trainingID, key); ok {
+			withHeartbeat[learner] = true
+		} else if learner, ok := learnerOfStatusKey(trainingID, key); ok {
+			withStatus[learner] = true
+		}
+	}
+	if len(withHeartbeat) == 0 {
+		return nil
+	}
+	var missing []int
+	for learner := range withStatus {
+		if !withHeartbeat[learner] {
+			missing = append(missing, learner)
+		}
+	}
+	sort.Ints(missing)
+	return missing
+}
+
+//learnerHeartbeats ... the learners whose heartbeat key expired, by the time it expired, and the ones declared dead.
+//Only learners which registered a heartbeat are tracked, learners which don't write one are never declared dead
+type learnerHeartbeats struct {
+	mu      sync.Mutex
+	expired map[int]time.Time
+	dead    map[int]bool
+}
+
+//heartbeat notes that the heartbeat key of the learner is present, e.g. because its restarted process registered again.
+//A learner declared dead before is alive again, and is declared dead once more should its heartbeat expire again
+func (h *learnerHeartbeats) heartbeat(learner int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.expired, learner)
+	delete(h.dead, learner)
+}
+
+//expire notes that the lease of the heartbeat key of the learner expired at now
+func (h *learnerHeartbeats) expire(learner int, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.expired == nil {
+		h.expired = make(map[int]time.Time)
+	}
+	if _, expired := h.expired[learner]; !expired {
+		h.expired[learner] = now
+	}
+}
+
+//declareDead returns the learners whose heartbeat expired longer than timeout before now without coming back, in
+//order, and remembers them as dead so that each learner is returned once. Learners which aren't members of the job
+//anymore, see monitorsLearner, are left out
+func (h *learnerHeartbeats) declareDead(now time.Time, timeout time.Duration, member func(learner int) bool) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var dead []int
+	for learner, since := range h.expired {
+		if !member(learner) {
+			// an elastic job let it go, its lease was deleted with it
+			delete(h.expired, learner)
+			continue
+		}
+		if now.Sub(since) >= timeout && !h.dead[learner] {
+			dead = append(dead, learner)
+		}
+	}
+	sort.Ints(dead)
+	if h.dead == nil && len(dead) > 0 {
+		h.dead = make(map[int]bool)
+	}
+	for _, learner := range dead {
+		h.dead[learner] = true
+	}
+	return dead
+}
+
+//watchHeartbeats watches the heartbeat keys of the learners, see learnerHeartbeatPath, to notice a learner process
+//which crashed inside a pod that still looks healthy: its statuses only change at phase boundaries, but its lease
+//expires within the TTL it was granted. A learner whose heartbeat key is gone for jobmonitor.learners.heartbeat.timeout,
+//without its process registering again, is declared dead: it is counted and logged, and with
+//jobmonitor.learners.heartbeat.action set to fail the job is failed with errCodeLearnerDead
+func (jm *JobMonitor) watchHeartbeats(logr *logger.LocLoggingEntry) {
+	timeout := jm.configDuration(heartbeatTimeoutKey)
+	if timeout <= 0 {
+		return
+	}
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(watchHeartbeats) could not connect to etcd, the heartbeats of the learners of %s are not watched", jm.TrainingID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	resp, err := etcd.Get(ctx, learnersPath(jm.TrainingID), clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	cancel()
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("(watchHeartbeats) could not read etcd, the heartbeats of the learners of %s are not watched", jm.TrainingID)
+		return
+	}
+
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	for _, learner := range learnersWithoutHeartbeat(jm.TrainingID, keys) {
+		if jm.monitorsLearner(learner) {
+			logr.Warnf("(watchHeartbeats) learner %d of %s has no heartbeat, counting it as expired from now on", learner, jm.TrainingID)
+			jm.heartbeats.expire(learner, jm.timeSource().Now())
+		}
+	}
+
+	ctx, cancel = context.WithCancel(jm.context())
+	defer cancel()
+	go jm.keepWatching(ctx, "learner-heartbeats", learnersPath(jm.TrainingID), true, resp.Header.Revision+1, 0, func(ev *clientv3.Event) {
+		learner, ok := learnerOfHeartbeatKey(jm.TrainingID, string(ev.Kv.Key))
+		if !ok || !jm.monitorsLearner(learner) {
+			// the deletion of the lease of a learner an elastic job let go may come after forgetLearner
+			return
+		}
+		if ev.Type == mvccpb.DELETE {
+			jm.heartbeats.expire(learner, jm.timeSource().Now())
+			return
+		}
+		jm.heartbeats.heartbeat(learner)
+	}, logr)
+
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := jm.timeSource().NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if jm.paused() {
+			continue
+		}
+		for _, learner := range jm.heartbeats.declareDead(jm.timeSource().Now(), timeout, jm.monitorsLearner) {
+			if jm.learnerTerminal(learner) {
+				// done, it only let its lease run out
+				continue
+			}
+			message := fmt.Sprintf("learner %d stopped sending heartbeats, its process is gone for at least %v", learner, timeout)
+			logr.Errorf("(watchHeartbeats) %s in %s", message, jm.TrainingID)
+			jm.metrics.deadLearnerCounter.Add(1)
+			if jm.configString(heartbeatActionKey) == heartbeatFail {
+				jm.sendFinalStatus(failedStatusUpdate(errCodeLearnerDead, message), []ReasonCode{ReasonLearnerDead}, logr)
+				jm.killDeployedJob(logr)
+				return
+			}
+		}
+	}
+}
+
+//learnerTerminal tells whether the learner reported a terminal status
+func (jm *JobMonitor) learnerTerminal(learner int) bool {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	status, seen := jm.learnerStatuses[learner]
+	return seen && isTerminalStatus(status)
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	v1core "k8s.io/api/core/v1"
+)
+
+const errCodeImagePull = "IMAGE_PULL"
+
+// waiting reasons of a container whose image can't be pulled
+var imagePullWaitingReasons = map[string]bool{"ErrImagePull": true, "ImagePullBackOff": true}
+
+//imagePullFailure ... a container of the job which fails to pull its image, since the first time it was seen failing
+type imagePullFailure struct {
+	pod       string
+	container string
+	image     string
+	message   string
+	since     time.Time
+}
+
+//statusMessage tells the user which image can't be pulled, with the error of the registry
+func (f *imagePullFailure) statusMessage() string {
+	return fmt.Sprintf("image %s of container %s in pod %s can not be pulled: %s", f.image, f.container, f.pod, f.message)
+}
+
+//imagePullFailures ... the containers of the pods of a job which fail to pull their image, by pod and container
+type imagePullFailures map[string]*imagePullFailure
+
+//observe updates the failures from the current pods of the job at now. A container which got its image, or whose pod
+//is gone, is no longer failing
+func (f imagePullFailures) observe(pods []v1core.Pod, now time.Time) {
+	failing := make(map[string]bool)
+	for _, pod := range pods {
+		statuses := append(append([]v1core.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+		for _, containerStatus := range statuses {
+			waiting := containerStatus.State.Waiting
+			if waiting == nil || !imagePullWaitingReasons[waiting.Reason] {
+				continue
+			}
+			key := pod.ObjectMeta.Name + "/" + containerStatus.Name
+			failing[key] = true
+			failure, ok := f[key]
+			if !ok {
+				failure = &imagePullFailure{pod: pod.ObjectMeta.Name, container: containerStatus.Name, image: containerStatus.Image, since: now}
+				f[key] = failure
+			}
+			// ImagePullBackOff just says back-off, the registry error comes with ErrImagePull
+			if waiting.Message != "" && (failure.message == "" || waiting.Reason == "ErrImagePull") {
+				failure.message = waiting.Message
+			}
+		}
+	}
+	for key := range f {
+		if !failing[key] {
+			delete(f, key)
+		}
+	}
+}
+
+//oldest is the failure which lasts the longest, nil if no container fails to pull its image
+func (f imagePullFailures) oldest() *imagePullFailure {
+	var oldest *imagePullFailure
+	for _, failure := range f {
+		if oldest == nil || failure.since.Before(oldest.since) {
+			oldest = failure
+		}
+	}
+	return oldest
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+
+	v1core "k8s.io/api/core/v1"
+)
+
+//initProgress ... how far a pod got through its init containers (data download, model fetch, ...)
+type initProgress struct {
+	pod     string
+	done    int
+	total   int
+	running string
+}
+
+func (p initProgress) String() string {
+	if p.running != "" {
+		return fmt.Sprintf("init %d/%d (%s)", p.done, p.total, p.running)
+	}
+	return fmt.Sprintf("init %d/%d", p.done, p.total)
+}
+
+func podInitProgress(pod v1core.Pod) initProgress {
+	progress := initProgress{pod: pod.ObjectMeta.Name, total: len(pod.Spec.InitContainers)}
+	for _, status := range pod.Status.InitContainerStatuses {
+		switch {
+		case status.State.Terminated != nil && status.State.Terminated.ExitCode == 0:
+			progress.done++
+		case status.State.Running != nil && progress.running == "":
+			progress.running = status.Name
+		}
+	}
+	return progress
+}
+
+//reportInitProgress surfaces the init containers the pods of the job are still working through as a DOWNLOADING
+//sub-phase, e.g. "init 2/3 (model-fetch)", instead of leaving the job in an undifferentiated PENDING. The pod which is
+//the furthest behind determines the progress of the job
+func (jm *JobMonitor) reportInitProgress(pods []v1core.Pod, logr *logger.LocLoggingEntry) {
+	self, _ := os.Hostname()
+	var slowest *initProgress
+	for _, pod := range pods {
+		if pod.ObjectMeta.Name == self || pod.Status.Phase != v1core.PodPending {
+			continue
+		}
+		progress := podInitProgress(pod)
+		if progress.total == 0 || progress.done == progress.total {
+			continue
+		}
+		if slowest == nil || progress.done*slowest.total < slowest.done*progress.total {
+			slowest = &progress
+		}
+	}
+	if slowest == nil || slowest.String() == jm.initReported {
+		return
+	}
+	if _, latched := jm.terminalLatch(); latched {
+		return
+	}
+
+	// only ever refine a job which didn't get any further on its own, never move it backwards
+	response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return
+	}
+	if !isWaitingStatus(parseStatus(response[0].Value, logr).Status) {
+		return
+	}
+
+	logr.Infof("(reportInitProgress) pod %s of %s is at %s", slowest.pod, jm.TrainingID, slowest)
+	err = jm.updateStatusInTrainer(&client.TrainingStatusUpdate{
+		Status:        grpc_trainer_v2.Status_DOWNLOADING,
+		Timestamp:     client.CurrentTimestampAsString(),
+		StatusMessage: slowest.String(),
+	}, []ReasonCode{ReasonInitProgress}, logr)
+	if err != nil && err != errStaleUpdate {
+		logr.WithError(err).Warnf("(reportInitProgress) failed to report the init progress of %s", jm.TrainingID)
+		return
+	}
+	jm.initReported = slowest.String()
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/spf13/viper"
+)
+
+// what happens to a job whose pods stay unschedulable for longer than the max pending duration
+const (
+	insufficientResourcesFail = "fail"
+	insufficientResourcesWait = "wait"
+)
+
+//insufficientResourcesPolicy ... how long the pods of a job may wait for resources (GPUs, typically), and what happens
+//then: the job is either failed with ErrCodeInsufficientResources, or keeps waiting. With notify set the users are told
+//through PENDING updates of the trainer why the job doesn't start
+type insufficientResourcesPolicy struct {
+	maxPending time.Duration
+	action     string
+	notify     bool
+}
+
+//insufficientResourcesPolicyFromConfig reads the policy from jobmonitor.pods.insufficient_resources.*. Without a max
+//pending duration, the pods get jobmonitor.pods.insufficient_resources.retries pod checks
+func insufficientResourcesPolicyFromConfig() insufficientResourcesPolicy {
+	policy := insufficientResourcesPolicy{
+		maxPending: viper.GetDuration(insuffResourcesMaxPendingKey),
+		action:     viper.GetString(insuffResourcesActionKey),
+		notify:     viper.GetBool(insuffResourcesNotifyKey),
+	}
+	if policy.maxPending <= 0 {
+		policy.maxPending = time.Duration(insuffResourcesRetries()) * podCheckInterval
+	}
+	if policy.action != insufficientResourcesWait {
+		policy.action = insufficientResourcesFail
+	}
+	return policy
+}
+
+func (p insufficientResourcesPolicy) keepsWaiting() bool {
+	return p.action == insufficientResourcesWait
+}
+
+//notifyPending tells the trainer, and through it the users, why the pods of a still pending job don't get scheduled.
+//Nothing is sent once the job got further than PENDING
+func (jm *JobMonitor) notifyPending(policy insufficientResourcesPolicy, waited time.Duration, schedulerMessage string, logr *logger.LocLoggingEntry) {
+	if !policy.notify {
+		return
+	}
+	value, found, err := jm.quorumGet(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil {
+		return
+	}
+	if found {
+		if !isWaitingStatus(parseStatus(value, logr).Status) {
+			return
+		}
+	}
+	message := fmt.Sprintf("waiting for resources for %v: %s", waited-waited%time.Second, schedulerMessage)
+	if !policy.keepsWaiting() {
+		message = fmt.Sprintf("%s, the job fails if it can't be scheduled within %v", message, policy.maxPending)
+	}
+	update := &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_PENDING, Timestamp: client.CurrentTimestampAsString(), StatusMessage: message}
+	if err := jm.updateStatusInTrainer(update, []ReasonCode{ReasonInsufficientResources}, logr); err != nil && err != errStaleUpdate {
+		logr.WithError(err).Warnf("(notifyPending) failed to tell the trainer why %s is pending", jm.TrainingID)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/spf13/viper"
+)
+
+const zkConfig = "config"
+
+//the trainer writes per job overrides of the job monitor config as <training id>/config/<config key> at submission time
+func jobConfigPath(trainingID string) string {
+	return trainingID + "/" + zkConfig + "/"
+}
+
+//config keys which may be overridden per job. Operator limits (like the cap of teardown deferrals) are deliberately not
+//part of this, neither are urls the job monitor sends requests to
+var overridableConfigKeys = map[string]bool{
+	deferTeardownWindowKey:     true,
+	learnerMismatchKey:         true,
+	completionVerifiersKey:     true,
+	completionMetricKey:        true,
+	completionMetricMinKey:     true,
+	completionMetricMaxKey:     true,
+	messageLocaleKey:           true,
+	maxRuntimeKey:              true,
+	phaseTimeoutDownloadingKey: true,
+	phaseTimeoutProcessingKey:  true,
+	phaseTimeoutStoringKey:     true,
+	phaseTimeoutActionKey:      true,
+	heartbeatTimeoutKey:        true,
+	heartbeatActionKey:         true,
+	lostLearnerThresholdKey:    true,
+	unwiredLearnerThresholdKey: true,
+	haltTimeoutKey:             true,
+	learnerRestartMaxKey:       true,
+	learnerRestartBackoffKey:   true,
+	learnerFailurePolicyKey:    true,
+	learnerMinCompletedKey:     true,
+	elasticLearnersKey:         true,
+	earlyStoppingRulesKey:      true,
+	logTailLinesKey:            true,
+}
+
+//loadJobConfig reads the per job config overrides of the training, it has to be called before monitoring starts
+func (jm *JobMonitor) loadJobConfig(logr *logger.LocLoggingEntry) {
+	jm.jobConfig = make(map[string]string)
+
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("could not read the per job config of %s, using the global config", jm.TrainingID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	resp, err := etcd.Get(ctx, jobConfigPath(jm.TrainingID), clientv3.WithPrefix())
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("could not read the per job config of %s, using the global config", jm.TrainingID)
+		return
+	}
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), jobConfigPath(jm.TrainingID))
+		if !overridableConfigKeys[key] {
+			logr.Warnf("ignoring per job config %s of %s, it can not be overridden per job", key, jm.TrainingID)
+			continue
+		}
+		logr.Infof("per job config of %s overrides %s with %s", jm.TrainingID, key, string(kv.Value))
+		jm.jobConfig[key] = string(kv.Value)
+	}
+}
+
+//hasJobConfig tells whether the job overrides the given config key
+func (jm *JobMonitor) hasJobConfig(key string) bool {
+	_, ok := jm.jobConfig[key]
+	return ok
+}
+
+func (jm *JobMonitor) configString(key string) string {
+	if value, ok := jm.jobConfig[key]; ok {
+		return value
+	}
+	return viper.GetString(key)
+}
+
+func (jm *JobMonitor) configInt(key string) int {
+	if value, ok := jm.jobConfig[key]; ok {
+		if i, err := strconv.Atoi(value); err == nil {
+			return i
+		}
+	}
+	return viper.GetInt(key)
+}
+
+func (jm *JobMonitor) configDuration(key string) time.Duration {
+	if value, ok := jm.jobConfig[key]; ok {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+	}
+	return viper.GetDuration(key)
+}
@@ -19,15 +19,21 @@ package jobmonitor
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/go-kit/kit/metrics/statsd"
 
 	"github.com/cenkalti/backoff"
 	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/spf13/viper"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/AISphere/ffdl-commons/config"
 	"github.com/AISphere/ffdl-lcm/coord"
@@ -38,7 +44,6 @@ import (
 	"k8s.io/client-go/kubernetes"
 
 	service "github.com/AISphere/ffdl-lcm/service"
-	lcmClient "github.com/AISphere/ffdl-lcm/service/client"
 	"github.com/AISphere/ffdl-trainer/client"
 	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
 )
@@ -53,15 +58,45 @@ const (
 	zkStatus   = "status"
 )
 
-const (
-	numRetries             = 10
-	insuffResourcesRetries = 10
-	ctxTimeout             = 10 * time.Second
-)
-
 type jobMonitorMetrics struct {
 	failedETCDConnectivityCounter, failedK8sConnectivityCounter, insufficientK8sResourcesErrorCounter, failedImagePullK8sErrorCounter,
 	failedETCDWatchCounter metrics.Counter
+	completedJobCounter, failedJobCounter, haltedJobCounter metrics.Counter
+	cancelledJobCounter                                     metrics.Counter
+	silentETCDWatchCounter, evictedPodCounter               metrics.Counter
+	lateLearnerWriteCounter, zoneCorrelatedFailureCounter   metrics.Counter
+	runawayLearnerCounter, droppedAuditEventCounter         metrics.Counter
+	failedAuxiliaryCounter, oomKilledLearnerCounter         metrics.Counter
+	nodeFailedLearnerCounter, rescheduledLearnerCounter     metrics.Counter
+	maxRuntimeExceededCounter, phaseTimeoutCounter          metrics.Counter
+	deadLearnerCounter, lostLearnerCounter                  metrics.Counter
+	unwiredLearnerCounter, restartedLearnerCounter          metrics.Counter
+	toleratedLearnerFailureCounter, earlyStoppedJobCounter  metrics.Counter
+	etcdWatchSilenceGauge, scoredResultsGauge               metrics.Gauge
+	learnerWriteRateGauge                                   metrics.Gauge
+	// 1 while the job monitor runs in the degraded mode of the mode label, see degraded.go
+	degradedModeGauge metrics.Gauge
+	// the overall status of the job, as the value of its grpc_trainer_v2.Status
+	jobStatusGauge metrics.Gauge
+	// time spent in each phase of the job, and from the first status to the terminal one, in milliseconds
+	phaseTimings      map[grpc_trainer_v2.Status]metrics.Histogram
+	jobDurationTiming metrics.Histogram
+	learnerCounts     *learnerCountGauges
+	// time from a status being written (its timestamp) to the trainer acknowledging it, per status, in milliseconds
+	updateLatencies map[grpc_trainer_v2.Status]metrics.Histogram
+	// time taken by the calls to etcd through the coordinator, in milliseconds
+	etcdLatencyTiming metrics.Histogram
+	// time from the job monitor coming up to all pods of the job running, in milliseconds
+	jobStartLatencyTiming metrics.Histogram
+}
+
+//the phases of a job which get a timer, terminal statuses end the job instead
+var timedPhases = []grpc_trainer_v2.Status{
+	grpc_trainer_v2.Status_NOT_STARTED,
+	grpc_trainer_v2.Status_PENDING,
+	grpc_trainer_v2.Status_DOWNLOADING,
+	grpc_trainer_v2.Status_PROCESSING,
+	grpc_trainer_v2.Status_STORING,
 }
 
 //JobMonitor ...
@@ -71,125 +106,546 @@ type JobMonitor struct {
 	TrainingID            string
 	UserID                string
 	JobName               string
+	JobKind               string
 	NumLearners           int
+	Labels                map[string]string
+	Framework             string
+	FrameworkVersion      string
+	ResumesFrom           string
+	DeferFailedTeardown   time.Duration
 	trMap                 map[string]([]string)
 	numTerminalLearners   uint64
+	teardownRetrying      int32
+	lastTrainerUpdate     int64
+	lastTrainerFailure    int64
+	terminalStatus        int32
+	publishedStatus       int32
+	priority              int
+	unschedulable         int32
+	haltRequested         int32
+	earlyStopped          int32
+	pausedState           int32
+	trainerTerminal       int32
+	processed             map[int]int
+	processedMu           sync.Mutex
+	persistedOffsets      map[int]string
+	auditTrail            auditTrail
+	writeRates            learnerWriteRates
+	heartbeats            learnerHeartbeats
+	watermarks            resourceWatermarks
+	degraded              degradedModes
+	elasticity            elasticLearners
+	summaries             learnerSummaries
+	earlyStopping         earlyStopping
+	election              leaderElection
+	auxiliary             auxiliaryServices
+	etcd                  *etcdClient
+	etcdMu                sync.Mutex
+	etcdConfig            coord.Config
+	jobConfig             map[string]string
+	learnerStatuses       map[int]grpc_trainer_v2.Status
+	learnerTimestamps     map[int]string
+	learnerPhases         map[int]learnerPhase
+	learnerStatusMu       sync.Mutex
+	updateLogs            *logSampler
+	learnersFound         int32
+	learnersIgnored       int32
+	outcomes              *outcomeBudget
+	resources             *grpc_trainer_v2.ResourceRequirements
+	resourcesMu           sync.Mutex
+	watches               map[string]*watchLiveness
+	watchesMu             sync.Mutex
+	initReported          string
+	phase                 grpc_trainer_v2.Status
+	phaseStarted          time.Time
+	jobStarted            time.Time
+	phaseMu               sync.Mutex
+	created               time.Time
+	clock                 Clock
 	metrics               *jobMonitorMetrics
 	EtcdClient            coord.Coordinator
+	killer                JobKiller
+	lifecycle             LifecycleClients
+	attempt               int32
+	deployedAttempt       int
+	maxAttempts           int
+	profile               string
+	registry              JobRegistry
+	// canceled once the job monitor stops monitoring the job, because its workload is gone or Stop was called
+	ctx    context.Context
+	cancel context.CancelFunc
+	// the trainer updates being sent, Stop waits for them
+	inFlight sync.WaitGroup
 }
 
-var failedTrainerConnectivityCounter metrics.Counter
+var failedTrainerConnectivityCounter metrics.Counter = discard.NewCounter()
 
-// count etcd progress notifications (arrive every 10 mins)
-var etcdJobProgressNotificationCounter uint32
-var etcdLearnerProgressNotificationCounter uint32
-
-// number of progress notifications to count before dropping a log line (e.g., 6 * 10 minutes = log every hour)
-const etcdProgressNotificationLogFrequency = 6
+//Config ... everything a JobMonitor needs, so that it can be embedded (e.g. in the LCM or in tests) without reading
+//the global configuration of the process
+type Config struct {
+	TrainingID            string
+	UserID                string
+	JobName               string
+	NumLearners           int
+	UseNativeDistribution bool
+	Labels                map[string]string
+	// framework name (tensorflow, pytorch, caffe, ...) and version of the training spec
+	Framework           string
+	FrameworkVersion    string
+	DeferFailedTeardown time.Duration
+	// JobKindTraining (default) or JobKindBatchScoring
+	JobKind string
+	// optional, the training id of the job whose last checkpoint this job resumes from
+	ResumesFrom string
+	// take NumLearners, JobName, Framework, FrameworkVersion and UseNativeDistribution from the job spec of the trainer
+	FromTrainer bool
+	// connection settings of etcd, used unless Coordinator is set
+	Etcd coord.Config
+	// optional, connected from Etcd if not set
+	Coordinator coord.Coordinator
+	// optional, connected from the in-cluster kubernetes config if not set
+	K8sClient kubernetes.Interface
+	// optional, metrics are discarded if not set, see StatsdMetrics
+	Metrics MetricsProvider
+	// optional, kills the job instead of the grpc API of the LCM, for job monitors running inside the LCM
+	Killer JobKiller
+	// optional, the LCM and the trainer the job monitor talks to, connected for each call if not set. Its Metrics are
+	// not used, see Metrics
+	Lifecycle LifecycleClients
+	// optional, the wall clock if not set, see FakeClock
+	Clock Clock
+	// optional, the attempt of the job the trainer deployed. A later attempt than the one in etcd archives the previous
+	// attempt, even if it wasn't torn down completely
+	Attempt int
+	// optional, how many attempts the trainer gives the job, shown along with the attempt
+	MaxAttempts int
+	// optional, ProfileStandard or ProfileMinimal, taken from the class of the job if not set
+	Profile string
+	// optional, everything is logged and measured and only Profile gives a job the minimal profile if not set
+	Sampling *Sampling
+	// optional, where the job monitor is listed while it monitors the job, e.g. ProcessJobs. It isn't listed if not set
+	Registry JobRegistry
+	// the client of the watches and raw reads, connected from Etcd if not set. Only set by RunBenchmark, to keep the
+	// job monitor on the in-memory etcd its Coordinator is served by, and by a Controller, which shares its own
+	etcd *etcdClient
+}
 
 //NewJobMonitor ...
 func NewJobMonitor(trainingID string, userID string, numLearners int, jobName string, useNativeDistribution bool, statsdClient *statsd.Statsd, logr *logger.LocLoggingEntry) (*JobMonitor, error) {
+	cfg := Config{
+		TrainingID:            trainingID,
+		UserID:                userID,
+		JobName:               jobName,
+		NumLearners:           numLearners,
+		UseNativeDistribution: useNativeDistribution,
+	}
+	if statsdClient != nil {
+		cfg.Metrics = StatsdMetrics(statsdClient)
+	}
+	return NewJobMonitorFromConfig(cfg, logr)
+}
+
+//NewJobMonitorFromConfig ... creates the job monitor of the pod, see NewJobMonitor. Connections which aren't given in
+//cfg are taken from the global configuration, and if they fail the job is failed and killed
+func NewJobMonitorFromConfig(cfg Config, logr *logger.LocLoggingEntry) (*JobMonitor, error) {
 
+	trainingID, userID, jobName := cfg.TrainingID, cfg.UserID, cfg.JobName
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
 	logr.Infof("Starting Job Monitor service for training %s", trainingID)
-	// assert necessary config keys
-	config.FatalOnAbsentKey(config.ETCDEndpoints)
+	if cfg.Coordinator == nil {
+		// assert necessary config keys
+		config.FatalOnAbsentKey(config.ETCDEndpoints)
+	}
+	cfg = withProcessConfig(cfg)
 
-	jmMetrics := jobMonitorMetrics{
-		failedETCDConnectivityCounter:        statsdClient.NewCounter("jobmonitor.etcd.connectivity.failed", 1),
-		failedK8sConnectivityCounter:         statsdClient.NewCounter("jobmonitor.k8s.connectivity.failed", 1),
-		insufficientK8sResourcesErrorCounter: statsdClient.NewCounter("jobmonitor.k8s.insufficientResources.failed", 1),
-		failedImagePullK8sErrorCounter:       statsdClient.NewCounter("jobmonitor.k8s.imagePull.failed", 1),
-		failedETCDWatchCounter:               statsdClient.NewCounter("jobmonitor.etcd.watch.failed", 1),
+	if cfg.Metrics != nil {
+		failedTrainerConnectivityCounter = cfg.Metrics.NewCounter("jobmonitor.trainer.connectivity.failed")
+	}
+	if len(cfg.Etcd.Endpoints) == 0 {
+		cfg.Etcd = defaultCoordinatorConfig()
 	}
 
-	k8sConfig, err := lcmconfig.GetKubernetesConfig()
-	if err != nil {
-		logr.WithError(err).Errorf("Failed to obtain kubernetes config for jobmonitor: %v", k8sConfig)
-		return nil, err
+	if cfg.FromTrainer {
+		// without a job spec there is nothing to monitor, but the job is left alone as the trainer might just be down
+		if err := bootstrapFromTrainer(&cfg, logr); err != nil {
+			logr.WithError(err).Errorf("Failed to bootstrap the job monitor of %s from the trainer", trainingID)
+			return nil, err
+		}
+		jobName = cfg.JobName
 	}
 
-	k8sClient, err := kubernetes.NewForConfig(k8sConfig)
-	if err != nil {
-		jmMetrics.failedK8sConnectivityCounter.Add(1)
-		logr.WithError(err).Errorf("Failed to connect to k8s while creating new lcm service for training %s", trainingID)
+	if cfg.K8sClient == nil {
+		k8sConfig, err := lcmconfig.GetKubernetesConfig()
+		if err != nil {
+			logr.WithError(err).Errorf("Failed to obtain kubernetes config for jobmonitor: %v", k8sConfig)
+			return nil, err
+		}
 
-		if err := updateJobStatusOnError(trainingID, userID, client.ErrCodeK8SConnection, service.StatusMessages_INTERNAL_ERROR.String(), logr); err != nil {
-			logr.WithError(err).Errorf("Failed to write the status %s for training %s to trainer", grpc_trainer_v2.Status_FAILED, trainingID)
+		err = waitOutMaintenance(clock, "kubernetes", func() error {
+			var err error
+			cfg.K8sClient, err = kubernetes.NewForConfig(k8sConfig)
+			return err
+		}, logr)
+		if err != nil {
+			newJobMonitorMetrics(cfg).failedK8sConnectivityCounter.Add(1)
+			logr.WithError(err).Errorf("Failed to connect to k8s while creating new lcm service for training %s", trainingID)
+
+			if err := updateJobStatusOnError(trainingID, userID, client.ErrCodeK8SConnection, ReasonK8sConnection, service.StatusMessages_INTERNAL_ERROR.String(), logr); err != nil {
+				logr.WithError(err).Errorf("Failed to write the status %s for training %s to trainer", grpc_trainer_v2.Status_FAILED, trainingID)
+			}
+			if err := killAfterDelay(clock, cfg.Lifecycle.LCM, trainingID, userID, jobName, logr); err != nil {
+				logr.WithError(err).Errorf("Failed to kill the deployed job %s", trainingID)
+			}
+			return nil, fmt.Errorf("Failed to connect to k8s")
 		}
-		if err := KillDeployedJob(trainingID, userID, jobName, logr); err != nil {
-			logr.WithError(err).Errorf("Failed to kill the deployed job %s", trainingID)
+	}
+
+	if cfg.Coordinator == nil {
+		connectivityErr := waitOutMaintenance(clock, "etcd", func() error {
+			var err error
+			cfg.Coordinator, err = coordinator(cfg.Etcd, logr)
+			return err
+		}, logr)
+		if connectivityErr != nil {
+			shutdownTrainingOnETCDFailure(clock, cfg.Lifecycle.LCM, trainingID, userID, jobName, connectivityErr, logr)
+			return nil, connectivityErr
 		}
-		return nil, fmt.Errorf("Failed to connect to k8s")
 	}
 
-	client, connectivityErr := coordinator(logr)
-	if connectivityErr != nil {
-		shutdownTrainingOnETCDFailure(trainingID, userID, jobName, connectivityErr, logr)
-		return nil, connectivityErr
+	return New(cfg, logr)
+}
+
+//withProcessConfig fills in the sampling cfg leaves unset from the global configuration, and lists the job monitor in
+//ProcessJobs unless cfg names another registry, for the job monitors monitoring the jobs of this process
+func withProcessConfig(cfg Config) Config {
+	if cfg.Sampling == nil {
+		cfg.Sampling = processSampling()
+	}
+	if cfg.Registry == nil {
+		cfg.Registry = ProcessJobs
+	}
+	return cfg
+}
+
+//New ... library friendly constructor of a JobMonitor. Unlike NewJobMonitorFromConfig it never exits the process, reads no
+//global configuration for the connections, the sampling or the registry and leaves the job alone if it fails, it just
+//returns the error
+func New(cfg Config, logr *logger.LocLoggingEntry) (*JobMonitor, error) {
+	if cfg.TrainingID == "" {
+		return nil, fmt.Errorf("no training id given")
+	}
+
+	sampling := fullSampling
+	if cfg.Sampling != nil {
+		sampling = *cfg.Sampling
+	}
+	profile := jobProfile(cfg)
+	updateLogRate := sampling.UpdateLogRate
+	if profile == ProfileMinimal {
+		cfg.Metrics = sampleMetrics(cfg.Metrics, sampling.MinimalMetricsRate)
+		updateLogRate = 0
+	}
+	jmMetrics := newJobMonitorMetrics(cfg)
+	clock := cfg.Clock
+	if clock == nil {
+		clock = RealClock()
+	}
+
+	if cfg.K8sClient == nil {
+		k8sConfig, err := lcmconfig.GetKubernetesConfig()
+		if err != nil {
+			return nil, err
+		}
+		if cfg.K8sClient, err = kubernetes.NewForConfig(k8sConfig); err != nil {
+			jmMetrics.failedK8sConnectivityCounter.Add(1)
+			return nil, err
+		}
+	}
+
+	if cfg.Coordinator == nil {
+		if len(cfg.Etcd.Endpoints) == 0 {
+			return nil, fmt.Errorf("neither a coordinator nor etcd endpoints given for training %s", cfg.TrainingID)
+		}
+		var err error
+		if cfg.Coordinator, err = coordinator(cfg.Etcd, logr); err != nil {
+			jmMetrics.failedETCDConnectivityCounter.Add(1)
+			return nil, err
+		}
+	}
+
+	if cfg.JobKind == "" {
+		cfg.JobKind = JobKindTraining
 	}
 
 	jm := &JobMonitor{
-		k8sClient:             k8sClient,
-		UseNativeDistribution: useNativeDistribution,
-		TrainingID:            trainingID,
-		UserID:                userID,
-		JobName:               jobName,
-		NumLearners:           numLearners,
+		k8sClient:             cfg.K8sClient,
+		UseNativeDistribution: cfg.UseNativeDistribution,
+		TrainingID:            cfg.TrainingID,
+		UserID:                cfg.UserID,
+		JobName:               cfg.JobName,
+		JobKind:               cfg.JobKind,
+		NumLearners:           cfg.NumLearners,
+		Labels:                cfg.Labels,
+		Framework:             cfg.Framework,
+		FrameworkVersion:      cfg.FrameworkVersion,
+		ResumesFrom:           cfg.ResumesFrom,
+		DeferFailedTeardown:   cfg.DeferFailedTeardown,
+		priority:              jobPriority(cfg.Labels),
+		auditTrail:            auditTrail{flushNow: make(chan struct{}, 1)},
 		trMap:                 initTransitionMap(),
-		metrics:               &jmMetrics,
-		EtcdClient:            client,
+		metrics:               jmMetrics,
+		EtcdClient:            timeCoordinator(cfg.Coordinator, jmMetrics.etcdLatencyTiming),
+		etcd:                  cfg.etcd,
+		etcdConfig:            cfg.Etcd,
+		updateLogs:            newLogSampler(updateLogRate),
+		outcomes:              outcomesOf(cfg.Metrics),
+		created:               clock.Now(),
+		clock:                 clock,
+		killer:                cfg.Killer,
+		lifecycle:             cfg.Lifecycle,
+		attempt:               1,
+		deployedAttempt:       cfg.Attempt,
+		maxAttempts:           cfg.MaxAttempts,
+		profile:               profile,
+		registry:              cfg.Registry,
+	}
+	jm.ctx, jm.cancel = context.WithCancel(context.Background())
+	if jm.registry != nil {
+		jm.registry.Register(jm)
 	}
 
 	return jm, nil
 }
 
+//newJobMonitorMetrics creates the metrics of a job. Every metric emitted for this job carries the job labels, so
+//consumers can slice by team/project or framework
+func newJobMonitorMetrics(cfg Config) *jobMonitorMetrics {
+	f := newMetricsFactory(cfg)
+	phaseTimings := make(map[grpc_trainer_v2.Status]metrics.Histogram)
+	phases := timedPhases
+	if trainerKnowsQueued {
+		phases = append([]grpc_trainer_v2.Status{statusQueued}, phases...)
+	}
+	for _, phase := range phases {
+		phaseTimings[phase] = f.timing("jobmonitor.job.phase." + strings.ToLower(phase.String()))
+	}
+	updateLatencies := make(map[grpc_trainer_v2.Status]metrics.Histogram)
+	for value, name := range grpc_trainer_v2.Status_name {
+		updateLatencies[grpc_trainer_v2.Status(value)] = f.timing("jobmonitor.trainer.update.latency." + strings.ToLower(name))
+	}
+	return &jobMonitorMetrics{
+		failedETCDConnectivityCounter:        f.counter("jobmonitor.etcd.connectivity.failed"),
+		failedK8sConnectivityCounter:         f.counter("jobmonitor.k8s.connectivity.failed"),
+		insufficientK8sResourcesErrorCounter: f.counter("jobmonitor.k8s.insufficientResources.failed"),
+		failedImagePullK8sErrorCounter:       f.counter("jobmonitor.k8s.imagePull.failed"),
+		failedETCDWatchCounter:               f.counter("jobmonitor.etcd.watch.failed"),
+		completedJobCounter:                  f.counter("jobmonitor.job.completed"),
+		failedJobCounter:                     f.counter("jobmonitor.job.failed"),
+		haltedJobCounter:                     f.counter("jobmonitor.job.halted"),
+		cancelledJobCounter:                  f.counter("jobmonitor.job.cancelled"),
+		silentETCDWatchCounter:               f.counter("jobmonitor.etcd.watch.silent", "watch"),
+		evictedPodCounter:                    f.counter("jobmonitor.k8s.pod.evicted"),
+		lateLearnerWriteCounter:              f.counter("jobmonitor.learner.write.late"),
+		zoneCorrelatedFailureCounter:         f.counter("jobmonitor.learner.failures.zone_correlated"),
+		runawayLearnerCounter:                f.counter("jobmonitor.learner.runaway"),
+		droppedAuditEventCounter:             f.counter("jobmonitor.audit.dropped"),
+		failedAuxiliaryCounter:               f.counter("jobmonitor.auxiliary.failed"),
+		oomKilledLearnerCounter:              f.counter("jobmonitor.learner.oom_killed"),
+		nodeFailedLearnerCounter:             f.counter("jobmonitor.learner.node_failure"),
+		rescheduledLearnerCounter:            f.counter("jobmonitor.learner.rescheduled"),
+		maxRuntimeExceededCounter:            f.counter("jobmonitor.job.max_runtime_exceeded"),
+		phaseTimeoutCounter:                  f.counter("jobmonitor.learner.phase_timeout"),
+		deadLearnerCounter:                   f.counter("jobmonitor.learner.dead"),
+		lostLearnerCounter:                   f.counter("jobmonitor.learner.lost"),
+		unwiredLearnerCounter:                f.counter("jobmonitor.learner.unwired"),
+		restartedLearnerCounter:              f.counter("jobmonitor.learner.restarted"),
+		toleratedLearnerFailureCounter:       f.counter("jobmonitor.learner.failure_tolerated"),
+		earlyStoppedJobCounter:               f.counter("jobmonitor.job.early_stopped"),
+		etcdWatchSilenceGauge:                f.gauge("jobmonitor.etcd.watch.silence_seconds", "watch"),
+		scoredResultsGauge:                   f.gauge("jobmonitor.scoring.results"),
+		learnerWriteRateGauge:                f.gauge("jobmonitor.learner.write_rate", "learner"),
+		jobStatusGauge:                       f.gauge("jobmonitor.job.status"),
+		degradedModeGauge:                    f.gauge("jobmonitor.degraded", "mode"),
+		phaseTimings:                         phaseTimings,
+		jobDurationTiming:                    f.timing("jobmonitor.job.duration"),
+		learnerCounts:                        newLearnerCountGauges(f),
+		updateLatencies:                      updateLatencies,
+		etcdLatencyTiming:                    f.timing("jobmonitor.etcd.latency"),
+		jobStartLatencyTiming:                f.timing("jobmonitor.job.start_latency"),
+	}
+}
+
 //update job status in mongo
 func updateJobStatusInTrainer(trainingID string, userID string, statusUpdate *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) error {
-	updStatus := statusUpdate.Status
-	logr.Infof("(updateJobStatus) Updating status of %s to %s", trainingID, updStatus.String())
-	updateRequest := &grpc_trainer_v2.UpdateRequest{TrainingId: trainingID, Status: updStatus, Timestamp: statusUpdate.Timestamp,
-		UserId: userID, StatusMessage: statusUpdate.StatusMessage, ErrorCode: statusUpdate.ErrorCode}
-	trainer, err := client.NewTrainer()
-	if err != nil {
-		logr.WithError(err).Errorf("(updateJobStatus) Creating training client for status update failed. Training ID %s New Status %s", trainingID, updStatus.String())
+	return updateJobStatusInTrainerWithMetadata(trainingID, userID, statusUpdate, nil, logr)
+}
+
+//update job status in mongo of the job managed by this job monitor
+func (jm *JobMonitor) updateStatusInTrainer(statusUpdate *client.TrainingStatusUpdate, reasons []ReasonCode, logr *logger.LocLoggingEntry) error {
+	if !jm.leading() {
+		return errNotLeader
+	}
+	if jm.staleUpdate(statusUpdate, logr) {
+		return errStaleUpdate
 	}
-	defer trainer.Close()
+	jm.inFlight.Add(1)
+	defer jm.inFlight.Done()
+	md := jm.statusMetadata(reasons, logr)
+	statusUpdate, locale := jm.localize(statusUpdate)
+	if locale != "" {
+		md.Set(messageLocaleHeader, locale)
+	}
+	_, err := sendTrainerUpdate(context.Background(), jm.lifecycle.Trainer, jm.EtcdClient, JobRef{TrainingID: jm.TrainingID, UserID: jm.UserID}, statusUpdate, md, logr)
+	jm.observeTrainerUpdate(err)
+	if err == nil {
+		if !hasReason(reasons, ReasonTrainingMetrics) {
+			// sent again with the metrics, the status isn't new
+			jm.observeUpdateLatency(statusUpdate)
+		}
+		jm.leaveDegradedMode(degradedTrainerUpdates, logr)
+	} else if failing := jm.checkTrainerUpdates(); failing != nil {
+		jm.enterDegradedMode(degradedTrainerUpdates, failing.Error(), logr)
+	}
+	return err
+}
 
-	defaultBackoff := backoff.NewExponentialBackOff()
-	defaultBackoff.MaxElapsedTime = 1 * time.Minute
-	defaultBackoff.MaxInterval = 5 * time.Second
+//observeUpdateLatency records how long it took from the status being written by a learner to the trainer having it,
+//which is how stale the status the users see in the UI is
+func (jm *JobMonitor) observeUpdateLatency(statusUpdate *client.TrainingStatusUpdate) {
+	written, ok := parseStatusTimestamp(statusUpdate.Timestamp)
+	if !ok || jm.metrics == nil {
+		return
+	}
+	if latency, ok := jm.metrics.updateLatencies[statusUpdate.Status]; ok {
+		latency.Observe(float64(time.Since(written) / time.Millisecond))
+	}
+}
 
-	err = backoff.RetryNotify(func() error {
-		_, err = trainer.Client().UpdateTrainingJob(context.Background(), updateRequest)
-		return err
-	}, defaultBackoff, func(err error, t time.Duration) {
-		logr.WithError(err).Errorf("Failed to update status to the trainer. Retrying WARNING: Status updates for %s may be temporarily inconsistent due to failure to communicate with Trainer.", trainingID)
-	})
+//parseStatusTimestamp parses the timestamp of a status, milliseconds since the epoch as written by the learners
+func parseStatusTimestamp(timestamp string) (time.Time, bool) {
+	millis, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil || millis <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)), true
+}
 
-	if err != nil {
-		failedTrainerConnectivityCounter.Add(1)
-		logr.WithError(err).Errorf("Failed to update status to the trainer. Already retried several times.WARNING : Status of job %s will likely be incorrect", trainingID)
-		return err
+//statusMetadata is the grpc metadata sent along with every status update of the job: its scale, lineage and the status
+//of each of its learners
+func (jm *JobMonitor) statusMetadata(reasons []ReasonCode, logr *logger.LocLoggingEntry) metadata.MD {
+	pods := jm.learnerPods(logr)
+	md := metadata.Pairs(resourceSummaryHeader, jm.resourceSummary(pods, logr).String())
+	if learners := jm.learnerBreakdown(pods); learners != "" {
+		md.Set(learnerStatusesHeader, learners)
+	}
+	if len(reasons) > 0 {
+		md.Set(reasonCodesHeader, joinReasonCodes(reasons))
+	}
+	if jm.ResumesFrom != "" {
+		md.Set(resumesFromHeader, jm.ResumesFrom)
+	}
+	md.Set(attemptHeader, jm.attemptSummary())
+	if metrics := jm.summaries.lastAggregated(); metrics != "" {
+		md.Set(trainingMetricsHeader, metrics)
+	}
+	if jm.elastic() {
+		md.Set(parallelismHeader, strconv.Itoa(jm.learnerCount()))
+	}
+	if auxiliary := jm.auxiliarySummary(); auxiliary != "" {
+		md.Set(auxiliaryHeader, auxiliary)
+	}
+	// the final update carries the memory watermarks, to help right-size the next submission
+	if _, latched := jm.terminalLatch(); latched {
+		if watermarks := jm.watermarkSummary(); watermarks != "" {
+			md.Set(watermarksHeader, watermarks)
+		}
 	}
+	return md
+}
 
+//update job status in mongo, sending md along with the update
+func updateJobStatusInTrainerWithMetadata(trainingID string, userID string, statusUpdate *client.TrainingStatusUpdate, md metadata.MD, logr *logger.LocLoggingEntry) error {
+	_, err := sendTrainerUpdate(context.Background(), nil, nil, JobRef{TrainingID: trainingID, UserID: userID}, statusUpdate, md, logr)
 	return err
 }
 
+// trainer update delivery semantics
+const (
+	deliveryAtLeastOnce = "at-least-once"
+	deliveryAtMostOnce  = "at-most-once"
+)
+
+// grpc metadata key carrying the idempotency key of an update in at-least-once mode
+const idempotencyKeyHeader = "idempotency-key"
+
+func trainerDeliveryMode() string {
+	if viper.GetString(trainerDeliveryKey) == deliveryAtMostOnce {
+		return deliveryAtMostOnce
+	}
+	return deliveryAtLeastOnce
+}
+
 // update job status in mongo on error
-func updateJobStatusOnError(trainingID string, userID string, errorCode string, statusMessage string, logr *logger.LocLoggingEntry) error {
-	statusUpdate := client.TrainingStatusUpdate{
+func updateJobStatusOnError(trainingID string, userID string, errorCode string, reason ReasonCode, statusMessage string, logr *logger.LocLoggingEntry) error {
+	_, err := FailJob(context.Background(), LifecycleClients{}, JobRef{TrainingID: trainingID, UserID: userID}, errorCode, reason, statusMessage, logr)
+	return err
+}
+
+func failedStatusUpdate(errorCode string, statusMessage string) *client.TrainingStatusUpdate {
+	return &client.TrainingStatusUpdate{
 		Status:        grpc_trainer_v2.Status_FAILED,
 		Timestamp:     client.CurrentTimestampAsString(),
 		ErrorCode:     errorCode,
 		StatusMessage: statusMessage,
 	}
-	return updateJobStatusInTrainer(trainingID, userID, &statusUpdate, logr)
 }
 
-//ManageDistributedJob ...manages a DLaaS training job
+//ManageDistributedJob ...manages a DLaaS training job. Its components log through their own loggers, which carry the
+//training, user and component fields. With jobmonitor.leader_election.enabled the job is only managed once this
+//replica won the leadership, until then it is the standby
 func (jm *JobMonitor) ManageDistributedJob(logr *logger.LocLoggingEntry) {
-	go jm.checkIfJobStarted(logr)
-	go jm.monitorJob(logr)
+	if !leaderElectionEnabled() {
+		jm.manageDistributedJob(logr)
+		return
+	}
+	go func() {
+		if err := jm.campaign(logr); err != nil {
+			if jm.context().Err() == nil {
+				logr.WithError(err).Errorf("failed to campaign for the leadership of %s", jm.TrainingID)
+				close(jm.lostLeadership())
+			}
+			return
+		}
+		jm.manageDistributedJob(logr)
+	}()
+}
+
+func (jm *JobMonitor) manageDistributedJob(logr *logger.LocLoggingEntry) {
+	jm.loadJobConfig(logr)
+	if err := jm.archivePreviousAttempt(logr); err != nil {
+		logr.WithError(err).Warnf("failed to archive the previous attempt of %s, its statuses may mix with the ones of this attempt", jm.TrainingID)
+	}
+	jm.resumePendingTeardown(jm.componentLogger(logr, componentTeardown))
+	jm.deliverPendingOutcomes(jm.componentLogger(logr, componentTeardown))
+	jm.inheritCheckpoint(logr)
+	go jm.keepFlushingAudit(jm.componentLogger(logr, componentAudit))
+	go jm.checkIfJobStarted(jm.componentLogger(logr, componentPods))
+	go jm.watchForOOMKills(jm.componentLogger(logr, componentPods))
+	go jm.watchForNodeFailures(jm.componentLogger(logr, componentPods))
+	go jm.enforceMaxRuntime(jm.componentLogger(logr, componentStatus))
+	go jm.detectStuckPhases(jm.componentLogger(logr, componentStatus))
+	go jm.watchHeartbeats(jm.componentLogger(logr, componentStatus))
+	go jm.detectHalfOpenLearners(jm.componentLogger(logr, componentStatus))
+	go jm.watchHaltRequest(jm.componentLogger(logr, componentStatus))
+	go jm.watchPauseRequest(jm.componentLogger(logr, componentPods))
+	go jm.watchSummaryMetrics(jm.componentLogger(logr, componentStatus))
+	go jm.monitorJob(jm.componentLogger(logr, componentStatus))
+	if services := configuredAuxiliaryServices(); len(services) > 0 {
+		go jm.monitorAuxiliaryServices(services, jm.componentLogger(logr, componentPods))
+	}
 }
 
 //monitors the job at the path jobBasePath() generall /training_id/ under which there is /training_id/status/ indicating over all job status
@@ -197,45 +653,126 @@ func (jm *JobMonitor) ManageDistributedJob(logr *logger.LocLoggingEntry) {
 //the trailing slash on status/ on learner is important as it distinguishes the regex from status_summary_metrics
 func (jm *JobMonitor) monitorJob(logr *logger.LocLoggingEntry) {
 
-	err := backoff.RetryNotify(func() error {
+	err := retryNotify(jm.timeSource(), func() error {
 		_, err := jm.EtcdClient.PutIfKeyMissing(overallJobStatusPath(jm.TrainingID), grpc_trainer_v2.Status_NOT_STARTED.String(), logr)
 		return err
-	}, etdInteractionBackoff(1*time.Minute, 10*time.Second), func(err error, t time.Duration) { jm.metrics.failedETCDConnectivityCounter.Add(1) })
+	}, jm.exponentialBackoff(1*time.Minute, 10*time.Second), func(err error, t time.Duration) { jm.metrics.failedETCDConnectivityCounter.Add(1) })
 
 	//not doing anything here, since this is probably a job monitor restarting
 	if err != nil {
 		logr.WithError(err).Warnf("job monitor possibly restarted and that's why the status %s for the path %s :", grpc_trainer_v2.Status_NOT_STARTED.String(), overallJobStatusPath(jm.TrainingID))
 	}
 
-	//processed[1], for example, stores the number of status updates of learner 1 that have been processed
-	processed := make(map[int]int)
+	if jm.isBatchScoring() {
+		jm.monitorScoringJob(logr)
+		return
+	}
 
+	//processed[1], for example, stores the number of status updates of learner 1 that have been processed
+	jm.processedMu.Lock()
+	jm.processed = make(map[int]int)
+	jm.persistedOffsets = make(map[int]string)
 	for i := 1; i <= jm.NumLearners; i++ {
 		//To start, no status updates have been processed for any learner
-		processed[i] = 0
+		jm.processed[i] = 0
+	}
+	jm.processedMu.Unlock()
+	for i := 1; i <= jm.NumLearners; i++ {
+		jm.recordLearnerStatus(i, grpc_trainer_v2.Status_NOT_STARTED)
 	}
 
-	ticker := time.NewTicker(1 * time.Minute)
-	for range ticker.C {
+	vocabulary := statusVocabularyFromConfig()
+	// a restarted job monitor picks up after the statuses its predecessor processed
+	jm.loadProcessedOffsets(vocabulary, logr)
+	jm.loadPublishedStatus(logr)
+	jm.resumePendingRestarts(logr)
+	jm.restoreTerminalLearners(logr)
+	if learnerStatusMode() == learnerStatusWatch {
+		err := jm.watchLearnerStatuses(vocabulary, logr)
+		if err == nil {
+			return
+		}
+		logr.WithError(err).Warnf("watching the learner statuses of %s keeps failing, falling back to polling them", jm.TrainingID)
+	}
 
-		for i := 1; i <= jm.NumLearners; i++ {
-			seqName := indvidualJobStatusPath(jm.TrainingID, i)
-			seq := jm.EtcdClient.NewValueSequence(seqName, logr)
-			statuses, err := seq.GetAll(logr)
+	ticker := jm.timeSource().NewTicker(jm.learnerPollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-jm.Done():
+			return
+		case <-ticker.C():
+		}
 
-			if err != nil {
-				logr.Errorf("Job Monitor could not connect to ETCD to get the status of Learner %d\n", i)
-				jm.metrics.failedETCDConnectivityCounter.Add(1)
-				continue
-			}
+		if jm.checkLearnerCount(logr) {
+			return
+		}
 
-			for j := processed[i]; j < len(statuses); j++ {
-				jm.processUpdateLearnerStatus(seqName, statuses[j], logr)
-				processed[i]++
-			}
+		for _, i := range jm.learnerNumbers() {
+			jm.processLearnerStatuses(i, vocabulary, logr)
+		}
+	}
+
+}
+
+//processLearnerStatuses processes the statuses the learner wrote since the last call
+func (jm *JobMonitor) processLearnerStatuses(i int, vocabulary *statusVocabulary, logr *logger.LocLoggingEntry) {
+	logr = jm.learnerLogger(logr, componentStatus, i)
+	seqName := indvidualJobStatusPath(jm.TrainingID, i)
+	statuses, err := jm.sequenceValues(seqName, logr)
+
+	if err != nil {
+		logr.Errorf("Job Monitor could not connect to ETCD to get the status of Learner %d\n", i)
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		return
+	}
+	if jm.isQuarantined(i) || jm.checkLearnerWriteRate(i, len(statuses)-jm.processedOffset(i), logr) {
+		jm.processQuarantinedStatuses(i, seqName, statuses, vocabulary, logr)
+		return
+	}
+	// before the statuses, a terminal one sends the completion summary
+	jm.sampleWatermarks(i, logr)
+
+	for j := jm.processedOffset(i); j < len(statuses); j++ {
+		status := statuses[j]
+		if translated, _, ok := vocabulary.translate(status); ok {
+			status = translated
+		}
+		update := parseStatus(status, logr)
+		if (update.Status == grpc_trainer_v2.Status_FAILED && jm.restartFailedLearner(i, update, logr)) || jm.tolerateLearnerStatus(i, update, logr) {
+			jm.advanceProcessedOffset(i)
+			continue
 		}
+		jm.recordLearnerStatus(i, update.Status)
+		jm.recordLearnerTimestamp(i, update.Timestamp)
+		jm.recordLearnerPhase(i, update.Status, update.Timestamp)
+		jm.processUpdateLearnerStatus(seqName, status, logr)
+		jm.advanceProcessedOffset(i)
 	}
+	jm.persistProcessedOffset(i, logr)
+}
 
+func (jm *JobMonitor) processedOffset(learner int) int {
+	jm.processedMu.Lock()
+	defer jm.processedMu.Unlock()
+	return jm.processed[learner]
+}
+
+func (jm *JobMonitor) advanceProcessedOffset(learner int) {
+	jm.processedMu.Lock()
+	defer jm.processedMu.Unlock()
+	jm.processed[learner]++
+}
+
+//processedOffsets returns a copy of the processed status counts of all learners
+func (jm *JobMonitor) processedOffsets() map[int]int {
+	jm.processedMu.Lock()
+	defer jm.processedMu.Unlock()
+	offsets := make(map[int]int, len(jm.processed))
+	for learner, offset := range jm.processed {
+		offsets[learner] = offset
+	}
+	return offsets
 }
 
 //gets triggered when the /status node is updated
@@ -245,52 +782,130 @@ func (jm *JobMonitor) processUpdateJobStatus(currStatus string, logr *logger.Loc
 	logr.Infof("(processUpdateJobStatus) got triggered with the current status %s", currStatus)
 	//Variable to notify whether the job needs further status monitoring
 	markComplete := false
-	statusUpdate := client.GetStatus(currStatus, logr)
+	statusUpdate := parseStatus(currStatus, logr)
+	reasons := []ReasonCode{ReasonJobReported}
+
+	if statusUpdate.Status == grpc_trainer_v2.Status_COMPLETED {
+		if err := jm.verifyCompletion(logr); err != nil {
+			logr.WithError(err).Errorf("(processUpdateJobStatus) job %s reported %s but failed the completion verification", jm.TrainingID, statusUpdate.Status)
+			statusUpdate = failedStatusUpdate(errCodeCompletionUnverified, err.Error())
+			reasons = []ReasonCode{ReasonCompletionUnverified}
+		} else if tolerated := jm.toleratedFailures(); tolerated != "" {
+			statusUpdate.StatusMessage = fmt.Sprintf("%s (%s)", statusUpdate.StatusMessage, tolerated)
+			reasons = append(reasons, ReasonFailuresTolerated)
+		}
+	}
+	if statusUpdate.Status == grpc_trainer_v2.Status_FAILED {
+		// the learners only see their job fail, kubernetes tells why
+		failedAt, ok := parseStatusTimestamp(statusUpdate.Timestamp)
+		if !ok {
+			failedAt = jm.timeSource().Now()
+		}
+		if kill, found := findOOMKill(jm.learnerPods(logr), failedAt); found {
+			statusUpdate.ErrorCode, statusUpdate.StatusMessage = errCodeOOMKilled, kill.statusMessage()
+			reasons = append(reasons, ReasonOOMKilled)
+		}
+		if zone := jm.correlatedFailureZone(logr); zone != "" {
+			statusUpdate.StatusMessage = fmt.Sprintf("%s (likely zone outage in %s)", statusUpdate.StatusMessage, zone)
+			reasons = append(reasons, ReasonZoneOutage)
+		} else {
+			go jm.recheckFailureZone(logr)
+		}
+	}
 
 	status := statusUpdate.Status
-	error := updateJobStatusInTrainer(jm.TrainingID, jm.UserID, statusUpdate, logr)
-	if error != nil {
+	jm.observePhase(status)
+	deferral := jm.teardownDeferral(status)
+	if deferral > 0 {
+		statusUpdate.StatusMessage = fmt.Sprintf("%s (teardown deferred by %v for debugging)", statusUpdate.StatusMessage, deferral)
+		reasons = append(reasons, ReasonTeardownDeferred)
+	}
+	var error error
+	if isTerminalStatus(status) {
+		if jm.isBatchScoring() && status == grpc_trainer_v2.Status_COMPLETED {
+			jm.reportScoringResults(statusUpdate, logr)
+		}
+		error = jm.sendFinalStatus(statusUpdate, reasons, logr)
+	} else {
+		error = jm.updateStatusInTrainer(statusUpdate, reasons, logr)
+	}
+	if error != nil && error != errStaleUpdate {
 		logr.WithError(error).Errorf("Failed to write the status %s for training %s to trainer", status, jm.TrainingID)
 	}
 
 	//if native distribution and status of the entire job is complete then kill the deployed job
-	if status == grpc_trainer_v2.Status_COMPLETED || status == grpc_trainer_v2.Status_FAILED || status == grpc_trainer_v2.Status_HALTED {
-		logr.Infof("(processUpdateJobStatus) overall status of the job was set up as %v and native distribution status was %v", currStatus, jm.UseNativeDistribution)
-		if jm.UseNativeDistribution {
-			logr.Debugf("(processUpdateJobStatus) No need to wait for all learners to terminate. Already updated status. Killing job %s", jm.TrainingID)
-			err := KillDeployedJob(jm.TrainingID, jm.UserID, jm.JobName, logr)
-			if err != nil {
-				logr.WithError(err).Errorf("(processUpdateJobStatus) failed to kill the deployed job %s", jm.TrainingID)
-			}
-			markComplete = true
-			return markComplete
-		}
-		//Job has completed, now wait 1 minute for all learners to upload logs and clean themselves up
-		if atomic.LoadUint64(&jm.numTerminalLearners) < uint64(jm.NumLearners) {
-			logr.Debugf("(processUpdateJobStatus) Sleeping for 60s to allow all remaining learners to complete")
-			time.Sleep(60 * time.Second)
-		}
-		// check if they cleaned themselves up, and log it.  Teardown happens either way.
-		if atomic.LoadUint64(&jm.numTerminalLearners) < uint64(jm.NumLearners) {
-			logr.Debugf("(processUpdateJobStatus) Killing remaining learners in %s", jm.TrainingID)
-		} else {
-			logr.Debugf("(processUpdateJobStatus) All learners of %s have completed. It can now be safely killed", jm.TrainingID)
-		}
-		err := KillDeployedJob(jm.TrainingID, jm.UserID, jm.JobName, logr)
-		if err != nil {
-			logr.WithError(err).Errorf("(processUpdateJobStatus) failed to kill the deployed job %s", jm.TrainingID)
+	if isTerminalStatus(status) {
+		jm.countJobOutcome(status)
+		if deferral > 0 {
+			logr.Warnf("(processUpdateJobStatus) deferring teardown of failed job %s by %v. The learner pods keep their resources (including GPUs) allocated until then", jm.TrainingID, deferral)
+			go func() {
+				select {
+				case <-jm.context().Done():
+					logr.Warnf("(processUpdateJobStatus) stopped during the deferred teardown of %s, it is resumed by the next job monitor", jm.TrainingID)
+					return
+				case <-jm.timeSource().After(deferral):
+				}
+				jm.tearDownTerminalJob(currStatus, logr)
+			}()
+			return true
 		}
+		jm.tearDownTerminalJob(currStatus, logr)
 		markComplete = true
 	}
 
 	return markComplete
 }
 
-//This function processes an update to learner status, i.e. it updates the overall job status
-func (jm *JobMonitor) processUpdateLearnerStatus(learnerStatusPath string, learnerStatusValue string, logr *logger.LocLoggingEntry) error {
+//tearDownTerminalJob kills the deployed job once its overall status is terminal. Unless the job is natively
+//distributed, the learners which are still running get jobmonitor.learners.grace to finish first
+func (jm *JobMonitor) tearDownTerminalJob(currStatus string, logr *logger.LocLoggingEntry) {
+	logr.Infof("(processUpdateJobStatus) overall status of the job was set up as %v and native distribution status was %v", currStatus, jm.UseNativeDistribution)
+	if jm.UseNativeDistribution || jm.isBatchScoring() {
+		logr.Debugf("(processUpdateJobStatus) No need to wait for all learners to terminate. Already updated status. Killing job %s", jm.TrainingID)
+		jm.waitForRequestedGrace(logr)
+		err := jm.killDeployedJob(logr)
+		if err != nil {
+			logr.WithError(err).Errorf("(processUpdateJobStatus) failed to kill the deployed job %s", jm.TrainingID)
+		}
+		return
+	}
+	//Job has completed, now give all learners some time to upload logs and clean themselves up
+	if atomic.LoadUint64(&jm.numTerminalLearners) < uint64(jm.learnerCount()) {
+		grace := viper.GetDuration(learnerGraceKey)
+		logr.Debugf("(processUpdateJobStatus) Sleeping for %v to allow all remaining learners to complete", grace)
+		jm.timeSource().Sleep(grace)
+	}
+	jm.waitForRequestedGrace(logr)
+	// check if they cleaned themselves up, and log it.  Teardown happens either way.
+	if atomic.LoadUint64(&jm.numTerminalLearners) < uint64(jm.learnerCount()) {
+		logr.Debugf("(processUpdateJobStatus) Killing remaining learners in %s", jm.TrainingID)
+	} else {
+		logr.Debugf("(processUpdateJobStatus) All learners of %s have completed. It can now be safely killed", jm.TrainingID)
+	}
+	err := jm.killDeployedJob(logr)
+	if err != nil {
+		logr.WithError(err).Errorf("(processUpdateJobStatus) failed to kill the deployed job %s", jm.TrainingID)
+	}
+}
 
-	learnerStatus := client.GetStatus(learnerStatusValue, logr).Status
-	logr.Infof("got triggered with the current path %s and value %s (status %s)", learnerStatusPath, learnerStatusValue, learnerStatus)
+//This function processes an update to learner status, i.e. it updates the overall job status
+func (jm *JobMonitor) processUpdateLearnerStatus(learnerStatusPath string, learnerStatusValue string, logr *logger.LocLoggingEntry) (err error) {
+
+	learnerStatus := parseStatus(learnerStatusValue, logr).Status
+	span, logr := startSpan(logr, spanLearnerStatus, spanKindInternal, map[string]string{"training_id": jm.TrainingID, "status_path": learnerStatusPath, "status": learnerStatus.String()})
+	defer func() { endSpan(span, err) }()
+	jm.logRoutineUpdate(logr, "got triggered with the current path %s and value %s (status %s)", learnerStatusPath, learnerStatusValue, learnerStatus)
+
+	//once the job is terminal nothing a learner writes can change its outcome, so only keep a record of late writers
+	if jobStatus, latched := jm.terminalLatch(); latched {
+		logr.Warnf("(audit) ignoring status %s written to %s after the job %s already was %s", learnerStatusValue, learnerStatusPath, jm.TrainingID, jobStatus)
+		jm.audit(logr, auditLateWrite, "%s written to %s after the job was %s", learnerStatus, learnerStatusPath, jobStatus)
+		jm.metrics.lateLearnerWriteCounter.Add(1)
+		if isTerminalStatus(learnerStatus) {
+			atomic.AddUint64(&jm.numTerminalLearners, 1)
+		}
+		return nil
+	}
 
 	response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr)
 	if err != nil {
@@ -302,23 +917,108 @@ func (jm *JobMonitor) processUpdateLearnerStatus(learnerStatusPath string, learn
 	}
 
 	currentOverallJobStatus := response[0].Value
+	if isTerminalStatus(learnerStatus) {
+		// a terminal status leads to a final trainer update and a kill, so don't decide on a possibly stale read
+		if quorumValue, found, qerr := jm.quorumGet(overallJobStatusPath(jm.TrainingID), logr); qerr == nil && found {
+			currentOverallJobStatus = quorumValue
+		} else if qerr != nil {
+			logr.WithError(qerr).Warnf("quorum read of the overall status of %s failed, falling back to the coordinator read", jm.TrainingID)
+		}
+	}
 	// currentOverallJobStatus may be a JSON value -> parse and convert to TrainingStatusUpdate struct
-	currentOverallJobStatusObj := client.GetStatus(currentOverallJobStatus, logr)
+	currentOverallJobStatusObj := parseStatus(currentOverallJobStatus, logr)
 	jobStatus := currentOverallJobStatusObj.Status
 	if jm.isTransitionAllowed(jobStatus.String(), learnerStatus.String()) {
 		logr.Infof("Transition was allowed, changing overall status of job from %s to learners status %s", jobStatus, learnerStatus)
-		jm.EtcdClient.CompareAndSwap(overallJobStatusPath(jm.TrainingID), learnerStatusValue, currentOverallJobStatus, logr)
-		jm.processUpdateJobStatus(learnerStatusValue, logr)
+		jm.auditStatus(logr, auditTransition, learnerStatus.String(), "%s to %s, reported at %s", jobStatus, learnerStatus, learnerStatusPath)
+		casSpan, casLogr := startSpan(logr, spanCompareAndSwap, spanKindClient, map[string]string{"key": overallJobStatusPath(jm.TrainingID), "status": learnerStatus.String()})
+		swapped, casErr := jm.EtcdClient.CompareAndSwap(overallJobStatusPath(jm.TrainingID), learnerStatusValue, currentOverallJobStatus, casLogr)
+		endSpan(casSpan, casErr)
+		if isTerminalStatus(learnerStatus) && (casErr != nil || !swapped) {
+			logr.WithError(casErr).Warnf("overall status of %s changed concurrently, not acting on the terminal learner status %s", jm.TrainingID, learnerStatus)
+		} else {
+			if swapped && casErr == nil {
+				jm.publishTransition(jobStatus, learnerStatus, parseStatus(learnerStatusValue, logr).ErrorCode, logr)
+			}
+			jm.processUpdateJobStatus(learnerStatusValue, logr)
+		}
+	} else if jobStatus == learnerStatus {
+		// the other learners catching up with the overall status
+		jm.logRoutineUpdate(logr, "Transition not needed, overall job status already is learner status %s", learnerStatus)
 	} else {
 		logr.Warnf("Transition not allowed job from overall job status %s to learner status %s", jobStatus, learnerStatus)
 	}
 	//keep an eye on idividual learners as well, if they terminate then check if all of them are done then check if job can be terminated
-	if learnerStatus == grpc_trainer_v2.Status_COMPLETED || learnerStatus == grpc_trainer_v2.Status_FAILED || learnerStatus == grpc_trainer_v2.Status_HALTED {
+	if isTerminalStatus(learnerStatus) {
 		atomic.AddUint64(&jm.numTerminalLearners, 1)
 	}
 	return err
 }
 
+func isTerminalStatus(status grpc_trainer_v2.Status) bool {
+	return status == grpc_trainer_v2.Status_COMPLETED || status == grpc_trainer_v2.Status_FAILED || status == grpc_trainer_v2.Status_HALTED ||
+		(trainerKnowsCancelled && status == statusCancelled)
+}
+
+//markTerminal remembers the terminal status the job monitor decided on for the job
+func (jm *JobMonitor) markTerminal(status grpc_trainer_v2.Status) {
+	atomic.StoreInt32(&jm.terminalStatus, int32(status))
+}
+
+//terminalLatch returns the terminal status of the job and true once the job monitor decided on one
+func (jm *JobMonitor) terminalLatch() (grpc_trainer_v2.Status, bool) {
+	status := grpc_trainer_v2.Status(atomic.LoadInt32(&jm.terminalStatus))
+	return status, isTerminalStatus(status)
+}
+
+func (jm *JobMonitor) hasFailed() bool {
+	return grpc_trainer_v2.Status(atomic.LoadInt32(&jm.terminalStatus)) == grpc_trainer_v2.Status_FAILED
+}
+
+func (jm *JobMonitor) countJobOutcome(status grpc_trainer_v2.Status) {
+	if jm.metrics == nil {
+		return
+	}
+	switch status {
+	case grpc_trainer_v2.Status_COMPLETED:
+		jm.metrics.completedJobCounter.Add(1)
+	case grpc_trainer_v2.Status_FAILED:
+		jm.metrics.failedJobCounter.Add(1)
+	case grpc_trainer_v2.Status_HALTED:
+		jm.metrics.haltedJobCounter.Add(1)
+	}
+	if trainerKnowsCancelled && status == statusCancelled {
+		jm.metrics.cancelledJobCounter.Add(1)
+	}
+}
+
+//observePhase records the time spent in the phase the job is leaving when the overall status moves to status, and
+//the duration of the whole job once it is terminal
+func (jm *JobMonitor) observePhase(status grpc_trainer_v2.Status) {
+	if jm.metrics == nil {
+		return
+	}
+	jm.phaseMu.Lock()
+	defer jm.phaseMu.Unlock()
+	jm.metrics.jobStatusGauge.Set(float64(status))
+
+	now := jm.timeSource().Now()
+	if jm.jobStarted.IsZero() {
+		jm.jobStarted = now
+	} else if status != jm.phase {
+		if timing, ok := jm.metrics.phaseTimings[jm.phase]; ok {
+			timing.Observe(float64(now.Sub(jm.phaseStarted) / time.Millisecond))
+		}
+	}
+	if jm.phaseStarted.IsZero() || status != jm.phase {
+		jm.phase = status
+		jm.phaseStarted = now
+	}
+	if isTerminalStatus(status) {
+		jm.metrics.jobDurationTiming.Observe(float64(now.Sub(jm.jobStarted) / time.Millisecond))
+	}
+}
+
 func overallJobStatusPath(trainingID string) string {
 	return trainingID + "/" + zkStatus
 }
@@ -331,58 +1031,22 @@ func jobBasePath(trainingID string) string {
 	return trainingID + "/"
 }
 
-//KillDeployedJob ... Contact the LCM and kill training job
+//KillDeployedJob ... Contact the LCM and kill training job, after jobmonitor.kill.delay. See Kill for the same with
+//injected clients
 func KillDeployedJob(trainingID string, userID string, jobName string, logr *logger.LocLoggingEntry) error {
-	time.Sleep(10 * time.Second)
-	logr.Infof("(killDeployedJob) Sending job kill request to LCM for %s", trainingID)
-	jobKillReq := &service.JobKillRequest{Name: jobName, TrainingId: trainingID, UserId: userID}
-	lcm, err := lcmClient.NewLcm(nil)
-	if err != nil {
-		logr.Errorln("(KillDeployedJob) Cannot create lcm service client: ", err.Error())
-		return err
-	}
-	defer lcm.Close()
-
-	defaultBackoff := backoff.NewExponentialBackOff()
-	defaultBackoff.MaxElapsedTime = 1 * time.Minute
-	defaultBackoff.MaxInterval = 5 * time.Second
-
-	err = backoff.Retry(func() error {
-		_, err = lcm.Client().KillTrainingJob(context.Background(), jobKillReq)
-		if err != nil {
-			logr.WithError(err).Errorf("Failed to send request to LCM to garbage collect Training Job %s. Retrying", trainingID)
-		}
-		return err
-	}, defaultBackoff)
-
-	if err != nil {
-		logr.WithError(err).Errorf("(killDeployedJob) Successfully sent request to LCM to garbage collect Failed to send request to LCM to garbage collect Training Job %s. Already retried several times.", trainingID)
-		return err
-	}
+	return killAfterDelay(realClock{}, nil, trainingID, userID, jobName, logr)
+}
 
+//killAfterDelay is KillDeployedJob waiting out jobmonitor.kill.delay on clock, through lcm or a client connected for
+//the call if it is nil
+func killAfterDelay(clock Clock, lcm service.LifecycleManagerClient, trainingID string, userID string, jobName string, logr *logger.LocLoggingEntry) error {
+	clock.Sleep(viper.GetDuration(killDelayKey))
+	_, err := sendKill(context.Background(), lcm, JobRef{TrainingID: trainingID, UserID: userID, JobName: jobName}, logr)
 	return err
 }
 
 func learnerSummaryMetricsPath(trainingID string, learnerID int) string {
-	return fmt.Sprintf("%s/learners/learner_%d/%s", trainingID, learnerID, "summary_metrics")
-}
-
-func initTransitionMap() map[string]([]string) {
-	transistionMap := make(map[string]([]string))
-	allowDOWNLOADING := []string{grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
-	allowPROCESSING := []string{grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String()}
-	allowSTORING := []string{grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
-	allowCOMPLETED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
-	allowFAILED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
-	allowHALTED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
-
-	transistionMap[grpc_trainer_v2.Status_DOWNLOADING.String()] = allowDOWNLOADING
-	transistionMap[grpc_trainer_v2.Status_PROCESSING.String()] = allowPROCESSING
-	transistionMap[grpc_trainer_v2.Status_STORING.String()] = allowSTORING
-	transistionMap[grpc_trainer_v2.Status_COMPLETED.String()] = allowCOMPLETED
-	transistionMap[grpc_trainer_v2.Status_FAILED.String()] = allowFAILED
-	transistionMap[grpc_trainer_v2.Status_HALTED.String()] = allowHALTED
-	return transistionMap
+	return fmt.Sprintf("%s/learners/learner_%d/%s", trainingID, learnerID, zkSummaryMetrics)
 }
 
 func (jm *JobMonitor) isTransitionAllowed(fromStatus string, toStatus string) bool {
@@ -403,14 +1067,13 @@ func etdInteractionBackoff(maxElapsedTime, maxInterval time.Duration) *backoff.E
 }
 
 //onError function on how to deal with the scenario if connecting to coordinator failed. the error is still returned in case
-func coordinator(logr *logger.LocLoggingEntry) (coord.Coordinator, error) {
+func coordinator(cfg coord.Config, logr *logger.LocLoggingEntry) (coord.Coordinator, error) {
 
 	var instance coord.Coordinator
 	var err error
 	err = backoff.
 		RetryNotify(func() error {
-			instance, err = coord.NewCoordinator(coord.Config{Endpoints: config.GetEtcdEndpoints(), Prefix: config.GetEtcdPrefix(),
-				Cert: config.GetEtcdCertLocation(), Username: config.GetEtcdUsername(), Password: config.GetEtcdPassword()}, logr)
+			instance, err = newCoordinator(cfg, logr)
 			return err
 		}, etdInteractionBackoff(1*time.Minute, 30*time.Second), func(err error, t time.Duration) {
 			logr.WithError(err).Errorf("failed to establish connection with etcd")
@@ -419,13 +1082,19 @@ func coordinator(logr *logger.LocLoggingEntry) (coord.Coordinator, error) {
 	return instance, err
 }
 
-func shutdownTrainingOnETCDFailure(trainingID, userID, jobName string, err error, logr *logger.LocLoggingEntry) {
+//the etcd connection settings from the global config of the process
+func defaultCoordinatorConfig() coord.Config {
+	return coord.Config{Endpoints: config.GetEtcdEndpoints(), Prefix: config.GetEtcdPrefix(),
+		Cert: config.GetEtcdCertLocation(), Username: config.GetEtcdUsername(), Password: config.GetEtcdPassword()}
+}
+
+func shutdownTrainingOnETCDFailure(clock Clock, lcm service.LifecycleManagerClient, trainingID, userID, jobName string, err error, logr *logger.LocLoggingEntry) {
 
 	logr.WithError(err).Error("failed to connect to etcd while monitoring training and shutting down the job")
-	if err := updateJobStatusOnError(trainingID, userID, client.ErrCodeEtcdConnection, service.StatusMessages_INTERNAL_ERROR.String(), logr); err != nil {
+	if err := updateJobStatusOnError(trainingID, userID, client.ErrCodeEtcdConnection, ReasonEtcdConnection, service.StatusMessages_INTERNAL_ERROR.String(), logr); err != nil {
 		logr.WithError(err).Errorf("Failed to write the status %s for training %s to trainer", grpc_trainer_v2.Status_FAILED, trainingID)
 	}
-	if err := KillDeployedJob(trainingID, userID, jobName, logr); err != nil {
+	if err := killAfterDelay(clock, lcm, trainingID, userID, jobName, logr); err != nil {
 		logr.WithError(err).Errorf("Failed to kill the deployed job %s", trainingID)
 	}
 }
@@ -18,10 +18,40 @@
 package jobmonitor
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-job-monitor/jobmonitor/grpc_jobmonitor"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/AISphere/ffdl-lcm/service"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func init() {
@@ -57,3 +87,1720 @@ func TestTransitions(t *testing.T) {
 	assert.EqualValues(t, false, jm.isTransitionAllowed("FAILED", "COMPLETED"))
 
 }
+
+func TestParseJobLabels(t *testing.T) {
+	labels := ParseJobLabels("team=vision, project = resnet ,experiment_id=42,bogus,=novalue")
+
+	assert.EqualValues(t, map[string]string{"team": "vision", "project": "resnet", "experiment_id": "42"}, labels)
+	assert.EqualValues(t, []string{"experiment_id", "42", "project", "resnet", "team", "vision"}, labelValues(labels))
+	assert.Empty(t, ParseJobLabels(""))
+}
+
+func TestParseGraceRequest(t *testing.T) {
+	d, reason, err := parseGraceRequest("5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, d)
+	assert.Empty(t, reason)
+
+	d, reason, err = parseGraceRequest(`{"duration": "90s", "reason": "uploading checkpoint"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+	assert.Equal(t, "uploading checkpoint", reason)
+
+	_, _, err = parseGraceRequest("need 5 more minutes")
+	assert.Error(t, err)
+}
+
+func TestStatusVocabulary(t *testing.T) {
+	scoring := newStatusVocabulary(nil, nil).withInbound(scoringStatusMap)
+	value, status, ok := scoring.translate("SCORING")
+	assert.True(t, ok)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, status)
+	assert.Equal(t, "PROCESSING", value)
+
+	value, status, ok = scoring.translate(`{"status": "queued", "timestamp": "1530000000000"}`)
+	assert.True(t, ok)
+	assert.Equal(t, grpc_trainer_v2.Status_PENDING, status)
+	assert.JSONEq(t, `{"status": "PENDING", "timestamp": "1530000000000"}`, value)
+
+	_, _, ok = scoring.translate("TRAINING")
+	assert.False(t, ok)
+
+	value, status, ok = scoring.translate("STORING")
+	assert.True(t, ok)
+	assert.Equal(t, grpc_trainer_v2.Status_STORING, status)
+	assert.Equal(t, "STORING", value)
+
+	extended := newStatusVocabulary(map[string]grpc_trainer_v2.Status{"RUNNING": grpc_trainer_v2.Status_PROCESSING},
+		map[grpc_trainer_v2.Status]grpc_trainer_v2.Status{grpc_trainer_v2.Status_STORING: grpc_trainer_v2.Status_PROCESSING})
+	_, status, ok = extended.translate("running")
+	assert.True(t, ok)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, status)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, extended.outboundStatus(grpc_trainer_v2.Status_STORING))
+	assert.Equal(t, grpc_trainer_v2.Status_FAILED, extended.outboundStatus(grpc_trainer_v2.Status_FAILED))
+}
+
+func TestSummaryMetric(t *testing.T) {
+	summary := `{"iteration": 1000, "values": {"accuracy": 0.92, "loss": "n/a"}}`
+
+	value, ok := summaryMetric(summary, "values.accuracy")
+	assert.True(t, ok)
+	assert.Equal(t, 0.92, value)
+
+	value, ok = summaryMetric(summary, "iteration")
+	assert.True(t, ok)
+	assert.Equal(t, 1000.0, value)
+
+	_, ok = summaryMetric(summary, "values.loss")
+	assert.False(t, ok)
+	_, ok = summaryMetric(summary, "values.accuracy.top1")
+	assert.False(t, ok)
+	_, ok = summaryMetric("not json", "iteration")
+	assert.False(t, ok)
+}
+
+func TestLearnerOfStatusKey(t *testing.T) {
+	learner, ok := learnerOfStatusKey("training-1", "training-1/learners/learner_12/status/0000000000000000004")
+	assert.True(t, ok)
+	assert.Equal(t, 12, learner)
+
+	_, ok = learnerOfStatusKey("training-1", "training-1/learners/learner_12/summary_metrics")
+	assert.False(t, ok)
+	_, ok = learnerOfStatusKey("training-1", "training-10/learners/learner_1/status/0000000000000000001")
+	assert.False(t, ok)
+}
+
+func TestRestoreTerminalLearners(t *testing.T) {
+	jm := &JobMonitor{
+		TrainingID: "training-1",
+		// learner 3 wasn't resumed, its statuses are processed (and counted) again
+		processed: map[int]int{1: 4, 2: 7, 3: 0},
+		learnerStatuses: map[int]grpc_trainer_v2.Status{
+			1: grpc_trainer_v2.Status_COMPLETED,
+			2: grpc_trainer_v2.Status_PROCESSING,
+			3: grpc_trainer_v2.Status_COMPLETED,
+		},
+	}
+	jm.restoreTerminalLearners(jm.componentLogger(nil, componentStatus))
+	assert.Equal(t, uint64(1), jm.numTerminalLearners)
+}
+
+func TestLoadProcessedOffsetsOfJoinedLearners(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	memory := newMemoryEtcd()
+	ctx := context.Background()
+	for learner, statuses := range map[int][]string{1: {"DOWNLOADING", "PROCESSING"}, 3: {"DOWNLOADING", "PROCESSING", "STORING"}} {
+		for i, status := range statuses {
+			memory.Put(ctx, fmt.Sprintf("%s%019d", indvidualJobStatusPath("training-1", learner), i+1), status)
+		}
+	}
+	memory.Put(ctx, processedOffsetPath("training-1", 1), "2")
+	// learner 3 joined the elastic job beyond the 2 learners of its spec
+	memory.Put(ctx, processedOffsetPath("training-1", 3), "3")
+	jm := &JobMonitor{TrainingID: "training-1", NumLearners: 2, EtcdClient: memory.coordinator(), etcd: memory.client(),
+		metrics: newJobMonitorMetrics(Config{}), processed: make(map[int]int), persistedOffsets: make(map[int]string)}
+	jm.loadProcessedOffsets(newStatusVocabulary(nil, nil), logr)
+	assert.Equal(t, map[int]int{1: 2, 3: 3}, jm.processed)
+	assert.Equal(t, map[int]string{1: "2", 3: "3"}, jm.persistedOffsets)
+	assert.Equal(t, grpc_trainer_v2.Status_STORING, jm.learnerStatuses[3])
+}
+
+func TestWatermarkSummary(t *testing.T) {
+	jm := &JobMonitor{}
+	assert.Equal(t, "", jm.watermarkSummary())
+
+	jm.watermarks.peaks = map[int]*learnerWatermark{
+		2: {Memory: 9.8e9},
+		1: {Memory: 1.2e10, GPUMemory: 1.1e10},
+		3: {},
+	}
+	assert.Equal(t, "learner_1:memory=1.2e+10,gpu_memory=1.1e+10;learner_2:memory=9.8e+09", jm.watermarkSummary())
+}
+
+func TestValidateTunables(t *testing.T) {
+	defer viper.Set(learnerPollIntervalKey, nil)
+	defer viper.Set(insuffResourcesRetriesKey, nil)
+	defer viper.Set(killDelayKey, nil)
+	defer viper.Set(scoringPollIntervalKey, nil)
+
+	viper.Set(learnerPollIntervalKey, "1ms")
+	viper.Set(insuffResourcesRetriesKey, "ten")
+	viper.Set(killDelayKey, "2s")
+	viper.Set(scoringPollIntervalKey, "0s")
+	ValidateTunables((&JobMonitor{TrainingID: "training-1"}).componentLogger(nil, componentJobMonitor))
+	assert.Equal(t, time.Minute, viper.GetDuration(learnerPollIntervalKey))
+	assert.Equal(t, 10*time.Second, viper.GetDuration(scoringPollIntervalKey), "a ticker can't tick every 0s")
+	assert.Equal(t, 10, insuffResourcesRetries())
+	assert.Equal(t, 2*time.Second, viper.GetDuration(killDelayKey))
+}
+
+func TestKeptAcrossAttempts(t *testing.T) {
+	assert.True(t, keptAcrossAttempts("training-1", "training-1/attempt"))
+	assert.True(t, keptAcrossAttempts("training-1", "training-1/attempts/1/status"))
+	assert.True(t, keptAcrossAttempts("training-1", jobConfigPath("training-1")+"jobmonitor.grace.max"))
+	assert.False(t, keptAcrossAttempts("training-1", "training-1/status"))
+	assert.False(t, keptAcrossAttempts("training-1", "training-1/learners/learner_1/status/0000000000000000001"))
+	assert.False(t, keptAcrossAttempts("training-1", teardownPath("training-1")))
+}
+
+func TestAttemptSummary(t *testing.T) {
+	jm := &JobMonitor{}
+	assert.Equal(t, "1", jm.attemptSummary())
+	jm.attempt, jm.maxAttempts = 2, 3
+	assert.Equal(t, "2/3", jm.attemptSummary())
+}
+
+func TestLearnerBreakdown(t *testing.T) {
+	jm := &JobMonitor{}
+	assert.Equal(t, "", jm.learnerBreakdown(nil))
+
+	jm.recordLearnerTimestamp(2, "1541124840000")
+	jm.learnerStatuses = map[int]grpc_trainer_v2.Status{1: grpc_trainer_v2.Status_PROCESSING, 2: grpc_trainer_v2.Status_FAILED}
+	pods := []v1core.Pod{
+		{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-1"}, Spec: v1core.PodSpec{NodeName: "node-7"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-x"}, Spec: v1core.PodSpec{NodeName: "node-9"}},
+	}
+	assert.Equal(t, `[{"learner":1,"status":"PROCESSING"},{"learner":2,"status":"FAILED","timestamp":"1541124840000","node":"node-7"}]`,
+		jm.learnerBreakdown(pods))
+}
+
+func TestNewKillReason(t *testing.T) {
+	halted := &teardownRecord{Status: grpc_trainer_v2.Status_HALTED.String()}
+	assert.Equal(t, killReasonUserHalt, newKillReason(halted, []int{2}).Reason)
+
+	unscheduled := &teardownRecord{Status: grpc_trainer_v2.Status_FAILED.String(), Reasons: []ReasonCode{ReasonInsufficientResources}}
+	assert.Equal(t, killReasonTimeout, newKillReason(unscheduled, nil).Reason)
+	haltedUnscheduled := &teardownRecord{Status: grpc_trainer_v2.Status_HALTED.String(), Reasons: []ReasonCode{ReasonInsufficientResources}}
+	assert.Equal(t, killReasonUserHalt, newKillReason(haltedUnscheduled, nil).Reason, "a user halting a job waiting for resources halted it")
+	tooLong := &teardownRecord{Status: grpc_trainer_v2.Status_HALTED.String(), ErrorCode: errCodeMaxRuntime, Reasons: []ReasonCode{ReasonMaxRuntime}}
+	assert.Equal(t, killReasonTimeout, newKillReason(tooLong, nil).Reason)
+
+	jm := &JobMonitor{learnerStatuses: map[int]grpc_trainer_v2.Status{1: grpc_trainer_v2.Status_FAILED, 2: grpc_trainer_v2.Status_PROCESSING, 3: grpc_trainer_v2.Status_FAILED}}
+	failed := newKillReason(&teardownRecord{Status: grpc_trainer_v2.Status_FAILED.String(), Reasons: []ReasonCode{ReasonJobReported}}, jm.failedLearners())
+	assert.Equal(t, killReasonLearnerFailed, failed.Reason)
+	assert.Equal(t, []int{1, 3}, failed.Learners)
+}
+
+func TestLeading(t *testing.T) {
+	jm := &JobMonitor{}
+	assert.True(t, jm.leading())
+
+	viper.Set(leaderElectionKey, true)
+	defer viper.Set(leaderElectionKey, nil)
+	assert.False(t, jm.leading(), "a replica which didn't win the election yet is the standby")
+	assert.Equal(t, errNotLeader, jm.kill(nil))
+	assert.True(t, keptAcrossAttempts("training-1", leaderElectionPath("training-1")+"694d6f8d1b0e3a05"))
+}
+
+func TestAuxiliaryServices(t *testing.T) {
+	viper.Set(auxiliaryServicesKey, []string{"tensorboard", "ps=app==ps,job=={training_id}"})
+	defer viper.Set(auxiliaryServicesKey, nil)
+	services := configuredAuxiliaryServices()
+	assert.Equal(t, 2, len(services))
+	assert.Equal(t, "training_id==training-1,service==tensorboard", services[0].selector("training-1"))
+	assert.Equal(t, "ps", services[1].Name)
+	assert.Equal(t, "app==ps,job==training-1", services[1].selector("training-1"))
+	ps := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "ps", "job": "training-1", "service": "learner"}}}
+	assert.True(t, isAuxiliaryPod(ps, "training-1", services), "told apart by the selector of the service, not its name")
+	assert.False(t, isAuxiliaryPod(ps, "training-2", services))
+	tensorboard := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"training_id": "training-1", "service": "tensorboard"}}}
+	assert.True(t, isAuxiliaryPod(tensorboard, "training-1", services))
+	assert.False(t, isAuxiliaryPod(v1core.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"service": "ps"}}}, "training-1", services))
+
+	assert.Equal(t, auxiliaryMissing, auxiliaryPodsHealth(nil).State)
+	crashing := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ps-0"}, Status: v1core.PodStatus{Phase: v1core.PodRunning,
+		ContainerStatuses: []v1core.ContainerStatus{{Name: "ps", State: v1core.ContainerState{Waiting: &v1core.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}}}}}
+	running := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ps-1"}, Status: v1core.PodStatus{Phase: v1core.PodRunning}}
+	health := auxiliaryPodsHealth([]v1core.Pod{running, crashing})
+	assert.Equal(t, auxiliaryFailed, health.State)
+	assert.Equal(t, "ps-0", health.Pod)
+	assert.Equal(t, auxiliaryRunning, auxiliaryPodsHealth([]v1core.Pod{running}).State)
+}
+
+func TestJobProfile(t *testing.T) {
+	viper.Set(minimalProfileClassesKey, []string{"hpo-trial"})
+	defer viper.Set(minimalProfileClassesKey, nil)
+	assert.Equal(t, ProfileMinimal, jobProfile(withProcessConfig(Config{Labels: map[string]string{jobClassLabel: "hpo-trial"}})))
+	assert.Equal(t, ProfileStandard, jobProfile(withProcessConfig(Config{Labels: map[string]string{jobClassLabel: "production"}})))
+	assert.Equal(t, ProfileStandard, jobProfile(withProcessConfig(Config{Profile: ProfileStandard, Labels: map[string]string{jobClassLabel: "hpo-trial"}})))
+	// a job monitor embedded with a config of its own doesn't go by the global one
+	assert.Equal(t, ProfileStandard, jobProfile(Config{Labels: map[string]string{jobClassLabel: "hpo-trial"}}))
+	assert.Equal(t, ProfileMinimal, jobProfile(Config{Sampling: &Sampling{MinimalClasses: []string{"trial"}}, Labels: map[string]string{jobClassLabel: "trial"}}))
+
+	jm := &JobMonitor{profile: ProfileMinimal}
+	assert.Equal(t, 5*time.Minute, jm.learnerPollInterval())
+	assert.Equal(t, time.Minute, (&JobMonitor{}).learnerPollInterval())
+}
+
+func TestFindOOMKill(t *testing.T) {
+	healthy := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-0"}, Status: v1core.PodStatus{Phase: v1core.PodRunning}}
+	_, found := findOOMKill([]v1core.Pod{healthy}, time.Time{})
+	assert.False(t, found)
+
+	killedAt := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	restarted := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-2"}, Status: v1core.PodStatus{Phase: v1core.PodRunning,
+		ContainerStatuses: []v1core.ContainerStatus{{Name: "learner", LastTerminationState: v1core.ContainerState{Terminated: &v1core.ContainerStateTerminated{
+			Reason: oomKilledReason, FinishedAt: metav1.NewTime(killedAt)}}}}}}
+	_, found = findOOMKill([]v1core.Pod{healthy, restarted}, time.Time{})
+	assert.False(t, found, "the learner recovered from the OOM kill")
+	_, found = findOOMKill([]v1core.Pod{healthy, restarted}, killedAt.Add(time.Hour))
+	assert.False(t, found, "the job failed long after the OOM kill")
+	kill, found := findOOMKill([]v1core.Pod{healthy, restarted}, killedAt.Add(20*time.Second))
+	assert.True(t, found)
+	assert.Equal(t, 3, kill.learner)
+	assert.Contains(t, kill.statusMessage(), "learner 3 exceeded memory limit")
+
+	killed := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-0"}, Status: v1core.PodStatus{Phase: v1core.PodFailed,
+		ContainerStatuses: []v1core.ContainerStatus{{Name: "learner", State: v1core.ContainerState{Terminated: &v1core.ContainerStateTerminated{Reason: oomKilledReason}}}}}}
+	kill, found = findOOMKill([]v1core.Pod{killed}, time.Time{})
+	assert.True(t, found)
+	assert.Equal(t, 1, kill.learner)
+}
+
+func TestInterceptUpdate(t *testing.T) {
+	defer func() { updateInterceptors = nil }()
+	RegisterUpdateInterceptor(func(req *grpc_trainer_v2.UpdateRequest, md metadata.MD) {
+		req.StatusMessage = strings.Replace(req.StatusMessage, "node-7.internal", "<node>", -1)
+	})
+	RegisterUpdateInterceptor(func(req *grpc_trainer_v2.UpdateRequest, md metadata.MD) { panic("broken interceptor") })
+	RegisterUpdateInterceptor(func(req *grpc_trainer_v2.UpdateRequest, md metadata.MD) { md.Set("tenant", "acme") })
+
+	req := &grpc_trainer_v2.UpdateRequest{TrainingId: "training-1", StatusMessage: "learner 2 lost node-7.internal"}
+	md := metadata.MD{}
+	interceptUpdate(req, md, logger.LocLogger(jobLogEntry("training-1", "user-1")))
+	assert.Equal(t, "learner 2 lost <node>", req.StatusMessage)
+	assert.Equal(t, []string{"acme"}, md.Get("tenant"))
+}
+
+func TestImagePullFailures(t *testing.T) {
+	pulling := func(reason, message string) v1core.Pod {
+		return v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-0"}, Status: v1core.PodStatus{Phase: v1core.PodPending,
+			ContainerStatuses: []v1core.ContainerStatus{{Name: "learner", Image: "registry.example.com/tf:bad",
+				State: v1core.ContainerState{Waiting: &v1core.ContainerStateWaiting{Reason: reason, Message: message}}}}}}
+	}
+	failures := make(imagePullFailures)
+	start := fakeClockStart
+	failures.observe([]v1core.Pod{pulling("ErrImagePull", "manifest unknown")}, start)
+	failures.observe([]v1core.Pod{pulling("ImagePullBackOff", "Back-off pulling image")}, start.Add(time.Minute))
+	failure := failures.oldest()
+	assert.Equal(t, start, failure.since)
+	assert.Equal(t, "image registry.example.com/tf:bad of container learner in pod learner-training-1-0 can not be pulled: manifest unknown", failure.statusMessage())
+
+	failures.observe(nil, start.Add(2*time.Minute))
+	assert.Nil(t, failures.oldest())
+}
+
+func TestStaleUpdate(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	jm := &JobMonitor{TrainingID: "training-1", trainerTerminal: int32(grpc_trainer_v2.Status_COMPLETED)}
+	processing := &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_PROCESSING}
+	assert.False(t, jm.staleUpdate(processing, logr), "the guard is off by default")
+
+	viper.Set(staleGuardKey, true)
+	defer viper.Set(staleGuardKey, nil)
+	assert.True(t, jm.staleUpdate(processing, logr))
+	assert.False(t, jm.staleUpdate(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_FAILED}, logr))
+	assert.Equal(t, errStaleUpdate, jm.updateStatusInTrainer(processing, nil, logr), "not sent, and not taken for sent")
+}
+
+func TestInsufficientResourcesPolicy(t *testing.T) {
+	policy := insufficientResourcesPolicyFromConfig()
+	assert.Equal(t, time.Duration(insuffResourcesRetries())*podCheckInterval, policy.maxPending)
+	assert.False(t, policy.keepsWaiting())
+	assert.False(t, policy.notify)
+
+	viper.Set(insuffResourcesMaxPendingKey, "30m")
+	viper.Set(insuffResourcesActionKey, insufficientResourcesWait)
+	defer viper.Set(insuffResourcesMaxPendingKey, nil)
+	defer viper.Set(insuffResourcesActionKey, nil)
+	policy = insufficientResourcesPolicyFromConfig()
+	assert.Equal(t, 30*time.Minute, policy.maxPending)
+	assert.True(t, policy.keepsWaiting())
+
+	viper.Set(insuffResourcesActionKey, "retry")
+	assert.False(t, insufficientResourcesPolicyFromConfig().keepsWaiting(), "unknown actions fail the job")
+}
+
+func TestPostOutcome(t *testing.T) {
+	var received OutcomeNotification
+	var deliveryID string
+	fail := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveryID = r.Header.Get(outcomeDeliveryHeader)
+		json.NewDecoder(r.Body).Decode(&received)
+		if fail {
+			http.Error(w, "pipeline busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	delivery := &OutcomeDelivery{URL: server.URL, Notification: OutcomeNotification{TrainingID: "training-1", Attempt: 2, Status: "COMPLETED"}}
+	err := postOutcome(delivery)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "pipeline busy")
+	fail = false
+	assert.NoError(t, postOutcome(delivery))
+	assert.Equal(t, "training-1/2", deliveryID)
+	assert.Equal(t, delivery.Notification, received)
+}
+
+func TestNodeFailureOf(t *testing.T) {
+	now := fakeClockStart
+	pod := v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-1-0"}, Spec: v1core.PodSpec{NodeName: "node-3"},
+		Status: v1core.PodStatus{Phase: v1core.PodRunning}}
+	node := func(status v1core.ConditionStatus, since time.Duration) *v1core.Node {
+		return &v1core.Node{Status: v1core.NodeStatus{Conditions: []v1core.NodeCondition{{Type: v1core.NodeReady, Status: status,
+			LastTransitionTime: metav1.NewTime(now.Add(-since)), Message: "Kubelet stopped posting node status."}}}}
+	}
+
+	_, failed := nodeFailureOf(pod, node(v1core.ConditionTrue, time.Hour), now, 2*time.Minute)
+	assert.False(t, failed)
+	_, failed = nodeFailureOf(pod, node(v1core.ConditionUnknown, time.Minute), now, 2*time.Minute)
+	assert.False(t, failed, "within the grace period")
+	cause, failed := nodeFailureOf(pod, node(v1core.ConditionUnknown, 5*time.Minute), now, 2*time.Minute)
+	assert.True(t, failed)
+	assert.Equal(t, "the node is NotReady for 5m0s: Kubelet stopped posting node status.", cause)
+	cause, failed = nodeFailureOf(pod, nil, now, 2*time.Minute)
+	assert.True(t, failed)
+	assert.Equal(t, "the node was removed from the cluster", cause)
+
+	pod.Status.Reason = nodeLostReason
+	_, failed = nodeFailureOf(pod, node(v1core.ConditionTrue, time.Hour), now, 2*time.Minute)
+	assert.True(t, failed)
+}
+
+func TestLocalize(t *testing.T) {
+	viper.Set(messageCatalogKey, map[string]interface{}{
+		"fr": map[string]interface{}{"OOM_KILLED": "La tâche {training_id} a dépassé sa limite de mémoire ({message})"},
+	})
+	defer viper.Set(messageCatalogKey, nil)
+	oom := failedStatusUpdate(errCodeOOMKilled, "learner 1 exceeded memory limit")
+
+	jm := &JobMonitor{TrainingID: "training-1"}
+	localized, locale := jm.localize(oom)
+	assert.Equal(t, oom, localized, "no locale")
+	assert.Equal(t, "", locale)
+
+	jm.Labels = map[string]string{localeLabel: "fr_CA"}
+	localized, locale = jm.localize(oom)
+	assert.Equal(t, "fr_CA", locale)
+	assert.Equal(t, "La tâche training-1 a dépassé sa limite de mémoire (learner 1 exceeded memory limit)", localized.StatusMessage)
+	assert.Equal(t, "learner 1 exceeded memory limit", oom.StatusMessage, "the original update is kept")
+
+	localized, _ = jm.localize(failedStatusUpdate(errCodeImagePull, "image can not be pulled"))
+	assert.Equal(t, "image can not be pulled", localized.StatusMessage, "no template")
+}
+
+func TestHaltSelector(t *testing.T) {
+	jm := &JobMonitor{UserID: "user-1", Labels: map[string]string{tenantLabel: "acme", "project": "p1"}}
+	assert.True(t, HaltSelector{Tenant: "acme"}.matches(jm))
+	assert.True(t, HaltSelector{UserID: "user-1", Labels: map[string]string{"project": "p1"}}.matches(jm))
+	assert.False(t, HaltSelector{Tenant: "acme", Labels: map[string]string{"project": "p2"}}.matches(jm))
+	assert.False(t, HaltSelector{UserID: "user-2"}.matches(jm))
+	assert.Equal(t, "user=user-1,tenant=acme,project=p1", HaltSelector{UserID: "user-1", Tenant: "acme", Labels: map[string]string{"project": "p1"}}.String())
+
+	logr := logger.LocLogger(jobLogEntry("", ""))
+	_, err := HaltJobs(HaltSelector{}, "evacuation", logr)
+	assert.Error(t, err, "an empty selector would halt every job")
+	_, err = HaltJobs(HaltSelector{Tenant: "acme"}, " ", logr)
+	assert.Error(t, err)
+}
+
+func TestPhaseTimeouts(t *testing.T) {
+	viper.Set(phaseTimeoutDownloadingKey, "6h")
+	defer viper.Set(phaseTimeoutDownloadingKey, nil)
+	start := fakeClockStart
+	jm := &JobMonitor{clock: NewFakeClock(start)}
+	millis := func(at time.Time) string { return strconv.FormatInt(at.UnixNano()/int64(time.Millisecond), 10) }
+	jm.recordLearnerPhase(1, grpc_trainer_v2.Status_DOWNLOADING, millis(start))
+	jm.recordLearnerPhase(2, grpc_trainer_v2.Status_DOWNLOADING, millis(start.Add(5*time.Hour)))
+	jm.recordLearnerPhase(1, grpc_trainer_v2.Status_DOWNLOADING, millis(start.Add(time.Hour)))
+	jm.recordLearnerPhase(3, grpc_trainer_v2.Status_PROCESSING, millis(start))
+
+	exceeded := jm.phaseTimeouts(start.Add(7 * time.Hour))
+	assert.Len(t, exceeded, 1, "learner 2 is within its timeout, PROCESSING has none")
+	assert.Equal(t, "learner 1 is DOWNLOADING for 7h0m0s, longer than the timeout of 6h0m0s", exceeded[0].statusMessage(start.Add(7*time.Hour)))
+
+	jm.recordLearnerPhase(1, grpc_trainer_v2.Status_PROCESSING, millis(start.Add(7*time.Hour)))
+	assert.Empty(t, jm.phaseTimeouts(start.Add(7*time.Hour)))
+
+	jm.recordLearnerPhase(1, grpc_trainer_v2.Status_DOWNLOADING, millis(start.Add(8*time.Hour)))
+	again := jm.phaseTimeouts(start.Add(15 * time.Hour))
+	assert.Len(t, again, 2)
+	assert.Equal(t, exceeded[0].stuck(), again[0].stuck(), "a learner back in a phase is reported once, whatever the start")
+}
+
+func TestStatusHistory(t *testing.T) {
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) int64 { return start.Add(time.Duration(minutes) * time.Minute).UnixNano() }
+	events := []auditEvent{
+		{At: at(0), Kind: auditTransition, Status: "PENDING"},
+		{At: at(5), Kind: auditTransition, Status: "DOWNLOADING"},
+		{At: at(10), Kind: auditLeader, Detail: "leading"},
+		{At: at(15), Kind: auditTransition, Status: "PROCESSING"},
+		{At: at(16), Kind: auditTransition, Status: "PROCESSING"},
+		{At: at(20), Kind: auditTeardown, Status: "pods_gone"},
+		{At: at(30), Kind: auditFinalStatus, Status: "COMPLETED"},
+	}
+
+	history := statusHistory(events, start.Add(2*time.Minute), grpc_trainer_v2.Status_COMPLETED)
+	assert.Len(t, history, 2)
+	assert.Equal(t, grpc_trainer_v2.Status_DOWNLOADING, history[0].Status)
+	assert.Equal(t, strconv.FormatInt(at(5)/int64(time.Millisecond), 10), history[0].Timestamp)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, history[1].Status)
+
+	assert.Empty(t, statusHistory(events, start.Add(time.Hour), grpc_trainer_v2.Status_COMPLETED))
+	assert.Len(t, statusHistory(events, start, grpc_trainer_v2.Status_FAILED), 4)
+}
+
+func everyLearner(int) bool {
+	return true
+}
+
+func TestLearnerHeartbeats(t *testing.T) {
+	learner, ok := learnerOfHeartbeatKey("training-1", learnerHeartbeatPath("training-1", 12))
+	assert.True(t, ok)
+	assert.Equal(t, 12, learner)
+	_, ok = learnerOfHeartbeatKey("training-1", "training-1/learners/learner_12/status/0000000001")
+	assert.False(t, ok)
+
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := &learnerHeartbeats{}
+	h.expire(2, start)
+	h.expire(1, start.Add(10*time.Second))
+	h.expire(3, start)
+	h.heartbeat(3)
+	assert.Empty(t, h.declareDead(start.Add(30*time.Second), time.Minute, everyLearner))
+	assert.Equal(t, []int{2}, h.declareDead(start.Add(time.Minute), time.Minute, everyLearner))
+	assert.Equal(t, []int{1}, h.declareDead(start.Add(2*time.Minute), time.Minute, everyLearner))
+	assert.Empty(t, h.declareDead(start.Add(time.Hour), time.Minute, everyLearner))
+
+	// the lease of a learner an elastic job let go expires after the job forgot it
+	h.expire(4, start)
+	assert.Empty(t, h.declareDead(start.Add(time.Hour), time.Minute, func(learner int) bool { return learner != 4 }))
+	assert.Empty(t, h.declareDead(start.Add(time.Hour), time.Minute, everyLearner), "a learner which left is not tracked anymore")
+
+	keys := []string{
+		"training-1/learners/learner_1/status/0000000001",
+		learnerHeartbeatPath("training-1", 1),
+		"training-1/learners/learner_2/status/0000000001",
+		"training-1/learners/learner_3/status/0000000002",
+	}
+	assert.Equal(t, []int{2, 3}, learnersWithoutHeartbeat("training-1", keys))
+	assert.Empty(t, learnersWithoutHeartbeat("training-1", keys[2:]), "learners which never write heartbeats are left alone")
+}
+
+func TestBenchmarkStatuses(t *testing.T) {
+	assert.Equal(t, []grpc_trainer_v2.Status{grpc_trainer_v2.Status_DOWNLOADING, grpc_trainer_v2.Status_PROCESSING, grpc_trainer_v2.Status_STORING,
+		grpc_trainer_v2.Status_COMPLETED}, benchmarkStatuses(3))
+	statuses := benchmarkStatuses(6)
+	assert.Len(t, statuses, 6)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, statuses[3])
+
+	latencies := []time.Duration{1 * time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}
+	assert.Equal(t, 2*time.Millisecond, percentile(latencies, 0.5))
+	assert.Equal(t, 4*time.Millisecond, percentile(latencies, 0.99))
+	assert.Equal(t, time.Duration(0), percentile(nil, 0.5))
+}
+
+func TestTraceContext(t *testing.T) {
+	traced := logger.LocLogger(log.NewEntry(log.New()).WithFields(log.Fields{
+		logkeyTraceID: "4bf92f3577b34da6a3ce929d0e0e4736", logkeySpanID: "00f067aa0ba902b7"}))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent(traced))
+	md := metadata.MD{}
+	propagateTrace(traced, md)
+	assert.Equal(t, []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, md[traceparentHeader])
+
+	assert.Empty(t, traceparent(logger.LocLogger(log.NewEntry(log.New()))))
+	assert.Empty(t, traceparent(logger.LocLogger(log.NewEntry(log.New()).WithField(logkeyTraceID, "not hex"))))
+
+	viper.Set(tracingEndpointKey, "http://otel-collector:4318/v1/traces")
+	defer viper.Set(tracingEndpointKey, "")
+	var exported []*traceSpan
+	tracing.batcher = newSpanBatcher(func(ctx context.Context, batch []*traceSpan) error {
+		exported = append(exported, batch...)
+		return nil
+	})
+	defer ShutdownTracing(context.Background())
+
+	parent, logr := startSpan(traced, spanLearnerStatus, spanKindInternal, map[string]string{"training_id": "training-1"})
+	child, casLogr := startSpan(logr.WithField(logkeyComponent, componentStatus), spanCompareAndSwap, spanKindClient, nil)
+	assert.Equal(t, componentStatus, casLogr.Logger.Data[logkeyComponent], "the fields of the caller are kept")
+	endSpan(child, errors.New("compacted"))
+	endSpan(parent, nil)
+	assert.NoError(t, flushTraces(context.Background()))
+
+	assert.Len(t, exported, 2)
+	cas, status := exported[0], exported[1]
+	assert.Equal(t, spanCompareAndSwap, cas.name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", hex.EncodeToString(cas.traceID[:]))
+	assert.Equal(t, status.spanID, cas.parentID)
+	assert.Equal(t, "00f067aa0ba902b7", hex.EncodeToString(status.parentID[:]), "continues the trace of the log lines")
+	assert.Equal(t, hex.EncodeToString(status.spanID[:]), logr.Logger.Data[logkeySpanID])
+
+	var posted struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []map[string]interface{} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+	}))
+	defer collector.Close()
+	assert.NoError(t, exportSpans(context.Background(), collector.URL, exported))
+	postedSpan := posted.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", postedSpan["traceId"])
+	assert.Equal(t, hex.EncodeToString(status.spanID[:]), postedSpan["parentSpanId"])
+	assert.Equal(t, float64(spanKindClient), postedSpan["kind"])
+	assert.Equal(t, map[string]interface{}{"code": float64(otlpStatusCodeError), "message": "compacted"}, postedSpan["status"])
+
+	// stopped, the batcher exports what is left and a later span sets up a new one
+	assert.NoError(t, ShutdownTracing(context.Background()))
+	assert.Nil(t, tracing.batcher)
+}
+
+type fakeLCM struct {
+	service.LifecycleManagerClient
+	fail  int
+	kills []*service.JobKillRequest
+}
+
+func (f *fakeLCM) KillTrainingJob(ctx context.Context, in *service.JobKillRequest, opts ...grpc.CallOption) (*service.JobKillResponse, error) {
+	if f.kills = append(f.kills, in); len(f.kills) <= f.fail {
+		return nil, errors.New("unavailable")
+	}
+	return &service.JobKillResponse{}, nil
+}
+
+type fakeTrainer struct {
+	grpc_trainer_v2.TrainerClient
+	updates []*grpc_trainer_v2.UpdateRequest
+	reasons []string
+	keys    []string
+	err     error
+}
+
+func (f *fakeTrainer) UpdateTrainingJob(ctx context.Context, in *grpc_trainer_v2.UpdateRequest, opts ...grpc.CallOption) (*grpc_trainer_v2.UpdateResponse, error) {
+	f.updates = append(f.updates, in)
+	md, _ := metadata.FromOutgoingContext(ctx)
+	f.reasons = append(f.reasons, md[reasonCodesHeader]...)
+	f.keys = append(f.keys, md[idempotencyKeyHeader]...)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &grpc_trainer_v2.UpdateResponse{}, nil
+}
+
+func (f *fakeTrainer) GetTrainingJob(ctx context.Context, in *grpc_trainer_v2.GetRequest, opts ...grpc.CallOption) (*grpc_trainer_v2.GetResponse, error) {
+	return &grpc_trainer_v2.GetResponse{Job: &grpc_trainer_v2.Job{TrainingId: in.TrainingId}}, nil
+}
+
+func TestSharedHTTPClient(t *testing.T) {
+	first, err := httpClient()
+	assert.NoError(t, err)
+	again, _ := httpClient()
+	assert.True(t, first == again, "the connections of the client are reused")
+
+	viper.Set(requestTimeoutKey, "3s")
+	defer viper.Set(requestTimeoutKey, nil)
+	other, _ := httpClient()
+	assert.False(t, first == other)
+	assert.Equal(t, 3*time.Second, other.Timeout)
+}
+
+func TestLifecycleCalls(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	lcm := &fakeLCM{fail: 1}
+	trainer := &fakeTrainer{}
+	memory := newMemoryEtcd()
+	clients := LifecycleClients{LCM: lcm, Trainer: trainer, Metrics: NoopMetrics(), Coordinator: memory.coordinator()}
+	job := JobRef{TrainingID: "training-1", UserID: "user-1", JobName: "job-1"}
+
+	result, err := Kill(context.Background(), clients, job, logr)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, result.Attempts)
+	assert.Equal(t, "job-1", lcm.kills[1].Name)
+
+	result, err = FailJob(context.Background(), clients, job, client.ErrCodeK8SConnection, ReasonK8sConnection, "no kubernetes", logr)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.Attempts)
+	assert.Equal(t, grpc_trainer_v2.Status_FAILED, result.Status)
+	assert.Equal(t, "no kubernetes", trainer.updates[0].StatusMessage)
+	assert.Equal(t, []string{string(ReasonK8sConnection)}, trainer.reasons)
+
+	assert.Equal(t, []string{"training-1-1"}, trainer.keys)
+
+	// the same update sent again, also after a restart, carries the same idempotency key
+	update := &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_PROCESSING, Timestamp: "1541124840000"}
+	result, err = UpdateStatus(context.Background(), clients, job, update, nil, logr)
+	assert.NoError(t, err)
+	again, _ := UpdateStatus(context.Background(), clients, job, update, nil, logr)
+	assert.Equal(t, "training-1-2", result.IdempotencyKey)
+	assert.Equal(t, result.IdempotencyKey, again.IdempotencyKey)
+	restarted, _ := UpdateStatus(context.Background(), LifecycleClients{Trainer: trainer, Coordinator: memory.coordinator()}, job, update, nil, logr)
+	assert.Equal(t, result.IdempotencyKey, restarted.IdempotencyKey)
+	assert.Equal(t, []string{result.IdempotencyKey, result.IdempotencyKey, result.IdempotencyKey}, trainer.keys[1:])
+
+	// another update with the same status and timestamp is numbered on
+	paused := &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_PROCESSING, Timestamp: "1541124840000", StatusMessage: "paused"}
+	result, _ = UpdateStatus(context.Background(), clients, job, paused, nil, logr)
+	assert.Equal(t, "training-1-3", result.IdempotencyKey)
+	result, _ = UpdateStatus(context.Background(), clients, job, update, nil, logr)
+	assert.Equal(t, "training-1-4", result.IdempotencyKey)
+	result, _ = UpdateStatus(context.Background(), LifecycleClients{Trainer: trainer}, job, update, nil, logr)
+	assert.Empty(t, result.IdempotencyKey)
+
+	// an update the trainer refuses isn't retried
+	trainer.err = status.Error(codes.NotFound, "no such training")
+	result, err = UpdateStatus(context.Background(), clients, job, update, nil, logr)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, 1, result.Attempts)
+
+	// a canceled context ends the retries
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Kill(ctx, LifecycleClients{LCM: &fakeLCM{fail: 100}}, job, logr)
+	assert.Error(t, err)
+}
+
+func TestPublishTransitions(t *testing.T) {
+	type produced struct {
+		contentType string
+		body        struct {
+			Records []struct {
+				Key   string          `json:"key"`
+				Value TransitionEvent `json:"value"`
+			} `json:"records"`
+		}
+	}
+	requests := make(chan produced, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/job%20events", r.URL.EscapedPath())
+		var p produced
+		p.contentType = r.Header.Get("Content-Type")
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&p.body))
+		requests <- p
+	}))
+	defer proxy.Close()
+	viper.Set(eventsRESTProxyURLKey, proxy.URL+"/")
+	viper.Set(eventsRESTProxyTopicKey, "job events")
+	defer viper.Set(eventsRESTProxyURLKey, "")
+
+	etcd := &memCoordinator{values: make(map[string]string)}
+	jm := &JobMonitor{TrainingID: "training-1", UserID: "user-1", EtcdClient: etcd}
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	next := func() TransitionEvent {
+		select {
+		case p := <-requests:
+			assert.Equal(t, "application/vnd.kafka.json.v2+json", p.contentType)
+			assert.Len(t, p.body.Records, 1)
+			assert.Equal(t, "training-1", p.body.Records[0].Key)
+			return p.body.Records[0].Value
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event was published")
+			return TransitionEvent{}
+		}
+	}
+
+	jm.publishTransition(grpc_trainer_v2.Status_PENDING, grpc_trainer_v2.Status_PROCESSING, "", logr)
+	event := next()
+	assert.Equal(t, "user-1", event.UserID)
+	assert.Equal(t, "PENDING", event.OldStatus)
+	assert.Equal(t, "PROCESSING", event.NewStatus)
+
+	// the final status the learners reported already was published, the one the job monitor decided on wasn't
+	jm.publishTransition(grpc_trainer_v2.Status_PROCESSING, grpc_trainer_v2.Status_COMPLETED, "", logr)
+	next()
+	jm.publishFinalStatus(grpc_trainer_v2.Status_COMPLETED, "", logr)
+	jm.publishFinalStatus(grpc_trainer_v2.Status_FAILED, "LEARNER_DEAD", logr)
+	event = next()
+	assert.Equal(t, "COMPLETED", event.OldStatus)
+	assert.Equal(t, "FAILED", event.NewStatus)
+	assert.Equal(t, "LEARNER_DEAD", event.ErrorCode)
+	assert.NoError(t, events.flush(context.Background()))
+
+	// a restarted job monitor goes on from the status published last
+	restarted := &JobMonitor{TrainingID: "training-1", UserID: "user-1", EtcdClient: etcd}
+	restarted.loadPublishedStatus(logr)
+	restarted.publishFinalStatus(grpc_trainer_v2.Status_FAILED, "LEARNER_DEAD", logr)
+	select {
+	case p := <-requests:
+		t.Fatalf("the final status was published again: %+v", p.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type funcPublisher func(event TransitionEvent) error
+
+func (f funcPublisher) Publish(event TransitionEvent) error {
+	return f(event)
+}
+
+func TestPublishersQueueApart(t *testing.T) {
+	release := make(chan struct{})
+	published := make(chan TransitionEvent, 10)
+	eventPublishersMu.Lock()
+	saved := eventPublishers
+	eventPublishers = []EventPublisher{
+		funcPublisher(func(event TransitionEvent) error {
+			<-release
+			return nil
+		}),
+		funcPublisher(func(event TransitionEvent) error {
+			published <- event
+			return nil
+		}),
+	}
+	eventPublishersMu.Unlock()
+	defer func() {
+		eventPublishersMu.Lock()
+		eventPublishers = saved
+		eventPublishersMu.Unlock()
+		events.mu.Lock()
+		for _, name := range []string{"registered 0", "registered 1"} {
+			close(events.queues[name].pending)
+			delete(events.queues, name)
+		}
+		events.mu.Unlock()
+	}()
+
+	etcd := &memCoordinator{values: make(map[string]string)}
+	jm := &JobMonitor{TrainingID: "training-1", UserID: "user-1", EtcdClient: etcd}
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	jm.publishTransition(grpc_trainer_v2.Status_PENDING, grpc_trainer_v2.Status_PROCESSING, "", logr)
+
+	// a publisher which hangs holds up neither the others nor the job monitor, but the status isn't published yet
+	select {
+	case event := <-published:
+		assert.Equal(t, "PROCESSING", event.NewStatus)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the event waited for the other publisher")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	assert.Error(t, events.flush(ctx))
+	cancel()
+	assert.NotContains(t, etcd.values, publishedStatusPath("training-1"))
+
+	close(release)
+	assert.NoError(t, events.flush(context.Background()))
+	assert.Equal(t, "PROCESSING", etcd.values[publishedStatusPath("training-1")])
+}
+
+func TestCloudEventSinks(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan cloudEvent, 10)
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ce cloudEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&ce))
+		received <- r
+		bodies <- ce
+	}))
+	defer sink.Close()
+	viper.Set(cloudEventSinksKey, []string{sink.URL + "/all", sink.URL + "/failures " + cloudEventType("FAILED")})
+	viper.Set(cloudEventSecretKey, "s3cret")
+	defer viper.Set(cloudEventSinksKey, []string{})
+	defer viper.Set(cloudEventSecretKey, "")
+
+	sinks := configuredCloudEventSinks()
+	assert.Len(t, sinks, 2)
+	event := TransitionEvent{TrainingID: "training-1", OldStatus: "PROCESSING", NewStatus: "COMPLETED", Timestamp: time.Now(), Attempt: 1}
+	for _, s := range sinks {
+		assert.NoError(t, s.Publish(event))
+	}
+	// only the sink without types gets the completion
+	r := <-received
+	ce := <-bodies
+	assert.Equal(t, "/all", r.URL.Path)
+	assert.Len(t, received, 0)
+	assert.Equal(t, "application/cloudevents+json", r.Header.Get("Content-Type"))
+	assert.Equal(t, "1.0", ce.SpecVersion)
+	assert.Equal(t, "org.ffdl.training.status.completed", ce.Type)
+	assert.Equal(t, "training-1", ce.Subject)
+	assert.Equal(t, "COMPLETED", ce.Data.NewStatus)
+	body, _ := json.Marshal(newCloudEvent(event))
+	assert.Equal(t, "sha256="+signCloudEvent(body, "s3cret"), r.Header.Get(cloudEventSignatureHeader))
+
+	event.NewStatus = "FAILED"
+	for _, s := range sinks {
+		assert.NoError(t, s.Publish(event))
+	}
+	assert.Len(t, received, 2)
+}
+
+func TestPreflightReport(t *testing.T) {
+	report := PreflightReport{OK: true, Checks: []PreflightCheck{{Name: preflightEtcd, OK: true}, {Name: preflightLCM, OK: true}}}
+	assert.Equal(t, "all 2 checks passed", report.String())
+	report = PreflightReport{Checks: []PreflightCheck{{Name: preflightEtcd, OK: true},
+		{Name: preflightKubernetes, Error: "not allowed to delete pods in namespace default"}}}
+	assert.Equal(t, "1 of 2 checks failed: kubernetes: not allowed to delete pods in namespace default", report.String())
+}
+
+func TestHalfOpenLearners(t *testing.T) {
+	pod := func(ordinal int, phase v1core.PodPhase) v1core.Pod {
+		return v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-abc-" + strconv.Itoa(ordinal)}, Status: v1core.PodStatus{Phase: phase}}
+	}
+	start := time.Now()
+	var h halfOpenLearners
+	// learner 1 runs and reports, learner 2 is PROCESSING without a pod, learner 3 runs without ever reporting
+	pods := []v1core.Pod{pod(0, v1core.PodRunning), pod(2, v1core.PodRunning)}
+	statuses := map[int]grpc_trainer_v2.Status{1: grpc_trainer_v2.Status_PROCESSING, 2: grpc_trainer_v2.Status_PROCESSING}
+	lost, unwired := h.observe(pods, statuses, start, 5*time.Minute, 10*time.Minute, everyLearner)
+	assert.Empty(t, lost)
+	assert.Empty(t, unwired)
+
+	lost, unwired = h.observe(pods, statuses, start.Add(5*time.Minute), 5*time.Minute, 10*time.Minute, everyLearner)
+	assert.Equal(t, []int{2}, lost)
+	assert.Empty(t, unwired)
+	lost, unwired = h.observe(pods, statuses, start.Add(10*time.Minute), 5*time.Minute, 10*time.Minute, everyLearner)
+	assert.Empty(t, lost, "a lost learner is reported once")
+	assert.Equal(t, []int{3}, unwired)
+
+	// a recreated pod, or a terminal status, isn't a disagreement
+	h = halfOpenLearners{}
+	h.observe(nil, statuses, start, 5*time.Minute, 0, everyLearner)
+	h.observe([]v1core.Pod{pod(0, v1core.PodPending), pod(1, v1core.PodPending)}, statuses, start.Add(time.Minute), 5*time.Minute, 0, everyLearner)
+	statuses[2] = grpc_trainer_v2.Status_COMPLETED
+	lost, unwired = h.observe(nil, statuses, start.Add(7*time.Minute), 5*time.Minute, 0, everyLearner)
+	assert.Empty(t, lost)
+	assert.Empty(t, unwired)
+
+	// neither the learners an elastic job let go, nor the ones joining it, are compared
+	h = halfOpenLearners{}
+	member := func(learner int) bool { return learner != 2 && learner != 3 }
+	statuses = map[int]grpc_trainer_v2.Status{2: grpc_trainer_v2.Status_PROCESSING}
+	h.observe(pods[1:], statuses, start, 5*time.Minute, 5*time.Minute, member)
+	lost, unwired = h.observe(pods[1:], statuses, start.Add(time.Hour), 5*time.Minute, 5*time.Minute, member)
+	assert.Empty(t, lost)
+	assert.Empty(t, unwired)
+}
+
+func TestFailureAlerts(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := map[string]interface{}{"path": r.URL.Path}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		bodies <- body
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+	viper.Set(alertSlackWebhookKey, receiver.URL+"/slack")
+	viper.Set(alertPagerDutyRoutingKey, "routing-key")
+	viper.Set(alertPagerDutyURLKey, receiver.URL+"/pagerduty")
+	viper.Set(alertErrorCodesKey, []string{errCodeLearnerDead})
+	defer func() {
+		viper.Set(alertSlackWebhookKey, "")
+		viper.Set(alertPagerDutyRoutingKey, "")
+		viper.Set(alertPagerDutyURLKey, pagerDutyEventsURL)
+		viper.Set(alertErrorCodesKey, []string{})
+	}()
+
+	etcd := &memCoordinator{values: make(map[string]string)}
+	jm := &JobMonitor{TrainingID: "training-1", UserID: "user-1", JobName: "job-1", EtcdClient: etcd,
+		learnerStatuses: map[int]grpc_trainer_v2.Status{1: grpc_trainer_v2.Status_PROCESSING, 2: grpc_trainer_v2.Status_FAILED}}
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	jm.alertOnFailure(&teardownRecord{Status: "COMPLETED"}, logr)
+	jm.alertOnFailure(&teardownRecord{Status: "FAILED", ErrorCode: errCodeNodeFailure}, logr)
+	assert.Len(t, bodies, 0, "only the failures passing the filters are alerted about")
+
+	statusless, err := (&JobMonitor{TrainingID: "training-2", EtcdClient: etcd}).requestTeardown(nil, nil, logr)
+	assert.NoError(t, err)
+	assert.Equal(t, teardownRequested, statusless.State)
+	assert.Empty(t, statusless.Status, "no final status is made up for a teardown requested without one")
+	jm.alertOnFailure(statusless, logr)
+	assert.Len(t, bodies, 0)
+
+	failed, err := jm.requestTeardown(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_FAILED, ErrorCode: errCodeLearnerDead,
+		StatusMessage: "learner 2 stopped sending heartbeats"}, []ReasonCode{ReasonLearnerDead}, logr)
+	assert.NoError(t, err)
+	jm.alertOnFailure(failed, logr)
+	assert.Len(t, bodies, 2)
+	jm.alertOnFailure(failed, logr)
+	assert.Len(t, bodies, 2, "the teardown record tells it was alerted about already")
+	rec, _, _ := jm.loadTeardown(logr)
+	assert.True(t, rec.Alerted)
+	slack := <-bodies
+	assert.Equal(t, "/slack", slack["path"])
+	assert.Contains(t, slack["text"], "Training `training-1`")
+	assert.Contains(t, slack["text"], "learner 2: FAILED")
+	pagerDuty := <-bodies
+	assert.Equal(t, "/pagerduty", pagerDuty["path"])
+	assert.Equal(t, "trigger", pagerDuty["event_action"])
+	assert.Equal(t, "training-1/1", pagerDuty["dedup_key"])
+	details := pagerDuty["payload"].(map[string]interface{})["custom_details"].(map[string]interface{})
+	assert.Equal(t, "LEARNER_DEAD", details["error_code"])
+	assert.Len(t, details["learners"], 2)
+}
+
+func TestQueryService(t *testing.T) {
+	jm := &JobMonitor{TrainingID: "training-query", UserID: "user-1",
+		learnerStatuses: map[int]grpc_trainer_v2.Status{2: grpc_trainer_v2.Status_FAILED, 1: grpc_trainer_v2.Status_PROCESSING}}
+	registerJob(jm)
+	defer unregisterJob(jm.TrainingID)
+	viper.Set(apiTokenKey, "s3cret")
+	defer viper.Set(apiTokenKey, "")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := newQueryServer()
+	go server.Serve(listener)
+	defer server.Stop()
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	query := grpc_jobmonitor.NewJobMonitorClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = query.GetLearnerStatuses(ctx, &grpc_jobmonitor.LearnerStatusesRequest{TrainingId: jm.TrainingID})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer s3cret")
+	resp, err := query.GetLearnerStatuses(ctx, &grpc_jobmonitor.LearnerStatusesRequest{TrainingId: jm.TrainingID})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Learners, 2) {
+		assert.Equal(t, int32(1), resp.Learners[0].Learner)
+		assert.Equal(t, "FAILED", resp.Learners[1].Status)
+	}
+	_, err = query.GetJobStatus(ctx, &grpc_jobmonitor.JobStatusRequest{TrainingId: "training-elsewhere"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	events := []auditEvent{{At: int64(time.Second), Kind: auditTransition, Status: "PENDING"}, {At: int64(2 * time.Second), Kind: auditLeader},
+		{At: int64(3 * time.Second), Kind: auditTransition, Status: "PROCESSING"}, {At: int64(4 * time.Second), Kind: auditFinalStatus, Status: "FAILED"}}
+	transitions := transitionHistory(events, 2000)
+	if assert.Len(t, transitions, 2) {
+		assert.Equal(t, int64(3000), transitions[0].At)
+		assert.Equal(t, "FAILED", transitions[1].Status)
+	}
+}
+
+func TestJobPriority(t *testing.T) {
+	assert.Equal(t, 0, jobPriority(nil))
+	assert.Equal(t, 1, jobPriority(map[string]string{"priority": "High"}))
+	assert.Equal(t, -1, jobPriority(map[string]string{"priority": "low"}))
+	assert.Equal(t, 7, jobPriority(map[string]string{"priority": "7"}))
+	assert.Equal(t, 0, jobPriority(map[string]string{"priority": "urgent"}))
+}
+
+func TestAdminAPI(t *testing.T) {
+	jm := &JobMonitor{TrainingID: "training-admin", terminalStatus: int32(grpc_trainer_v2.Status_COMPLETED)}
+	registerJob(jm)
+	defer unregisterJob(jm.TrainingID)
+	handler := jobResourceHandler(map[string]http.Handler{"view": JobViewHandler(), "kill": JobKillHandler()})
+
+	for _, c := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/jobs/training-admin/kill?reason=diverged", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/jobs/training-elsewhere/kill?reason=diverged", http.StatusNotFound},
+		{http.MethodPost, "/jobs/training-admin/kill", http.StatusBadRequest},
+		{http.MethodPost, "/jobs/training-admin/kill?reason=diverged", http.StatusConflict},
+		{http.MethodPost, "/jobs/training-admin/view", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		assert.Equal(t, c.code, w.Code, c.method+" "+c.path)
+	}
+
+	// without a token the kill is refused, the view is still served
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	handler = jobResourceHandler(map[string]http.Handler{"view": JobViewHandler(), "kill": refuseWithoutAPIToken(JobKillHandler(), logr)})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs/training-admin/kill?reason=diverged", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	viper.Set(apiTokenKey, "s3cret")
+	defer viper.Set(apiTokenKey, "")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs/training-admin/kill?reason=diverged", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestParseTransitions(t *testing.T) {
+	graph, err := parseTransitions(map[string][]string{"processing": {"pending", "DOWNLOADING"}, "COMPLETED": {"PROCESSING"},
+		"FAILED": {"PROCESSING", "PENDING"}, "HALTED": {"PROCESSING"}})
+	assert.NoError(t, err)
+	jm := &JobMonitor{trMap: graph}
+	assert.True(t, jm.isTransitionAllowed("PENDING", "PROCESSING"))
+	assert.False(t, jm.isTransitionAllowed("PENDING", "COMPLETED"))
+
+	_, err = parseTransitions(map[string][]string{"PROCESSING": {"PENDING", "PAUSED"}, "COMPLETED": {"PROCESSING", "FAILED"},
+		"FAILED": {"PROCESSING"}})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown status PAUSED")
+		assert.Contains(t, err.Error(), "FAILED is terminal")
+		assert.Contains(t, err.Error(), "no transition leads to HALTED")
+	}
+	assert.True(t, (&JobMonitor{trMap: defaultTransitions()}).isTransitionAllowed("STORING", "COMPLETED"))
+}
+
+func TestQueuedAndCancelled(t *testing.T) {
+	queued, ok := statusVocabularyFromConfig().status("QUEUED")
+	assert.True(t, ok)
+	cancelled, ok := statusVocabularyFromConfig().status("cancelled")
+	assert.True(t, ok)
+	assert.True(t, isWaitingStatus(queued))
+	assert.True(t, isTerminalStatus(cancelled))
+
+	jm := &JobMonitor{trMap: defaultTransitions()}
+	assert.True(t, jm.isTransitionAllowed(grpc_trainer_v2.Status_NOT_STARTED.String(), queued.String()) || queued == grpc_trainer_v2.Status_PENDING)
+	assert.True(t, jm.isTransitionAllowed(queued.String(), grpc_trainer_v2.Status_DOWNLOADING.String()))
+	assert.True(t, jm.isTransitionAllowed(queued.String(), cancelled.String()))
+	assert.True(t, jm.isTransitionAllowed(grpc_trainer_v2.Status_PROCESSING.String(), cancelled.String()))
+	assert.False(t, jm.isTransitionAllowed(cancelled.String(), grpc_trainer_v2.Status_PROCESSING.String()))
+}
+
+func TestHaltRequest(t *testing.T) {
+	assert.Equal(t, "on request of its user: good enough", parseHaltRequest(" good enough\n").String())
+	assert.Equal(t, "on request of user-1", parseHaltRequest(`{"requested_by": "user-1"}`).String())
+	assert.Equal(t, haltRequest{Reason: "{not json"}, parseHaltRequest("{not json"))
+
+	jm := &JobMonitor{TrainingID: "training-halt", NumLearners: 2,
+		learnerStatuses: map[int]grpc_trainer_v2.Status{1: grpc_trainer_v2.Status_HALTED, 2: grpc_trainer_v2.Status_STORING}}
+	assert.False(t, jm.learnersStopped(), "learner 2 is still storing its results")
+	jm.learnerStatuses[2] = grpc_trainer_v2.Status_COMPLETED
+	assert.True(t, jm.learnersStopped())
+}
+
+func TestPauseLearners(t *testing.T) {
+	replicas := int32(3)
+	set := &appsv1beta1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-pause", Namespace: "learners"},
+		Spec: appsv1beta1.StatefulSetSpec{Replicas: &replicas}}
+	pods := []v1core.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-pause-0", Namespace: "learners",
+		OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: set.Name}}}}}
+	namespace, name, ok := learnerStatefulSet(pods)
+	assert.True(t, ok)
+	assert.Equal(t, "learners", namespace)
+	assert.Equal(t, set.Name, name)
+	_, _, ok = learnerStatefulSet([]v1core.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "jobmonitor-training-pause"}}})
+	assert.False(t, ok)
+
+	jm := &JobMonitor{TrainingID: "training-pause", k8sClient: fake.NewSimpleClientset(set)}
+	assert.NoError(t, jm.scaleLearners(namespace, name, 0))
+	scaled, err := jm.k8sClient.AppsV1beta1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(0), *scaled.Spec.Replicas)
+	assert.Error(t, jm.scaleLearners(namespace, "learner-elsewhere", 3))
+}
+
+func TestPauseAndResume(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-pause", "user-1"))
+	replicas := int32(3)
+	set := &appsv1beta1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-pause", Namespace: config.GetLearnerNamespace()},
+		Spec: appsv1beta1.StatefulSetSpec{Replicas: &replicas}}
+	pod := &v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: "learner-training-pause-0", Namespace: config.GetLearnerNamespace(),
+		Labels:          map[string]string{"training_id": "training-pause", "service": learnerServiceLabel},
+		OwnerReferences: []metav1.OwnerReference{{Kind: "StatefulSet", Name: set.Name}}}}
+	k8s := fake.NewSimpleClientset(set, pod)
+	memory := newMemoryEtcd()
+	memory.Put(context.Background(), overallJobStatusPath("training-pause"), "PROCESSING")
+	trainer := &fakeTrainer{}
+	monitor := func() *JobMonitor {
+		return &JobMonitor{TrainingID: "training-pause", EtcdClient: memory.coordinator(), etcd: memory.client(), k8sClient: k8s,
+			metrics: newJobMonitorMetrics(Config{}), lifecycle: LifecycleClients{Trainer: trainer}}
+	}
+	learners := func() int32 {
+		scaled, err := k8s.AppsV1beta1().StatefulSets(set.Namespace).Get(set.Name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		return *scaled.Spec.Replicas
+	}
+
+	jm := monitor()
+	jm.pause(" maintenance ", logr)
+	assert.True(t, jm.paused())
+	assert.Equal(t, int32(0), learners())
+	rec, err := jm.loadPauseRecord(logr)
+	assert.NoError(t, err)
+	assert.Equal(t, pauseRecord{StatefulSet: set.Name, Namespace: set.Namespace, Replicas: 3, Status: "PROCESSING",
+		Reason: "maintenance", PausedAt: rec.PausedAt}, *rec)
+	assert.Equal(t, grpc_trainer_v2.Status_PROCESSING, trainer.updates[0].Status)
+
+	// restarted while paused, the learner pods are gone and the pause is picked up from its record
+	assert.NoError(t, k8s.Core().Pods(pod.Namespace).Delete(pod.Name, nil))
+	jm = monitor()
+	jm.pause("maintenance", logr)
+	assert.True(t, jm.paused())
+	rec, _ = jm.loadPauseRecord(logr)
+	assert.Equal(t, int32(3), rec.Replicas)
+
+	jm.resume(logr)
+	assert.False(t, jm.paused())
+	assert.Equal(t, int32(3), learners())
+	rec, err = jm.loadPauseRecord(logr)
+	assert.NoError(t, err)
+	assert.Nil(t, rec)
+
+	// a pause record which was there already is kept when the learners can't be scaled
+	value, _ := json.Marshal(pauseRecord{StatefulSet: "learner-elsewhere", Namespace: set.Namespace, Replicas: 3, Status: "PROCESSING"})
+	memory.Put(context.Background(), pausedPath("training-pause"), string(value))
+	jm = monitor()
+	jm.pause("maintenance", logr)
+	assert.False(t, jm.paused())
+	rec, _ = jm.loadPauseRecord(logr)
+	assert.Equal(t, "learner-elsewhere", rec.StatefulSet)
+}
+
+func TestLearnerRestarts(t *testing.T) {
+	assert.Equal(t, 30*time.Second, learnerRestartBackoff(30*time.Second, 0))
+	assert.Equal(t, 2*time.Minute, learnerRestartBackoff(30*time.Second, 2))
+	assert.Equal(t, maxLearnerRestartBackoff, learnerRestartBackoff(30*time.Second, 20))
+	assert.Equal(t, time.Duration(0), learnerRestartBackoff(0, 3))
+	assert.Equal(t, "training-restart/pending_restarts/learner_2", pendingRestartPath("training-restart", 2))
+
+	labels := map[string]string{"training_id": "training-restart", "service": learnerServiceLabel}
+	pod := func(name string) *v1core.Pod {
+		return &v1core.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: config.GetLearnerNamespace(), Labels: labels}}
+	}
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	jm := &JobMonitor{TrainingID: "training-restart",
+		k8sClient: fake.NewSimpleClientset(pod("learner-training-restart-0"), pod("learner-training-restart-1"))}
+	assert.NoError(t, jm.restartLearnerPod(2, logr))
+	pods := jm.learnerPods(logr)
+	assert.Len(t, pods, 1)
+	assert.Equal(t, "learner-training-restart-0", pods[0].ObjectMeta.Name)
+	// a pod which is gone already is being recreated by its stateful set
+	assert.NoError(t, jm.restartLearnerPod(2, logr))
+
+	// without a restart budget a failed learner fails its job
+	defer viper.Set(learnerRestartMaxKey, viper.Get(learnerRestartMaxKey))
+	viper.Set(learnerRestartMaxKey, 0)
+	assert.False(t, jm.restartFailedLearner(1, failedStatusUpdate("", "learner crashed"), logr))
+
+	// the restart, its pending record and the offset past the FAILED status are written at once
+	defer viper.Set(learnerRestartBackoffKey, viper.Get(learnerRestartBackoffKey))
+	viper.Set(learnerRestartMaxKey, 2)
+	viper.Set(learnerRestartBackoffKey, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	memory := newMemoryEtcd()
+	memory.Put(ctx, processedOffsetPath("training-restart", 1), "3")
+	jm.EtcdClient, jm.etcd, jm.ctx, jm.metrics = memory.coordinator(), memory.client(), ctx, newJobMonitorMetrics(Config{})
+	jm.processed, jm.persistedOffsets = map[int]int{1: 3}, map[int]string{1: "3"}
+	jm.heartbeats.dead = map[int]bool{1: true}
+	assert.True(t, jm.restartFailedLearner(1, failedStatusUpdate("", "learner crashed"), logr))
+	restarts, _, err := jm.loadLearnerRestarts(logr)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restarts)
+	offset, _ := memory.Get(ctx, processedOffsetPath("training-restart", 1))
+	assert.Equal(t, "4", string(offset.Kvs[0].Value))
+	assert.Equal(t, "4", jm.persistedOffsets[1])
+	pending, _ := memory.Get(ctx, pendingRestartPath("training-restart", 1))
+	assert.Len(t, pending.Kvs, 1)
+	assert.False(t, jm.heartbeats.dead[1], "a restarted learner is declared dead again if it dies again")
+
+	// the FAILED status processed again by a job monitor which didn't see the offset move doesn't count the restart twice
+	jm.persistedOffsets[1] = "3"
+	assert.False(t, jm.restartFailedLearner(1, failedStatusUpdate("", "learner crashed"), logr))
+	restarts, _, _ = jm.loadLearnerRestarts(logr)
+	assert.Equal(t, 1, restarts)
+}
+
+func TestPartialFailureTolerance(t *testing.T) {
+	for value, required := range map[string]int{"3": 3, "75%": 3, "50%": 2, "100%": 4, "10": 4, "1%": 1} {
+		n, err := parseMinCompleted(value, 4)
+		assert.NoError(t, err, value)
+		assert.Equal(t, required, n, value)
+	}
+	for _, value := range []string{"", "0", "-1", "0%", "150%", "most"} {
+		_, err := parseMinCompleted(value, 4)
+		assert.Error(t, err, value)
+	}
+
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	jm := &JobMonitor{TrainingID: "training-tolerant", NumLearners: 4, metrics: newJobMonitorMetrics(Config{})}
+	failed := failedStatusUpdate("", "worker lost")
+	completed := &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_COMPLETED}
+	assert.False(t, jm.tolerateLearnerStatus(1, failed, logr), "the gang policy fails the job")
+
+	viper.Set(learnerFailurePolicyKey, failurePolicyTolerant)
+	viper.Set(learnerMinCompletedKey, "50%")
+	defer viper.Set(learnerFailurePolicyKey, failurePolicyGang)
+	defer viper.Set(learnerMinCompletedKey, "100%")
+	assert.True(t, jm.tolerateLearnerStatus(1, failed, logr))
+	assert.True(t, jm.tolerateLearnerStatus(2, failed, logr))
+	assert.False(t, jm.tolerateLearnerStatus(3, failed, logr), "two learners can't complete anymore")
+	assert.True(t, jm.tolerateLearnerStatus(3, completed, logr), "one of the two required learners completed")
+	assert.False(t, jm.tolerateLearnerStatus(4, completed, logr), "the second one completes the job")
+	assert.Equal(t, uint64(3), jm.numTerminalLearners)
+	assert.Equal(t, "2 of 4 learners failed, tolerated", jm.toleratedFailures())
+}
+
+func TestElasticLearners(t *testing.T) {
+	jm := &JobMonitor{TrainingID: "training-elastic", NumLearners: 3}
+	assert.Equal(t, []int{1, 2, 3}, jm.learnerNumbers())
+	assert.False(t, jm.monitorsLearner(4))
+
+	// learner 3 of the spec didn't write anything yet, it is still starting rather than gone
+	joined, left, learners := jm.elasticity.resize(map[int]bool{1: true, 2: true}, jm.NumLearners)
+	assert.Empty(t, joined)
+	assert.Empty(t, left)
+	assert.Equal(t, 3, learners)
+
+	joined, left, learners = jm.elasticity.resize(map[int]bool{1: true, 3: true, 4: true, 5: true}, jm.NumLearners)
+	assert.Equal(t, []int{4, 5}, joined)
+	assert.Equal(t, []int{2}, left)
+	assert.Equal(t, 4, learners)
+	assert.Equal(t, 4, jm.learnerCount())
+	assert.Equal(t, []int{1, 3, 4, 5}, jm.learnerNumbers())
+	assert.True(t, jm.monitorsLearner(5))
+	assert.False(t, jm.monitorsLearner(2))
+}
+
+func TestForwardSummaryMetrics(t *testing.T) {
+	metrics, err := parseForwardedMetrics([]string{"values.loss", "values.accuracy:max", "iteration:min"})
+	assert.NoError(t, err)
+	assert.Equal(t, forwardedMetric{metric: "values.loss", name: "loss", aggregation: aggregateMean}, metrics[0])
+	_, err = parseForwardedMetrics([]string{"values.loss:median"})
+	assert.Error(t, err)
+
+	aggregated := aggregateSummaryMetrics(map[int]string{
+		1: `{"iteration": 120, "values": {"loss": 0.5, "accuracy": 0.8}}`,
+		2: `{"iteration": 100, "values": {"loss": 0.3, "accuracy": 0.9}}`,
+		3: `not yet`,
+	}, metrics)
+	assert.InDelta(t, 0.4, aggregated["loss"], 1e-9)
+	assert.Equal(t, 0.9, aggregated["accuracy"])
+	assert.Equal(t, 100.0, aggregated["iteration"])
+	assert.Equal(t, 2.0, aggregated["learners_reporting"])
+	assert.Empty(t, aggregateSummaryMetrics(map[int]string{1: `{}`}, metrics))
+
+	learner, ok := learnerOfSummaryMetricsKey("training-1", learnerSummaryMetricsPath("training-1", 12))
+	assert.True(t, ok)
+	assert.Equal(t, 12, learner)
+	_, ok = learnerOfSummaryMetricsKey("training-1", "training-1/learners/learner_12/status/0001")
+	assert.False(t, ok)
+
+	var summaries learnerSummaries
+	summaries.record(1, `{"iteration": 1}`)
+	taken, changed := summaries.takeChanged()
+	assert.True(t, changed)
+	assert.Equal(t, map[int]string{1: `{"iteration": 1}`}, taken)
+	summaries.record(1, `{"iteration": 1}`)
+	_, changed = summaries.takeChanged()
+	assert.False(t, changed, "the same summary again is no change")
+	summaries.forget(1)
+	taken, changed = summaries.takeChanged()
+	assert.True(t, changed)
+	assert.Empty(t, taken)
+}
+
+func TestEarlyStopping(t *testing.T) {
+	rules, err := parseEarlyStoppingRules("nan(values.loss); plateau(values.val_loss, 2)")
+	assert.NoError(t, err)
+	assert.Equal(t, []earlyStoppingRule{{kind: earlyStopNaN, metric: "values.loss"},
+		{kind: earlyStopPlateau, metric: "values.val_loss", patience: 2}}, rules)
+	for _, spec := range []string{"plateau(values.loss)", "plateau(values.loss,0)", "plateau(values.loss,3,up)", "nan()", "stop(values.loss)", "nan values.loss"} {
+		_, err := parseEarlyStoppingRules(spec)
+		assert.Error(t, err, spec)
+	}
+	none, err := parseEarlyStoppingRules("")
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+
+	// Python's json module writes NaN bare
+	value, ok := earlyStoppingValue(`{"values": {"loss": NaN, "val_loss": 0.5}}`, "values.loss")
+	assert.True(t, ok)
+	assert.True(t, math.IsNaN(value))
+	value, ok = earlyStoppingValue(`{"values": {"val_loss": "0.5"}}`, "values.val_loss")
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, value)
+
+	var e earlyStopping
+	summary := func(valLoss float64) string { return fmt.Sprintf(`{"values": {"loss": 1, "val_loss": %g}}`, valLoss) }
+	for _, v := range []float64{0.9, 0.8, 0.85} {
+		_, met := e.evaluate(rules, 1, summary(v))
+		assert.False(t, met)
+	}
+	_, met := e.evaluate(rules, 2, summary(0.9))
+	assert.False(t, met, "every learner has its own plateau")
+	rule, met := e.evaluate(rules, 1, summary(0.8))
+	assert.True(t, met)
+	assert.Equal(t, "values.val_loss did not improve in 2 evaluations", rule.String())
+	rule, met = e.evaluate(rules, 2, `{"values": {"loss": NaN}}`)
+	assert.True(t, met)
+	assert.Equal(t, earlyStopNaN, rule.kind)
+
+	// a summary which only changed in the loss is no evaluation of the val_loss
+	e = earlyStopping{}
+	for _, loss := range []float64{1, 0.9, 0.8, 0.7, 0.6} {
+		_, met := e.evaluate(rules, 1, fmt.Sprintf(`{"values": {"loss": %g, "val_loss": 0.5}}`, loss))
+		assert.False(t, met, "val_loss unchanged at loss %g", loss)
+	}
+	_, met = e.evaluate(rules, 1, summary(0.6))
+	assert.False(t, met)
+
+	rec := &teardownRecord{Status: grpc_trainer_v2.Status_HALTED.String(), Reasons: []ReasonCode{ReasonEarlyStopped}}
+	assert.Equal(t, killReasonEarlyStopped, newKillReason(rec, nil).Reason)
+}
+
+func TestAttachLogTails(t *testing.T) {
+	assert.Equal(t, "learner 2 failed", attachLogTails("learner 2 failed", nil, 100))
+	message := attachLogTails("learner 2 failed", []learnerLogTail{
+		{learner: 1, lines: "loading data\n"},
+		{learner: 2, lines: "epoch 1\nepoch 2\nTraceback: out of cheese\n"},
+	}, 70)
+	assert.Equal(t, "learner 2 failed\n--- last log lines of learner 1 ---\nloading data"+
+		"\n--- last log lines of learner 2 ---\nepoch 2\nTraceback: out of cheese", message)
+
+	// too long, only the last whole lines fit
+	message = attachLogTails("failed", []learnerLogTail{{learner: 1, lines: "first line\nsecond line\nlast line"}}, 15)
+	assert.Equal(t, "failed\n--- last log lines of learner 1 ---\nlast line", message)
+}
+
+func TestRestartedContainer(t *testing.T) {
+	pod := v1core.Pod{Status: v1core.PodStatus{ContainerStatuses: []v1core.ContainerStatus{
+		{Name: "learner", RestartCount: 0},
+		{Name: "log-collector", RestartCount: 2},
+	}}}
+	assert.False(t, restartedContainer(pod, "learner"))
+	assert.True(t, restartedContainer(pod, "log-collector"))
+	assert.True(t, restartedContainer(pod, ""))
+	assert.False(t, restartedContainer(v1core.Pod{}, ""))
+}
+
+func prometheusSeriesOf(t *testing.T, trainingID string) int {
+	families, err := prometheusRegistry.registry.Gather()
+	assert.NoError(t, err)
+	series := 0
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == "training_id" && pair.GetValue() == trainingID {
+					series++
+				}
+			}
+		}
+	}
+	return series
+}
+
+func TestPrometheusMetricsFactory(t *testing.T) {
+	defer viper.Set(prometheusAddrKey, nil)
+	viper.Set(prometheusAddrKey, ":0")
+
+	m := newJobMonitorMetrics(Config{TrainingID: "training-prometheus", UserID: "user-prometheus"})
+	assert.NotPanics(t, func() {
+		m.completedJobCounter.Add(1)
+		m.silentETCDWatchCounter.With("watch", learnerStatusWatch).Add(1)
+		m.etcdWatchSilenceGauge.With("watch", learnerStatusWatch).Set(30)
+		m.learnerWriteRateGauge.With("learner", "1").Set(12)
+		m.learnerWriteRateGauge.With("learner", "2").Set(6)
+		m.degradedModeGauge.With("mode", degradedTrainerUpdates).Set(1)
+		m.jobDurationTiming.Observe(1000)
+	})
+	assert.Equal(t, 7, prometheusSeriesOf(t, "training-prometheus"))
+
+	forgetPrometheusSeries("training-prometheus", "user-prometheus")
+	assert.Equal(t, 0, prometheusSeriesOf(t, "training-prometheus"))
+}
+
+type closeCountingCoordinator struct {
+	coord.Coordinator
+	closed int
+}
+
+func (c *closeCountingCoordinator) Close(logr *logger.LocLoggingEntry) {
+	c.closed++
+}
+
+func TestStopLeavesSharedCoordinatorOpen(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-shared", "user-1"))
+	shared := &closeCountingCoordinator{}
+	jm := &JobMonitor{TrainingID: "training-shared", EtcdClient: sharedCoordinator{shared}}
+	assert.NoError(t, jm.Stop(context.Background(), logr))
+	assert.Equal(t, 0, shared.closed)
+
+	owned := &closeCountingCoordinator{}
+	jm = &JobMonitor{TrainingID: "training-owned", EtcdClient: owned}
+	assert.NoError(t, jm.Stop(context.Background(), logr))
+	assert.Equal(t, 1, owned.closed)
+}
+
+//memCoordinator keeps the values in a map, for the tests which go by the coordinator alone
+type memCoordinator struct {
+	coord.Coordinator
+	values map[string]string
+}
+
+func (c *memCoordinator) Get(key string, logr *logger.LocLoggingEntry) ([]coord.EtcdKVGetResponse, error) {
+	if value, ok := c.values[key]; ok {
+		return []coord.EtcdKVGetResponse{{Key: key, Value: value}}, nil
+	}
+	return nil, nil
+}
+
+func (c *memCoordinator) Put(key string, value string, logr *logger.LocLoggingEntry) error {
+	c.values[key] = value
+	return nil
+}
+
+func (c *memCoordinator) PutIfKeyMissing(key string, value string, logr *logger.LocLoggingEntry) (bool, error) {
+	if _, ok := c.values[key]; ok {
+		return false, nil
+	}
+	c.values[key] = value
+	return true, nil
+}
+
+func (c *memCoordinator) CompareAndSwap(key string, value string, prevValue string, logr *logger.LocLoggingEntry) (bool, error) {
+	if c.values[key] != prevValue {
+		return false, nil
+	}
+	c.values[key] = value
+	return true, nil
+}
+
+//racingCoordinator ... runs race once, right before the first compare and swap, as if another writer got there first
+type racingCoordinator struct {
+	*memCoordinator
+	race func()
+}
+
+func (c *racingCoordinator) CompareAndSwap(key string, value string, prevValue string, logr *logger.LocLoggingEntry) (bool, error) {
+	if race := c.race; race != nil {
+		c.race = nil
+		race()
+	}
+	return c.memCoordinator.CompareAndSwap(key, value, prevValue, logr)
+}
+
+func TestAdvanceTeardownRace(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	etcd := &racingCoordinator{memCoordinator: &memCoordinator{values: make(map[string]string)}}
+	jm := &JobMonitor{TrainingID: "training-1", EtcdClient: etcd}
+	jm.requestTeardown(failedStatusUpdate("", "learner crashed"), nil, logr)
+	jm.advanceTeardown(teardownTrainerFinal, logr)
+
+	etcd.race = func() { assert.True(t, jm.claimAlert(logr)) }
+	jm.advanceTeardown(teardownLcmAcked, logr)
+	rec, _, _ := jm.loadTeardown(logr)
+	assert.Equal(t, teardownLcmAcked, rec.State, "moved on after the record changed")
+	assert.True(t, rec.Alerted, "the alert claim racing it is kept")
+	assert.Len(t, jm.auditTrail.pending, 2)
+
+	etcd.race = func() {
+		moved := *rec
+		moved.State = teardownPodsGone
+		etcd.values[teardownPath("training-1")] = moved.encode()
+	}
+	jm.advanceTeardown(teardownPodsGone, logr)
+	assert.Len(t, jm.auditTrail.pending, 2, "only the swap which moved the teardown acts on it")
+}
+
+func TestFlushAuditToFreeKey(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-audit", "user-1"))
+	taken := auditPath("training-audit") + fmt.Sprintf("%019d", int64(time.Second))
+	memory := newMemoryEtcd()
+	memory.Put(context.Background(), taken, "written before a restart")
+	monitor := func() *JobMonitor {
+		return &JobMonitor{TrainingID: "training-audit", EtcdClient: memory.coordinator(), etcd: memory.client(),
+			metrics: newJobMonitorMetrics(Config{}), auditTrail: auditTrail{flushNow: make(chan struct{}, 1)}}
+	}
+	jm := monitor()
+	jm.recordAudit(logr, auditEvent{At: int64(time.Second), Kind: auditLeader, Detail: "leading"})
+	jm.flushAudit(logr)
+
+	written, _ := memory.Get(context.Background(), auditPath("training-audit"), clientv3.WithPrefix())
+	assert.Len(t, written.Kvs, 2)
+	assert.Equal(t, "written before a restart", string(written.Kvs[0].Value))
+	assert.Equal(t, auditPath("training-audit")+fmt.Sprintf("%019d", int64(time.Second)+1), string(written.Kvs[1].Key))
+	assert.Empty(t, jm.auditTrail.pending)
+	assert.Equal(t, len(written.Kvs[0].Value)+len(written.Kvs[1].Value), jm.auditTrail.written, "the batches before the restart count")
+	batch, err := decodeAuditBatch(written.Kvs[1].Value)
+	assert.NoError(t, err)
+	assert.Equal(t, "leading", batch[0].Detail)
+
+	// a restarted job monitor picks up the budget where its predecessors left it
+	viper.Set(auditBudgetKey, jm.auditTrail.written+1)
+	defer viper.Set(auditBudgetKey, nil)
+	jm = monitor()
+	jm.recordAudit(logr, auditEvent{At: int64(2 * time.Second), Kind: auditLeader, Detail: "leading again"})
+	jm.flushAudit(logr)
+	assert.Equal(t, 1, jm.auditTrail.dropped)
+}
+
+func TestComponentLoggers(t *testing.T) {
+	jm := &JobMonitor{TrainingID: "training-1", UserID: "user-1"}
+	traced := logger.LocLogger(jobLogEntry("", "").WithField(logkeyTraceID, "4bf92f3577b34da6a3ce929d0e0e4736"))
+	logr := jm.learnerLogger(traced, componentStatus, 2)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", logr.Logger.Data[logkeyTraceID], "the fields of the caller are kept")
+	assert.Equal(t, "training-1", logr.Logger.Data[logger.LogkeyTrainingID])
+	assert.Equal(t, 2, logr.Logger.Data[logkeyLearner])
+	assert.Empty(t, traced.Logger.Data[logkeyComponent])
+
+	logr = jm.componentLogger(nil, componentAPI)
+	assert.Equal(t, componentAPI, logr.Logger.Data[logkeyComponent])
+	assert.Equal(t, "user-1", logr.Logger.Data[logger.LogkeyUserID])
+}
+
+func TestLogContextDefaults(t *testing.T) {
+	defaults := logContextDefaults("training-1", "user-1")
+	assert.Equal(t, "training-1", defaults[logger.LogkeyTrainingID])
+	assert.Equal(t, "user-1", defaults[logger.LogkeyUserID])
+	assert.Equal(t, componentJobMonitor, defaults[logkeyComponent])
+
+	defaults = logContextDefaults("", "")
+	assert.NotContains(t, defaults, logger.LogkeyTrainingID, "controller mode has no job to default to")
+	assert.NotContains(t, defaults, logger.LogkeyUserID)
+	assert.Equal(t, componentJobMonitor, defaults[logkeyComponent])
+}
+
+func TestPersistProcessedOffsetChangedMeanwhile(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	etcd := &memCoordinator{values: map[string]string{processedOffsetPath("training-1", 1): "4"}}
+	jm := &JobMonitor{TrainingID: "training-1", EtcdClient: etcd, processed: map[int]int{1: 6}, persistedOffsets: map[int]string{1: "3"}}
+	jm.persistProcessedOffset(1, logr)
+	assert.Equal(t, "6", etcd.values[processedOffsetPath("training-1", 1)], "written over the offset found in etcd")
+	assert.Equal(t, "6", jm.persistedOffsets[1])
+
+	etcd.values[processedOffsetPath("training-1", 1)] = "9"
+	jm.processed[1] = 7
+	jm.persistProcessedOffset(1, logr)
+	assert.Equal(t, "9", etcd.values[processedOffsetPath("training-1", 1)], "an offset ahead is kept")
+	assert.Equal(t, "9", jm.persistedOffsets[1])
+}
+
+func TestMemoryEtcd(t *testing.T) {
+	logr := logger.LocLogger(jobLogEntry("training-1", "user-1"))
+	memory := newMemoryEtcd()
+	coordinator := memory.coordinator()
+	created, err := coordinator.PutIfKeyMissing(overallJobStatusPath("training-1"), "NOT_STARTED", logr)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, _ = coordinator.PutIfKeyMissing(overallJobStatusPath("training-1"), "PENDING", logr)
+	assert.False(t, created)
+	swapped, _ := coordinator.CompareAndSwap(overallJobStatusPath("training-1"), "DOWNLOADING", "PENDING", logr)
+	assert.False(t, swapped)
+	swapped, _ = coordinator.CompareAndSwap(overallJobStatusPath("training-1"), "DOWNLOADING", "NOT_STARTED", logr)
+	assert.True(t, swapped)
+
+	etcd := memory.client()
+	defer etcd.Close()
+	ctx := context.Background()
+	seq := indvidualJobStatusPath("training-1", 1)
+	etcd.Put(ctx, seq+"2", "PROCESSING")
+	etcd.Put(ctx, seq+"1", "DOWNLOADING")
+	values, err := readSequence(coordinator, seq, logr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DOWNLOADING", "PROCESSING"}, values)
+	resp, _ := etcd.Get(ctx, learnersPath("training-1"), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.Equal(t, int64(2), resp.Count)
+
+	// resumed from the revision of the first status, the watch sees both and what comes after
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := etcd.Watch(watchCtx, seq, clientv3.WithPrefix(), clientv3.WithRev(resp.Header.Revision-1))
+	etcd.Delete(ctx, seq+"2")
+	var seen []string
+	for len(seen) < 3 {
+		select {
+		case watched := <-events:
+			for _, ev := range watched.Events {
+				seen = append(seen, fmt.Sprintf("%s %s", ev.Type, strings.TrimPrefix(string(ev.Kv.Key), seq)))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the watch saw only %v", seen)
+		}
+	}
+	assert.Equal(t, []string{"PUT 2", "PUT 1", "DELETE 2"}, seen)
+}
+
+func TestControllerPutAgain(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	memory := newMemoryEtcd()
+	c := &Controller{cfg: ControllerConfig{Coordinator: memory.coordinator(), MaxJobs: 1}, prefix: "jobmonitor/controller/", etcd: memory.client(), slots: make(chan struct{}, 1), jobs: make(map[string]*controlledJob)}
+	// the only slot is taken, the trainings wait for it without a job monitor being created
+	c.slots <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	synced := make(chan struct{})
+	go func() {
+		c.sync(ctx, logr)
+		close(synced)
+	}()
+
+	// the training monitored with the spec of the key put last, or nil once it isn't monitored
+	monitored := func(revision int64) *controlledJob {
+		deadline := time.After(5 * time.Second)
+		for {
+			c.mu.Lock()
+			job := c.jobs["training-1"]
+			found := (revision == 0 && job == nil) || (job != nil && !job.removed && job.revision == revision)
+			c.mu.Unlock()
+			if found {
+				return job
+			}
+			select {
+			case <-deadline:
+				t.Fatalf("training-1 is not monitored at revision %d", revision)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+	etcd := memory.client()
+	key := c.prefix + "training-1"
+	put, _ := etcd.Put(ctx, key, `{"user_id":"user-1"}`)
+	first := monitored(put.Header.Revision)
+	etcd.Delete(ctx, key)
+	monitored(0)
+	<-first.done
+
+	// put again right after the delete, while the job monitor may still be stopping
+	for i := 0; i < 20; i++ {
+		put, _ = etcd.Put(ctx, key, `{"user_id":"user-1"}`)
+		job := monitored(put.Header.Revision)
+		etcd.Delete(ctx, key)
+		put, _ = etcd.Put(ctx, key, fmt.Sprintf(`{"user_id":"user-1","attempt":%d}`, i+2))
+		again := monitored(put.Header.Revision)
+		<-job.done
+		assert.Equal(t, again, monitored(put.Header.Revision))
+		assert.Equal(t, i+2, again.spec.Attempt)
+		assert.True(t, job != again, "a put after the delete starts a new job monitor")
+		etcd.Delete(ctx, key)
+		monitored(0)
+		<-again.done
+	}
+
+	cancel()
+	<-synced
+	c.wg.Wait()
+	assert.Empty(t, c.jobs)
+}
+
+func TestNewWithoutProcessConfig(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	memory := newMemoryEtcd()
+	viper.Set(updateLogSampleRateKey, 0.5)
+	defer viper.Set(updateLogSampleRateKey, nil)
+	cfg := Config{TrainingID: "training-embedded", UserID: "user-1", NumLearners: 1, Coordinator: memory.coordinator(), K8sClient: fake.NewSimpleClientset()}
+
+	jm, err := New(cfg, logr)
+	assert.NoError(t, err)
+	defer jm.finish()
+	assert.Equal(t, 1.0, jm.updateLogs.rate)
+	monitoredJobsMu.RLock()
+	_, listed := monitoredJobs["training-embedded"]
+	monitoredJobsMu.RUnlock()
+	assert.False(t, listed, "a job monitor without a registry isn't listed")
+
+	listedJM, err := New(withProcessConfig(cfg), logr)
+	assert.NoError(t, err)
+	defer listedJM.finish()
+	assert.Equal(t, 0.5, listedJM.updateLogs.rate)
+	monitoredJobsMu.RLock()
+	assert.True(t, monitoredJobs["training-embedded"] == listedJM)
+	monitoredJobsMu.RUnlock()
+
+	// a job monitor which stops after another one of its training was listed leaves that one listed
+	replacing, _ := New(withProcessConfig(cfg), logr)
+	defer replacing.finish()
+	listedJM.unregister()
+	monitoredJobsMu.RLock()
+	assert.True(t, monitoredJobs["training-embedded"] == replacing)
+	monitoredJobsMu.RUnlock()
+	replacing.unregister()
+	monitoredJobsMu.RLock()
+	_, listed = monitoredJobs["training-embedded"]
+	monitoredJobsMu.RUnlock()
+	assert.False(t, listed)
+}
@@ -0,0 +1,222 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+// page size of ListJobs if none is given, and the largest one accepted
+const (
+	defaultJobsPageSize = 100
+	maxJobsPageSize     = 1000
+)
+
+// the jobs monitored by this process, by training id
+var (
+	monitoredJobs   = make(map[string]*JobMonitor)
+	monitoredJobsMu sync.RWMutex
+)
+
+//JobRegistry ... where a job monitor is listed while it monitors its job, see Config.Registry
+type JobRegistry interface {
+	Register(jm *JobMonitor)
+	Unregister(jm *JobMonitor)
+}
+
+//ProcessJobs ... the registry of the jobs monitored by this process, the one the jobs, admin and health APIs serve
+var ProcessJobs JobRegistry = processJobs{}
+
+type processJobs struct{}
+
+func (processJobs) Register(jm *JobMonitor) {
+	registerJob(jm)
+}
+
+//Unregister ... unlists jm, unless another job monitor of its training was listed meanwhile
+func (processJobs) Unregister(jm *JobMonitor) {
+	monitoredJobsMu.Lock()
+	defer monitoredJobsMu.Unlock()
+	if monitoredJobs[jm.TrainingID] == jm {
+		delete(monitoredJobs, jm.TrainingID)
+	}
+}
+
+//unregister unlists the job monitor from the registry it was listed in
+func (jm *JobMonitor) unregister() {
+	if jm.registry != nil {
+		jm.registry.Unregister(jm)
+	}
+}
+
+func registerJob(jm *JobMonitor) {
+	monitoredJobsMu.Lock()
+	defer monitoredJobsMu.Unlock()
+	monitoredJobs[jm.TrainingID] = jm
+}
+
+func unregisterJob(trainingID string) {
+	monitoredJobsMu.Lock()
+	defer monitoredJobsMu.Unlock()
+	delete(monitoredJobs, trainingID)
+}
+
+//JobInfo ... what ListJobs tells about a monitored job
+type JobInfo struct {
+	TrainingID       string    `json:"training_id"`
+	UserID           string    `json:"user_id"`
+	JobName          string    `json:"job_name"`
+	Framework        string    `json:"framework,omitempty"`
+	FrameworkVersion string    `json:"framework_version,omitempty"`
+	Status           string    `json:"status"`
+	MonitoredSince   time.Time `json:"monitored_since"`
+	Attempt          int       `json:"attempt"`
+	MaxAttempts      int       `json:"max_attempts,omitempty"`
+}
+
+//JobFilter ... restricts the jobs listed by ListJobs, zero values don't filter
+type JobFilter struct {
+	UserID    string
+	Status    string
+	Framework string
+	// only jobs monitored for at least MinAge, and at most MaxAge
+	MinAge time.Duration
+	MaxAge time.Duration
+}
+
+func (f JobFilter) matches(info JobInfo, now time.Time) bool {
+	age := now.Sub(info.MonitoredSince)
+	return (f.UserID == "" || f.UserID == info.UserID) &&
+		(f.Status == "" || strings.EqualFold(f.Status, info.Status)) &&
+		(f.Framework == "" || strings.EqualFold(f.Framework, info.Framework)) &&
+		(f.MinAge <= 0 || age >= f.MinAge) &&
+		(f.MaxAge <= 0 || age <= f.MaxAge)
+}
+
+func (jm *JobMonitor) info() JobInfo {
+	status, latched := jm.terminalLatch()
+	if !latched {
+		jm.phaseMu.Lock()
+		status = jm.phase
+		jm.phaseMu.Unlock()
+	}
+	return JobInfo{
+		TrainingID:       jm.TrainingID,
+		UserID:           jm.UserID,
+		JobName:          jm.JobName,
+		Framework:        jm.Framework,
+		FrameworkVersion: jm.FrameworkVersion,
+		Status:           status.String(),
+		MonitoredSince:   jm.created,
+		Attempt:          jm.Attempt(),
+		MaxAttempts:      jm.maxAttempts,
+	}
+}
+
+//ListJobs ... lists the jobs monitored by this process which match filter, ordered by training id. At most pageSize
+//jobs are returned, the next page starts after the returned page token, which is empty on the last page
+func ListJobs(filter JobFilter, pageToken string, pageSize int) ([]JobInfo, string) {
+	if pageSize <= 0 {
+		pageSize = defaultJobsPageSize
+	}
+	if pageSize > maxJobsPageSize {
+		pageSize = maxJobsPageSize
+	}
+
+	monitoredJobsMu.RLock()
+	ids := make([]string, 0, len(monitoredJobs))
+	for id := range monitoredJobs {
+		if id > pageToken {
+			ids = append(ids, id)
+		}
+	}
+	monitoredJobsMu.RUnlock()
+	sort.Strings(ids)
+
+	now := time.Now()
+	jobs := make([]JobInfo, 0, pageSize)
+	for i, id := range ids {
+		monitoredJobsMu.RLock()
+		jm, ok := monitoredJobs[id]
+		monitoredJobsMu.RUnlock()
+		if !ok {
+			continue
+		}
+		if info := jm.info(); filter.matches(info, now) {
+			jobs = append(jobs, info)
+		}
+		if len(jobs) == pageSize {
+			if i < len(ids)-1 {
+				return jobs, id
+			}
+			break
+		}
+	}
+	return jobs, ""
+}
+
+//JobsHandler ... serves ListJobs as JSON, e.g. GET /jobs?user=u1&status=PROCESSING&framework=tensorflow&min_age=1h
+//&page_size=50&page_token=<next_page_token of the previous page>
+func JobsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		filter := JobFilter{UserID: query.Get("user"), Status: query.Get("status"), Framework: query.Get("framework")}
+		if status := query.Get("status"); status != "" {
+			if _, ok := grpc_trainer_v2.Status_value[strings.ToUpper(status)]; !ok {
+				http.Error(w, "unknown status "+status, http.StatusBadRequest)
+				return
+			}
+		}
+		for param, age := range map[string]*time.Duration{"min_age": &filter.MinAge, "max_age": &filter.MaxAge} {
+			if value := query.Get(param); value != "" {
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					http.Error(w, "invalid "+param+": "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				*age = d
+			}
+		}
+		pageSize := 0
+		if value := query.Get("page_size"); value != "" {
+			var err error
+			if pageSize, err = strconv.Atoi(value); err != nil {
+				http.Error(w, "invalid page_size: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		jobs, next := ListJobs(filter, query.Get("page_token"), pageSize)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Jobs          []JobInfo `json:"jobs"`
+			NextPageToken string    `json:"next_page_token,omitempty"`
+		}{jobs, next})
+	})
+}
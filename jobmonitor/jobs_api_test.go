@@ -0,0 +1,54 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListJobsFiltersAndPages(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		user := "u1"
+		if i%2 == 1 {
+			user = "u2"
+		}
+		registerJob(&JobMonitor{TrainingID: fmt.Sprintf("training-list-%d", i), UserID: user, Framework: "tensorflow", created: time.Now().Add(-time.Duration(i) * time.Hour)})
+	}
+	defer func() {
+		for i := 0; i < 5; i++ {
+			unregisterJob(fmt.Sprintf("training-list-%d", i))
+		}
+	}()
+
+	page, next := ListJobs(JobFilter{UserID: "u1"}, "", 2)
+	assert.Len(t, page, 2)
+	assert.Equal(t, "training-list-0", page[0].TrainingID)
+	assert.Equal(t, "training-list-2", page[1].TrainingID)
+	assert.Equal(t, "training-list-2", next)
+
+	page, next = ListJobs(JobFilter{UserID: "u1"}, next, 2)
+	assert.Len(t, page, 1)
+	assert.Equal(t, "training-list-4", page[0].TrainingID)
+	assert.Empty(t, next)
+
+	page, _ = ListJobs(JobFilter{MinAge: 90 * time.Minute, Status: "not_started", Framework: "TensorFlow"}, "", 0)
+	assert.Len(t, page, 3)
+}
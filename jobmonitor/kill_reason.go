@@ -0,0 +1,119 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+const zkKillReason = "kill_reason"
+
+// why the job monitor tears a job down, as written to the kill reason key of the job
+const (
+	killReasonCompleted     = "completed"
+	killReasonUserHalt      = "user_halt"
+	killReasonCancelled     = "cancelled"
+	killReasonAdminHalt     = "admin_halt"
+	killReasonEarlyStopped  = "early_stopped"
+	killReasonTimeout       = "timeout"
+	killReasonLearnerFailed = "learner_failed"
+	killReasonFailed        = "failed"
+)
+
+//killReason is the value of the kill reason key of a training. The helper containers of the learners read it when
+//their learner gets killed, so that their final logs and exit handling tell the same story as the job monitor
+type killReason struct {
+	Reason        string       `json:"reason"`
+	Status        string       `json:"status"`
+	ErrorCode     string       `json:"error_code,omitempty"`
+	StatusMessage string       `json:"status_message,omitempty"`
+	Learners      []int        `json:"learners,omitempty"`
+	Reasons       []ReasonCode `json:"reasons,omitempty"`
+	Timestamp     string       `json:"timestamp,omitempty"`
+}
+
+//learners read why the job is torn down from this key, it is written before the LCM is asked to kill the job
+func killReasonPath(trainingID string) string {
+	return trainingID + "/" + zkKillReason
+}
+
+//newKillReason tells why the job with the teardown record rec is killed, failedLearners are the learners whose latest
+//status is FAILED
+func newKillReason(rec *teardownRecord, failedLearners []int) *killReason {
+	reason := &killReason{Status: rec.Status, ErrorCode: rec.ErrorCode, StatusMessage: rec.StatusMessage,
+		Reasons: rec.Reasons, Timestamp: rec.Timestamp}
+	switch {
+	case rec.Status == grpc_trainer_v2.Status_COMPLETED.String():
+		reason.Reason = killReasonCompleted
+	case hasReason(rec.Reasons, ReasonMaxRuntime):
+		// the job ran for too long
+		reason.Reason = killReasonTimeout
+	case hasReason(rec.Reasons, ReasonAdminHalt):
+		reason.Reason = killReasonAdminHalt
+	case hasReason(rec.Reasons, ReasonEarlyStopped):
+		reason.Reason = killReasonEarlyStopped
+	case rec.Status == grpc_trainer_v2.Status_HALTED.String():
+		reason.Reason = killReasonUserHalt
+	case hasReason(rec.Reasons, ReasonInsufficientResources):
+		// the pods did not get scheduled within their retries
+		reason.Reason = killReasonTimeout
+	case trainerKnowsCancelled && rec.Status == statusCancelled.String():
+		reason.Reason = killReasonCancelled
+	case len(failedLearners) > 0:
+		reason.Reason = killReasonLearnerFailed
+		reason.Learners = failedLearners
+	default:
+		reason.Reason = killReasonFailed
+	}
+	return reason
+}
+
+func hasReason(reasons []ReasonCode, reason ReasonCode) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+//failedLearners are the learners whose latest status is FAILED, in order
+func (jm *JobMonitor) failedLearners() []int {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	var failed []int
+	for learner, status := range jm.learnerStatuses {
+		if status == grpc_trainer_v2.Status_FAILED {
+			failed = append(failed, learner)
+		}
+	}
+	sort.Ints(failed)
+	return failed
+}
+
+//writeKillReason records why the job is about to be killed. A reason which is already there is kept, it is from the
+//first kill request of the teardown and the learners may have read it already
+func (jm *JobMonitor) writeKillReason(rec *teardownRecord, logr *logger.LocLoggingEntry) {
+	value, _ := json.Marshal(newKillReason(rec, jm.failedLearners()))
+	if _, err := jm.EtcdClient.PutIfKeyMissing(killReasonPath(jm.TrainingID), string(value), logr); err != nil {
+		logr.WithError(err).Warnf("(writeKillReason) failed to write the kill reason of %s, the learners will not know why they are killed", jm.TrainingID)
+	}
+}
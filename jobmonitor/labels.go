@@ -0,0 +1,74 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//ParseJobLabels ... parses the user provided annotations of the training spec (team, project, experiment ID, ...)
+//which the LCM hands to the job monitor as a comma separated list of key=value pairs
+func ParseJobLabels(raw string) map[string]string {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.TrimSpace(kv[0])
+		if key == "" {
+			continue
+		}
+		labels[key] = strings.TrimSpace(kv[1])
+	}
+	return labels
+}
+
+//the labels the job metrics are tagged with, the job labels plus the framework of the training spec and the attempt
+//the trainer deployed, so that the metrics of a redeployed job can be told apart
+func metricLabels(cfg Config) map[string]string {
+	labels := make(map[string]string, len(cfg.Labels)+3)
+	for k, v := range cfg.Labels {
+		labels[k] = v
+	}
+	if cfg.Framework != "" {
+		labels["framework"] = cfg.Framework
+		labels["framework_version"] = cfg.FrameworkVersion
+	}
+	if cfg.Attempt > 0 {
+		labels["attempt"] = strconv.Itoa(cfg.Attempt)
+	}
+	return labels
+}
+
+//flattens the labels into the alternating key/value form expected by the With() of go-kit metrics, sorted by key
+//so that the same labels always produce the same label values
+func labelValues(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lv := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		lv = append(lv, k, labels[k])
+	}
+	return lv
+}
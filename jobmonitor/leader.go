@@ -0,0 +1,150 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/spf13/viper"
+)
+
+const zkLeader = "leader"
+
+var errNotLeader = errors.New("this replica of the job monitor is not the leader")
+
+//leaderElection ... the etcd session through which a replica of the job monitor holds the leadership of its job
+type leaderElection struct {
+	mu      sync.Mutex
+	session *concurrency.Session
+	lost    chan struct{}
+}
+
+//the replicas of the job monitor of a training campaign for the leadership under this prefix
+func leaderElectionPath(trainingID string) string {
+	return trainingID + "/" + zkLeader + "/"
+}
+
+func leaderElectionEnabled() bool {
+	return viper.GetBool(leaderElectionKey)
+}
+
+//leaderTTL is the TTL of the lease of the leader in seconds, a standby takes over at most that long after the leader died
+func leaderTTL() int {
+	ttl := int(viper.GetDuration(leaderElectionTTLKey) / time.Second)
+	if ttl < 1 {
+		return 1
+	}
+	return ttl
+}
+
+//campaign blocks until this replica is the leader of the job or the job monitor is stopped. The leadership is held
+//through a lease which is kept alive as long as the replica can reach etcd: when the leader dies, its lease expires
+//after jobmonitor.leader_election.ttl and the standby takes over
+func (jm *JobMonitor) campaign(logr *logger.LocLoggingEntry) error {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return err
+	}
+	session, err := concurrency.NewSession(etcd.Client, concurrency.WithTTL(leaderTTL()), concurrency.WithContext(jm.context()))
+	if err != nil {
+		return err
+	}
+	self, _ := os.Hostname()
+	logr.Infof("(campaign) %s is campaigning for the leadership of %s", self, jm.TrainingID)
+	if err := concurrency.NewElection(session, leaderElectionPath(jm.TrainingID)).Campaign(jm.context(), self); err != nil {
+		session.Close()
+		return err
+	}
+
+	e := &jm.election
+	e.mu.Lock()
+	e.session = session
+	e.mu.Unlock()
+	logr.Infof("(campaign) %s is the leader of %s", self, jm.TrainingID)
+	jm.audit(logr, auditLeader, "%s became the leader", self)
+
+	go func() {
+		<-session.Done()
+		if jm.context().Err() != nil {
+			return
+		}
+		// a new leader may already be monitoring the job, anything this replica still did would be duplicated
+		logr.Errorf("(campaign) %s lost the leadership of %s, it stops monitoring the job", self, jm.TrainingID)
+		close(jm.lostLeadership())
+		jm.finish()
+	}()
+	return nil
+}
+
+//leading tells whether this replica may act on the job: always without leader election, otherwise while its lease
+//is alive
+func (jm *JobMonitor) leading() bool {
+	if !leaderElectionEnabled() {
+		return true
+	}
+	e := &jm.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.session == nil {
+		return false
+	}
+	select {
+	case <-e.session.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+//LostLeadership ... is closed when this replica lost the leadership of the job, the process should exit so that it is
+//restarted as the standby
+func (jm *JobMonitor) LostLeadership() <-chan struct{} {
+	return jm.lostLeadership()
+}
+
+func (jm *JobMonitor) lostLeadership() chan struct{} {
+	e := &jm.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lost == nil {
+		e.lost = make(chan struct{})
+	}
+	return e.lost
+}
+
+//resignLeadership hands the leadership over to the standby right away, instead of after the TTL of the lease
+func (jm *JobMonitor) resignLeadership(logr *logger.LocLoggingEntry) {
+	e := &jm.election
+	e.mu.Lock()
+	session := e.session
+	e.session = nil
+	e.mu.Unlock()
+	if session == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if _, err := session.Client().Revoke(ctx, session.Lease()); err != nil {
+		logr.WithError(err).Warnf("(resignLeadership) failed to revoke the leader lease of %s, the standby takes over once it expires", jm.TrainingID)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1core "k8s.io/api/core/v1"
+)
+
+// grpc metadata key carrying the status of each learner of the job with every status update, as a JSON array of
+// learnerStatusEntry
+const learnerStatusesHeader = "learner-statuses"
+
+//learnerStatusEntry ... the status of one learner of a job, so that the UI can tell which of the learners failed
+type learnerStatusEntry struct {
+	Learner   int    `json:"learner"`
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp,omitempty"`
+	Node      string `json:"node,omitempty"`
+}
+
+//learnerOfPod tells the learner a learner pod runs. The learners are a stateful set, learner_1 runs in the pod with the
+//ordinal 0
+func learnerOfPod(pod v1core.Pod) (int, bool) {
+	name := pod.ObjectMeta.Name
+	ordinal, err := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	if err != nil || ordinal < 0 {
+		return 0, false
+	}
+	return ordinal + 1, true
+}
+
+//learnerBreakdown puts together the status of each learner of the job, along with the node its pod runs on. It is
+//empty until a learner status was seen
+func (jm *JobMonitor) learnerBreakdown(pods []v1core.Pod) string {
+	entries := jm.learnerStatusEntries(pods)
+	if len(entries) == 0 {
+		return ""
+	}
+	value, _ := json.Marshal(entries)
+	return string(value)
+}
+
+//learnerStatusEntries are the latest statuses of the learners which reported one, ordered by learner
+func (jm *JobMonitor) learnerStatusEntries(pods []v1core.Pod) []learnerStatusEntry {
+	nodes := make(map[int]string)
+	for _, pod := range pods {
+		if learner, ok := learnerOfPod(pod); ok {
+			nodes[learner] = pod.Spec.NodeName
+		}
+	}
+
+	jm.learnerStatusMu.Lock()
+	entries := make([]learnerStatusEntry, 0, len(jm.learnerStatuses))
+	for learner, status := range jm.learnerStatuses {
+		entries = append(entries, learnerStatusEntry{
+			Learner:   learner,
+			Status:    status.String(),
+			Timestamp: jm.learnerTimestamps[learner],
+			Node:      nodes[learner],
+		})
+	}
+	jm.learnerStatusMu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Learner < entries[j].Learner })
+	return entries
+}
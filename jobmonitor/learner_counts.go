@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"strings"
+
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/go-kit/kit/metrics"
+)
+
+//learnerCountGauges ... number of learners currently in each status, and in any terminal status
+type learnerCountGauges struct {
+	byStatus map[grpc_trainer_v2.Status]metrics.Gauge
+	terminal metrics.Gauge
+	// the number of learners of an elastic job, see resizeElasticLearners
+	parallelism metrics.Gauge
+}
+
+func newLearnerCountGauges(f metricsFactory) *learnerCountGauges {
+	gauges := &learnerCountGauges{byStatus: make(map[grpc_trainer_v2.Status]metrics.Gauge)}
+	gauges.terminal = f.gauge("jobmonitor.learners.terminal")
+	gauges.parallelism = f.gauge("jobmonitor.learners.parallelism")
+	for value, name := range grpc_trainer_v2.Status_name {
+		gauges.byStatus[grpc_trainer_v2.Status(value)] = f.gauge("jobmonitor.learners." + strings.ToLower(name))
+	}
+	return gauges
+}
+
+//recordLearnerStatus remembers the latest status of a learner and refreshes the learner count gauges
+func (jm *JobMonitor) recordLearnerStatus(learner int, status grpc_trainer_v2.Status) {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	if jm.learnerStatuses == nil {
+		jm.learnerStatuses = make(map[int]grpc_trainer_v2.Status)
+	}
+	if previous, seen := jm.learnerStatuses[learner]; seen && previous == status {
+		return
+	}
+	jm.learnerStatuses[learner] = status
+	jm.refreshLearnerCounts()
+}
+
+//refreshLearnerCounts sets the learner count gauges to the learner statuses, the caller holds learnerStatusMu
+func (jm *JobMonitor) refreshLearnerCounts() {
+	counts := make(map[grpc_trainer_v2.Status]int)
+	terminal := 0
+	for _, s := range jm.learnerStatuses {
+		counts[s]++
+		if isTerminalStatus(s) {
+			terminal++
+		}
+	}
+	for s, gauge := range jm.metrics.learnerCounts.byStatus {
+		gauge.Set(float64(counts[s]))
+	}
+	jm.metrics.learnerCounts.terminal.Set(float64(terminal))
+}
+
+//recordLearnerTimestamp remembers when the learner wrote its latest status
+func (jm *JobMonitor) recordLearnerTimestamp(learner int, timestamp string) {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	if jm.learnerTimestamps == nil {
+		jm.learnerTimestamps = make(map[int]string)
+	}
+	jm.learnerTimestamps[learner] = timestamp
+}
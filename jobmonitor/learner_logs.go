@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/spf13/viper"
+	v1core "k8s.io/api/core/v1"
+)
+
+// the most of the log tails which goes into the status message of a failed job, the trainer keeps the message along
+// with the job
+const maxAttachedLogBytes = 4096
+
+//learnerLogTail ... the last lines a learner logged
+type learnerLogTail struct {
+	learner int
+	lines   string
+}
+
+//attachLogTails appends the log tails of the learners to the status message of a failed job. The lines of each learner
+//get an equal share of maxBytes, from their end
+func attachLogTails(message string, tails []learnerLogTail, maxBytes int) string {
+	if len(tails) == 0 {
+		return message
+	}
+	share := maxBytes / len(tails)
+	var b strings.Builder
+	b.WriteString(message)
+	for _, tail := range tails {
+		lines := strings.TrimRight(tail.lines, "\n")
+		if len(lines) > share {
+			lines = lines[len(lines)-share:]
+			if i := strings.Index(lines, "\n"); i >= 0 {
+				lines = lines[i+1:]
+			}
+		}
+		fmt.Fprintf(&b, "\n--- last log lines of learner %d ---\n%s", tail.learner, lines)
+	}
+	return b.String()
+}
+
+//withLearnerLogs adds the last jobmonitor.logs.tail.lines lines the learners logged to the final status of a failed
+//job, so that its users have something to go by when the learners died before the log collector shipped their logs.
+//Only the learners which failed are tailed, or all of them if none did, from before the restart of their container if
+//it restarted. The logs of the learners are read at once and within the request timeout, whatever isn't read by then
+//is left out rather than holding up the final status
+func (jm *JobMonitor) withLearnerLogs(statusUpdate *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) *client.TrainingStatusUpdate {
+	lines := int64(jm.configInt(logTailLinesKey))
+	if lines <= 0 || jm.k8sClient == nil {
+		return statusUpdate
+	}
+	// the final status of a job is sent once, the tails went into it already
+	if rec, _, err := jm.loadTeardown(logr); err != nil || rec != nil {
+		return statusUpdate
+	}
+	failed := make(map[int]bool)
+	for _, learner := range jm.failedLearners() {
+		failed[learner] = true
+	}
+	container := viper.GetString(logTailContainerKey)
+	// the final status is sent while the monitor is shutting down too, so this doesn't go by its context
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var tails []learnerLogTail
+	for _, pod := range jm.learnerPods(logr) {
+		learner, ok := learnerOfPod(pod)
+		if !ok || (len(failed) > 0 && !failed[learner]) {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, learner int, restarted bool) {
+			defer wg.Done()
+			tail := func(previous bool) ([]byte, error) {
+				return jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).GetLogs(name,
+					&v1core.PodLogOptions{Container: container, TailLines: &lines, Previous: previous}).Context(ctx).Do().Raw()
+			}
+			// the process which crashed is the one before the restart, the current one may not have logged a thing
+			raw, err := tail(restarted)
+			if err != nil && restarted {
+				logr.WithError(err).Debugf("(withLearnerLogs) no log of learner %d of %s before its restart, tailing the current one", learner, jm.TrainingID)
+				raw, err = tail(false)
+			}
+			if err != nil {
+				logr.WithError(err).Warnf("(withLearnerLogs) failed to get the logs of learner %d of %s", learner, jm.TrainingID)
+				return
+			}
+			mu.Lock()
+			tails = append(tails, learnerLogTail{learner: learner, lines: string(raw)})
+			mu.Unlock()
+		}(pod.ObjectMeta.Name, learner, restartedContainer(pod, container))
+	}
+	wg.Wait()
+	if len(tails) == 0 {
+		return statusUpdate
+	}
+	sort.Slice(tails, func(i, j int) bool { return tails[i].learner < tails[j].learner })
+	withLogs := *statusUpdate
+	withLogs.StatusMessage = attachLogTails(statusUpdate.StatusMessage, tails, maxAttachedLogBytes)
+	return &withLogs
+}
+
+//restartedContainer tells whether the container of the pod restarted, the default container "" being any of them
+func restartedContainer(pod v1core.Pod, container string) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if (container == "" || status.Name == container) && status.RestartCount > 0 {
+			return true
+		}
+	}
+	return false
+}
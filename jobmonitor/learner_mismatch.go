@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+)
+
+// resolutions of a mismatch between the number of learners of the spec and the learners actually showing up
+const (
+	// keep monitoring the learners of the spec, ignore extra learners and keep waiting for missing ones
+	mismatchTrustSpec = "trust-spec"
+	// monitor every learner which writes to etcd, even beyond the number of the spec
+	mismatchTrustEtcd = "trust-etcd"
+	// fail the job
+	mismatchFail = "fail"
+)
+
+// error code of jobs failed because their learners don't match their spec
+const errCodeConfigMismatch = "CONFIG_MISMATCH"
+
+//learnerCount is the number of learners monitored, NumLearners unless more learners were found in etcd or the job is
+//elastic
+func (jm *JobMonitor) learnerCount() int {
+	if n, elastic := jm.elasticLearnerCount(); elastic {
+		return n
+	}
+	if n := atomic.LoadInt32(&jm.learnersFound); int(n) > jm.NumLearners {
+		return int(n)
+	}
+	return jm.NumLearners
+}
+
+//etcdLearners returns the learner numbers with a subtree in etcd
+func (jm *JobMonitor) etcdLearners(logr *logger.LocLoggingEntry) (map[int]bool, error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	prefix := fmt.Sprintf("%s/%s/%s", jm.TrainingID, zkLearners, zkLearner)
+	response, err := etcd.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	learners := make(map[int]bool)
+	for _, kv := range response.Kvs {
+		id := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+		if n, err := strconv.Atoi(id); err == nil && n > 0 {
+			learners[n] = true
+		}
+	}
+	return learners, nil
+}
+
+//etcdLearnerCount returns the highest learner number with a subtree in etcd
+func (jm *JobMonitor) etcdLearnerCount(logr *logger.LocLoggingEntry) (int, error) {
+	learners, err := jm.etcdLearners(logr)
+	if err != nil {
+		return 0, err
+	}
+	highest := 0
+	for n := range learners {
+		if n > highest {
+			highest = n
+		}
+	}
+	return highest, nil
+}
+
+//checkLearnerCount compares the number of learners found in etcd with the spec and resolves a mismatch as configured,
+//an elastic job has no mismatch but follows its learners instead. It returns true if the job was failed because of the mismatch
+func (jm *JobMonitor) checkLearnerCount(logr *logger.LocLoggingEntry) bool {
+	if jm.elastic() {
+		jm.resizeElasticLearners(logr)
+		return false
+	}
+	found, err := jm.etcdLearnerCount(logr)
+	if err != nil {
+		logr.WithError(err).Debugf("failed to count the learners of %s in etcd", jm.TrainingID)
+		return false
+	}
+	if found <= jm.learnerCount() {
+		return false
+	}
+
+	switch jm.configString(learnerMismatchKey) {
+	case mismatchTrustEtcd:
+		logr.Warnf("found %d learners of %s in etcd but the spec has %d, monitoring all of them", found, jm.TrainingID, jm.NumLearners)
+		previous := jm.learnerCount()
+		atomic.StoreInt32(&jm.learnersFound, int32(found))
+		for i := previous + 1; i <= found; i++ {
+			jm.recordLearnerStatus(i, grpc_trainer_v2.Status_NOT_STARTED)
+		}
+	case mismatchFail:
+		return jm.failOnLearnerMismatch(fmt.Sprintf("found %d learners in etcd but the spec has %d", found, jm.NumLearners), logr)
+	default:
+		if atomic.CompareAndSwapInt32(&jm.learnersIgnored, 0, 1) {
+			logr.Warnf("found %d learners of %s in etcd but the spec has %d, ignoring the extra learners", found, jm.TrainingID, jm.NumLearners)
+		}
+	}
+	return false
+}
+
+//checkPodCount is called once the pods of the job had their time to start, with the number of running learner pods
+func (jm *JobMonitor) checkPodCount(running int, logr *logger.LocLoggingEntry) bool {
+	if running >= jm.learnerCount() {
+		return false
+	}
+	if jm.configString(learnerMismatchKey) == mismatchFail {
+		return jm.failOnLearnerMismatch(fmt.Sprintf("found %d running learner pods but the spec has %d", running, jm.learnerCount()), logr)
+	}
+	logr.Warnf("found %d running learner pods of %s but the spec has %d, waiting for the learners to report", running, jm.TrainingID, jm.learnerCount())
+	return false
+}
+
+func (jm *JobMonitor) failOnLearnerMismatch(reason string, logr *logger.LocLoggingEntry) bool {
+	if jm.overallStatusIsTerminal(logr) {
+		return false
+	}
+	logr.Errorf("failing %s: %s", jm.TrainingID, reason)
+	jm.sendFinalStatus(failedStatusUpdate(errCodeConfigMismatch, reason), []ReasonCode{ReasonConfigMismatch}, logr)
+	jm.killDeployedJob(logr)
+	return true
+}
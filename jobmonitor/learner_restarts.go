@@ -0,0 +1,273 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	zkLearnerRestarts = "learner_restarts"
+	zkPendingRestarts = "pending_restarts"
+)
+
+// the backoff before a restart doubles with every restart of the job, up to this
+const maxLearnerRestartBackoff = 10 * time.Minute
+
+//the number of times the learners of a job were restarted after failing, the restart budget of the job is
+//jobmonitor.learners.restart.max
+func learnerRestartsPath(trainingID string) string {
+	return trainingID + "/" + zkLearnerRestarts
+}
+
+//pendingRestartsPath is the prefix of the restarts which wait out their backoff, one key per learner, see
+//pendingRestartPath
+func pendingRestartsPath(trainingID string) string {
+	return trainingID + "/" + zkPendingRestarts + "/"
+}
+
+//pendingRestartPath is the key of the pending restart of the learner, e.g. <training id>/pending_restarts/learner_2
+func pendingRestartPath(trainingID string, learner int) string {
+	return fmt.Sprintf("%s%s%d", pendingRestartsPath(trainingID), zkLearner, learner)
+}
+
+//pendingRestart ... a restart of a learner which waits out its backoff, written before the backoff starts so that a
+//restarted job monitor still deletes the pod of the learner. The failure of the learner is kept to fail the job with,
+//should the restart fail
+type pendingRestart struct {
+	Due           time.Time `json:"due"`
+	ErrorCode     string    `json:"error_code,omitempty"`
+	StatusMessage string    `json:"status_message,omitempty"`
+}
+
+//learnerRestartBackoff is how long to wait before the restart which follows the given number of restarts
+func learnerRestartBackoff(base time.Duration, restarts int) time.Duration {
+	backoff := base
+	for i := 0; i < restarts && backoff < maxLearnerRestartBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxLearnerRestartBackoff {
+		return maxLearnerRestartBackoff
+	}
+	return backoff
+}
+
+//loadLearnerRestarts reads the number of learner restarts of the job, along with the raw value for a compare and swap
+func (jm *JobMonitor) loadLearnerRestarts(logr *logger.LocLoggingEntry) (int, string, error) {
+	response, err := jm.EtcdClient.Get(learnerRestartsPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return 0, "", err
+	}
+	restarts, err := strconv.Atoi(response[0].Value)
+	if err != nil || restarts < 0 {
+		return 0, response[0].Value, fmt.Errorf("invalid learner restarts %q of %s", response[0].Value, jm.TrainingID)
+	}
+	return restarts, response[0].Value, nil
+}
+
+//restartFailedLearner restarts a learner which reported FAILED instead of having the job fail, as long as the job has
+//restarts left. It is meant for frameworks which checkpoint, whose restarted learner continues from the last
+//checkpoint. The restart is counted in etcd before the learner pod gets deleted after the backoff, so that its stateful
+//set recreates it, and the learner is tracked from NOT_STARTED again. The pending restart is written to etcd as well,
+//see countLearnerRestart and resumePendingRestarts. It returns false if the learner isn't restarted, the failure then
+//counts as usual
+func (jm *JobMonitor) restartFailedLearner(learner int, update *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) bool {
+	max := jm.configInt(learnerRestartMaxKey)
+	if max <= 0 || jm.k8sClient == nil || jm.paused() {
+		return false
+	}
+	if _, terminal := jm.terminalLatch(); terminal {
+		return false
+	}
+	restarts, previous, err := jm.loadLearnerRestarts(logr)
+	if err != nil {
+		logr.WithError(err).Errorf("(restartFailedLearner) could not read the learner restarts of %s, not restarting learner %d", jm.TrainingID, learner)
+		return false
+	}
+	if restarts >= max {
+		logr.Warnf("(restartFailedLearner) learner %d of %s failed, but the job used up its %d restarts", learner, jm.TrainingID, max)
+		jm.audit(logr, auditLearnerRestart, "learner %d failed with all %d restarts used up: %s", learner, max, update.StatusMessage)
+		return false
+	}
+	backoff := learnerRestartBackoff(jm.configDuration(learnerRestartBackoffKey), restarts)
+	pending := pendingRestart{Due: jm.timeSource().Now().Add(backoff), ErrorCode: update.ErrorCode, StatusMessage: update.StatusMessage}
+	if counted, err := jm.countLearnerRestart(learner, restarts, previous, pending, logr); err != nil || !counted {
+		logr.WithError(err).Errorf("(restartFailedLearner) could not count the restart of learner %d of %s, not restarting it", learner, jm.TrainingID)
+		return false
+	}
+
+	jm.recordLearnerStatus(learner, grpc_trainer_v2.Status_NOT_STARTED)
+	jm.recordLearnerPhase(learner, grpc_trainer_v2.Status_NOT_STARTED, "")
+	jm.heartbeats.heartbeat(learner)
+	message := fmt.Sprintf("learner %d failed (%s), restarting it in %v, restart %d of %d", learner, update.StatusMessage, backoff, restarts+1, max)
+	logr.Warnf("(restartFailedLearner) %s: %s", jm.TrainingID, message)
+	jm.metrics.restartedLearnerCounter.Add(1)
+	jm.audit(logr, auditLearnerRestart, "%s", message)
+	if response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr); err == nil && len(response) > 0 {
+		jm.updateStatusInTrainer(&client.TrainingStatusUpdate{Status: parseStatus(response[0].Value, logr).Status,
+			Timestamp: client.CurrentTimestampAsString(), StatusMessage: message}, []ReasonCode{ReasonLearnerRestarted}, logr)
+	}
+	go jm.restartLearnerAfter(learner, pending, logr)
+	return true
+}
+
+//countLearnerRestart counts the restart of the learner, writes it as pending and moves the processed offset of the
+//learner past its FAILED status in one transaction, unless the restarts or the offset changed since they were read.
+//A job monitor dying right after neither counts the restart again nor deletes the recreated pod, its successor
+//resumes the pending restart instead of processing the FAILED status
+func (jm *JobMonitor) countLearnerRestart(learner int, restarts int, previous string, pending pendingRestart, logr *logger.LocLoggingEntry) (bool, error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return false, err
+	}
+	value, err := json.Marshal(pending)
+	if err != nil {
+		return false, err
+	}
+	jm.processedMu.Lock()
+	offset := strconv.Itoa(jm.processed[learner] + 1)
+	persistedOffset := jm.persistedOffsets[learner]
+	jm.processedMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	txn, err := etcd.Txn(ctx).If(
+		unchangedValue(learnerRestartsPath(jm.TrainingID), previous),
+		unchangedValue(processedOffsetPath(jm.TrainingID, learner), persistedOffset)).Then(
+		clientv3.OpPut(learnerRestartsPath(jm.TrainingID), strconv.Itoa(restarts+1)),
+		clientv3.OpPut(pendingRestartPath(jm.TrainingID, learner), string(value)),
+		clientv3.OpPut(processedOffsetPath(jm.TrainingID, learner), offset)).Commit()
+	if err != nil || !txn.Succeeded {
+		return false, err
+	}
+	jm.processedMu.Lock()
+	jm.persistedOffsets[learner] = offset
+	jm.processedMu.Unlock()
+	return true, nil
+}
+
+//unchangedValue compares key to its previous value, "" for a key which was missing
+func unchangedValue(key string, previous string) clientv3.Cmp {
+	if previous == "" {
+		return clientv3.Compare(clientv3.Version(key), "=", 0)
+	}
+	return clientv3.Compare(clientv3.Value(key), "=", previous)
+}
+
+//resumePendingRestarts picks up the restarts a previous incarnation of the job monitor counted but didn't get to
+//after their backoff. The learners are tracked from NOT_STARTED again rather than by the FAILED status they wrote last
+func (jm *JobMonitor) resumePendingRestarts(logr *logger.LocLoggingEntry) {
+	if jm.k8sClient == nil {
+		return
+	}
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	response, err := etcd.Get(ctx, pendingRestartsPath(jm.TrainingID), clientv3.WithPrefix())
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("(resumePendingRestarts) could not read the pending learner restarts of %s", jm.TrainingID)
+		return
+	}
+	for _, kv := range response.Kvs {
+		learner, err := strconv.Atoi(strings.TrimPrefix(string(kv.Key), pendingRestartsPath(jm.TrainingID)+zkLearner))
+		var pending pendingRestart
+		if err == nil {
+			err = json.Unmarshal(kv.Value, &pending)
+		}
+		if err != nil {
+			logr.WithError(err).Warnf("(resumePendingRestarts) ignoring the invalid pending restart %s", string(kv.Key))
+			continue
+		}
+		logr.Infof("(resumePendingRestarts) resuming the restart of learner %d of %s, due at %s", learner, jm.TrainingID, pending.Due)
+		jm.recordLearnerStatus(learner, grpc_trainer_v2.Status_NOT_STARTED)
+		jm.recordLearnerPhase(learner, grpc_trainer_v2.Status_NOT_STARTED, "")
+		go jm.restartLearnerAfter(learner, pending, logr)
+	}
+}
+
+//restartLearnerAfter deletes the pod of the learner once its restart is due. A job whose learner can't be restarted
+//fails with the status the learner reported
+func (jm *JobMonitor) restartLearnerAfter(learner int, pending pendingRestart, logr *logger.LocLoggingEntry) {
+	if wait := pending.Due.Sub(jm.timeSource().Now()); wait > 0 {
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(wait):
+		}
+	}
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	err := jm.restartLearnerPod(learner, logr)
+	if err == nil {
+		jm.removePendingRestart(learner, logr)
+		return
+	}
+	logr.WithError(err).Errorf("(restartFailedLearner) failed to restart learner %d of %s, failing the job", learner, jm.TrainingID)
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	jm.sendFinalStatus(failedStatusUpdate(pending.ErrorCode, pending.StatusMessage), []ReasonCode{ReasonJobReported}, logr)
+	jm.killDeployedJob(logr)
+}
+
+func (jm *JobMonitor) removePendingRestart(learner int, logr *logger.LocLoggingEntry) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if _, err := etcd.Delete(ctx, pendingRestartPath(jm.TrainingID, learner)); err != nil {
+		logr.WithError(err).Warnf("(restartFailedLearner) failed to remove the pending restart of learner %d of %s", learner, jm.TrainingID)
+	}
+}
+
+//restartLearnerPod deletes the pod of the learner for its stateful set to recreate it. A pod which is gone already is
+//being recreated. The LCM isn't involved: it only deploys, halts and kills whole jobs, and the stateful set it deployed
+//recreates the pod from the spec of the job, the same way a pod is rescheduled off a failed node (see
+//rescheduleLearner)
+func (jm *JobMonitor) restartLearnerPod(learner int, logr *logger.LocLoggingEntry) error {
+	for _, pod := range jm.learnerPods(logr) {
+		if l, ok := learnerOfPod(pod); !ok || l != learner {
+			continue
+		}
+		err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).Delete(pod.ObjectMeta.Name, &metav1.DeleteOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return err
+		}
+		logr.Infof("(restartFailedLearner) deleted pod %s to restart learner %d of %s", pod.ObjectMeta.Name, learner, jm.TrainingID)
+	}
+	return nil
+}
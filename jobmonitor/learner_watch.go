@@ -0,0 +1,137 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/spf13/viper"
+)
+
+// modes of reading the statuses of the learners
+const (
+	// GetAll of every status sequence once a minute
+	learnerStatusPoll = "poll"
+	// react to the etcd watch events of the status sequences right away
+	learnerStatusWatch = "watch"
+)
+
+// in watch mode, all status sequences are still read this often, in case an event got lost to a compaction
+const learnerStatusResyncInterval = 10 * time.Minute
+
+// watch drops in a row without any progress before the monitor falls back to polling
+const learnerWatchMaxFailures = 5
+
+func learnersPath(trainingID string) string {
+	return trainingID + "/" + zkLearners + "/"
+}
+
+//learnerOfStatusKey returns the learner a key of a learner status sequence belongs to, e.g. 2 for
+//<training id>/learners/learner_2/status/<sequence number>
+func learnerOfStatusKey(trainingID string, key string) (int, bool) {
+	rest := strings.TrimPrefix(key, learnersPath(trainingID)+zkLearner)
+	if rest == key {
+		return 0, false
+	}
+	parts := strings.SplitN(rest, "/", 3)
+	if len(parts) < 3 || parts[1] != zkStatus {
+		return 0, false
+	}
+	learner, err := strconv.Atoi(parts[0])
+	return learner, err == nil
+}
+
+//watchLearnerStatuses processes the learner statuses as their etcd watch events come in. It returns only if the watch
+//failed repeatedly, in which case the caller falls back to polling
+func (jm *JobMonitor) watchLearnerStatuses(vocabulary *statusVocabulary, logr *logger.LocLoggingEntry) error {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return err
+	}
+	// the revision the statuses are caught up with below, the watch picks up everything after it
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	resp, err := etcd.Get(ctx, learnersPath(jm.TrainingID), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		return err
+	}
+
+	ctx, cancel = context.WithCancel(jm.context())
+	defer cancel()
+	updated := make(chan int, 256)
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- jm.watchFromRevision(ctx, "learner-statuses", learnersPath(jm.TrainingID), true, resp.Header.Revision+1, learnerWatchMaxFailures, func(ev *clientv3.Event) {
+			if ev.Type != mvccpb.PUT {
+				return
+			}
+			if learner, ok := learnerOfStatusKey(jm.TrainingID, string(ev.Kv.Key)); ok {
+				select {
+				case updated <- learner:
+				case <-ctx.Done():
+				}
+			}
+		}, logr)
+	}()
+
+	for _, i := range jm.learnerNumbers() {
+		jm.processLearnerStatuses(i, vocabulary, logr)
+	}
+
+	clock := jm.timeSource()
+	checks := clock.NewTicker(jm.learnerPollInterval())
+	defer checks.Stop()
+	resync := clock.NewTicker(learnerStatusResyncInterval)
+	defer resync.Stop()
+	for {
+		select {
+		case learner := <-updated:
+			if !jm.monitorsLearner(learner) && jm.elastic() {
+				jm.resizeElasticLearners(logr)
+			}
+			if jm.monitorsLearner(learner) {
+				jm.processLearnerStatuses(learner, vocabulary, logr)
+			}
+		case <-checks.C():
+			if jm.checkLearnerCount(logr) {
+				return nil
+			}
+		case <-resync.C():
+			for _, i := range jm.learnerNumbers() {
+				jm.processLearnerStatuses(i, vocabulary, logr)
+			}
+		case err := <-watchErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func learnerStatusMode() string {
+	if viper.GetString(learnerStatusModeKey) == learnerStatusWatch {
+		return learnerStatusWatch
+	}
+	return learnerStatusPoll
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	service "github.com/AISphere/ffdl-lcm/service"
+	lcmClient "github.com/AISphere/ffdl-lcm/service/client"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//JobRef ... names the job a lifecycle call is about
+type JobRef struct {
+	TrainingID string
+	UserID     string
+	// the name of the job with the LCM, only needed by Kill
+	JobName string
+}
+
+//LifecycleClients ... what the lifecycle calls Kill, UpdateStatus and FailJob talk to, for FfDL components like the LCM
+//cleanup jobs or admin tools which have their own connections. Clients which aren't set are connected for each call
+//from the global configuration, like the job monitor does
+type LifecycleClients struct {
+	LCM     service.LifecycleManagerClient
+	Trainer grpc_trainer_v2.TrainerClient
+	// optional, the calls are counted and timed as jobmonitor.lifecycle.<call>.{succeeded,failed,latency}
+	Metrics MetricsProvider
+	// optional, where the sequence numbers of the idempotency keys of the updates are kept. Without it the updates
+	// carry no idempotency key
+	Coordinator coord.Coordinator
+}
+
+//LifecycleResult ... the outcome of a lifecycle call
+type LifecycleResult struct {
+	TrainingID string
+	// the calls made to the LCM or trainer, more than 1 if they were retried
+	Attempts int
+	Duration time.Duration
+	// the status the trainer was sent, in the vocabulary of the trainer, unset for Kill
+	Status grpc_trainer_v2.Status
+	// the idempotency key of an update delivered at least once, see jobmonitor.trainer.delivery
+	IdempotencyKey string
+}
+
+//Kill ... asks the LCM to kill the job, retrying for up to a minute or until ctx is done. Unlike KillDeployedJob it
+//doesn't wait for jobmonitor.kill.delay first
+func Kill(ctx context.Context, clients LifecycleClients, job JobRef, logr *logger.LocLoggingEntry) (LifecycleResult, error) {
+	result, err := sendKill(ctx, clients.LCM, job, logr)
+	observeLifecycleCall(clients.Metrics, "kill", result, err)
+	return result, err
+}
+
+//UpdateStatus ... sends the status update of the job to the trainer, along with the reasons for it, with the delivery
+//semantics of jobmonitor.trainer.delivery. Retries end when ctx is done
+func UpdateStatus(ctx context.Context, clients LifecycleClients, job JobRef, update *client.TrainingStatusUpdate, reasons []ReasonCode, logr *logger.LocLoggingEntry) (LifecycleResult, error) {
+	md := metadata.MD{}
+	if len(reasons) > 0 {
+		md.Set(reasonCodesHeader, joinReasonCodes(reasons))
+	}
+	result, err := sendTrainerUpdate(ctx, clients.Trainer, clients.Coordinator, job, update, md, logr)
+	observeLifecycleCall(clients.Metrics, "update", result, err)
+	return result, err
+}
+
+//FailJob ... fails the job in the trainer with errorCode and statusMessage, e.g. for a job whose workload can't be
+//looked after anymore
+func FailJob(ctx context.Context, clients LifecycleClients, job JobRef, errorCode string, reason ReasonCode, statusMessage string, logr *logger.LocLoggingEntry) (LifecycleResult, error) {
+	return UpdateStatus(ctx, clients, job, failedStatusUpdate(errorCode, statusMessage), []ReasonCode{reason}, logr)
+}
+
+func observeLifecycleCall(provider MetricsProvider, call string, result LifecycleResult, err error) {
+	if provider == nil {
+		return
+	}
+	name := "jobmonitor.lifecycle." + call
+	provider.NewHistogram(name + ".latency").Observe(float64(result.Duration / time.Millisecond))
+	if err != nil {
+		provider.NewCounter(name + ".failed").Add(1)
+		return
+	}
+	provider.NewCounter(name + ".succeeded").Add(1)
+}
+
+//sendKill asks the LCM to kill the job through lcm, or a client connected for the call if it is nil
+func sendKill(ctx context.Context, lcm service.LifecycleManagerClient, job JobRef, logr *logger.LocLoggingEntry) (result LifecycleResult, err error) {
+	result.TrainingID = job.TrainingID
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+	logr.Infof("(killDeployedJob) Sending job kill request to LCM for %s", job.TrainingID)
+	if lcm == nil {
+		connection, err := lcmClient.NewLcm(nil)
+		if err != nil {
+			logr.Errorln("(KillDeployedJob) Cannot create lcm service client: ", err.Error())
+			return result, err
+		}
+		defer connection.Close()
+		lcm = connection.Client()
+	}
+
+	defaultBackoff := backoff.NewExponentialBackOff()
+	defaultBackoff.MaxElapsedTime = 1 * time.Minute
+	defaultBackoff.MaxInterval = 5 * time.Second
+
+	if value := traceparent(logr); value != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, traceparentHeader, value)
+	}
+	jobKillReq := &service.JobKillRequest{Name: job.JobName, TrainingId: job.TrainingID, UserId: job.UserID}
+	err = backoff.Retry(func() error {
+		result.Attempts++
+		_, err := lcm.KillTrainingJob(ctx, jobKillReq)
+		if err != nil {
+			logr.WithError(err).Errorf("Failed to send request to LCM to garbage collect Training Job %s. Retrying", job.TrainingID)
+		}
+		return err
+	}, backoff.WithContext(defaultBackoff, ctx))
+
+	if err != nil {
+		logr.WithError(err).Errorf("(killDeployedJob) Failed to send request to LCM to garbage collect Training Job %s. Already retried several times.", job.TrainingID)
+	}
+	return result, err
+}
+
+const zkUpdateSequence = "update_sequence"
+
+// how often the sequence number of an update is claimed before giving up, when other updates claim it meanwhile
+const updateSequenceAttempts = 5
+
+//the sequence number last handed out to an update of the job to the trainer is kept as <training id>/update_sequence
+func updateSequencePath(trainingID string) string {
+	return trainingID + "/" + zkUpdateSequence
+}
+
+//updateSequence is the value of the update sequence key of a training: the number last handed out, and a digest of
+//the update it went to
+type updateSequence struct {
+	Sequence int64  `json:"sequence"`
+	Update   string `json:"update"`
+}
+
+//updateDigest identifies the content of an update and the metadata sent along with it, but for the trace context,
+//which differs for every call
+func updateDigest(update *grpc_trainer_v2.UpdateRequest, md metadata.MD) string {
+	content := metadata.Join(md, metadata.Pairs("status", update.Status.String(), "timestamp", update.Timestamp,
+		"status_message", update.StatusMessage, "error_code", update.ErrorCode))
+	delete(content, traceparentHeader)
+	encoded, _ := json.Marshal(content)
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:])
+}
+
+//updateIdempotencyKey identifies an update by the job and a sequence number of the job kept in etcd, so that two
+//updates with the same status and timestamp, e.g. a pause and a resume message, carry different keys. The update sent
+//last keeps its number, so the same update sent again, e.g. by a job monitor which restarted before the trainer
+//acknowledged it, carries the same key
+func updateIdempotencyKey(c coord.Coordinator, trainingID string, update *grpc_trainer_v2.UpdateRequest, md metadata.MD, logr *logger.LocLoggingEntry) (string, error) {
+	key := updateSequencePath(trainingID)
+	digest := updateDigest(update, md)
+	for attempt := 0; attempt < updateSequenceAttempts; attempt++ {
+		kvs, err := c.Get(key, logr)
+		if err != nil {
+			return "", err
+		}
+		last := updateSequence{}
+		if len(kvs) > 0 {
+			if err := json.Unmarshal([]byte(kvs[0].Value), &last); err != nil {
+				return "", fmt.Errorf("invalid update sequence of %s: %v", trainingID, err)
+			}
+			if last.Update == digest {
+				return trainingID + "-" + strconv.FormatInt(last.Sequence, 10), nil
+			}
+		}
+		next := updateSequence{Sequence: last.Sequence + 1, Update: digest}
+		value, _ := json.Marshal(next)
+		var claimed bool
+		if len(kvs) == 0 {
+			claimed, err = c.PutIfKeyMissing(key, string(value), logr)
+		} else {
+			claimed, err = c.CompareAndSwap(key, string(value), kvs[0].Value, logr)
+		}
+		if err != nil {
+			return "", err
+		}
+		if claimed {
+			return trainingID + "-" + strconv.FormatInt(next.Sequence, 10), nil
+		}
+	}
+	return "", fmt.Errorf("the update sequence of %s keeps changing", trainingID)
+}
+
+//rejectedUpdate tells whether the trainer refused the update for good, a retry would be refused the same way
+func rejectedUpdate(err error) bool {
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.NotFound, codes.PermissionDenied:
+		return true
+	}
+	return false
+}
+
+//sendTrainerUpdate sends the status update to the trainer through trainer, or a client connected for the call if it is
+//nil, sending md along with it. The idempotency key of the update is numbered through sequence, the update carries none
+//if it is nil
+func sendTrainerUpdate(ctx context.Context, trainer grpc_trainer_v2.TrainerClient, sequence coord.Coordinator, job JobRef, statusUpdate *client.TrainingStatusUpdate, md metadata.MD, logr *logger.LocLoggingEntry) (result LifecycleResult, err error) {
+	trainingID, userID := job.TrainingID, job.UserID
+	updStatus := statusUpdate.Status
+	span, logr := startSpan(logr, spanTrainerUpdate, spanKindClient, map[string]string{"training_id": trainingID, "status": updStatus.String()})
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+		endSpan(span, err)
+	}()
+	logr.Infof("(updateJobStatus) Updating status of %s to %s", trainingID, updStatus.String())
+	updateRequest := &grpc_trainer_v2.UpdateRequest{TrainingId: trainingID, Status: statusVocabularyFromConfig().outboundStatus(updStatus), Timestamp: statusUpdate.Timestamp,
+		UserId: userID, StatusMessage: statusUpdate.StatusMessage, ErrorCode: statusUpdate.ErrorCode}
+	result.TrainingID, result.Status = trainingID, updateRequest.Status
+	if md == nil {
+		md = metadata.MD{}
+	}
+	propagateTrace(logr, md)
+	interceptUpdate(updateRequest, md, logr)
+
+	if trainer == nil {
+		connection, err := client.NewTrainer()
+		if err != nil {
+			logr.WithError(err).Errorf("(updateJobStatus) Creating training client for status update failed. Training ID %s New Status %s", trainingID, updStatus.String())
+			failedTrainerConnectivityCounter.Add(1)
+			return result, err
+		}
+		defer connection.Close()
+		trainer = connection.Client()
+	}
+
+	if len(md) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, md)
+	}
+	var deliveryBackoff backoff.BackOff
+	switch trainerDeliveryMode() {
+	case deliveryAtMostOnce:
+		// a retry after e.g. a timeout could apply the update twice, so never retry
+		deliveryBackoff = &backoff.StopBackOff{}
+	default:
+		// retry until the trainer acknowledges the update, for up to jobmonitor.trainer.retry.max_elapsed. The
+		// idempotency key lets the trainer drop duplicates, including the ones of a restarted job monitor
+		if sequence != nil {
+			key, err := updateIdempotencyKey(sequence, trainingID, updateRequest, md, logr)
+			if err != nil {
+				logr.WithError(err).Warnf("(updateJobStatus) failed to number the update of %s, it is sent without an idempotency key", trainingID)
+			}
+			result.IdempotencyKey = key
+		}
+		if result.IdempotencyKey != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, idempotencyKeyHeader, result.IdempotencyKey)
+		}
+		exponentialBackoff := backoff.NewExponentialBackOff()
+		exponentialBackoff.MaxElapsedTime = viper.GetDuration(trainerRetryMaxElapsedKey)
+		exponentialBackoff.MaxInterval = 30 * time.Second
+		deliveryBackoff = exponentialBackoff
+	}
+
+	err = backoff.RetryNotify(func() error {
+		result.Attempts++
+		if err := simulatedTrainerOutage(); err != nil {
+			return err
+		}
+		_, err := trainer.UpdateTrainingJob(ctx, updateRequest)
+		if rejectedUpdate(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(deliveryBackoff, ctx), func(err error, t time.Duration) {
+		logr.WithError(err).Errorf("Failed to update status to the trainer. Retrying WARNING: Status updates for %s may be temporarily inconsistent due to failure to communicate with Trainer.", trainingID)
+	})
+
+	if err != nil {
+		failedTrainerConnectivityCounter.Add(1)
+		logr.WithError(err).Errorf("Failed to update status to the trainer (delivery %s). WARNING : Status of job %s will likely be incorrect", trainerDeliveryMode(), trainingID)
+	}
+	return result, err
+}
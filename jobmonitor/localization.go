@@ -0,0 +1,86 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"strings"
+
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/spf13/viper"
+)
+
+// job label carrying the locale of the user who submitted the job, e.g. fr or pt-BR
+const localeLabel = "locale"
+
+// grpc metadata key carrying the locale the status message of an update was localized into
+const messageLocaleHeader = "message-locale"
+
+//jobLocale is the locale the users of the job read its status messages in: the locale label of the job, taken from the
+//profile of the user, or else jobmonitor.messages.locale of the job or the deployment. Empty if the messages aren't
+//localized
+func (jm *JobMonitor) jobLocale() string {
+	if locale := strings.TrimSpace(jm.Labels[localeLabel]); locale != "" {
+		return locale
+	}
+	return strings.TrimSpace(jm.configString(messageLocaleKey))
+}
+
+//messageTemplate looks up the template for an error code in the catalog of the locale, falling back from a regional
+//locale like pt-BR to its language. The catalog is configured by locale and error code, e.g.
+//
+//	jobmonitor.messages.catalog:
+//	  de:
+//	    OOM_KILLED: "Der Job wurde beendet, ein Learner hat sein Speicherlimit überschritten ({message})"
+//
+//viper doesn't keep the case of keys, so neither locales nor error codes are case sensitive
+func messageTemplate(locale string, errorCode string) (string, bool) {
+	locale = strings.ToLower(strings.Replace(locale, "_", "-", -1))
+	for locale != "" {
+		if template, ok := viper.GetStringMapString(messageCatalogKey + "." + locale)[strings.ToLower(errorCode)]; ok && template != "" {
+			return template, true
+		}
+		if i := strings.LastIndex(locale, "-"); i > 0 {
+			locale = locale[:i]
+		} else {
+			locale = ""
+		}
+	}
+	return "", false
+}
+
+//localize returns the update with its status message translated into the locale of the job, along with that locale.
+//The catalog has templates by error code, in which {message} stands for the message the job monitor generated, which
+//usually carries details like the registry error of an image pull, and {training_id} and {job_name} for the job.
+//Updates without an error code, or for which the catalog has no template, are returned as they are with an empty
+//locale. The teardown record, the audit trail and the logs keep the original message for the operators
+func (jm *JobMonitor) localize(statusUpdate *client.TrainingStatusUpdate) (*client.TrainingStatusUpdate, string) {
+	if statusUpdate.ErrorCode == "" {
+		return statusUpdate, ""
+	}
+	locale := jm.jobLocale()
+	if locale == "" {
+		return statusUpdate, ""
+	}
+	template, ok := messageTemplate(locale, statusUpdate.ErrorCode)
+	if !ok {
+		return statusUpdate, ""
+	}
+	localized := *statusUpdate
+	localized.StatusMessage = strings.NewReplacer("{message}", statusUpdate.StatusMessage, "{training_id}", jm.TrainingID,
+		"{job_name}", jm.JobName).Replace(template)
+	return &localized, locale
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// the period the log line budget of a training applies to
+const logBudgetWindow = time.Hour
+
+// how often a training over its budget gets a summary of the lines suppressed
+const logBudgetSummaryInterval = time.Minute
+
+type trainingLogBudget struct {
+	windowStart time.Time
+	lines       int
+	suppressed  int
+	lastSummary time.Time
+}
+
+//budgetFormatter ... caps the Info and Debug lines written per training per hour. Beyond the budget lines are
+//dropped and replaced by a periodic summary of how many were, which protects the log pipeline of the cluster during
+//incident storms. Warnings and errors are always written
+type budgetFormatter struct {
+	inner   log.Formatter
+	budget  int
+	mu      sync.Mutex
+	budgets map[string]*trainingLogBudget
+}
+
+var logBudgetOnce sync.Once
+
+//installLogBudget puts the log line budget in front of the formatter of the standard logger, once per process
+func installLogBudget() {
+	logBudgetOnce.Do(func() {
+		budget := viper.GetInt(logBudgetKey)
+		if budget <= 0 {
+			return
+		}
+		standard := log.StandardLogger()
+		standard.Formatter = &budgetFormatter{inner: standard.Formatter, budget: budget, budgets: make(map[string]*trainingLogBudget)}
+	})
+}
+
+func (f *budgetFormatter) Format(entry *log.Entry) ([]byte, error) {
+	trainingID, _ := entry.Data[logger.LogkeyTrainingID].(string)
+	if entry.Level <= log.WarnLevel || trainingID == "" {
+		return f.inner.Format(entry)
+	}
+
+	f.mu.Lock()
+	now := time.Now()
+	b, ok := f.budgets[trainingID]
+	if !ok {
+		b = &trainingLogBudget{windowStart: now}
+		f.budgets[trainingID] = b
+	}
+	summary := ""
+	if now.Sub(b.windowStart) >= logBudgetWindow {
+		if b.suppressed > 0 {
+			summary = fmt.Sprintf("suppressed %d routine log lines for training %s, the log budget of %d lines per %v was exceeded", b.suppressed, trainingID, f.budget, logBudgetWindow)
+		}
+		*b = trainingLogBudget{windowStart: now}
+		f.forgetIdle(now)
+	}
+	write := b.lines < f.budget
+	if write {
+		b.lines++
+	} else {
+		b.suppressed++
+		if now.Sub(b.lastSummary) >= logBudgetSummaryInterval {
+			summary = fmt.Sprintf("suppressed %d routine log lines for training %s, the log budget of %d lines per %v is exceeded", b.suppressed, trainingID, f.budget, logBudgetWindow)
+			b.suppressed = 0
+			b.lastSummary = now
+		}
+	}
+	f.mu.Unlock()
+
+	var out []byte
+	if summary != "" {
+		summaryEntry := &log.Entry{Logger: entry.Logger, Data: entry.Data, Time: entry.Time, Level: log.WarnLevel, Message: summary}
+		line, err := f.inner.Format(summaryEntry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, line...)
+	}
+	if write {
+		line, err := f.inner.Format(entry)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, line...)
+	}
+	return out, nil
+}
+
+//forgetIdle drops the budgets of trainings which did not log for a whole window, f.mu has to be held
+func (f *budgetFormatter) forgetIdle(now time.Time) {
+	for trainingID, b := range f.budgets {
+		if now.Sub(b.windowStart) >= 2*logBudgetWindow {
+			delete(f.budgets, trainingID)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	log "github.com/sirupsen/logrus"
+)
+
+// the fields every log line of the job monitor carries, on top of the training and user id
+const (
+	logkeyComponent = "component"
+	logkeyLearner   = "learner"
+)
+
+// the components of the job monitor, as logged in the component field
+const (
+	componentJobMonitor  = "jobmonitor"
+	componentStatus      = "status"
+	componentPods        = "pods"
+	componentTeardown    = "teardown"
+	componentAudit       = "audit"
+	componentAPI         = "api"
+	componentDiagnostics = "diagnostics"
+)
+
+//componentLogger ... the logger of a component of the job monitor of jm, every line carries the training id, user id
+//and component. It is derived from logr, so the fields of the caller stay on the lines, e.g. the trace context. Code
+//logging on behalf of no caller, like the API handlers, passes nil
+func (jm *JobMonitor) componentLogger(logr *logger.LocLoggingEntry, component string) *logger.LocLoggingEntry {
+	return jm.jobLogger(logr, log.Fields{logkeyComponent: component})
+}
+
+//learnerLogger ... the logger of a component handling a single learner, its lines carry the learner as well
+func (jm *JobMonitor) learnerLogger(logr *logger.LocLoggingEntry, component string, learner int) *logger.LocLoggingEntry {
+	return jm.jobLogger(logr, log.Fields{logkeyComponent: component, logkeyLearner: learner})
+}
+
+func (jm *JobMonitor) jobLogger(logr *logger.LocLoggingEntry, fields log.Fields) *logger.LocLoggingEntry {
+	if logr == nil || logr.Logger == nil {
+		return logger.LocLogger(jobLogEntry(jm.TrainingID, jm.UserID).WithFields(fields))
+	}
+	fields[logger.LogkeyTrainingID] = jm.TrainingID
+	fields[logger.LogkeyUserID] = jm.UserID
+	return logr.WithFields(fields)
+}
+
+//contextFormatter ... fills in the context fields a log line is missing, so that log based alerting can rely on them
+//even for lines logged without a component logger, e.g. by the libraries the job monitor uses
+type contextFormatter struct {
+	inner log.Formatter
+	// the training and user id of the first job monitor of the process, unless it monitors many jobs
+	defaults log.Fields
+}
+
+var logContext struct {
+	once      sync.Once
+	formatter *contextFormatter
+}
+
+//installLogContext puts the context fields in front of the formatter of the standard logger, once per process. Only
+//a job monitor process installs it, a process embedding the job monitor keeps its own log context. An empty training
+//or user id, as in controller mode, is no default: a line of no job in particular shouldn't claim an empty one
+func installLogContext(trainingID string, userID string) {
+	logContext.once.Do(func() {
+		standard := log.StandardLogger()
+		logContext.formatter = &contextFormatter{inner: standard.Formatter, defaults: logContextDefaults(trainingID, userID)}
+		standard.Formatter = logContext.formatter
+	})
+}
+
+func logContextDefaults(trainingID string, userID string) log.Fields {
+	defaults := log.Fields{logkeyComponent: componentJobMonitor}
+	if trainingID != "" {
+		defaults[logger.LogkeyTrainingID] = trainingID
+	}
+	if userID != "" {
+		defaults[logger.LogkeyUserID] = userID
+	}
+	return defaults
+}
+
+func (f *contextFormatter) Format(entry *log.Entry) ([]byte, error) {
+	missing := false
+	for key := range f.defaults {
+		if _, ok := entry.Data[key]; !ok {
+			missing = true
+			break
+		}
+	}
+	if !missing {
+		return f.inner.Format(entry)
+	}
+
+	data := make(log.Fields, len(entry.Data)+len(f.defaults))
+	for key, value := range f.defaults {
+		data[key] = value
+	}
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	filled := *entry
+	filled.Data = data
+	return f.inner.Format(&filled)
+}
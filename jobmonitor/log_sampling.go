@@ -0,0 +1,69 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+//logSampler ... decides which routine log lines get written. Lines which are not written are counted, and the count
+//is reported with the next line that is, so the volume of the updates stays visible
+type logSampler struct {
+	rate       float64
+	suppressed uint64
+	mu         sync.Mutex
+	random     *rand.Rand
+}
+
+func newLogSampler(rate float64) *logSampler {
+	return &logSampler{rate: rate, random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+//sample returns whether to write the next line, and if so how many lines were dropped since the last written one
+func (s *logSampler) sample() (bool, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rate < 1 && s.random.Float64() >= s.rate {
+		s.suppressed++
+		return false, 0
+	}
+	suppressed := s.suppressed
+	s.suppressed = 0
+	return true, suppressed
+}
+
+//logRoutineUpdate logs a routine learner update at Info, subject to sampling. Transitions and errors must not be
+//logged through here, they are always written
+func (jm *JobMonitor) logRoutineUpdate(logr *logger.LocLoggingEntry, format string, args ...interface{}) {
+	if jm.updateLogs == nil {
+		logr.Infof(format, args...)
+		return
+	}
+	write, suppressed := jm.updateLogs.sample()
+	if !write {
+		return
+	}
+	if suppressed > 0 {
+		logr.Infof("%s (%d similar updates not logged)", fmt.Sprintf(format, args...), suppressed)
+		return
+	}
+	logr.Infof(format, args...)
+}
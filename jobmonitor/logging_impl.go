@@ -24,6 +24,12 @@ import (
 
 //InitLogger ... initializes new logger with trainingID and userID
 func InitLogger(trainingID string, userID string) *log.Entry {
+	installLogBudget()
+	installLogContext(trainingID, userID)
+	return jobLogEntry(trainingID, userID)
+}
+
+func jobLogEntry(trainingID string, userID string) *log.Entry {
 	data := logger.NewDlaaSLogData(logger.LogkeyLcmService)
 	data[logger.LogkeyTrainingID] = trainingID
 	data[logger.LogkeyUserID] = userID
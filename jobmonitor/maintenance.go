@@ -0,0 +1,168 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/AISphere/ffdl-trainer/client"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// etcd key (shared by all jobs) operators can declare maintenance windows in, in addition to the config
+const maintenancePath = "jobmonitor/maintenance"
+
+// how long the maintenance windows read from etcd are used before they are read again
+const maintenanceRefreshInterval = time.Minute
+
+//maintenanceWindow ... a planned maintenance (e.g. an etcd or trainer upgrade), declared as start/end in RFC 3339,
+//for example 2018-06-01T02:00:00Z/2018-06-01T04:00:00Z
+type maintenanceWindow struct {
+	start, end time.Time
+}
+
+func (w maintenanceWindow) String() string {
+	return w.start.Format(time.RFC3339) + "/" + w.end.Format(time.RFC3339)
+}
+
+func parseMaintenanceWindow(value string) (maintenanceWindow, error) {
+	times := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	if len(times) != 2 {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window %s is not of the form start/end", value)
+	}
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(times[0]))
+	if err != nil {
+		return maintenanceWindow{}, err
+	}
+	end, err := time.Parse(time.RFC3339, strings.TrimSpace(times[1]))
+	if err != nil {
+		return maintenanceWindow{}, err
+	}
+	if !end.After(start) {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window %s ends before it starts", value)
+	}
+	return maintenanceWindow{start: start, end: end}, nil
+}
+
+func parseMaintenanceWindows(values []string) []maintenanceWindow {
+	var windows []maintenanceWindow
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		window, err := parseMaintenanceWindow(value)
+		if err != nil {
+			log.WithError(err).Warnf("ignoring maintenance window %s", value)
+			continue
+		}
+		windows = append(windows, window)
+	}
+	return windows
+}
+
+// the maintenance windows last read from etcd, process wide
+var (
+	etcdMaintenanceWindows []maintenanceWindow
+	etcdMaintenanceRead    time.Time
+	etcdMaintenanceMu      sync.Mutex
+)
+
+//refreshMaintenanceWindows reads the maintenance windows declared in etcd, unless they were read recently. The value
+//of the key holds one window per line
+func refreshMaintenanceWindows(coordinator coord.Coordinator, logr *logger.LocLoggingEntry) {
+	etcdMaintenanceMu.Lock()
+	defer etcdMaintenanceMu.Unlock()
+	if coordinator == nil || time.Since(etcdMaintenanceRead) < maintenanceRefreshInterval {
+		return
+	}
+	response, err := coordinator.Get(maintenancePath, logr)
+	if err != nil {
+		// keep the windows we know of, etcd being unreachable might just be the maintenance
+		logr.WithError(err).Debugf("failed to read the maintenance windows from etcd")
+		return
+	}
+	etcdMaintenanceRead = time.Now()
+	etcdMaintenanceWindows = nil
+	if len(response) > 0 {
+		etcdMaintenanceWindows = parseMaintenanceWindows(strings.Split(response[0].Value, "\n"))
+	}
+}
+
+//activeMaintenanceWindow returns the maintenance window, from the config or etcd, the given time falls into
+func activeMaintenanceWindow(at time.Time) (maintenanceWindow, bool) {
+	etcdMaintenanceMu.Lock()
+	windows := append(parseMaintenanceWindows(viper.GetStringSlice(maintenanceWindowsKey)), etcdMaintenanceWindows...)
+	etcdMaintenanceMu.Unlock()
+	for _, window := range windows {
+		if !at.Before(window.start) && at.Before(window.end) {
+			return window, true
+		}
+	}
+	return maintenanceWindow{}, false
+}
+
+//inMaintenance tells whether a maintenance window is going on right now
+func (jm *JobMonitor) inMaintenance(logr *logger.LocLoggingEntry) (maintenanceWindow, bool) {
+	refreshMaintenanceWindows(jm.EtcdClient, logr)
+	return activeMaintenanceWindow(jm.timeSource().Now())
+}
+
+//the error codes of transient connectivity errors, which during a maintenance window are expected and not the fault of
+//the platform
+var connectivityErrorCodes = map[string]bool{
+	client.ErrCodeEtcdConnection: true,
+	client.ErrCodeK8SConnection:  true,
+}
+
+//waitOutMaintenance retries connect for as long as a maintenance window is going on, so that jobs starting during a
+//planned upgrade are not failed for not getting a connection. It returns the last error of connect
+func waitOutMaintenance(clock Clock, what string, connect func() error, logr *logger.LocLoggingEntry) error {
+	err := connect()
+	for err != nil {
+		window, ok := activeMaintenanceWindow(clock.Now())
+		if !ok {
+			return err
+		}
+		logr.WithError(err).Warnf("failed to connect to %s during the maintenance window %s, retrying", what, window)
+		clock.Sleep(30 * time.Second)
+		err = connect()
+	}
+	return nil
+}
+
+//deferDuringMaintenance holds back a non critical action until the ongoing maintenance window, if any, is over
+func (jm *JobMonitor) deferDuringMaintenance(action string, logr *logger.LocLoggingEntry) {
+	for {
+		window, ok := jm.inMaintenance(logr)
+		if !ok {
+			return
+		}
+		logr.Infof("deferring %s of %s until the maintenance window %s is over", action, jm.TrainingID, window)
+		wait := window.end.Sub(jm.timeSource().Now())
+		if wait > maintenanceRefreshInterval {
+			// the window might get cut short
+			wait = maintenanceRefreshInterval
+		}
+		jm.timeSource().Sleep(wait)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+const zkStartedAt = "started_at"
+
+// error code of jobs which got halted for running longer than their maximum runtime
+const errCodeMaxRuntime = "MAX_RUNTIME_EXCEEDED"
+
+// how often a job with a maximum runtime is checked for having exceeded it
+const maxRuntimeCheckInterval = time.Minute
+
+//when the job started running, i.e. first got past PENDING, it is written once per attempt
+func startedAtPath(trainingID string) string {
+	return trainingID + "/" + zkStartedAt
+}
+
+//jobStartTime tells when the job started running. The first job monitor to see the job past PENDING records the time,
+//so that the runtime of a job doesn't start over when its job monitor is restarted. ok is false while the job is
+//still waiting to be scheduled
+func (jm *JobMonitor) jobStartTime(logr *logger.LocLoggingEntry) (started time.Time, ok bool) {
+	value, found, err := jm.quorumGet(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil || !found {
+		return time.Time{}, false
+	}
+	if isWaitingStatus(parseStatus(value, logr).Status) {
+		return time.Time{}, false
+	}
+	now := jm.timeSource().Now().UTC().Format(time.RFC3339Nano)
+	if _, err := jm.EtcdClient.PutIfKeyMissing(startedAtPath(jm.TrainingID), now, logr); err != nil {
+		return time.Time{}, false
+	}
+	response, err := jm.EtcdClient.Get(startedAtPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return time.Time{}, false
+	}
+	if started, err = time.Parse(time.RFC3339Nano, response[0].Value); err != nil {
+		logr.WithError(err).Warnf("(jobStartTime) invalid start time %q of %s", response[0].Value, jm.TrainingID)
+		return time.Time{}, false
+	}
+	return started, true
+}
+
+//enforceMaxRuntime halts the job with errCodeMaxRuntime once it ran for longer than jobmonitor.job.max_runtime, which
+//jobs may set for themselves. Jobs hanging forever would otherwise keep their GPUs. It does nothing for jobs without a
+//maximum runtime
+func (jm *JobMonitor) enforceMaxRuntime(logr *logger.LocLoggingEntry) {
+	maxRuntime := jm.configDuration(maxRuntimeKey)
+	if maxRuntime <= 0 {
+		return
+	}
+	var started time.Time
+	for {
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if started.IsZero() {
+			started, _ = jm.jobStartTime(logr)
+		}
+		if !started.IsZero() {
+			if runtime := jm.timeSource().Now().Sub(started); runtime >= maxRuntime {
+				jm.haltOnMaxRuntime(maxRuntime, runtime, logr)
+				return
+			}
+		}
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(maxRuntimeCheckInterval):
+		}
+	}
+}
+
+func (jm *JobMonitor) haltOnMaxRuntime(maxRuntime time.Duration, runtime time.Duration, logr *logger.LocLoggingEntry) {
+	message := fmt.Sprintf("the job was halted after running for %v, longer than its maximum runtime of %v", runtime-runtime%time.Second, maxRuntime)
+	logr.Warnf("(enforceMaxRuntime) %s: %s", jm.TrainingID, message)
+	jm.metrics.maxRuntimeExceededCounter.Add(1)
+	jm.sendFinalStatus(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_HALTED, Timestamp: client.CurrentTimestampAsString(),
+		ErrorCode: errCodeMaxRuntime, StatusMessage: message}, []ReasonCode{ReasonMaxRuntime}, logr)
+	jm.killDeployedJob(logr)
+}
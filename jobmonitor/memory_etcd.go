@@ -0,0 +1,422 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/coreos/etcd/clientv3"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+//memoryEtcd is an etcd kept in memory, for benchmarks that measure the job monitor and not etcd. It serves the calls the
+//job monitor makes: gets, puts and deletes of keys and ranges, transactions comparing versions, revisions and values,
+//and watches which can be resumed from a revision. Leases, compaction and historical reads are not supported, and what
+//connects to etcd by itself, like the outcome deliveries of the process, doesn't see it
+type memoryEtcd struct {
+	mu       sync.Mutex
+	revision int64
+	kvs      map[string]*mvccpb.KeyValue
+	// every event since the start, so watches can be resumed from any revision
+	events  []*clientv3.Event
+	watches map[*memoryWatch]bool
+}
+
+func newMemoryEtcd() *memoryEtcd {
+	return &memoryEtcd{kvs: make(map[string]*mvccpb.KeyValue), watches: make(map[*memoryWatch]bool)}
+}
+
+//client returns an etcd client served by the store. Closing it ends its own watches only
+func (m *memoryEtcd) client() *etcdClient {
+	cli := clientv3.NewCtxClient(context.Background())
+	cli.KV = m
+	cli.Watcher = &memoryWatcher{etcd: m, watches: make(map[*memoryWatch]bool)}
+	cli.Lease = memoryLease{}
+	return &etcdClient{Client: cli}
+}
+
+//coordinator returns a coordinator served by the store
+func (m *memoryEtcd) coordinator() coord.Coordinator {
+	return kvCoordinator{kv: m}
+}
+
+func (m *memoryEtcd) header() *pb.ResponseHeader {
+	return &pb.ResponseHeader{Revision: m.revision}
+}
+
+//inRange tells whether key is in the range of op: the key itself, or [key, end) for a range, without an upper bound if
+//end is "\x00"
+func inRange(key []byte, op clientv3.Op) bool {
+	end := op.RangeBytes()
+	if len(end) == 0 {
+		return bytes.Equal(key, op.KeyBytes())
+	}
+	if bytes.Compare(key, op.KeyBytes()) < 0 {
+		return false
+	}
+	return (len(end) == 1 && end[0] == 0) || bytes.Compare(key, end) < 0
+}
+
+func (m *memoryEtcd) get(op clientv3.Op) *pb.RangeResponse {
+	resp := &pb.RangeResponse{Header: m.header()}
+	for key, kv := range m.kvs {
+		if !inRange([]byte(key), op) {
+			continue
+		}
+		resp.Count++
+		if op.IsCountOnly() {
+			continue
+		}
+		found := *kv
+		if op.IsKeysOnly() {
+			found.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, &found)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool { return bytes.Compare(resp.Kvs[i].Key, resp.Kvs[j].Key) < 0 })
+	return resp
+}
+
+func (m *memoryEtcd) put(op clientv3.Op) *pb.PutResponse {
+	m.revision++
+	key := string(op.KeyBytes())
+	kv := &mvccpb.KeyValue{Key: op.KeyBytes(), Value: op.ValueBytes(), CreateRevision: m.revision, ModRevision: m.revision, Version: 1}
+	if prev, ok := m.kvs[key]; ok {
+		kv.CreateRevision, kv.Version = prev.CreateRevision, prev.Version+1
+	}
+	m.kvs[key] = kv
+	m.publish(&clientv3.Event{Type: mvccpb.PUT, Kv: kv})
+	return &pb.PutResponse{Header: m.header()}
+}
+
+func (m *memoryEtcd) delete(op clientv3.Op) *pb.DeleteRangeResponse {
+	var deleted []string
+	for key := range m.kvs {
+		if inRange([]byte(key), op) {
+			deleted = append(deleted, key)
+		}
+	}
+	if len(deleted) == 0 {
+		return &pb.DeleteRangeResponse{Header: m.header()}
+	}
+	sort.Strings(deleted)
+	m.revision++
+	for _, key := range deleted {
+		delete(m.kvs, key)
+		m.publish(&clientv3.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: m.revision}})
+	}
+	return &pb.DeleteRangeResponse{Header: m.header(), Deleted: int64(len(deleted))}
+}
+
+//compare evaluates a comparison of a transaction against the current value of its key. A missing key has version,
+//revisions and value 0
+func (m *memoryEtcd) compare(cmp clientv3.Cmp) bool {
+	kv, ok := m.kvs[string(cmp.Key)]
+	if !ok {
+		kv = &mvccpb.KeyValue{}
+	}
+	var result int
+	switch target := cmp.TargetUnion.(type) {
+	case *pb.Compare_Version:
+		result = compareInt64(kv.Version, target.Version)
+	case *pb.Compare_CreateRevision:
+		result = compareInt64(kv.CreateRevision, target.CreateRevision)
+	case *pb.Compare_ModRevision:
+		result = compareInt64(kv.ModRevision, target.ModRevision)
+	case *pb.Compare_Value:
+		if !ok {
+			return false
+		}
+		result = bytes.Compare(kv.Value, target.Value)
+	default:
+		return false
+	}
+	switch cmp.Result {
+	case pb.Compare_EQUAL:
+		return result == 0
+	case pb.Compare_NOT_EQUAL:
+		return result != 0
+	case pb.Compare_GREATER:
+		return result > 0
+	case pb.Compare_LESS:
+		return result < 0
+	}
+	return false
+}
+
+func compareInt64(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+//do runs op, holding the lock
+func (m *memoryEtcd) do(op clientv3.Op) (*pb.ResponseOp, error) {
+	switch {
+	case op.IsGet():
+		if op.Rev() > 0 {
+			return nil, fmt.Errorf("the in-memory etcd can't read at a revision")
+		}
+		return &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: m.get(op)}}, nil
+	case op.IsPut():
+		return &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: m.put(op)}}, nil
+	case op.IsDelete():
+		return &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: m.delete(op)}}, nil
+	case op.IsTxn():
+		cmps, thenOps, elseOps := op.Txn()
+		resp, err := m.txn(cmps, thenOps, elseOps)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.ResponseOp{Response: &pb.ResponseOp_ResponseTxn{ResponseTxn: resp}}, nil
+	}
+	return nil, fmt.Errorf("the in-memory etcd can't run the operation")
+}
+
+func (m *memoryEtcd) txn(cmps []clientv3.Cmp, thenOps []clientv3.Op, elseOps []clientv3.Op) (*pb.TxnResponse, error) {
+	resp := &pb.TxnResponse{Succeeded: true}
+	for _, cmp := range cmps {
+		if !m.compare(cmp) {
+			resp.Succeeded = false
+			break
+		}
+	}
+	ops := thenOps
+	if !resp.Succeeded {
+		ops = elseOps
+	}
+	for _, op := range ops {
+		opResp, err := m.do(op)
+		if err != nil {
+			return nil, err
+		}
+		resp.Responses = append(resp.Responses, opResp)
+	}
+	resp.Header = m.header()
+	return resp, nil
+}
+
+//Put ... see clientv3.KV
+func (m *memoryEtcd) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpPut(key, val, opts...))
+	return resp.Put(), err
+}
+
+//Get ... see clientv3.KV
+func (m *memoryEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpGet(key, opts...))
+	return resp.Get(), err
+}
+
+//Delete ... see clientv3.KV
+func (m *memoryEtcd) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := m.Do(ctx, clientv3.OpDelete(key, opts...))
+	return resp.Del(), err
+}
+
+//Compact ... see clientv3.KV, the in-memory etcd keeps every revision
+func (m *memoryEtcd) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return nil, fmt.Errorf("the in-memory etcd can't be compacted")
+}
+
+//Do ... see clientv3.KV
+func (m *memoryEtcd) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return clientv3.OpResponse{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	resp, err := m.do(op)
+	if err != nil {
+		return clientv3.OpResponse{}, err
+	}
+	return opResponse(resp), nil
+}
+
+//opResponse returns resp as the client sees it
+func opResponse(resp *pb.ResponseOp) clientv3.OpResponse {
+	switch r := resp.Response.(type) {
+	case *pb.ResponseOp_ResponseRange:
+		return (*clientv3.GetResponse)(r.ResponseRange).OpResponse()
+	case *pb.ResponseOp_ResponsePut:
+		return (*clientv3.PutResponse)(r.ResponsePut).OpResponse()
+	case *pb.ResponseOp_ResponseDeleteRange:
+		return (*clientv3.DeleteResponse)(r.ResponseDeleteRange).OpResponse()
+	default:
+		return (*clientv3.TxnResponse)(resp.GetResponseTxn()).OpResponse()
+	}
+}
+
+//Txn ... see clientv3.KV
+func (m *memoryEtcd) Txn(ctx context.Context) clientv3.Txn {
+	return &opTxn{kv: m, ctx: ctx}
+}
+
+//opTxn ... a transaction committed as a single operation of kv
+type opTxn struct {
+	kv               clientv3.KV
+	ctx              context.Context
+	cmps             []clientv3.Cmp
+	thenOps, elseOps []clientv3.Op
+}
+
+func (t *opTxn) If(cmps ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cmps...)
+	return t
+}
+
+func (t *opTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+func (t *opTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+func (t *opTxn) Commit() (*clientv3.TxnResponse, error) {
+	resp, err := t.kv.Do(t.ctx, clientv3.OpTxn(t.cmps, t.thenOps, t.elseOps))
+	return resp.Txn(), err
+}
+
+//publish hands the event to the watches it is in the range of, holding the lock
+func (m *memoryEtcd) publish(ev *clientv3.Event) {
+	m.events = append(m.events, ev)
+	for w := range m.watches {
+		if inRange(ev.Kv.Key, w.op) {
+			w.queue(ev)
+		}
+	}
+}
+
+//memoryWatcher ... the watches of a client of the in-memory etcd
+type memoryWatcher struct {
+	etcd    *memoryEtcd
+	mu      sync.Mutex
+	watches map[*memoryWatch]bool
+}
+
+type memoryWatch struct {
+	op      clientv3.Op
+	mu      sync.Mutex
+	pending []*clientv3.Event
+	// signalled when events are pending
+	ready  chan struct{}
+	cancel context.CancelFunc
+}
+
+func (w *memoryWatch) queue(events ...*clientv3.Event) {
+	w.mu.Lock()
+	w.pending = append(w.pending, events...)
+	w.mu.Unlock()
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+//Watch ... see clientv3.Watcher. The watch starts at the revision given with clientv3.WithRev, or after the current one
+func (w *memoryWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ctx, cancel := context.WithCancel(ctx)
+	watch := &memoryWatch{op: clientv3.OpGet(key, opts...), ready: make(chan struct{}, 1), cancel: cancel}
+	w.mu.Lock()
+	w.watches[watch] = true
+	w.mu.Unlock()
+
+	m := w.etcd
+	m.mu.Lock()
+	if rev := watch.op.Rev(); rev > 0 {
+		for _, ev := range m.events {
+			if ev.Kv.ModRevision >= rev && inRange(ev.Kv.Key, watch.op) {
+				watch.queue(ev)
+			}
+		}
+	}
+	m.watches[watch] = true
+	m.mu.Unlock()
+
+	out := make(chan clientv3.WatchResponse)
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			delete(m.watches, watch)
+			m.mu.Unlock()
+			w.mu.Lock()
+			delete(w.watches, watch)
+			w.mu.Unlock()
+			close(out)
+		}()
+		for {
+			var resp clientv3.WatchResponse
+			select {
+			case <-ctx.Done():
+				return
+			case <-watch.ready:
+				watch.mu.Lock()
+				resp.Events, watch.pending = watch.pending, nil
+				watch.mu.Unlock()
+				if len(resp.Events) == 0 {
+					// taken along with the events of an earlier signal
+					continue
+				}
+				resp.Header.Revision = resp.Events[len(resp.Events)-1].Kv.ModRevision
+			case <-time.After(etcdProgressNotificationInterval):
+				// like etcd, tell an idle watch how far it is
+				m.mu.Lock()
+				resp.Header.Revision = m.revision
+				m.mu.Unlock()
+			}
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+//Close ... see clientv3.Watcher, ends the watches of the client
+func (w *memoryWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for watch := range w.watches {
+		watch.cancel()
+	}
+	return nil
+}
+
+//memoryLease ... leases aren't supported by the in-memory etcd, it only needs closing
+type memoryLease struct {
+	clientv3.Lease
+}
+
+func (memoryLease) Close() error {
+	return nil
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/spf13/viper"
+)
+
+const zkSummaryMetrics = "summary_metrics"
+
+// grpc metadata key carrying the training metrics aggregated across the learners, see forwardSummaryMetrics
+const trainingMetricsHeader = "training-metrics"
+
+// how the values of a forwarded metric are aggregated across the learners
+const (
+	aggregateMean = "mean"
+	aggregateMin  = "min"
+	aggregateMax  = "max"
+)
+
+//forwardedMetric ... a summary metric forwarded to the trainer, configured as <metric>[:<aggregation>], e.g.
+//values.loss or iteration:min. It is forwarded under the last field of the metric, e.g. loss
+type forwardedMetric struct {
+	metric      string
+	name        string
+	aggregation string
+}
+
+func parseForwardedMetrics(specs []string) ([]forwardedMetric, error) {
+	metrics := make([]forwardedMetric, 0, len(specs))
+	for _, spec := range specs {
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+		m := forwardedMetric{metric: parts[0], aggregation: aggregateMean}
+		m.name = m.metric[strings.LastIndex(m.metric, ".")+1:]
+		if len(parts) == 2 {
+			m.aggregation = parts[1]
+		}
+		if m.name == "" {
+			return nil, fmt.Errorf("invalid metric %q", spec)
+		}
+		if m.aggregation != aggregateMean && m.aggregation != aggregateMin && m.aggregation != aggregateMax {
+			return nil, fmt.Errorf("unknown aggregation %q of metric %q", m.aggregation, m.metric)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+//learnerSummaries ... the latest summary metrics of each learner, whether they changed since they were forwarded, and
+//the aggregated metrics last forwarded, which go along with every further update of the trainer
+type learnerSummaries struct {
+	mu         sync.Mutex
+	latest     map[int]string
+	changed    bool
+	aggregated string
+}
+
+//record remembers the latest summary of the learner, it returns false if the learner reported the same one before
+func (s *learnerSummaries) record(learner int, summary string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latest == nil {
+		s.latest = make(map[int]string)
+	}
+	if previous, seen := s.latest[learner]; seen && previous == summary {
+		return false
+	}
+	s.latest[learner] = summary
+	s.changed = true
+	return true
+}
+
+//forget drops the summary of a learner an elastic job let go, so that it leaves the aggregates
+func (s *learnerSummaries) forget(learner int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, seen := s.latest[learner]; seen {
+		delete(s.latest, learner)
+		s.changed = true
+	}
+}
+
+//takeChanged returns a copy of the summaries if they changed since the last call
+func (s *learnerSummaries) takeChanged() (map[int]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.changed {
+		return nil, false
+	}
+	s.changed = false
+	summaries := make(map[int]string, len(s.latest))
+	for learner, summary := range s.latest {
+		summaries[learner] = summary
+	}
+	return summaries, true
+}
+
+func (s *learnerSummaries) setAggregated(aggregated string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.aggregated = aggregated
+}
+
+func (s *learnerSummaries) lastAggregated() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aggregated
+}
+
+//aggregateSummaryMetrics aggregates the metrics across the summaries of the learners, leaving out the metrics no
+//learner reports. learners_reporting counts the learners which report any of them
+func aggregateSummaryMetrics(summaries map[int]string, metrics []forwardedMetric) map[string]float64 {
+	aggregated := make(map[string]float64)
+	reporting := make(map[int]bool)
+	for _, m := range metrics {
+		var values []float64
+		for learner, summary := range summaries {
+			if value, ok := summaryMetric(summary, m.metric); ok {
+				values = append(values, value)
+				reporting[learner] = true
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		result := values[0]
+		switch m.aggregation {
+		case aggregateMin:
+			for _, v := range values {
+				result = math.Min(result, v)
+			}
+		case aggregateMax:
+			for _, v := range values {
+				result = math.Max(result, v)
+			}
+		default:
+			sum := 0.0
+			for _, v := range values {
+				sum += v
+			}
+			result = sum / float64(len(values))
+		}
+		aggregated[m.name] = result
+	}
+	if len(aggregated) > 0 {
+		aggregated["learners_reporting"] = float64(len(reporting))
+	}
+	return aggregated
+}
+
+//learnerOfSummaryMetricsKey returns the learner a summary metrics key belongs to, see learnerSummaryMetricsPath
+func learnerOfSummaryMetricsKey(trainingID string, key string) (int, bool) {
+	rest := strings.TrimPrefix(key, learnersPath(trainingID)+zkLearner)
+	if rest == key || !strings.HasSuffix(rest, "/"+zkSummaryMetrics) {
+		return 0, false
+	}
+	learner, err := strconv.Atoi(strings.TrimSuffix(rest, "/"+zkSummaryMetrics))
+	return learner, err == nil
+}
+
+//watchSummaryMetrics watches the summary metrics the learners write, checks every new summary against the early
+//stopping rules of the job, see checkEarlyStopping, and forwards them to the trainer, see forwardSummaryMetrics
+func (jm *JobMonitor) watchSummaryMetrics(logr *logger.LocLoggingEntry) {
+	if jm.isBatchScoring() {
+		return
+	}
+	interval := viper.GetDuration(metricsForwardIntervalKey)
+	metrics, err := parseForwardedMetrics(viper.GetStringSlice(metricsForwardNamesKey))
+	if err != nil {
+		logr.WithError(err).Errorf("(watchSummaryMetrics) invalid %s, the metrics of %s are not forwarded", metricsForwardNamesKey, jm.TrainingID)
+		interval = 0
+	}
+	rules, err := parseEarlyStoppingRules(jm.configString(earlyStoppingRulesKey))
+	if err != nil {
+		logr.WithError(err).Errorf("(watchSummaryMetrics) invalid %s, %s is not stopped early", earlyStoppingRulesKey, jm.TrainingID)
+		rules = nil
+	}
+	if interval <= 0 && len(rules) == 0 {
+		return
+	}
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(watchSummaryMetrics) could not connect to etcd, the summary metrics of %s are not watched", jm.TrainingID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	resp, err := etcd.Get(ctx, learnersPath(jm.TrainingID), clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("(watchSummaryMetrics) could not read etcd, the summary metrics of %s are not watched", jm.TrainingID)
+		return
+	}
+	for _, learner := range jm.learnerNumbers() {
+		if response, err := jm.EtcdClient.Get(learnerSummaryMetricsPath(jm.TrainingID, learner), logr); err == nil && len(response) > 0 {
+			if jm.summaries.record(learner, response[0].Value) {
+				jm.checkEarlyStopping(rules, learner, response[0].Value, logr)
+			}
+		}
+	}
+
+	ctx, cancel = context.WithCancel(jm.context())
+	defer cancel()
+	go jm.keepWatching(ctx, "learner-summary-metrics", learnersPath(jm.TrainingID), true, resp.Header.Revision+1, 0, func(ev *clientv3.Event) {
+		if ev.Type != mvccpb.PUT {
+			return
+		}
+		if learner, ok := learnerOfSummaryMetricsKey(jm.TrainingID, string(ev.Kv.Key)); ok && jm.monitorsLearner(learner) && jm.summaries.record(learner, string(ev.Kv.Value)) {
+			jm.checkEarlyStopping(rules, learner, string(ev.Kv.Value), logr)
+		}
+	}, logr)
+
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := jm.timeSource().NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		jm.forwardSummaryMetrics(metrics, logr)
+	}
+}
+
+//forwardSummaryMetrics sends the trainer an update with the current status of the job and the metrics configured in
+//jobmonitor.metrics.forward.names, aggregated across the learners, if they changed since the last one, so that its
+//users see the job progress live. The UpdateRequest of the trainer has no field for metrics, they travel as JSON in the
+//trainingMetricsHeader of the update: a trainer which doesn't read that header only sees the status sent again
+func (jm *JobMonitor) forwardSummaryMetrics(metrics []forwardedMetric, logr *logger.LocLoggingEntry) {
+	if !jm.leading() {
+		return
+	}
+	summaries, changed := jm.summaries.takeChanged()
+	if !changed {
+		return
+	}
+	aggregated := aggregateSummaryMetrics(summaries, metrics)
+	if len(aggregated) == 0 {
+		return
+	}
+	value, _ := json.Marshal(aggregated)
+	response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return
+	}
+	update := parseStatus(response[0].Value, logr)
+	if isTerminalStatus(update.Status) {
+		return
+	}
+	// the status is the one the job has, but the update is sent now
+	update.Timestamp = client.CurrentTimestampAsString()
+	jm.summaries.setAggregated(string(value))
+	if err := jm.updateStatusInTrainer(update, []ReasonCode{ReasonTrainingMetrics}, logr); err != nil && err != errStaleUpdate {
+		logr.WithError(err).Debugf("(forwardSummaryMetrics) failed to forward the metrics of %s", jm.TrainingID)
+	}
+}
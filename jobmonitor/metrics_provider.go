@@ -0,0 +1,123 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"strings"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/statsd"
+)
+
+//MetricsProvider ... creates the metrics of the job monitor, so that it can be embedded in services which use another
+//metrics backend than statsd. Names are dot separated (jobmonitor.job.failed), histograms observe milliseconds
+type MetricsProvider interface {
+	NewCounter(name string) metrics.Counter
+	NewGauge(name string) metrics.Gauge
+	NewHistogram(name string) metrics.Histogram
+}
+
+//StatsdMetrics ... a MetricsProvider sending the metrics through statsdClient. statsd has no labels, so the labels given
+//to With() are appended to the name as key.value pairs, e.g. jobmonitor.job.failed.framework.tensorflow
+func StatsdMetrics(statsdClient *statsd.Statsd) MetricsProvider {
+	return statsdMetrics{statsdClient}
+}
+
+//NoopMetrics ... a MetricsProvider discarding all metrics
+func NoopMetrics() MetricsProvider {
+	return noopMetrics{}
+}
+
+type statsdMetrics struct {
+	client *statsd.Statsd
+}
+
+func (m statsdMetrics) NewCounter(name string) metrics.Counter {
+	return statsdCounter{m.client.NewCounter(name, 1), m.client, name}
+}
+
+func (m statsdMetrics) NewGauge(name string) metrics.Gauge {
+	return statsdGauge{m.client.NewGauge(name), m.client, name}
+}
+
+func (m statsdMetrics) NewHistogram(name string) metrics.Histogram {
+	return statsdHistogram{m.client.NewTiming(name, 1), m.client, name}
+}
+
+//the With() of the go-kit statsd metrics ignores the labels, these create the metric of the labeled name instead
+type statsdCounter struct {
+	metrics.Counter
+	client *statsd.Statsd
+	name   string
+}
+
+func (c statsdCounter) With(labelValues ...string) metrics.Counter {
+	return statsdMetrics{c.client}.NewCounter(labeledName(c.name, labelValues))
+}
+
+type statsdGauge struct {
+	metrics.Gauge
+	client *statsd.Statsd
+	name   string
+}
+
+func (g statsdGauge) With(labelValues ...string) metrics.Gauge {
+	return statsdMetrics{g.client}.NewGauge(labeledName(g.name, labelValues))
+}
+
+type statsdHistogram struct {
+	metrics.Histogram
+	client *statsd.Statsd
+	name   string
+}
+
+func (h statsdHistogram) With(labelValues ...string) metrics.Histogram {
+	return statsdMetrics{h.client}.NewHistogram(labeledName(h.name, labelValues))
+}
+
+//labeledName appends the labels to the name of a statsd metric, a key without value gets "unknown" like go-kit does.
+//Anything but letters, digits, - and _ is replaced by _, so that a label value can't add levels to the name
+func labeledName(name string, labelValues []string) string {
+	if len(labelValues)%2 != 0 {
+		labelValues = append(append([]string(nil), labelValues...), "unknown")
+	}
+	parts := []string{name}
+	for _, part := range labelValues {
+		parts = append(parts, strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+				return r
+			}
+			return '_'
+		}, part))
+	}
+	return strings.Join(parts, ".")
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) NewCounter(name string) metrics.Counter     { return discard.NewCounter() }
+func (noopMetrics) NewGauge(name string) metrics.Gauge         { return discard.NewGauge() }
+func (noopMetrics) NewHistogram(name string) metrics.Histogram { return discard.NewHistogram() }
+
+//metricsOrNoop returns provider, or one discarding the metrics if there is none
+func metricsOrNoop(provider MetricsProvider) MetricsProvider {
+	if provider == nil {
+		return NoopMetrics()
+	}
+	return provider
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/spf13/viper"
+)
+
+// transports of the metrics of the job monitor
+const (
+	// statsd over UDP, through the metrics pusher of ffdl-commons
+	MetricsTransportStatsd = "statsd"
+	// push to a Prometheus Pushgateway over HTTP
+	MetricsTransportPushgateway = "pushgateway"
+	// POST the statsd lines to an HTTP collector
+	MetricsTransportHTTP = "http"
+)
+
+//MetricsTransport ... the configured transport of the metrics, for clusters where UDP egress is blocked it is one of
+//the HTTP based ones
+func MetricsTransport() string {
+	return viper.GetString(metricsTransportKey)
+}
+
+//StartHTTPMetricsPusher ... pushes the metrics collected by statsdClient to the configured HTTP endpoint every interval
+func StartHTTPMetricsPusher(statsdClient *statsd.Statsd, interval time.Duration, logr *logger.LocLoggingEntry) {
+	url := viper.GetString(metricsURLKey)
+	if url == "" {
+		logr.Errorf("metrics transport %s needs %s to be set, metrics are not pushed", MetricsTransport(), metricsURLKey)
+		return
+	}
+	client, err := httpClient()
+	if err != nil {
+		logr.WithError(err).Errorf("invalid TLS config for the metrics transport, metrics are not pushed")
+		return
+	}
+	pusher := &httpMetricsPusher{
+		transport: MetricsTransport(),
+		url:       url,
+		client:    client,
+		counters:  make(map[string]float64),
+		gauges:    make(map[string]float64),
+		timings:   make(map[string]*timingTotals),
+	}
+	if pusher.transport == MetricsTransportPushgateway {
+		instance, _ := os.Hostname()
+		pusher.url = fmt.Sprintf("%s/metrics/job/jobmonitor/instance/%s", strings.TrimSuffix(url, "/"), instance)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := pusher.push(statsdClient); err != nil {
+				logr.WithError(err).Warnf("failed to push the metrics to %s", pusher.url)
+			}
+		}
+	}()
+}
+
+type timingTotals struct {
+	count, sum float64
+}
+
+//httpMetricsPusher ... a Pushgateway keeps the last pushed value, while statsd only sends what happened since the
+//last flush, so counters and timings are accumulated here
+type httpMetricsPusher struct {
+	transport string
+	url       string
+	client    *http.Client
+	counters  map[string]float64
+	gauges    map[string]float64
+	timings   map[string]*timingTotals
+}
+
+func (p *httpMetricsPusher) push(statsdClient *statsd.Statsd) error {
+	var lines bytes.Buffer
+	if _, err := statsdClient.WriteTo(&lines); err != nil {
+		return err
+	}
+
+	var req *http.Request
+	var err error
+	if p.transport == MetricsTransportPushgateway {
+		p.accumulate(lines.String())
+		req, err = http.NewRequest(http.MethodPut, p.url, strings.NewReader(p.exposition()))
+		if err == nil {
+			req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		}
+	} else {
+		if lines.Len() == 0 {
+			return nil
+		}
+		req, err = http.NewRequest(http.MethodPost, p.url, &lines)
+		if err == nil {
+			req.Header.Set("Content-Type", "text/plain")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("metrics endpoint %s answered with %s", p.url, resp.Status)
+	}
+	return nil
+}
+
+//accumulate adds statsd lines (name:value|type[|@rate]) to the totals
+func (p *httpMetricsPusher) accumulate(lines string) {
+	scanner := bufio.NewScanner(strings.NewReader(lines))
+	for scanner.Scan() {
+		nameValue := strings.SplitN(scanner.Text(), ":", 2)
+		if len(nameValue) != 2 {
+			continue
+		}
+		fields := strings.Split(nameValue[1], "|")
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			continue
+		}
+		name := prometheusName(nameValue[0])
+		switch fields[1] {
+		case "c":
+			p.counters[name] += value
+		case "g":
+			p.gauges[name] = value
+		case "ms":
+			totals, ok := p.timings[name]
+			if !ok {
+				totals = &timingTotals{}
+				p.timings[name] = totals
+			}
+			totals.count++
+			totals.sum += value
+		}
+	}
+}
+
+//exposition renders the totals in the Prometheus text format
+func (p *httpMetricsPusher) exposition() string {
+	var out bytes.Buffer
+	for _, name := range sortedKeys(p.counters) {
+		fmt.Fprintf(&out, "# TYPE %s counter\n%s %g\n", name, name, p.counters[name])
+	}
+	for _, name := range sortedKeys(p.gauges) {
+		fmt.Fprintf(&out, "# TYPE %s gauge\n%s %g\n", name, name, p.gauges[name])
+	}
+	names := make([]string, 0, len(p.timings))
+	for name := range p.timings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&out, "# TYPE %s_milliseconds summary\n%s_milliseconds_count %g\n%s_milliseconds_sum %g\n",
+			name, name, p.timings[name].count, name, p.timings[name].sum)
+	}
+	return out.String()
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//prometheusName turns a statsd metric name like jobmonitor.etcd.watch.failed into jobmonitor_etcd_watch_failed
+func prometheusName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/statsd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushgatewayExpositionAccumulates(t *testing.T) {
+	p := &httpMetricsPusher{counters: make(map[string]float64), gauges: make(map[string]float64), timings: make(map[string]*timingTotals)}
+
+	p.accumulate("jobmonitor.job.failed:1.000000|c\njobmonitor.etcd.watch.silence_seconds:12.000000|g\njobmonitor.job.duration:1500.000000|ms\n")
+	p.accumulate("jobmonitor.job.failed:2.000000|c\njobmonitor.etcd.watch.silence_seconds:3.000000|g\njobmonitor.job.duration:500.000000|ms|@0.500000\nbogus\n")
+
+	assert.Equal(t, "# TYPE jobmonitor_job_failed counter\njobmonitor_job_failed 3\n"+
+		"# TYPE jobmonitor_etcd_watch_silence_seconds gauge\njobmonitor_etcd_watch_silence_seconds 3\n"+
+		"# TYPE jobmonitor_job_duration_milliseconds summary\njobmonitor_job_duration_milliseconds_count 2\njobmonitor_job_duration_milliseconds_sum 2000\n",
+		p.exposition())
+}
+
+func TestStatsdLabelsInName(t *testing.T) {
+	client := statsd.New("", log.NewNopLogger())
+	provider := StatsdMetrics(client)
+	provider.NewCounter("jobmonitor.job.failed").With("team", "vision", "framework_version", "1.5.0").Add(1)
+	provider.NewGauge("jobmonitor.etcd.watch.silence_seconds").With("watch").Set(3)
+	provider.NewCounter("jobmonitor.job.completed").Add(1)
+
+	var lines bytes.Buffer
+	_, err := client.WriteTo(&lines)
+	assert.NoError(t, err)
+	assert.Contains(t, lines.String(), "jobmonitor.job.failed.team.vision.framework_version.1_5_0:1.000000|c\n")
+	assert.Contains(t, lines.String(), "jobmonitor.etcd.watch.silence_seconds.watch.unknown:3.000000|g\n")
+	assert.Contains(t, lines.String(), "jobmonitor.job.completed:1.000000|c\n")
+}
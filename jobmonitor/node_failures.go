@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+
+	v1core "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const errCodeNodeFailure = "NODE_FAILURE"
+
+// what happens to a job whose learner is on a failed node
+const (
+	nodeFailureFail       = "fail"
+	nodeFailureReschedule = "reschedule"
+)
+
+// the reason kubernetes gives the pods of a node which stopped reporting
+const nodeLostReason = "NodeLost"
+
+//nodeFailure ... a learner whose node died, stopped reporting or was removed from the cluster
+type nodeFailure struct {
+	learner int
+	pod     string
+	node    string
+	cause   string
+}
+
+func (f nodeFailure) statusMessage() string {
+	return fmt.Sprintf("learner %d lost its node %s: %s", f.learner, f.node, f.cause)
+}
+
+//nodeFailureOf tells why the node of a learner pod failed, if it did. node is nil if the node was removed from the
+//cluster. A node has to be NotReady for grace before it counts as failed, so that a kubelet restart doesn't take jobs down
+func nodeFailureOf(pod v1core.Pod, node *v1core.Node, now time.Time, grace time.Duration) (string, bool) {
+	if pod.Spec.NodeName == "" {
+		return "", false
+	}
+	if pod.Status.Reason == nodeLostReason || pod.Status.Phase == v1core.PodUnknown {
+		return "the node stopped reporting the state of the pod", true
+	}
+	if node == nil {
+		return "the node was removed from the cluster", true
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type != v1core.NodeReady || condition.Status == v1core.ConditionTrue {
+			continue
+		}
+		if notReady := now.Sub(condition.LastTransitionTime.Time); notReady >= grace {
+			return fmt.Sprintf("the node is NotReady for %v: %s", notReady-notReady%time.Second, condition.Message), true
+		}
+	}
+	return "", false
+}
+
+//findNodeFailures looks up the nodes of the learner pods and returns the learners on failed nodes. Nodes which can't
+//be looked up for other reasons than being gone are taken to be fine
+func (jm *JobMonitor) findNodeFailures(pods []v1core.Pod, logr *logger.LocLoggingEntry) []nodeFailure {
+	now := jm.timeSource().Now()
+	grace := viper.GetDuration(nodeFailureGraceKey)
+	nodes := make(map[string]*v1core.Node)
+	var failures []nodeFailure
+	for _, pod := range pods {
+		learner, ok := learnerOfPod(pod)
+		name := pod.Spec.NodeName
+		if !ok || name == "" {
+			continue
+		}
+		node, looked := nodes[name]
+		if !looked {
+			var err error
+			if node, err = jm.k8sClient.Core().Nodes().Get(name, metav1.GetOptions{}); err != nil {
+				if !k8serrors.IsNotFound(err) {
+					logr.WithError(err).Debugf("(findNodeFailures) failed to get the node %s", name)
+					continue
+				}
+				node = nil
+			}
+			nodes[name] = node
+		}
+		if cause, failed := nodeFailureOf(pod, node, now, grace); failed {
+			failures = append(failures, nodeFailure{learner: learner, pod: pod.ObjectMeta.Name, node: name, cause: cause})
+		}
+	}
+	return failures
+}
+
+//watchForNodeFailures checks the nodes of the learners every podCheckInterval. A learner on a dead node doesn't update its
+//status anymore, so without this check its job would hang. Depending on jobmonitor.nodes.failure.action the job is
+//either failed with errCodeNodeFailure, or the learner pod is force deleted so that its stateful set recreates it on a
+//healthy node, at most jobmonitor.nodes.failure.max_reschedules times per job
+func (jm *JobMonitor) watchForNodeFailures(logr *logger.LocLoggingEntry) {
+	if jm.k8sClient == nil {
+		return
+	}
+	// the pods deleted for a reschedule, by the node they were deleted from, so that a pod which takes a while to go away
+	// isn't rescheduled twice
+	rescheduled := make(map[string]string)
+	for {
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(podCheckInterval):
+		}
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		for _, failure := range jm.findNodeFailures(jm.learnerPods(logr), logr) {
+			if rescheduled[failure.pod] == failure.node {
+				continue
+			}
+			if jm.configString(nodeFailureActionKey) != nodeFailureReschedule || len(rescheduled) >= viper.GetInt(nodeFailureMaxReschedulesKey) {
+				jm.failOnNodeFailure(failure, logr)
+				return
+			}
+			if err := jm.rescheduleLearner(failure, logr); err != nil {
+				logr.WithError(err).Errorf("(watchForNodeFailures) failed to reschedule learner %d of %s, failing the job", failure.learner, jm.TrainingID)
+				jm.failOnNodeFailure(failure, logr)
+				return
+			}
+			rescheduled[failure.pod] = failure.node
+		}
+	}
+}
+
+//rescheduleLearner force deletes the pod of a learner on a failed node. Kubernetes keeps the pods of stateful sets on
+//unreachable nodes until they are deleted, as it can't tell whether they are still running
+func (jm *JobMonitor) rescheduleLearner(failure nodeFailure, logr *logger.LocLoggingEntry) error {
+	var immediately int64
+	err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).Delete(failure.pod, &metav1.DeleteOptions{GracePeriodSeconds: &immediately})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return err
+	}
+	logr.Warnf("(watchForNodeFailures) %s, deleted pod %s to have it rescheduled", failure.statusMessage(), failure.pod)
+	jm.metrics.rescheduledLearnerCounter.Add(1)
+	jm.audit(logr, auditNodeFailure, "%s, rescheduled", failure.statusMessage())
+	return nil
+}
+
+func (jm *JobMonitor) failOnNodeFailure(failure nodeFailure, logr *logger.LocLoggingEntry) {
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	logr.Errorf("(watchForNodeFailures) %s, failing job %s", failure.statusMessage(), jm.TrainingID)
+	jm.metrics.nodeFailedLearnerCounter.Add(1)
+	jm.sendFinalStatus(failedStatusUpdate(errCodeNodeFailure, failure.statusMessage()), []ReasonCode{ReasonNodeFailure}, logr)
+	jm.killDeployedJob(logr)
+}
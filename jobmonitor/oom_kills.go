@@ -0,0 +1,142 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const errCodeOOMKilled = "OOM_KILLED"
+
+// the termination reason kubernetes gives a container which exceeded its memory limit
+const oomKilledReason = "OOMKilled"
+
+// how close to the failure of the job a learner container has to have been OOMKilled before its last restart for the
+// OOM kill to be taken as the cause
+const oomKillMatchWindow = 1 * time.Minute
+
+//oomKill ... a learner container kubernetes killed for exceeding its memory limit
+type oomKill struct {
+	learner   int
+	pod       string
+	container string
+}
+
+func (k oomKill) statusMessage() string {
+	return fmt.Sprintf("learner %d exceeded memory limit (container %s of pod %s was OOMKilled)", k.learner, k.container, k.pod)
+}
+
+//findOOMKill looks for a learner container which is terminated as OOMKilled in the learner pods. One which was OOMKilled
+//before its last restart, and recovered from it, only counts if that was within oomKillMatchWindow of failedAt, when
+//the job failed. With a zero failedAt only the current states count
+func findOOMKill(pods []v1core.Pod, failedAt time.Time) (oomKill, bool) {
+	for _, pod := range pods {
+		learner, ok := learnerOfPod(pod)
+		if !ok {
+			continue
+		}
+		for _, containerStatus := range pod.Status.ContainerStatuses {
+			found := false
+			if current := containerStatus.State.Terminated; current != nil && current.Reason == oomKilledReason {
+				found = true
+			}
+			if last := containerStatus.LastTerminationState.Terminated; !failedAt.IsZero() && last != nil && last.Reason == oomKilledReason {
+				gap := failedAt.Sub(last.FinishedAt.Time)
+				found = found || (gap <= oomKillMatchWindow && gap >= -oomKillMatchWindow)
+			}
+			if found {
+				return oomKill{learner: learner, pod: pod.ObjectMeta.Name, container: containerStatus.Name}, true
+			}
+		}
+	}
+	return oomKill{}, false
+}
+
+//watchForOOMKills follows the container statuses of the learner pods, and fails the job with errCodeOOMKilled as soon as
+//a learner got OOMKilled. Such a learner can't tell the job monitor itself, and its job would otherwise only show a
+//generic failure, if any
+func (jm *JobMonitor) watchForOOMKills(logr *logger.LocLoggingEntry) {
+	if jm.k8sClient == nil {
+		return
+	}
+	selector := fmt.Sprintf("training_id==%s,service==%s", jm.TrainingID, learnerServiceLabel)
+	for jm.context().Err() == nil {
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if kill, found := findOOMKill(jm.learnerPods(logr), time.Time{}); found {
+			jm.failOnOOMKill(kill, logr)
+			return
+		}
+
+		podEvents, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).Watch(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			logr.WithError(err).Debugf("(watchForOOMKills) failed to watch the learner pods of %s, looking again in %v", jm.TrainingID, podCheckInterval)
+			select {
+			case <-jm.context().Done():
+			case <-jm.timeSource().After(podCheckInterval):
+			}
+			continue
+		}
+		found := jm.waitForOOMKill(podEvents.ResultChan(), logr)
+		podEvents.Stop()
+		if found {
+			return
+		}
+	}
+}
+
+//waitForOOMKill handles the pod events until one shows an OOMKilled learner, which fails the job, the job monitor
+//stops or the watch is closed. It tells whether an OOMKilled learner was found
+func (jm *JobMonitor) waitForOOMKill(events <-chan watch.Event, logr *logger.LocLoggingEntry) bool {
+	for {
+		select {
+		case <-jm.context().Done():
+			return false
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			pod, isPod := event.Object.(*v1core.Pod)
+			if !isPod {
+				continue
+			}
+			if kill, found := findOOMKill([]v1core.Pod{*pod}, time.Time{}); found {
+				jm.failOnOOMKill(kill, logr)
+				return true
+			}
+		}
+	}
+}
+
+func (jm *JobMonitor) failOnOOMKill(kill oomKill, logr *logger.LocLoggingEntry) {
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	logr.Errorf("(watchForOOMKills) %s, failing job %s", kill.statusMessage(), jm.TrainingID)
+	jm.metrics.oomKilledLearnerCounter.Add(1)
+	jm.sendFinalStatus(failedStatusUpdate(errCodeOOMKilled, kill.statusMessage()), []ReasonCode{ReasonOOMKilled}, logr)
+	jm.killDeployedJob(logr)
+}
@@ -0,0 +1,400 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/cenkalti/backoff"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/spf13/viper"
+)
+
+const zkOutcomeNotifications = "outcome_notifications"
+
+// states of the delivery of an outcome notification
+const (
+	outcomePending   = "pending"
+	outcomeDelivered = "delivered"
+	outcomeExpired   = "expired"
+)
+
+// header carrying <training id>/<attempt> with every outcome notification, it stays the same across the retries and
+// replays of a notification so that receivers can drop the duplicates
+const outcomeDeliveryHeader = "X-Outcome-Delivery"
+
+//OutcomeNotification ... what the outcome webhook is told about an attempt of a job which reached its final status
+type OutcomeNotification struct {
+	TrainingID    string `json:"training_id"`
+	UserID        string `json:"user_id"`
+	JobName       string `json:"job_name"`
+	Attempt       int    `json:"attempt"`
+	Status        string `json:"status"`
+	ErrorCode     string `json:"error_code,omitempty"`
+	StatusMessage string `json:"status_message,omitempty"`
+	Timestamp     string `json:"timestamp,omitempty"`
+}
+
+//OutcomeDelivery ... an outcome notification and how its delivery went. It is kept in etcd from the final status on, so
+//that the delivery survives restarts of the job monitor and can be looked up and replayed once the job is gone
+type OutcomeDelivery struct {
+	Notification OutcomeNotification `json:"notification"`
+	URL          string              `json:"url"`
+	State        string              `json:"state"`
+	Attempts     int                 `json:"attempts"`
+	LastError    string              `json:"last_error,omitempty"`
+	Created      time.Time           `json:"created"`
+	// the delivery is retried until then, and expires afterwards
+	Deadline  time.Time `json:"deadline"`
+	Delivered string    `json:"delivered,omitempty"`
+}
+
+func outcomeNotificationsPath(trainingID string) string {
+	return trainingID + "/" + zkOutcomeNotifications + "/"
+}
+
+func outcomeNotificationPath(trainingID string, attempt int) string {
+	return outcomeNotificationsPath(trainingID) + strconv.Itoa(attempt)
+}
+
+//recordOutcome persists the outcome notification of the final status in rec, if jobmonitor.outcome.webhook.url is set
+//for the job, and delivers it. The first attempt is made right away since the kill following the final status takes
+//the job monitor down, the retries go on in the background for as long as the process lives, see outcomeDeliveries.
+//Notifications which are pending when it goes away are delivered by the next job monitor of the job, or by
+//ReplayOutcome
+func (jm *JobMonitor) recordOutcome(rec *teardownRecord, logr *logger.LocLoggingEntry) {
+	url := jm.configString(outcomeWebhookURLKey)
+	if url == "" {
+		return
+	}
+	now := time.Now().UTC()
+	delivery := &OutcomeDelivery{
+		Notification: OutcomeNotification{TrainingID: jm.TrainingID, UserID: jm.UserID, JobName: jm.JobName, Attempt: jm.Attempt(),
+			Status: rec.Status, ErrorCode: rec.ErrorCode, StatusMessage: rec.StatusMessage, Timestamp: rec.Timestamp},
+		URL:      expandJobURL(url, jm),
+		State:    outcomePending,
+		Created:  now,
+		Deadline: now.Add(viper.GetDuration(outcomeWebhookHorizonKey)),
+	}
+	value, _ := json.Marshal(delivery)
+	key := outcomeNotificationPath(jm.TrainingID, jm.Attempt())
+	if _, err := jm.EtcdClient.PutIfKeyMissing(key, string(value), logr); err != nil {
+		logr.WithError(err).Errorf("(recordOutcome) failed to persist the outcome notification of %s, it is not delivered", jm.TrainingID)
+		return
+	}
+	if etcd, err := jm.watchClient(logr); err == nil {
+		if done, _ := attemptOutcomeDelivery(etcd, key, logr); done {
+			return
+		}
+	}
+	jm.deliverPendingOutcomes(logr)
+}
+
+//deliverPendingOutcomes hands the pending outcome notifications of the job to outcomeDeliveries
+func (jm *JobMonitor) deliverPendingOutcomes(logr *logger.LocLoggingEntry) {
+	jm.etcdMu.Lock()
+	etcd := jm.etcd
+	jm.etcdMu.Unlock()
+	if etcd != nil && !etcd.shared {
+		// closed once the job monitor stops
+		etcd = nil
+	}
+	outcomeDeliveries.deliver(jm.etcdConfig, etcd, jm.TrainingID, logr)
+}
+
+//outcomeDeliverer retries the delivery of the pending outcome notifications of the jobs monitored by this process. The
+//job monitor of a job stops, and closes its etcd clients, once the workload of the job is gone, which is mostly before
+//the webhook took the notification. So the deliveries don't go by the job monitor but by the process, with etcd
+//clients of their own unless the job monitor shares the client of a Controller, and end when the notifications are
+//delivered or expire
+type outcomeDeliverer struct {
+	mu         sync.Mutex
+	delivering map[string]bool
+}
+
+var outcomeDeliveries = &outcomeDeliverer{delivering: make(map[string]bool)}
+
+//deliver retries the pending outcome notifications of the training in the background, unless that is going on already.
+//They go through shared if given, otherwise through a client connected from etcdConfig
+func (d *outcomeDeliverer) deliver(etcdConfig coord.Config, shared *etcdClient, trainingID string, logr *logger.LocLoggingEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.delivering[trainingID] {
+		return
+	}
+	d.delivering[trainingID] = true
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.delivering, trainingID)
+			d.mu.Unlock()
+		}()
+		etcd := shared
+		if etcd == nil {
+			var err error
+			if etcd, err = newEtcdClient(etcdConfig, logr); err != nil {
+				logr.WithError(err).Warnf("(deliverPendingOutcomes) could not connect to etcd, the outcome notifications of %s stay pending", trainingID)
+				return
+			}
+			defer etcd.Close()
+		}
+		deliveries, err := loadOutcomeDeliveries(etcd, trainingID)
+		if err != nil {
+			logr.WithError(err).Warnf("(deliverPendingOutcomes) failed to read the outcome notifications of %s", trainingID)
+			return
+		}
+		for _, delivery := range deliveries {
+			if delivery.State != outcomePending {
+				continue
+			}
+			key := outcomeNotificationPath(trainingID, delivery.Notification.Attempt)
+			if err := deliverOutcome(context.Background(), etcd, key, logr); err != nil {
+				logr.WithError(err).Warnf("(deliverPendingOutcomes) stopped delivering the outcome notification %s", key)
+			}
+		}
+	}()
+}
+
+//deliverOutcome retries the delivery of the notification at key with exponential backoff until it is no longer
+//pending, or ctx is done
+func deliverOutcome(ctx context.Context, etcd *etcdClient, key string, logr *logger.LocLoggingEntry) error {
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.MaxElapsedTime = 0 // the deadline of the delivery ends the retries
+	retryBackoff.MaxInterval = 5 * time.Minute
+	return backoff.RetryNotify(func() error {
+		_, err := attemptOutcomeDelivery(etcd, key, logr)
+		return err
+	}, backoff.WithContext(retryBackoff, ctx), func(err error, t time.Duration) {
+		logr.WithError(err).Warnf("(deliverOutcome) outcome notification %s not delivered yet, retrying in %v", key, t)
+	})
+}
+
+//attemptOutcomeDelivery posts the notification at key once, unless it is no longer pending, and records how that
+//went. done tells whether the delivery is over, delivered or expired. Receivers see a notification at least once: if
+//recording the result fails after the post went through, it is posted again
+func attemptOutcomeDelivery(etcd *etcdClient, key string, logr *logger.LocLoggingEntry) (done bool, err error) {
+	delivery, revision, err := loadOutcomeDelivery(etcd, key)
+	if err != nil {
+		return false, err
+	}
+	if delivery == nil || delivery.State != outcomePending {
+		return true, nil
+	}
+	if time.Now().After(delivery.Deadline) {
+		delivery.State = outcomeExpired
+		logr.Errorf("(attemptOutcomeDelivery) giving up on the outcome notification %s after %d attempts: %s", key, delivery.Attempts, delivery.LastError)
+		return true, storeOutcomeDelivery(etcd, key, delivery, revision)
+	}
+
+	postErr := postOutcome(delivery)
+	delivery.Attempts++
+	if postErr != nil {
+		delivery.LastError = postErr.Error()
+	} else {
+		delivery.State, delivery.LastError = outcomeDelivered, ""
+		delivery.Delivered = time.Now().UTC().Format(time.RFC3339)
+		logr.Infof("(attemptOutcomeDelivery) delivered the outcome notification %s to %s", key, delivery.URL)
+	}
+	if err := storeOutcomeDelivery(etcd, key, delivery, revision); err != nil {
+		return false, err
+	}
+	return postErr == nil, postErr
+}
+
+func postOutcome(delivery *OutcomeDelivery) error {
+	body, err := json.Marshal(delivery.Notification)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(outcomeDeliveryHeader, fmt.Sprintf("%s/%d", delivery.Notification.TrainingID, delivery.Notification.Attempt))
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		reason, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("rejected by %s (%s): %s", delivery.URL, resp.Status, strings.TrimSpace(string(reason)))
+	}
+	return nil
+}
+
+//loadOutcomeDelivery reads the notification at key along with its revision, it returns nil if there is none
+func loadOutcomeDelivery(etcd *etcdClient, key string) (*OutcomeDelivery, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	resp, err := etcd.Get(ctx, key)
+	if err != nil || len(resp.Kvs) == 0 {
+		return nil, 0, err
+	}
+	delivery := &OutcomeDelivery{}
+	if err := json.Unmarshal(resp.Kvs[0].Value, delivery); err != nil {
+		return nil, 0, fmt.Errorf("invalid outcome notification %s: %v", key, err)
+	}
+	return delivery, resp.Kvs[0].ModRevision, nil
+}
+
+//storeOutcomeDelivery writes the notification back, unless somebody else (another replica, a replay) changed it since
+//it was read at revision
+func storeOutcomeDelivery(etcd *etcdClient, key string, delivery *OutcomeDelivery, revision int64) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	txn, err := etcd.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).Then(clientv3.OpPut(key, string(value))).Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("outcome notification %s changed concurrently", key)
+	}
+	return nil
+}
+
+//loadOutcomeDeliveries reads the outcome notifications of all the attempts of a job, ordered by attempt
+func loadOutcomeDeliveries(etcd *etcdClient, trainingID string) ([]OutcomeDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	resp, err := etcd.Get(ctx, outcomeNotificationsPath(trainingID), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]OutcomeDelivery, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		var delivery OutcomeDelivery
+		if err := json.Unmarshal(kv.Value, &delivery); err != nil {
+			return nil, fmt.Errorf("invalid outcome notification %s: %v", kv.Key, err)
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Notification.Attempt < deliveries[j].Notification.Attempt })
+	return deliveries, nil
+}
+
+//OutcomeDeliveries ... the outcome notifications of the attempts of a training and how their delivery went, also for
+//trainings which are no longer monitored
+func OutcomeDeliveries(trainingID string, logr *logger.LocLoggingEntry) ([]OutcomeDelivery, error) {
+	etcd, err := newEtcdClient(defaultCoordinatorConfig(), logr)
+	if err != nil {
+		return nil, err
+	}
+	defer etcd.Close()
+	return loadOutcomeDeliveries(etcd, trainingID)
+}
+
+//ReplayOutcome ... delivers the outcome notification of an attempt of a training again, the latest attempt if attempt
+//is 0, whether its delivery expired or went through already. It is retried for another
+//jobmonitor.outcome.webhook.horizon, or until ctx is done
+func ReplayOutcome(ctx context.Context, trainingID string, attempt int, logr *logger.LocLoggingEntry) error {
+	etcd, err := newEtcdClient(defaultCoordinatorConfig(), logr)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+	if attempt == 0 {
+		deliveries, err := loadOutcomeDeliveries(etcd, trainingID)
+		if err != nil {
+			return err
+		}
+		if len(deliveries) == 0 {
+			return fmt.Errorf("training %s has no outcome notification", trainingID)
+		}
+		attempt = deliveries[len(deliveries)-1].Notification.Attempt
+	}
+
+	key := outcomeNotificationPath(trainingID, attempt)
+	delivery, revision, err := loadOutcomeDelivery(etcd, key)
+	if err != nil {
+		return err
+	}
+	if delivery == nil {
+		return fmt.Errorf("attempt %d of training %s has no outcome notification", attempt, trainingID)
+	}
+	logr.Infof("replaying the outcome notification %s, it was %s after %d attempts", key, delivery.State, delivery.Attempts)
+	delivery.State = outcomePending
+	delivery.Deadline = time.Now().UTC().Add(viper.GetDuration(outcomeWebhookHorizonKey))
+	if err := storeOutcomeDelivery(etcd, key, delivery, revision); err != nil {
+		return err
+	}
+	if err := deliverOutcome(ctx, etcd, key, logr); err != nil {
+		return err
+	}
+	if delivery, _, err = loadOutcomeDelivery(etcd, key); err != nil || delivery == nil {
+		return err
+	}
+	if delivery.State != outcomeDelivered {
+		return fmt.Errorf("outcome notification %s %s: %s", key, delivery.State, delivery.LastError)
+	}
+	return nil
+}
+
+//OutcomeDeliveryHandler ... serves OutcomeDeliveries as JSON, GET /jobs/<training id>/outcome
+func OutcomeDeliveryHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "use GET", http.StatusMethodNotAllowed)
+			return
+		}
+		trainingID := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")[0]
+		var deliveries []OutcomeDelivery
+		var err error
+		monitoredJobsMu.RLock()
+		jm, ok := monitoredJobs[trainingID]
+		monitoredJobsMu.RUnlock()
+		if ok {
+			var etcd *etcdClient
+			if etcd, err = jm.watchClient(jm.componentLogger(nil, componentAPI)); err == nil {
+				deliveries, err = loadOutcomeDeliveries(etcd, trainingID)
+			}
+		} else {
+			deliveries, err = OutcomeDeliveries(trainingID, logger.LocLogger(jobLogEntry(trainingID, "").WithField(logkeyComponent, componentAPI)))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if len(deliveries) == 0 {
+			http.Error(w, fmt.Sprintf("training %s has no outcome notification", trainingID), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+	})
+}
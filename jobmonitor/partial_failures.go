@@ -0,0 +1,141 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+// the values of jobmonitor.learners.failure_policy
+const (
+	// one failed learner fails the job, and the first completed learner completes it
+	failurePolicyGang = "gang"
+	// the job completes once jobmonitor.learners.min_completed of its learners completed, and fails only once too
+	// many of them failed for that to happen
+	failurePolicyTolerant = "tolerant"
+)
+
+//parseMinCompleted reads the number of learners out of learners which have to complete, either a number (e.g. 3) or
+//a percentage of the learners (e.g. 75%), rounded up. It is between 1 and learners
+func parseMinCompleted(value string, learners int) (int, error) {
+	value = strings.TrimSpace(value)
+	var required int
+	if percent := strings.TrimSuffix(value, "%"); percent != value {
+		p, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid percentage of learners %q", value)
+		}
+		required = int(p * float64(learners) / 100)
+		if float64(required)*100 < p*float64(learners) {
+			required++
+		}
+	} else {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid number of learners %q", value)
+		}
+		required = n
+	}
+	if required > learners {
+		required = learners
+	}
+	if required < 1 {
+		required = 1
+	}
+	return required, nil
+}
+
+//tolerant tells whether the job tolerates failed learners, and how many of its learners have to complete then
+func (jm *JobMonitor) tolerant(logr *logger.LocLoggingEntry) (int, bool) {
+	if jm.configString(learnerFailurePolicyKey) != failurePolicyTolerant {
+		return 0, false
+	}
+	required, err := parseMinCompleted(jm.configString(learnerMinCompletedKey), jm.learnerCount())
+	if err != nil {
+		logr.WithError(err).Warnf("%s of %s, all its learners have to complete", learnerMinCompletedKey, jm.TrainingID)
+		return jm.learnerCount(), true
+	}
+	return required, true
+}
+
+//learnersIn counts the learners other than the given one which are in status
+func (jm *JobMonitor) learnersIn(status grpc_trainer_v2.Status, except int) int {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	count := 0
+	for learner, s := range jm.learnerStatuses {
+		if learner != except && s == status {
+			count++
+		}
+	}
+	return count
+}
+
+//tolerateLearnerStatus keeps a terminal learner status of a job with the tolerant failure policy from deciding its
+//outcome: a failed learner as long as enough of the others can still complete, and a completed learner until enough of
+//them completed. The learner is counted as terminal either way. It returns false if the status decides the outcome of
+//the job as usual
+func (jm *JobMonitor) tolerateLearnerStatus(learner int, update *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) bool {
+	if update.Status != grpc_trainer_v2.Status_FAILED && update.Status != grpc_trainer_v2.Status_COMPLETED {
+		return false
+	}
+	required, tolerant := jm.tolerant(logr)
+	if !tolerant {
+		return false
+	}
+	if _, terminal := jm.terminalLatch(); terminal {
+		return false
+	}
+	learners := jm.learnerCount()
+	switch update.Status {
+	case grpc_trainer_v2.Status_FAILED:
+		failed := jm.learnersIn(grpc_trainer_v2.Status_FAILED, learner) + 1
+		if learners-failed < required {
+			logr.Warnf("(tolerateLearnerStatus) learner %d of %s failed, %d of its %d learners failed and %d have to complete, failing the job", learner, jm.TrainingID, failed, learners, required)
+			return false
+		}
+		logr.Warnf("(tolerateLearnerStatus) tolerating the failure of learner %d of %s, %d of its %d learners failed and %d have to complete", learner, jm.TrainingID, failed, learners, required)
+		jm.metrics.toleratedLearnerFailureCounter.Add(1)
+		jm.audit(logr, auditToleratedFailure, "learner %d failed, %d of %d learners failed with %d required to complete: %s", learner, failed, learners, required, update.StatusMessage)
+	case grpc_trainer_v2.Status_COMPLETED:
+		completed := jm.learnersIn(grpc_trainer_v2.Status_COMPLETED, learner) + 1
+		if completed >= required {
+			return false
+		}
+		logr.Infof("(tolerateLearnerStatus) learner %d of %s completed, %d of the %d required learners completed", learner, jm.TrainingID, completed, required)
+	}
+	jm.recordLearnerStatus(learner, update.Status)
+	jm.recordLearnerTimestamp(learner, update.Timestamp)
+	atomic.AddUint64(&jm.numTerminalLearners, 1)
+	return true
+}
+
+//toleratedFailures is the part of the status message of a completed job which tells about the learners that failed
+//along the way, empty if none did
+func (jm *JobMonitor) toleratedFailures() string {
+	if failed := jm.learnersIn(grpc_trainer_v2.Status_FAILED, 0); failed > 0 {
+		return fmt.Sprintf("%d of %d learners failed, tolerated", failed, jm.learnerCount())
+	}
+	return ""
+}
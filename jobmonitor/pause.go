@@ -0,0 +1,265 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	zkPauseRequest = "pause_request"
+	zkPaused       = "paused"
+)
+
+//a user pauses the job by writing the reason to this key, and resumes it by deleting the key again
+func pauseRequestPath(trainingID string) string {
+	return trainingID + "/" + zkPauseRequest
+}
+
+//what the job was like when it got paused, written once its learners are scaled to zero and removed on resume
+func pausedPath(trainingID string) string {
+	return trainingID + "/" + zkPaused
+}
+
+//pauseRecord ... the learner stateful set of a paused job and what it is scaled back to on resume
+type pauseRecord struct {
+	StatefulSet string `json:"stateful_set"`
+	Namespace   string `json:"namespace"`
+	Replicas    int32  `json:"replicas"`
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+	PausedAt    string `json:"paused_at"`
+}
+
+//learnerStatefulSet finds the stateful set which runs the learner pods
+func learnerStatefulSet(pods []v1core.Pod) (namespace string, name string, ok bool) {
+	for _, pod := range pods {
+		for _, owner := range pod.OwnerReferences {
+			if owner.Kind == "StatefulSet" {
+				return pod.Namespace, owner.Name, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+//paused tells whether the learners of the job are scaled to zero on request of its user. The checks which expect
+//learner pods to be around hold off while it is
+func (jm *JobMonitor) paused() bool {
+	return atomic.LoadInt32(&jm.pausedState) == 1
+}
+
+//watchPauseRequest pauses the job when its pause request key is set and resumes it when the key is deleted, see
+//pause and resume. The state of the keys when the job monitor comes up is acted on as well, so a restarted job
+//monitor picks up a pause or resume its predecessor didn't finish
+func (jm *JobMonitor) watchPauseRequest(logr *logger.LocLoggingEntry) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(watchPauseRequest) could not connect to etcd, pause requests of %s are not watched", jm.TrainingID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	requested, err := etcd.Get(ctx, pauseRequestPath(jm.TrainingID))
+	cancel()
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("(watchPauseRequest) could not read etcd, pause requests of %s are not watched", jm.TrainingID)
+		return
+	}
+	rec, err := jm.loadPauseRecord(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(watchPauseRequest) could not read whether %s is paused, pause requests are not watched", jm.TrainingID)
+		return
+	}
+	switch {
+	case len(requested.Kvs) > 0:
+		// with a pause record already there this finishes the pause, scaling to zero again doesn't hurt
+		jm.pause(string(requested.Kvs[0].Value), logr)
+	case rec != nil:
+		atomic.StoreInt32(&jm.pausedState, 1)
+		jm.resume(logr)
+	}
+
+	ctx, cancel = context.WithCancel(jm.context())
+	defer cancel()
+	jm.keepWatching(ctx, "pause-request", pauseRequestPath(jm.TrainingID), false, requested.Header.Revision+1, 0, func(ev *clientv3.Event) {
+		if ev.Type == mvccpb.DELETE {
+			jm.resume(logr)
+			return
+		}
+		jm.pause(string(ev.Kv.Value), logr)
+	}, logr)
+}
+
+func (jm *JobMonitor) loadPauseRecord(logr *logger.LocLoggingEntry) (*pauseRecord, error) {
+	response, err := jm.EtcdClient.Get(pausedPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return nil, err
+	}
+	rec := &pauseRecord{}
+	if err := json.Unmarshal([]byte(response[0].Value), rec); err != nil {
+		return nil, fmt.Errorf("invalid pause record %q of %s: %v", response[0].Value, jm.TrainingID, err)
+	}
+	return rec, nil
+}
+
+//pause records the current status of the job and the number of its learners, then scales the learner stateful set to
+//zero. The etcd state of the job, including the processed offsets, is left as it is for the job to continue from on
+//resume. A job which is terminal, or whose learner pods can't be found, isn't paused. When a pause record is there
+//already, of a job monitor which went away while pausing or after it, the pause is finished with it: the learners may
+//be scaled to zero already and get scaled back to the number recorded first. The job only counts as paused once its
+//learners were scaled to zero, if that fails the pause record is removed again, unless it was there already. The LCM
+//has no call to scale the learners of a job, only to kill or halt it, so the stateful set is scaled directly, the same
+//way learner restarts delete their pods
+func (jm *JobMonitor) pause(reason string, logr *logger.LocLoggingEntry) {
+	if _, terminal := jm.terminalLatch(); terminal || jm.paused() || !jm.leading() {
+		return
+	}
+	reason = strings.TrimSpace(reason)
+	rec, created, err := jm.recordPause(reason, logr)
+	if err != nil {
+		logr.WithError(err).Errorf("(pause) %s can't be paused", jm.TrainingID)
+		return
+	}
+	if err := jm.scaleLearners(rec.Namespace, rec.StatefulSet, 0); err != nil {
+		jm.metrics.failedK8sConnectivityCounter.Add(1)
+		logr.WithError(err).Errorf("(pause) failed to scale the learners of %s to zero, not pausing it", jm.TrainingID)
+		if !created {
+			return
+		}
+		if err := jm.removePauseRecord(logr); err != nil {
+			logr.WithError(err).Warnf("(pause) failed to remove the pause record of %s", jm.TrainingID)
+		}
+		return
+	}
+	atomic.StoreInt32(&jm.pausedState, 1)
+
+	message := "the job was paused"
+	if rec.Reason != "" {
+		message += ": " + rec.Reason
+	}
+	logr.Infof("(pause) paused %s at %s, scaled its %d learners to zero", jm.TrainingID, rec.Status, rec.Replicas)
+	jm.audit(logr, auditPause, "paused at %s with %d learners: %s", rec.Status, rec.Replicas, rec.Reason)
+	status, _ := statusByName(rec.Status)
+	jm.updateStatusInTrainer(&client.TrainingStatusUpdate{Status: status, Timestamp: client.CurrentTimestampAsString(),
+		StatusMessage: message}, []ReasonCode{ReasonPaused}, logr)
+}
+
+//recordPause returns the pause record of the job. Unless there is one already, it is written from the learner
+//stateful set, found through the learner pods, and the current status of the job; created tells whether it was
+func (jm *JobMonitor) recordPause(reason string, logr *logger.LocLoggingEntry) (rec *pauseRecord, created bool, err error) {
+	if rec, err = jm.loadPauseRecord(logr); err != nil || rec != nil {
+		return rec, false, err
+	}
+	namespace, name, ok := learnerStatefulSet(jm.learnerPods(logr))
+	if !ok {
+		return nil, false, fmt.Errorf("found no learner stateful set of %s", jm.TrainingID)
+	}
+	set, err := jm.k8sClient.AppsV1beta1().StatefulSets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		jm.metrics.failedK8sConnectivityCounter.Add(1)
+		return nil, false, fmt.Errorf("failed to get the learner stateful set %s: %v", name, err)
+	}
+	current, _, err := jm.authoritativeStatus(logr)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read the status: %v", err)
+	}
+	rec = &pauseRecord{StatefulSet: name, Namespace: namespace, Replicas: int32(jm.learnerCount()), Status: current.Status.String(),
+		Reason: reason, PausedAt: jm.timeSource().Now().UTC().Format(time.RFC3339)}
+	if set.Spec.Replicas != nil {
+		rec.Replicas = *set.Spec.Replicas
+	}
+	value, _ := json.Marshal(rec)
+	if created, err = jm.EtcdClient.PutIfKeyMissing(pausedPath(jm.TrainingID), string(value), logr); err != nil || created {
+		return rec, created, err
+	}
+	// written meanwhile by another pause
+	if rec, err = jm.loadPauseRecord(logr); err == nil && rec == nil {
+		err = fmt.Errorf("the pause record of %s went away", jm.TrainingID)
+	}
+	return rec, false, err
+}
+
+//resume scales the learners of a paused job back to the number they had, and resumes the checks which expect them to
+//be around. The learners get monitored from the offsets processed before the pause
+func (jm *JobMonitor) resume(logr *logger.LocLoggingEntry) {
+	if !jm.paused() || !jm.leading() {
+		return
+	}
+	rec, err := jm.loadPauseRecord(logr)
+	if err != nil || rec == nil {
+		logr.WithError(err).Errorf("(resume) failed to read how %s was paused, it can't be resumed", jm.TrainingID)
+		return
+	}
+	if err := jm.scaleLearners(rec.Namespace, rec.StatefulSet, rec.Replicas); err != nil {
+		jm.metrics.failedK8sConnectivityCounter.Add(1)
+		logr.WithError(err).Errorf("(resume) failed to scale the learners of %s back to %d", jm.TrainingID, rec.Replicas)
+		return
+	}
+	// the learners were gone on purpose, their missing heartbeats and the time they spent paused don't count
+	jm.heartbeats.mu.Lock()
+	jm.heartbeats.expired = nil
+	jm.heartbeats.mu.Unlock()
+	jm.learnerStatusMu.Lock()
+	jm.learnerPhases = nil
+	jm.learnerStatusMu.Unlock()
+	if err := jm.removePauseRecord(logr); err != nil {
+		logr.WithError(err).Warnf("(resume) failed to remove the pause record of %s", jm.TrainingID)
+	}
+	atomic.StoreInt32(&jm.pausedState, 0)
+
+	logr.Infof("(resume) resumed %s, paused at %s since %s, with %d learners", jm.TrainingID, rec.Status, rec.PausedAt, rec.Replicas)
+	jm.audit(logr, auditResume, "resumed with %d learners, paused since %s", rec.Replicas, rec.PausedAt)
+	status, _ := statusByName(rec.Status)
+	jm.updateStatusInTrainer(&client.TrainingStatusUpdate{Status: status, Timestamp: client.CurrentTimestampAsString(),
+		StatusMessage: "the job was resumed"}, []ReasonCode{ReasonResumed}, logr)
+}
+
+func (jm *JobMonitor) removePauseRecord(logr *logger.LocLoggingEntry) error {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	_, err = etcd.Delete(ctx, pausedPath(jm.TrainingID))
+	return err
+}
+
+//scaleLearners sets the number of replicas of the learner stateful set
+func (jm *JobMonitor) scaleLearners(namespace string, name string, replicas int32) error {
+	sets := jm.k8sClient.AppsV1beta1().StatefulSets(namespace)
+	set, err := sets.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	set.Spec.Replicas = &replicas
+	_, err = sets.Update(set)
+	return err
+}
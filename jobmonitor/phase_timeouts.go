@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+)
+
+// error code of jobs failed for a learner staying in a phase for longer than its timeout
+const errCodePhaseTimeout = "PHASE_TIMEOUT"
+
+// what happens once a learner exceeds the timeout of its phase: it is only reported (alert), or the job fails (fail)
+const (
+	phaseTimeoutAlert = "alert"
+	phaseTimeoutFail  = "fail"
+)
+
+// the phases of a learner which can be timed out, by the config key of their timeout
+var phaseTimeoutKeys = map[grpc_trainer_v2.Status]string{
+	grpc_trainer_v2.Status_DOWNLOADING: phaseTimeoutDownloadingKey,
+	grpc_trainer_v2.Status_PROCESSING:  phaseTimeoutProcessingKey,
+	grpc_trainer_v2.Status_STORING:     phaseTimeoutStoringKey,
+}
+
+//learnerPhase ... the status a learner is in, and since when
+type learnerPhase struct {
+	status grpc_trainer_v2.Status
+	since  time.Time
+}
+
+//recordLearnerPhase notes when the learner moved to status, going by the timestamp of the status it wrote, or the time
+//the status was seen if it has none. A status the learner is in already doesn't move the start of its phase
+func (jm *JobMonitor) recordLearnerPhase(learner int, status grpc_trainer_v2.Status, timestamp string) {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	if jm.learnerPhases == nil {
+		jm.learnerPhases = make(map[int]learnerPhase)
+	}
+	if phase, seen := jm.learnerPhases[learner]; seen && phase.status == status {
+		return
+	}
+	since, ok := parseStatusTimestamp(timestamp)
+	if !ok {
+		since = jm.timeSource().Now()
+	}
+	jm.learnerPhases[learner] = learnerPhase{status: status, since: since}
+}
+
+//phaseTimeout ... a learner which stayed in a phase for longer than its timeout
+type phaseTimeout struct {
+	learner int
+	phase   learnerPhase
+	timeout time.Duration
+}
+
+//stuckPhase ... the learner and the phase it is stuck in, whatever the start of that phase
+type stuckPhase struct {
+	learner int
+	status  grpc_trainer_v2.Status
+}
+
+func (p phaseTimeout) stuck() stuckPhase {
+	return stuckPhase{learner: p.learner, status: p.phase.status}
+}
+
+func (p phaseTimeout) statusMessage(now time.Time) string {
+	stuck := now.Sub(p.phase.since)
+	return fmt.Sprintf("learner %d is %s for %v, longer than the timeout of %v", p.learner, p.phase.status, stuck-stuck%time.Second, p.timeout)
+}
+
+//phaseTimeouts returns the learners which exceeded the timeout of their phase at now, in order
+func (jm *JobMonitor) phaseTimeouts(now time.Time) []phaseTimeout {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	var exceeded []phaseTimeout
+	for learner, phase := range jm.learnerPhases {
+		key, ok := phaseTimeoutKeys[phase.status]
+		if !ok {
+			continue
+		}
+		if timeout := jm.configDuration(key); timeout > 0 && now.Sub(phase.since) > timeout {
+			exceeded = append(exceeded, phaseTimeout{learner: learner, phase: phase, timeout: timeout})
+		}
+	}
+	sort.Slice(exceeded, func(i, j int) bool { return exceeded[i].learner < exceeded[j].learner })
+	return exceeded
+}
+
+//detectStuckPhases looks for learners stuck in DOWNLOADING, PROCESSING or STORING for longer than
+//jobmonitor.learners.phase_timeout.<phase>, e.g. a learner hanging on a dead data connection. Each learner exceeding the
+//timeout of a phase is counted and logged once; with jobmonitor.learners.phase_timeout.action set to fail, the job is
+//failed with errCodePhaseTimeout as well
+func (jm *JobMonitor) detectStuckPhases(logr *logger.LocLoggingEntry) {
+	configured := false
+	for _, key := range phaseTimeoutKeys {
+		configured = configured || jm.configDuration(key) > 0
+	}
+	if !configured {
+		return
+	}
+	reported := make(map[stuckPhase]bool)
+	ticker := jm.timeSource().NewTicker(jm.learnerPollInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-jm.context().Done():
+			return
+		case <-ticker.C():
+		}
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if jm.paused() {
+			continue
+		}
+		now := jm.timeSource().Now()
+		for _, exceeded := range jm.phaseTimeouts(now) {
+			if reported[exceeded.stuck()] {
+				continue
+			}
+			reported[exceeded.stuck()] = true
+			message := exceeded.statusMessage(now)
+			logr.Warnf("(detectStuckPhases) %s of %s", message, jm.TrainingID)
+			jm.metrics.phaseTimeoutCounter.Add(1)
+			if jm.configString(phaseTimeoutActionKey) == phaseTimeoutFail {
+				jm.sendFinalStatus(failedStatusUpdate(errCodePhaseTimeout, message), []ReasonCode{ReasonPhaseTimeout}, logr)
+				jm.killDeployedJob(logr)
+				return
+			}
+		}
+	}
+}
@@ -17,33 +17,88 @@
 package jobmonitor
 
 import (
+	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/AISphere/ffdl-commons/config"
 	"github.com/AISphere/ffdl-commons/logger"
 	"github.com/AISphere/ffdl-lcm/service"
+	"github.com/spf13/viper"
 
 	v1core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 
 	trainerClient "github.com/AISphere/ffdl-trainer/client"
 )
 
+// pod status reason set by the kubelet when it evicts a pod, e.g. because of node memory pressure
+const podReasonEvicted = "Evicted"
+
+// error code of jobs failed because their learners were evicted
+const errCodeEvicted = "EVICTED"
+
+// how often the pods of a starting job are looked at if none of them changes
+const podCheckInterval = 30 * time.Second
+
+//checkIfJobStarted follows the pods of the job until all of them run, failing the job if they don't get there in time
 func (jm *JobMonitor) checkIfJobStarted(logr *logger.LocLoggingEntry) {
 	selector := "training_id==" + jm.TrainingID
 	logr.Debugf("(Job Monitor checkIfJobStarted) Checking if there are kubernetes learner PODS associated with training job %s", jm.TrainingID)
 
-	for i := 1; i <= insuffResourcesRetries; i++ {
+	// evicted pods are rescheduled by kubernetes, so they get a retry budget of their own instead of failing the job
+	clock := jm.timeSource()
+	policy := insufficientResourcesPolicyFromConfig()
+	deadline := clock.Now().Add(policy.maxPending)
+	var pendingSince time.Time
+	evicted := make(map[string]bool)
+	evictionMessage := ""
+	auxiliary := configuredAuxiliaryServices()
+	imagePulls := make(imagePullFailures)
+
+	// the pods are looked at again as soon as one of them changes, and at the latest every podCheckInterval
+	var podEvents watch.Interface
+	defer atomic.StoreInt32(&jm.unschedulable, 0)
+	defer func() {
+		if podEvents != nil {
+			podEvents.Stop()
+		}
+	}()
+
+	for {
+		if podEvents == nil {
+			var err error
+			if podEvents, err = jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).Watch(metav1.ListOptions{LabelSelector: selector}); err != nil {
+				logr.WithError(err).Debugf("(Job Monitor checkIfJobStarted) failed to watch the pods of %s, checking them every %v", jm.TrainingID, podCheckInterval)
+				podEvents = nil
+			}
+		}
+		last := !clock.Now().Before(deadline)
 		pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
 
 		numPending := 0
+		schedulerMessage := ""
 		numRunning := 0
 		numFailed := 0
+		numEvicted := 0
 
-		numPodsExpected := jm.NumLearners + 2 //1 helper plus 1 job monitor
+		numPodsExpected := jm.learnerCount() + 2 //1 helper plus 1 job monitor
 
 		if err == nil {
+			jm.reportInitProgress(pods.Items, logr)
+			trainingPods := make([]v1core.Pod, 0, len(pods.Items))
+			for _, pod := range pods.Items {
+				if !isAuxiliaryPod(pod, jm.TrainingID, auxiliary) {
+					trainingPods = append(trainingPods, pod)
+				}
+			}
+			imagePulls.observe(trainingPods, clock.Now())
 			for _, pod := range pods.Items {
+				// the auxiliary services are looked after by monitorAuxiliaryServices
+				if isAuxiliaryPod(pod, jm.TrainingID, auxiliary) {
+					continue
+				}
 				switch pod.Status.Phase {
 				case v1core.PodRunning:
 					numRunning++
@@ -57,6 +112,7 @@ func (jm *JobMonitor) checkIfJobStarted(logr *logger.LocLoggingEntry) {
 						if condition.Type == v1core.PodScheduled && condition.Status == v1core.ConditionFalse {
 							logr.Debugf("Pending Pod Condition reason %s message %s", condition.Reason, condition.Message)
 							numPending++
+							schedulerMessage = condition.Message
 						}
 					}
 
@@ -75,6 +131,17 @@ func (jm *JobMonitor) checkIfJobStarted(logr *logger.LocLoggingEntry) {
 					}
 
 				case v1core.PodFailed:
+					if pod.Status.Reason == podReasonEvicted {
+						numEvicted++
+						if !evicted[pod.ObjectMeta.Name] {
+							evicted[pod.ObjectMeta.Name] = true
+							jm.metrics.evictedPodCounter.Add(1)
+							evictionMessage = fmt.Sprintf("pod %s was evicted from node %s: %s", pod.ObjectMeta.Name, pod.Spec.NodeName, pod.Status.Message)
+							logr.Warnf("(Job Monitor checkIfJobStarted) %s", evictionMessage)
+							deadline = clock.Now().Add(time.Duration(viper.GetInt(evictionRetriesKey)) * podCheckInterval)
+						}
+						continue
+					}
 					logr.Debugf("(Job Monitor checkIfJobStarted) Job %s seems to have a failed pod %s", jm.TrainingID, pod.ObjectMeta.Name)
 					logr.Debugf("(Job Monitor checkIfJobStarted) Pod status message is %s Reason is %s", pod.Status.Message, pod.Status.Reason)
 					numFailed++
@@ -97,25 +164,104 @@ func (jm *JobMonitor) checkIfJobStarted(logr *logger.LocLoggingEntry) {
 			}
 		}
 
+		if err == nil {
+			unschedulable := int32(0)
+			if numPending >= 1 {
+				unschedulable = 1
+			}
+			atomic.StoreInt32(&jm.unschedulable, unschedulable)
+		}
+
 		if numRunning >= numPodsExpected {
 			logr.Debugf("All learner pods, one helper and one job monitor seem to have started")
+			jm.metrics.jobStartLatencyTiming.Observe(float64(clock.Now().Sub(jm.created) / time.Millisecond))
+			return
+		}
+
+		if last && (numPending >= 1 || numFailed >= 1 || numEvicted >= 1) && jm.overallStatusIsTerminal(logr) {
+			logr.Infof("(Job Monitor checkIfJobStarted) overall status of %s is already terminal, leaving the teardown to the status processing", jm.TrainingID)
 			return
 		}
 
-		if i == insuffResourcesRetries && numPending >= 1 {
+		// a wrong image or missing pull secret doesn't get better by waiting
+		if failure := imagePulls.oldest(); failure != nil && (last || clock.Now().Sub(failure.since) >= viper.GetDuration(imagePullThresholdKey)) &&
+			!jm.overallStatusIsTerminal(logr) {
+			jm.metrics.failedImagePullK8sErrorCounter.Add(1)
+			logr.Errorf("(Job Monitor checkIfJobStarted) %s, failing job %s", failure.statusMessage(), jm.TrainingID)
+			jm.sendFinalStatus(failedStatusUpdate(errCodeImagePull, failure.statusMessage()), []ReasonCode{ReasonImagePull}, logr)
+			jm.killDeployedJob(logr)
+			return
+		}
+
+		if numPending >= 1 && pendingSince.IsZero() {
+			pendingSince = clock.Now()
+			jm.notifyPending(policy, 0, schedulerMessage, logr)
+		}
+		if last && numPending >= 1 && numFailed == 0 && numEvicted == 0 && policy.keepsWaiting() {
+			logr.Warnf("(Job Monitor checkIfJobStarted) pods of %s are unschedulable for %v, waiting on: %s", jm.TrainingID, clock.Now().Sub(pendingSince), schedulerMessage)
+			jm.notifyPending(policy, clock.Now().Sub(pendingSince), schedulerMessage, logr)
+			deadline = clock.Now().Add(policy.maxPending)
+			last = false
+		}
+
+		if last && numPending >= 1 {
 			jm.metrics.insufficientK8sResourcesErrorCounter.Add(1)
-			updateJobStatusOnError(jm.TrainingID, jm.UserID, trainerClient.ErrCodeInsufficientResources, service.StatusMessages_INSUFFICIENT_RESOURCES.String(), logr)
-			time.Sleep(30 * time.Second)
-			KillDeployedJob(jm.TrainingID, jm.UserID, jm.JobName, logr)
+			jm.sendFinalStatus(failedStatusUpdate(trainerClient.ErrCodeInsufficientResources, service.StatusMessages_INSUFFICIENT_RESOURCES.String()), []ReasonCode{ReasonInsufficientResources}, logr)
+			clock.Sleep(30 * time.Second)
+			jm.killDeployedJob(logr)
+			return
+		}
+
+		if numFailed >= 1 && last {
+			jm.sendFinalStatus(failedStatusUpdate(trainerClient.ErrFailedPodReasonUnknown, service.StatusMessages_INTERNAL_ERROR.String()), []ReasonCode{ReasonPodFailed}, logr)
+			jm.killDeployedJob(logr)
+		}
+
+		if numEvicted >= 1 && numFailed == 0 && last {
+			jm.sendFinalStatus(failedStatusUpdate(errCodeEvicted, evictionMessage), []ReasonCode{ReasonEvicted}, logr)
+			jm.killDeployedJob(logr)
 			return
 		}
 
-		if numFailed >= 1 && i == insuffResourcesRetries {
-			updateJobStatusOnError(jm.TrainingID, jm.UserID, trainerClient.ErrFailedPodReasonUnknown, service.StatusMessages_INTERNAL_ERROR.String(), logr)
-			KillDeployedJob(jm.TrainingID, jm.UserID, jm.JobName, logr)
+		if last && numPending == 0 && numFailed == 0 && numEvicted == 0 {
+			// nothing is going to start anymore, the spec might be wrong
+			jm.checkPodCount(numRunning-2, logr)
+			return
 		}
 
-		time.Sleep(30 * time.Second)
+		if last {
+			return
+		}
+		stopped, watchClosed := jm.waitForPodChange(podEvents, deadline)
+		if stopped {
+			return
+		}
+		if watchClosed {
+			podEvents.Stop()
+			podEvents = nil
+		}
 	}
 
 }
+
+//waitForPodChange waits until a pod of the job changed, podCheckInterval passed or the deadline is reached, whichever
+//comes first. It tells whether the job monitor got stopped meanwhile, and whether the watch of the pods was closed
+func (jm *JobMonitor) waitForPodChange(podEvents watch.Interface, deadline time.Time) (stopped bool, watchClosed bool) {
+	wait := podCheckInterval
+	clock := jm.timeSource()
+	if untilDeadline := deadline.Sub(clock.Now()); untilDeadline > 0 && untilDeadline < wait {
+		wait = untilDeadline
+	}
+	var events <-chan watch.Event
+	if podEvents != nil {
+		events = podEvents.ResultChan()
+	}
+	select {
+	case <-jm.Done():
+		return true, false
+	case _, ok := <-events:
+		return false, !ok
+	case <-clock.After(wait):
+		return false, false
+	}
+}
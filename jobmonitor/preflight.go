@@ -0,0 +1,224 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/lcmconfig"
+	lcmClient "github.com/AISphere/ffdl-lcm/service/client"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// the checks of the preflight
+const (
+	preflightEtcd       = "etcd"
+	preflightKubernetes = "kubernetes"
+	preflightTrainer    = "trainer"
+	preflightLCM        = "lcm"
+)
+
+// the training the trainer is asked for by the preflight, it is not expected to exist
+const preflightTrainingID = "jobmonitor-preflight"
+
+//kubernetesPermission ... an RBAC verb the job monitor needs on a resource, in the learner namespace unless the
+//resource is cluster scoped
+type kubernetesPermission struct {
+	Verb          string
+	Group         string
+	Resource      string
+	Subresource   string
+	ClusterScoped bool
+}
+
+func (p kubernetesPermission) resource() string {
+	if p.Subresource != "" {
+		return p.Resource + "/" + p.Subresource
+	}
+	return p.Resource
+}
+
+//requiredKubernetesPermissions are the permissions the job monitor uses: it inspects, watches, reschedules and
+//annotates the pods of the learners, looks up their nodes to correlate failures, scales the learner stateful sets to
+//pause jobs, and tails the logs of the learners of failed jobs
+var requiredKubernetesPermissions = []kubernetesPermission{
+	{Verb: "list", Resource: "pods"},
+	{Verb: "watch", Resource: "pods"},
+	{Verb: "delete", Resource: "pods"},
+	{Verb: "patch", Resource: "pods"},
+	{Verb: "get", Resource: "pods", Subresource: "log"},
+	{Verb: "get", Resource: "nodes", ClusterScoped: true},
+	{Verb: "get", Group: "apps", Resource: "statefulsets"},
+	{Verb: "update", Group: "apps", Resource: "statefulsets"},
+}
+
+//PreflightCheck ... the outcome of one check of the preflight
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+//PreflightReport ... the outcome of the preflight, OK if all the checks passed
+type PreflightReport struct {
+	OK     bool             `json:"ok"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+func (r PreflightReport) String() string {
+	var failed []string
+	for _, c := range r.Checks {
+		if !c.OK {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return fmt.Sprintf("all %d checks passed", len(r.Checks))
+	}
+	return fmt.Sprintf("%d of %d checks failed: %s", len(failed), len(r.Checks), strings.Join(failed, "; "))
+}
+
+//Preflight ... checks that the job monitor can do its job with the configuration it is given: that it can read and
+//write its keys in etcd, has the RBAC permissions it needs in kubernetes, and reaches the trainer and the LCM. It is
+//meant to run at rollout, so that a broken deployment shows before the first job fails for it. Nothing a job depends
+//on is changed: the etcd key written is the preflight's own, and the trainer is only asked about a training which
+//doesn't exist
+func Preflight(logr *logger.LocLoggingEntry) PreflightReport {
+	checks := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{preflightEtcd, func() (string, error) { return preflightEtcdCheck(logr) }},
+		{preflightKubernetes, preflightKubernetesCheck},
+		{preflightTrainer, preflightTrainerCheck},
+		{preflightLCM, preflightLCMCheck},
+	}
+	report := PreflightReport{OK: true}
+	for _, c := range checks {
+		detail, err := c.run()
+		check := PreflightCheck{Name: c.name, OK: err == nil, Detail: detail}
+		if err != nil {
+			check.Error = err.Error()
+			report.OK = false
+			logr.WithError(err).Errorf("(Preflight) the %s check failed", c.name)
+		}
+		report.Checks = append(report.Checks, check)
+	}
+	return report
+}
+
+//preflightEtcdCheck counts the keys under the prefix, and writes and removes a key of its own
+func preflightEtcdCheck(logr *logger.LocLoggingEntry) (string, error) {
+	cfg := defaultCoordinatorConfig()
+	etcd, err := newEtcdClient(cfg, logr)
+	if err != nil {
+		return "", err
+	}
+	defer etcd.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if _, err := etcd.Get(ctx, "", clientv3.WithPrefix(), clientv3.WithCountOnly()); err != nil {
+		return "", fmt.Errorf("failed to read: %v", err)
+	}
+	host, _ := os.Hostname()
+	key := "jobmonitor/preflight/" + host
+	if _, err := etcd.Put(ctx, key, "ok"); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", key, err)
+	}
+	if _, err := etcd.Delete(ctx, key); err != nil {
+		return "", fmt.Errorf("failed to delete %s: %v", key, err)
+	}
+	return fmt.Sprintf("read and wrote under %q at %s", cfg.Prefix, strings.Join(cfg.Endpoints, ",")), nil
+}
+
+//preflightKubernetesCheck connects to the API server and asks it whether the job monitor has each of the
+//requiredKubernetesPermissions
+func preflightKubernetesCheck() (string, error) {
+	k8sConfig, err := lcmconfig.GetKubernetesConfig()
+	if err != nil {
+		return "", err
+	}
+	k8s, err := kubernetes.NewForConfig(k8sConfig)
+	if err != nil {
+		return "", err
+	}
+	version, err := k8s.Discovery().ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	var denied []string
+	for _, p := range requiredKubernetesPermissions {
+		attributes := &authorizationv1.ResourceAttributes{Verb: p.Verb, Group: p.Group, Resource: p.Resource, Subresource: p.Subresource}
+		if !p.ClusterScoped {
+			attributes.Namespace = config.GetLearnerNamespace()
+		}
+		review, err := k8s.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: attributes}})
+		if err != nil {
+			return "", fmt.Errorf("failed to review the permission to %s %s: %v", p.Verb, p.resource(), err)
+		}
+		if !review.Status.Allowed {
+			denied = append(denied, p.Verb+" "+p.resource())
+		}
+	}
+	if len(denied) > 0 {
+		return "", fmt.Errorf("not allowed to %s in namespace %s", strings.Join(denied, ", "), config.GetLearnerNamespace())
+	}
+	return fmt.Sprintf("kubernetes %s, all %d permissions granted", version.GitVersion, len(requiredKubernetesPermissions)), nil
+}
+
+//preflightTrainerCheck asks the trainer about a training which doesn't exist, any answer but a failure to reach it or
+//to authenticate means the trainer updates will go through
+func preflightTrainerCheck() (string, error) {
+	connection, err := client.NewTrainer()
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	_, err = connection.Client().GetTrainingJob(ctx, &grpc_trainer_v2.GetRequest{TrainingId: preflightTrainingID, UserId: preflightTrainingID})
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Unauthenticated, codes.PermissionDenied, codes.Unimplemented:
+		return "", err
+	}
+	return "reachable", nil
+}
+
+//preflightLCMCheck connects to the LCM. Unlike the trainer's, none of the calls of the LCM is free of side effects, so
+//it is not called
+func preflightLCMCheck() (string, error) {
+	connection, err := lcmClient.NewLcm(nil)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+	return "connected, no call made", nil
+}
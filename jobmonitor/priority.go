@@ -0,0 +1,99 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+// the named priorities a job can be labeled with, other values have to be integers
+var namedPriorities = map[string]int{"low": -1, "normal": 0, "high": 1}
+
+//jobPriority reads the priority of a job from the label of its training spec named by jobmonitor.priority.label,
+//either low, normal or high, or an integer. Jobs without one are normal
+func jobPriority(labels map[string]string) int {
+	value := strings.ToLower(strings.TrimSpace(labels[viper.GetString(priorityLabelKey)]))
+	if priority, named := namedPriorities[value]; named {
+		return priority
+	}
+	if priority, err := strconv.Atoi(value); err == nil {
+		return priority
+	}
+	return namedPriorities["normal"]
+}
+
+//priorityTeardown tells whether the terminal jobs of this process are torn down in the order of their priority, see
+//jobmonitor.teardown.priority.enabled. It only kicks in under resource pressure, i.e. while the pods of one of the
+//monitored jobs can't be scheduled for want of resources: the lower priority jobs are then torn down first, and
+//verifying that their workload is gone is put off while higher priority jobs are active, so that the kills freeing
+//the resources come first
+func priorityTeardown() bool {
+	return viper.GetBool(priorityTeardownKey) && underResourcePressure()
+}
+
+//underResourcePressure tells whether the pods of one of the jobs monitored by this process are unschedulable
+func underResourcePressure() bool {
+	monitoredJobsMu.RLock()
+	defer monitoredJobsMu.RUnlock()
+	for _, jm := range monitoredJobs {
+		if atomic.LoadInt32(&jm.unschedulable) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//higherPriorityActive tells whether this process monitors a job of a priority above the given one which isn't terminal
+func higherPriorityActive(priority int) bool {
+	monitoredJobsMu.RLock()
+	defer monitoredJobsMu.RUnlock()
+	for _, jm := range monitoredJobs {
+		if _, terminal := jm.terminalLatch(); !terminal && jm.priority > priority {
+			return true
+		}
+	}
+	return false
+}
+
+//deferVerification tells whether the verification of the teardown of the job is put off, see priorityTeardown
+func (jm *JobMonitor) deferVerification() bool {
+	return priorityTeardown() && higherPriorityActive(jm.priority)
+}
+
+//waitOutHigherPriorityJobs holds the verification of the teardown of the job back while it is deferred, at most for
+//jobmonitor.teardown.priority.max_deferral
+func (jm *JobMonitor) waitOutHigherPriorityJobs(logr *logger.LocLoggingEntry) {
+	if !jm.deferVerification() {
+		return
+	}
+	max := viper.GetDuration(priorityMaxDeferralKey)
+	logr.Infof("(waitOutHigherPriorityJobs) deferring the verification of the teardown of %s (priority %d) by up to %v, higher priority jobs are active under resource pressure",
+		jm.TrainingID, jm.priority, max)
+	deadline := jm.timeSource().Now().Add(max)
+	for jm.deferVerification() && jm.timeSource().Now().Before(deadline) {
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(podCheckInterval):
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+)
+
+const zkProcessed = "processed"
+
+//the number of statuses of a learner the job monitor processed is kept as <training id>/processed/<learner>, so that a
+//restarted job monitor resumes where the previous one stopped instead of replaying the whole status sequence
+func processedOffsetPath(trainingID string, learner int) string {
+	return processedOffsetsPath(trainingID) + strconv.Itoa(learner)
+}
+
+func processedOffsetsPath(trainingID string) string {
+	return fmt.Sprintf("%s/%s/", trainingID, zkProcessed)
+}
+
+//persistedProcessedOffsets returns the processed offsets previous job monitors of the job persisted, by learner. They are
+//listed by prefix, so that the ones of learners which joined an elastic job beyond its spec are found too. Without the
+//etcd client the offsets of the learners of the spec are looked up one by one
+func (jm *JobMonitor) persistedProcessedOffsets(logr *logger.LocLoggingEntry) map[int]string {
+	offsets := make(map[int]string)
+	prefix := processedOffsetsPath(jm.TrainingID)
+	etcd, err := jm.watchClient(logr)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+		defer cancel()
+		var response *clientv3.GetResponse
+		if response, err = etcd.Get(ctx, prefix, clientv3.WithPrefix()); err == nil {
+			for _, kv := range response.Kvs {
+				learner, err := strconv.Atoi(strings.TrimPrefix(string(kv.Key), prefix))
+				if err != nil || learner <= 0 {
+					logr.Warnf("ignoring the processed offset %s, which isn't the one of a learner", string(kv.Key))
+					continue
+				}
+				offsets[learner] = string(kv.Value)
+			}
+			return offsets
+		}
+	}
+	jm.metrics.failedETCDConnectivityCounter.Add(1)
+	logr.WithError(err).Warnf("could not list the processed offsets of %s, looking up the ones of its %d learners", jm.TrainingID, jm.NumLearners)
+	for i := 1; i <= jm.NumLearners; i++ {
+		if response, err := jm.EtcdClient.Get(processedOffsetPath(jm.TrainingID, i), logr); err == nil && len(response) > 0 {
+			offsets[i] = response[0].Value
+		}
+	}
+	return offsets
+}
+
+//loadProcessedOffsets resumes the processed offsets a previous job monitor of the job persisted, and the last status
+//each learner was seen in
+func (jm *JobMonitor) loadProcessedOffsets(vocabulary *statusVocabulary, logr *logger.LocLoggingEntry) {
+	offsets := jm.persistedProcessedOffsets(logr)
+	learners := make([]int, 0, len(offsets))
+	for learner := range offsets {
+		learners = append(learners, learner)
+	}
+	sort.Ints(learners)
+	for _, i := range learners {
+		value := offsets[i]
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset <= 0 {
+			logr.Warnf("ignoring the invalid processed offset %q of learner %d of %s", value, i, jm.TrainingID)
+			continue
+		}
+		statuses, err := jm.sequenceValues(indvidualJobStatusPath(jm.TrainingID, i), logr)
+		if err != nil {
+			// without the statuses the offset can't be checked, processing them again is the lesser evil
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			continue
+		}
+		if offset > len(statuses) {
+			logr.Warnf("learner %d of %s has %d statuses but %d were processed, resuming after the last one", i, jm.TrainingID, len(statuses), offset)
+			offset = len(statuses)
+		}
+		if offset == 0 {
+			continue
+		}
+		last := statuses[offset-1]
+		if translated, _, ok := vocabulary.translate(last); ok {
+			last = translated
+		}
+		jm.recordLearnerStatus(i, parseStatus(last, logr).Status)
+		// the phase started no later than its last status, which errs on the side of not timing it out too early
+		jm.recordLearnerPhase(i, parseStatus(last, logr).Status, parseStatus(last, logr).Timestamp)
+
+		jm.processedMu.Lock()
+		jm.processed[i] = offset
+		jm.persistedOffsets[i] = value
+		jm.processedMu.Unlock()
+		logr.Infof("resuming the statuses of learner %d of %s after the %d already processed", i, jm.TrainingID, offset)
+	}
+}
+
+//restoreTerminalLearners rebuilds numTerminalLearners from the last status of the learners whose statuses were resumed.
+//Those statuses aren't processed again, so a restarted job monitor would otherwise wait out the grace period for
+//learners which finished long ago
+func (jm *JobMonitor) restoreTerminalLearners(logr *logger.LocLoggingEntry) {
+	jm.processedMu.Lock()
+	resumed := make([]int, 0, len(jm.processed))
+	for learner, offset := range jm.processed {
+		if offset > 0 {
+			resumed = append(resumed, learner)
+		}
+	}
+	jm.processedMu.Unlock()
+
+	var terminal uint64
+	jm.learnerStatusMu.Lock()
+	for _, learner := range resumed {
+		if isTerminalStatus(jm.learnerStatuses[learner]) {
+			terminal++
+		}
+	}
+	jm.learnerStatusMu.Unlock()
+	if terminal > 0 {
+		logr.Infof("%d learners of %s already were terminal before the job monitor restarted", terminal, jm.TrainingID)
+	}
+	atomic.StoreUint64(&jm.numTerminalLearners, terminal)
+}
+
+//persistProcessedOffset writes the processed offset of the learner to etcd, if it advanced since the last write. A
+//job monitor dying between processing a status and persisting the offset processes that status again after a restart.
+//When the persisted offset isn't the one last written, e.g. a previous job monitor of the job wrote it meanwhile, the
+//write is tried again from the current one, unless that one is ahead already
+func (jm *JobMonitor) persistProcessedOffset(learner int, logr *logger.LocLoggingEntry) {
+	jm.processedMu.Lock()
+	offset := jm.processed[learner]
+	value := strconv.Itoa(offset)
+	previous, persisted := jm.persistedOffsets[learner]
+	jm.processedMu.Unlock()
+	if persisted && previous == value {
+		return
+	}
+
+	key := processedOffsetPath(jm.TrainingID, learner)
+	ahead := false
+	for attempt := 0; attempt < 3; attempt++ {
+		var written bool
+		var err error
+		if persisted {
+			written, err = jm.EtcdClient.CompareAndSwap(key, value, previous, logr)
+		} else {
+			written, err = jm.EtcdClient.PutIfKeyMissing(key, value, logr)
+		}
+		if err != nil {
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			logr.WithError(err).Warnf("failed to persist the processed offset %s of learner %d of %s", value, learner, jm.TrainingID)
+			return
+		}
+		if written {
+			jm.processedMu.Lock()
+			jm.persistedOffsets[learner] = value
+			jm.processedMu.Unlock()
+			return
+		}
+		response, err := jm.EtcdClient.Get(key, logr)
+		if err != nil {
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			logr.WithError(err).Warnf("failed to read the processed offset of learner %d of %s", learner, jm.TrainingID)
+			return
+		}
+		if len(response) == 0 {
+			previous, persisted = "", false
+			continue
+		}
+		previous, persisted = response[0].Value, true
+		if current, err := strconv.Atoi(previous); err == nil && current >= offset {
+			ahead = true
+			break
+		}
+	}
+	// the next write goes from the offset found in etcd
+	jm.processedMu.Lock()
+	if persisted {
+		jm.persistedOffsets[learner] = previous
+	} else {
+		delete(jm.persistedOffsets, learner)
+	}
+	jm.processedMu.Unlock()
+	if !ahead {
+		logr.Warnf("the processed offset of learner %d of %s keeps changing, left it at %s", learner, jm.TrainingID, previous)
+	}
+}
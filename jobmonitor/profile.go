@@ -0,0 +1,162 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/spf13/viper"
+)
+
+// the monitoring profiles of a job
+const (
+	// everything the job monitor has to offer
+	ProfileStandard = "standard"
+	// for fleets of many small jobs: no Info logs for routine updates, sampled counters and timings, longer learner
+	// poll intervals and no diagnostics dumps
+	ProfileMinimal = "minimal"
+)
+
+// the job label telling the class of a job, e.g. class=hpo-trial, see jobmonitor.profiles.minimal.classes
+const jobClassLabel = "class"
+
+//Sampling ... how much of the logs and metrics of a job monitor are kept, and which jobs get the minimal profile
+type Sampling struct {
+	// the share of the status updates which are logged, see jobmonitor.log.updates.sample.rate
+	UpdateLogRate float64
+	// the share of the counters and timings kept for jobs with the minimal profile, whose status updates aren't
+	// logged, see jobmonitor.profiles.minimal.metrics.sample_rate
+	MinimalMetricsRate float64
+	// the job classes which get the minimal profile, see jobmonitor.profiles.minimal.classes
+	MinimalClasses []string
+}
+
+//fullSampling keeps everything, the sampling of a job monitor whose Config has none
+var fullSampling = Sampling{UpdateLogRate: 1, MinimalMetricsRate: 1}
+
+//processSampling is the sampling of the global configuration
+func processSampling() *Sampling {
+	return &Sampling{
+		UpdateLogRate:      viper.GetFloat64(updateLogSampleRateKey),
+		MinimalMetricsRate: viper.GetFloat64(minimalProfileSampleRateKey),
+		MinimalClasses:     viper.GetStringSlice(minimalProfileClassesKey),
+	}
+}
+
+//jobProfile is the monitoring profile of the job: Config.Profile if set, otherwise the minimal one for the job
+//classes listed in Config.Sampling
+func jobProfile(cfg Config) string {
+	if cfg.Profile != "" {
+		return cfg.Profile
+	}
+	if class, ok := cfg.Labels[jobClassLabel]; ok && cfg.Sampling != nil {
+		for _, minimal := range cfg.Sampling.MinimalClasses {
+			if class == minimal {
+				return ProfileMinimal
+			}
+		}
+	}
+	return ProfileStandard
+}
+
+func (jm *JobMonitor) minimalProfile() bool {
+	return jm.profile == ProfileMinimal
+}
+
+//learnerPollInterval is how often the learners of the job are looked at, at least
+//jobmonitor.profiles.minimal.poll.interval for jobs with the minimal profile
+func (jm *JobMonitor) learnerPollInterval() time.Duration {
+	interval := jm.configDuration(learnerPollIntervalKey)
+	if minimal := viper.GetDuration(minimalProfilePollIntervalKey); jm.minimalProfile() && interval < minimal {
+		return minimal
+	}
+	return interval
+}
+
+//sampledMetrics ... a MetricsProvider whose counters and histograms record only the given fraction of the
+//observations. Counters are scaled up by the inverse of the rate, so that their sum stays right on average. Gauges
+//are not sampled, they only ever keep the latest value
+type sampledMetrics struct {
+	MetricsProvider
+	rate float64
+}
+
+//sampleMetrics samples the counters and histograms of provider at rate, rates of 1 and above keep everything
+func sampleMetrics(provider MetricsProvider, rate float64) MetricsProvider {
+	if provider == nil || rate >= 1 {
+		return provider
+	}
+	return sampledMetrics{provider, rate}
+}
+
+func (m sampledMetrics) NewCounter(name string) metrics.Counter {
+	return sampledCounter{m.MetricsProvider.NewCounter(name), newSampler(m.rate)}
+}
+
+func (m sampledMetrics) NewHistogram(name string) metrics.Histogram {
+	return sampledHistogram{m.MetricsProvider.NewHistogram(name), newSampler(m.rate)}
+}
+
+//sampler decides which observations go through
+type sampler struct {
+	rate   float64
+	mu     *sync.Mutex
+	random *rand.Rand
+}
+
+func newSampler(rate float64) sampler {
+	return sampler{rate: rate, mu: &sync.Mutex{}, random: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func (s sampler) sample() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.random.Float64() < s.rate
+}
+
+type sampledCounter struct {
+	metrics.Counter
+	sampler
+}
+
+func (c sampledCounter) With(labelValues ...string) metrics.Counter {
+	return sampledCounter{c.Counter.With(labelValues...), c.sampler}
+}
+
+func (c sampledCounter) Add(delta float64) {
+	if c.sample() {
+		c.Counter.Add(delta / c.rate)
+	}
+}
+
+type sampledHistogram struct {
+	metrics.Histogram
+	sampler
+}
+
+func (h sampledHistogram) With(labelValues ...string) metrics.Histogram {
+	return sampledHistogram{h.Histogram.With(labelValues...), h.sampler}
+}
+
+func (h sampledHistogram) Observe(value float64) {
+	if h.sample() {
+		h.Histogram.Observe(value)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/multi"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/spf13/viper"
+)
+
+// the labels of every metric on the Prometheus endpoint, the metrics the callers label further with With() declare
+// their own labels after these
+var prometheusLabels = []string{"training_id", "user_id"}
+
+//buckets of the latencies, in milliseconds
+var prometheusLatencyBuckets = []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+//prometheusRegistry ... the metrics are registered once per process, the jobs only differ by their label values
+var prometheusRegistry = struct {
+	sync.Mutex
+	registry   *prometheus.Registry
+	counters   map[string]*prometheus.CounterVec
+	gauges     map[string]*prometheus.GaugeVec
+	histograms map[string]*prometheus.HistogramVec
+}{
+	registry:   prometheus.NewRegistry(),
+	counters:   make(map[string]*prometheus.CounterVec),
+	gauges:     make(map[string]*prometheus.GaugeVec),
+	histograms: make(map[string]*prometheus.HistogramVec),
+}
+
+//PrometheusAddr ... the address the Prometheus /metrics endpoint is served on, empty if the metrics are only sent to
+//statsd
+func PrometheusAddr() string {
+	return viper.GetString(prometheusAddrKey)
+}
+
+//ServePrometheus ... serves the metrics of the monitored jobs in the Prometheus format on addr/metrics
+func ServePrometheus(addr string, logr *logger.LocLoggingEntry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheusRegistry.registry, promhttp.HandlerOpts{}))
+
+	logr.Infof("serving the Prometheus metrics on %s/metrics", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logr.WithError(err).Errorf("failed to serve the Prometheus metrics on %s", addr)
+		}
+	}()
+}
+
+//metricsFactory creates the metrics of a job with the metrics provider of the job and, if the Prometheus endpoint is
+//enabled, on the Prometheus registry as well
+type metricsFactory struct {
+	provider   MetricsProvider
+	lv         []string
+	prometheus bool
+	promLV     []string
+}
+
+func newMetricsFactory(cfg Config) metricsFactory {
+	return metricsFactory{
+		provider:   metricsOrNoop(cfg.Metrics),
+		lv:         labelValues(metricLabels(cfg)),
+		prometheus: PrometheusAddr() != "",
+		promLV:     []string{"training_id", cfg.TrainingID, "user_id", cfg.UserID},
+	}
+}
+
+//vectorLabels are the labels of the vector of a metric the callers label further with the given names
+func vectorLabels(labels []string) []string {
+	return append(append([]string(nil), prometheusLabels...), labels...)
+}
+
+//counter is a counter of the job, labels are the names of the labels the callers add with With(), which the Prometheus
+//vector of the counter has to declare
+func (f metricsFactory) counter(name string, labels ...string) metrics.Counter {
+	c := f.provider.NewCounter(name).With(f.lv...)
+	if !f.prometheus {
+		return c
+	}
+	prometheusRegistry.Lock()
+	defer prometheusRegistry.Unlock()
+	vec, ok := prometheusRegistry.counters[name]
+	if !ok {
+		vec = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheusName(name) + "_total", Help: name}, vectorLabels(labels))
+		prometheusRegistry.registry.MustRegister(vec)
+		prometheusRegistry.counters[name] = vec
+	}
+	return multi.NewCounter(c, kitprometheus.NewCounter(vec).With(f.promLV...))
+}
+
+//gauge is a gauge of the job, labels as for counter
+func (f metricsFactory) gauge(name string, labels ...string) metrics.Gauge {
+	g := f.provider.NewGauge(name).With(f.lv...)
+	if !f.prometheus {
+		return g
+	}
+	prometheusRegistry.Lock()
+	defer prometheusRegistry.Unlock()
+	vec, ok := prometheusRegistry.gauges[name]
+	if !ok {
+		vec = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: prometheusName(name), Help: name}, vectorLabels(labels))
+		prometheusRegistry.registry.MustRegister(vec)
+		prometheusRegistry.gauges[name] = vec
+	}
+	return multi.NewGauge(g, kitprometheus.NewGauge(vec).With(f.promLV...))
+}
+
+//timing is a histogram of durations in milliseconds, labels as for counter
+func (f metricsFactory) timing(name string, labels ...string) metrics.Histogram {
+	h := f.provider.NewHistogram(name).With(f.lv...)
+	if !f.prometheus {
+		return h
+	}
+	prometheusRegistry.Lock()
+	defer prometheusRegistry.Unlock()
+	vec, ok := prometheusRegistry.histograms[name]
+	if !ok {
+		vec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    prometheusName(name) + "_milliseconds",
+			Help:    name,
+			Buckets: prometheusLatencyBuckets,
+		}, vectorLabels(labels))
+		prometheusRegistry.registry.MustRegister(vec)
+		prometheusRegistry.histograms[name] = vec
+	}
+	return multi.NewHistogram(h, kitprometheus.NewHistogram(vec).With(f.promLV...))
+}
+
+//forgetPrometheusSeries drops the series of a job which is no longer monitored, so that a long running monitor of many
+//jobs doesn't keep exposing the finished ones
+func forgetPrometheusSeries(trainingID, userID string) {
+	prometheusRegistry.Lock()
+	defer prometheusRegistry.Unlock()
+	for _, vec := range prometheusRegistry.counters {
+		deleteSeries(vec, vec.Delete, trainingID, userID)
+	}
+	for _, vec := range prometheusRegistry.gauges {
+		deleteSeries(vec, vec.Delete, trainingID, userID)
+	}
+	for _, vec := range prometheusRegistry.histograms {
+		deleteSeries(vec, vec.Delete, trainingID, userID)
+	}
+}
+
+//deleteSeries deletes all the series of the job from a vector, whatever the values of the labels the callers added
+func deleteSeries(vec prometheus.Collector, del func(prometheus.Labels) bool, trainingID, userID string) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+	var series []prometheus.Labels
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		labels := make(prometheus.Labels, len(pb.Label))
+		for _, pair := range pb.Label {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["training_id"] == trainingID && labels["user_id"] == userID {
+			series = append(series, labels)
+		}
+	}
+	// the vector is locked while it is collected
+	for _, labels := range series {
+		del(labels)
+	}
+}
+
+//timedCoordinator ... records the latency of the calls to etcd made through the coordinator
+type timedCoordinator struct {
+	coord.Coordinator
+	latency metrics.Histogram
+}
+
+func timeCoordinator(c coord.Coordinator, latency metrics.Histogram) coord.Coordinator {
+	if c == nil {
+		return nil
+	}
+	return timedCoordinator{c, latency}
+}
+
+func (c timedCoordinator) observe(start time.Time) {
+	c.latency.Observe(float64(time.Since(start) / time.Millisecond))
+}
+
+func (c timedCoordinator) Put(key string, value string, logr *logger.LocLoggingEntry) error {
+	defer c.observe(time.Now())
+	return c.Coordinator.Put(key, value, logr)
+}
+
+func (c timedCoordinator) PutIfKeyMissing(key string, value string, logr *logger.LocLoggingEntry) (bool, error) {
+	defer c.observe(time.Now())
+	return c.Coordinator.PutIfKeyMissing(key, value, logr)
+}
+
+func (c timedCoordinator) CompareAndSwap(key string, value string, prevValue string, logr *logger.LocLoggingEntry) (bool, error) {
+	defer c.observe(time.Now())
+	return c.Coordinator.CompareAndSwap(key, value, prevValue, logr)
+}
+
+func (c timedCoordinator) Get(key string, logr *logger.LocLoggingEntry) ([]coord.EtcdKVGetResponse, error) {
+	defer c.observe(time.Now())
+	return c.Coordinator.Get(key, logr)
+}
+
+// like NewValueSequence, not timed
+func (c timedCoordinator) sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	return readSequence(c.Coordinator, prefix, logr)
+}
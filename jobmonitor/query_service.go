@@ -0,0 +1,170 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-job-monitor/jobmonitor/grpc_jobmonitor"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+//QueryAddr ... the address the gRPC query service is served on, empty if it is not served
+func QueryAddr() string {
+	return viper.GetString(queryAddrKey)
+}
+
+//ServeQueryService ... serves the grpc_jobmonitor.JobMonitor service on addr, so that the trainer UI and debugging
+//tools can ask the job monitor what it believes about the jobs it monitors. If jobmonitor.api.token is set, calls
+//have to carry it as a bearer token in their authorization metadata, like the requests of the APIs
+func ServeQueryService(addr string, logr *logger.LocLoggingEntry) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to serve the query service on %s", addr)
+		return
+	}
+	server := newQueryServer()
+	logr.Infof("serving the query service on %s", addr)
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logr.WithError(err).Errorf("failed to serve the query service on %s", addr)
+		}
+	}()
+}
+
+func newQueryServer() *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(requireQueryToken))
+	grpc_jobmonitor.RegisterJobMonitorServer(server, queryService{})
+	return server
+}
+
+func requireQueryToken(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if token := viper.GetString(apiTokenKey); token != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		given := ""
+		if values := md.Get("authorization"); len(values) > 0 {
+			given = strings.TrimPrefix(values[0], "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+	}
+	return handler(ctx, req)
+}
+
+//queryService ... answers the calls of the query service from the jobs monitored by this process
+type queryService struct{}
+
+func monitoredJob(trainingID string) (*JobMonitor, error) {
+	monitoredJobsMu.RLock()
+	jm, ok := monitoredJobs[trainingID]
+	monitoredJobsMu.RUnlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "training %s is not monitored here", trainingID)
+	}
+	return jm, nil
+}
+
+//GetJobStatus ... the status the job monitor holds authoritative for the job, see authoritativeStatus
+func (queryService) GetJobStatus(ctx context.Context, req *grpc_jobmonitor.JobStatusRequest) (*grpc_jobmonitor.JobStatusResponse, error) {
+	jm, err := monitoredJob(req.TrainingId)
+	if err != nil {
+		return nil, err
+	}
+	logr := jm.componentLogger(nil, componentAPI)
+	current, reasons, err := jm.authoritativeStatus(logr)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	_, terminal := jm.terminalLatch()
+	resp := &grpc_jobmonitor.JobStatusResponse{
+		TrainingId:      jm.TrainingID,
+		UserId:          jm.UserID,
+		JobName:         jm.JobName,
+		Status:          current.Status.String(),
+		ErrorCode:       current.ErrorCode,
+		StatusMessage:   current.StatusMessage,
+		StatusTimestamp: current.Timestamp,
+		Attempt:         int32(jm.Attempt()),
+		Terminal:        terminal,
+		Leading:         jm.leading(),
+	}
+	if rec != nil {
+		resp.Teardown = rec.State
+	}
+	for _, reason := range reasons {
+		resp.Reasons = append(resp.Reasons, string(reason))
+	}
+	return resp, nil
+}
+
+//GetLearnerStatuses ... the latest status each learner of the job reported, with the node of its pod
+func (queryService) GetLearnerStatuses(ctx context.Context, req *grpc_jobmonitor.LearnerStatusesRequest) (*grpc_jobmonitor.LearnerStatusesResponse, error) {
+	jm, err := monitoredJob(req.TrainingId)
+	if err != nil {
+		return nil, err
+	}
+	resp := &grpc_jobmonitor.LearnerStatusesResponse{TrainingId: jm.TrainingID}
+	for _, entry := range jm.learnerStatusEntries(jm.learnerPods(jm.componentLogger(nil, componentAPI))) {
+		resp.Learners = append(resp.Learners, &grpc_jobmonitor.LearnerStatus{Learner: int32(entry.Learner), Status: entry.Status,
+			Timestamp: entry.Timestamp, Node: entry.Node})
+	}
+	return resp, nil
+}
+
+//GetTransitionHistory ... the transitions of the job according to its audit trail, oldest first
+func (queryService) GetTransitionHistory(ctx context.Context, req *grpc_jobmonitor.TransitionHistoryRequest) (*grpc_jobmonitor.TransitionHistoryResponse, error) {
+	jm, err := monitoredJob(req.TrainingId)
+	if err != nil {
+		return nil, err
+	}
+	events, err := jm.auditEvents(jm.componentLogger(nil, componentAPI))
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	resp := &grpc_jobmonitor.TransitionHistoryResponse{TrainingId: jm.TrainingID, Transitions: transitionHistory(events, req.Since)}
+	jm.auditTrail.mu.Lock()
+	resp.Incomplete = jm.auditTrail.dropped > 0
+	jm.auditTrail.mu.Unlock()
+	return resp, nil
+}
+
+//transitionHistory picks the transitions out of the audit events, the ones since the given unix milliseconds only
+func transitionHistory(events []auditEvent, since int64) []*grpc_jobmonitor.Transition {
+	var transitions []*grpc_jobmonitor.Transition
+	for _, event := range events {
+		at := event.At / int64(time.Millisecond)
+		if (event.Kind != auditTransition && event.Kind != auditFinalStatus) || at < since {
+			continue
+		}
+		transitions = append(transitions, &grpc_jobmonitor.Transition{At: at, Kind: event.Kind, Status: event.Status, Detail: event.Detail})
+	}
+	return transitions
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"strings"
+)
+
+// grpc metadata key carrying the comma separated reason codes of a status update
+const reasonCodesHeader = "reason-codes"
+
+//ReasonCode ... machine readable reason of a status update sent by the job monitor. The status message of an update
+//is meant for humans, automation (auto-retry services, dashboards) should look at the reason codes of the update, which
+//are sent as the reason-codes metadata of every update
+type ReasonCode string
+
+// the reason codes of the status updates sent by the job monitor
+const (
+	// the status was reported by the learners (or the scorer) of the job
+	ReasonJobReported ReasonCode = "JOB_REPORTED"
+	// the init containers of the job are making progress, see the status message for how far they got
+	ReasonInitProgress ReasonCode = "INIT_PROGRESS"
+	// a learner wrote statuses at a pathological rate and is ignored from now on
+	ReasonRunawayLearner ReasonCode = "RUNAWAY_LEARNER"
+	// the pods of the job could not be scheduled
+	ReasonInsufficientResources ReasonCode = "INSUFFICIENT_RESOURCES"
+	// a pod of the job failed for an unknown reason
+	ReasonPodFailed ReasonCode = "POD_FAILED"
+	// the pods of the job were evicted, and did not come back within the retries
+	ReasonEvicted ReasonCode = "EVICTED"
+	// the learners found do not match the spec of the job
+	ReasonConfigMismatch ReasonCode = "CONFIG_MISMATCH"
+	// the job reported COMPLETED but did not pass the completion verification
+	ReasonCompletionUnverified ReasonCode = "COMPLETION_UNVERIFIED"
+	// several learners failed at once in the same zone, which likely has an outage
+	ReasonZoneOutage ReasonCode = "ZONE_OUTAGE"
+	// the teardown of the failed job is deferred for debugging
+	ReasonTeardownDeferred ReasonCode = "TEARDOWN_DEFERRED"
+	// the job monitor could not connect to kubernetes
+	ReasonK8sConnection ReasonCode = "K8S_CONNECTION"
+	// the job monitor could not connect to etcd
+	ReasonEtcdConnection ReasonCode = "ETCD_CONNECTION"
+	// a critical auxiliary service of the job, e.g. its parameter servers, failed
+	ReasonAuxiliaryFailed ReasonCode = "AUXILIARY_FAILED"
+	// a learner container exceeded its memory limit and was OOMKilled
+	ReasonOOMKilled ReasonCode = "OOM_KILLED"
+	// a pod of the job could not pull its image
+	ReasonImagePull ReasonCode = "IMAGE_PULL"
+	// the node of a learner died, stopped reporting or was removed from the cluster
+	ReasonNodeFailure ReasonCode = "NODE_FAILURE"
+	// the job ran for longer than its maximum runtime
+	ReasonMaxRuntime ReasonCode = "MAX_RUNTIME"
+	// an administrator halted the job, see HaltJobs
+	ReasonAdminHalt ReasonCode = "ADMIN_HALT"
+	// a learner stayed in a phase for longer than its timeout
+	ReasonPhaseTimeout ReasonCode = "PHASE_TIMEOUT"
+	// the heartbeat of a learner stopped, see watchHeartbeats
+	ReasonLearnerDead ReasonCode = "LEARNER_DEAD"
+	// etcd had a learner running whose pod was gone, see detectHalfOpenLearners
+	ReasonLearnerLost ReasonCode = "LEARNER_LOST"
+	// the update repairs the view of the trainer, see Resync
+	ReasonResync ReasonCode = "RESYNC"
+	// the user of the job asked for it to halt, see haltGracefully
+	ReasonUserHalt ReasonCode = "USER_HALT"
+	// the learners of the job were scaled to zero on request of its user, or back again, see pause and resume
+	ReasonPaused  ReasonCode = "PAUSED"
+	ReasonResumed ReasonCode = "RESUMED"
+	// a failed learner is restarted instead of failing the job, see restartFailedLearner
+	ReasonLearnerRestarted ReasonCode = "LEARNER_RESTARTED"
+	// the job completed with some of its learners failed, which its failure policy tolerates, see tolerateLearnerStatus
+	ReasonFailuresTolerated ReasonCode = "FAILURES_TOLERATED"
+	// learners joined or left the elastic job, see resizeElasticLearners
+	ReasonLearnersResized ReasonCode = "LEARNERS_RESIZED"
+	// the update carries the latest training metrics of the learners, see forwardSummaryMetrics
+	ReasonTrainingMetrics ReasonCode = "TRAINING_METRICS"
+	// one of the early stopping rules of the job was met, see checkEarlyStopping
+	ReasonEarlyStopped ReasonCode = "EARLY_STOPPED"
+)
+
+func joinReasonCodes(reasons []ReasonCode) string {
+	codes := make([]string, len(reasons))
+	for i, reason := range reasons {
+		codes[i] = string(reason)
+	}
+	return strings.Join(codes, ",")
+}
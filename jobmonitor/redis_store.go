@@ -0,0 +1,326 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// the keys of the job monitor in Redis start with this
+	redisRoot = "ffdl"
+	// the longest a watch waits for a notification before reading its range again
+	redisMaxWait = time.Minute
+	// the connections kept open for the next requests
+	redisIdleConns = 4
+)
+
+//redisReadScript reads the keys in the lexicographic ranges of ARGV (pairs of ZRANGEBYLEX bounds) from the index
+//KEYS[2], at the revision in KEYS[1]. It returns the revision, then the key, value, create revision, mod revision and
+//version of every key found
+var redisReadScript = redis.NewScript(3, `
+local out = {tonumber(redis.call('GET', KEYS[1]) or '0')}
+for i = 1, #ARGV, 2 do
+	for _, key in ipairs(redis.call('ZRANGEBYLEX', KEYS[2], ARGV[i], ARGV[i + 1])) do
+		local kv = redis.call('HMGET', KEYS[3] .. key, 'v', 'c', 'm', 'ver')
+		if kv[1] then
+			table.insert(out, key)
+			for _, field in ipairs(kv) do
+				table.insert(out, field)
+			end
+		end
+	end
+end
+return out
+`)
+
+//redisCommitScript checks that the keys of ARGV are at the mod revisions given with them, 0 for a missing key, and
+//then increments the revision in KEYS[1], writes the puts and removes the deletes, keeping the index KEYS[2] of the
+//keys, and publishes the revision on KEYS[1]. ARGV is the count of checks followed by the key and mod revision of
+//each, then the count of puts followed by the key, value and version of each, then the count of deletes followed by
+//their keys. It returns the revision, or 0 if a check failed
+var redisCommitScript = redis.NewScript(3, `
+local i = 1
+local function count()
+	i = i + 1
+	return tonumber(ARGV[i - 1])
+end
+for _ = 1, count() do
+	if (redis.call('HGET', KEYS[3] .. ARGV[i], 'm') or '0') ~= ARGV[i + 1] then
+		return 0
+	end
+	i = i + 2
+end
+local rev = redis.call('INCR', KEYS[1])
+for _ = 1, count() do
+	local key = ARGV[i]
+	if redis.call('HSETNX', KEYS[3] .. key, 'c', rev) == 1 then
+		redis.call('ZADD', KEYS[2], 0, key)
+	end
+	redis.call('HSET', KEYS[3] .. key, 'v', ARGV[i + 1], 'm', rev, 'ver', ARGV[i + 2])
+	i = i + 3
+end
+for _ = 1, count() do
+	redis.call('DEL', KEYS[3] .. ARGV[i])
+	redis.call('ZREM', KEYS[2], ARGV[i])
+	i = i + 1
+end
+redis.call('PUBLISH', KEYS[1], rev)
+return rev
+`)
+
+//redisStore ... keeps the keys in a single Redis server: a key is the hash ffdl:kv:<key> of its value, revisions and
+//version, its name is in the sorted set ffdl:keys for the keys to be listed by range, and ffdl:rev counts the
+//revisions. Reads and commits are Lua scripts, so a commit checks and writes its keys at once. The endpoints are
+//redis:// or rediss:// URLs with the database in their path, tried in turn; the username and password of the
+//coordinator config are the ones of Redis, and the certificate the CA of its TLS. Every commit publishes its revision
+//on ffdl:rev, which the watches subscribe to along with the keyspace notifications of it, if Redis sends them
+type redisStore struct {
+	pool *redis.Pool
+	// the keyspace notification channel of the revision key
+	keyspace string
+}
+
+func openRedisStore(coordConfig coord.Config, logr *logger.LocLoggingEntry) (kvStore, error) {
+	var options []redis.DialOption
+	if user := coordConfig.Username; user != "" {
+		options = append(options, redis.DialUsername(user))
+	}
+	if password := coordConfig.Password; password != "" {
+		options = append(options, redis.DialPassword(password))
+	}
+	if cert := coordConfig.Cert; cert != "" {
+		tlsConfig, err := transport.TLSInfo{TrustedCAFile: cert}.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := applyTLSConfig(tlsConfig); err != nil {
+			return nil, err
+		}
+		options = append(options, redis.DialTLSConfig(tlsConfig))
+	}
+	// the endpoints are replicas of the same server, with the same database
+	db := 0
+	u, err := url.Parse(coordConfig.Endpoints[0])
+	if err != nil {
+		return nil, err
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("the redis endpoint %s has no database number in its path", coordConfig.Endpoints[0])
+		}
+	}
+	var current int32
+	endpoints := coordConfig.Endpoints
+	s := &redisStore{keyspace: fmt.Sprintf("__keyspace@%d__:%s", db, redisKey("rev"))}
+	s.pool = &redis.Pool{
+		MaxIdle:     redisIdleConns,
+		IdleTimeout: 5 * time.Minute,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			var err error
+			for tried := 0; tried < len(endpoints); tried++ {
+				at := atomic.LoadInt32(&current)
+				var conn redis.Conn
+				if conn, err = redis.DialURLContext(ctx, endpoints[int(at)%len(endpoints)], options...); err == nil {
+					return conn, nil
+				}
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				atomic.CompareAndSwapInt32(&current, at, at+1)
+			}
+			return nil, err
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		s.pool.Close()
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := redis.DoContext(conn, ctx, "PING"); err != nil {
+		s.pool.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func redisKey(name string) string {
+	return redisRoot + ":" + name
+}
+
+//keys returns KEYS of the scripts
+func (s *redisStore) keys() []interface{} {
+	return []interface{}{redisKey("rev"), redisKey("keys"), redisKey("kv:")}
+}
+
+//script runs script with the keys of the store and args
+func (s *redisStore) script(ctx context.Context, script *redis.Script, args []interface{}) (interface{}, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ctxTimeout())
+		defer cancel()
+	}
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return script.DoContext(ctx, conn, append(s.keys(), args...)...)
+}
+
+//lexRange returns the ZRANGEBYLEX bounds of the range of op
+func lexRange(op clientv3.Op) []interface{} {
+	key, end := op.KeyBytes(), op.RangeBytes()
+	switch {
+	case len(end) == 0:
+		return []interface{}{"[" + string(key), "[" + string(key)}
+	case len(end) == 1 && end[0] == 0:
+		return []interface{}{"[" + string(key), "+"}
+	default:
+		return []interface{}{"[" + string(key), "(" + string(end)}
+	}
+}
+
+func (s *redisStore) read(ctx context.Context, ranges []clientv3.Op) ([]*mvccpb.KeyValue, int64, error) {
+	var args []interface{}
+	for _, r := range ranges {
+		args = append(args, lexRange(r)...)
+	}
+	values, err := redis.Values(s.script(ctx, redisReadScript, args))
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(values) == 0 || (len(values)-1)%5 != 0 {
+		return nil, 0, fmt.Errorf("redis answered a read with %d values", len(values))
+	}
+	rev, err := redis.Int64(values[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	var kvs []*mvccpb.KeyValue
+	seen := make(map[string]bool)
+	for i := 1; i < len(values); i += 5 {
+		key, err := redis.Bytes(values[i], nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		if seen[string(key)] {
+			continue
+		}
+		seen[string(key)] = true
+		kv := &mvccpb.KeyValue{Key: key}
+		if kv.Value, err = redis.Bytes(values[i+1], nil); err != nil {
+			return nil, 0, err
+		}
+		for field, n := range []*int64{&kv.CreateRevision, &kv.ModRevision, &kv.Version} {
+			if *n, err = redis.Int64(values[i+2+field], nil); err != nil {
+				return nil, 0, fmt.Errorf("redis has a malformed entry for %s: %v", key, err)
+			}
+		}
+		kvs = append(kvs, kv)
+	}
+	sortKeyValues(kvs)
+	return kvs, rev, nil
+}
+
+func (s *redisStore) commit(ctx context.Context, c storeCommit) (int64, bool, error) {
+	var checks, puts, deletes []interface{}
+	check := func(key []byte, kv *mvccpb.KeyValue) {
+		rev := int64(0)
+		if kv != nil {
+			rev = kv.ModRevision
+		}
+		checks = append(checks, key, strconv.FormatInt(rev, 10))
+	}
+	for key, kv := range c.expected {
+		check([]byte(key), kv)
+	}
+	for _, put := range c.puts {
+		// the version written follows the one read
+		check(put.kv.Key, put.prev)
+		puts = append(puts, put.kv.Key, put.kv.Value, put.kv.Version)
+	}
+	for _, kv := range c.deletes {
+		deletes = append(deletes, kv.Key)
+	}
+	args := append([]interface{}{len(checks) / 2}, checks...)
+	args = append(append(args, len(puts)/3), puts...)
+	args = append(append(args, len(deletes)), deletes...)
+	rev, err := redis.Int64(s.script(ctx, redisCommitScript, args))
+	if err != nil {
+		return 0, false, err
+	}
+	return rev, rev != 0, nil
+}
+
+//wait subscribes to the revision key, and returns on the first notification of a commit after it or once it is
+//past rev already
+func (s *redisStore) wait(ctx context.Context, op clientv3.Op, rev int64) error {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, waitTimeout(ctx, redisMaxWait))
+	defer cancel()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	subscription := redis.PubSubConn{Conn: conn}
+	channels := []interface{}{redisKey("rev"), s.keyspace}
+	if err := subscription.Subscribe(channels...); err != nil {
+		return err
+	}
+	for {
+		switch m := subscription.ReceiveContext(ctx).(type) {
+		case redis.Message:
+			return nil
+		case redis.Subscription:
+			if m.Count < len(channels) {
+				continue
+			}
+			// subscribed to all channels, a commit before isn't notified
+			_, current, err := s.read(ctx, nil)
+			if err != nil || current > rev {
+				return err
+			}
+		case error:
+			if parent.Err() == nil && ctx.Err() != nil {
+				return nil
+			}
+			return m
+		}
+	}
+}
+
+func (s *redisStore) close() error {
+	return s.pool.Close()
+}
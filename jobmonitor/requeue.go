@@ -0,0 +1,207 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+)
+
+const (
+	zkAttempt  = "attempt"
+	zkAttempts = "attempts"
+)
+
+// grpc metadata key carrying the attempt of the job with every status update, e.g. "2/3" for the second of three
+const attemptHeader = "attempt"
+
+//the number of the current attempt of a job, missing until the job was requeued for the first time
+func attemptPath(trainingID string) string {
+	return trainingID + "/" + zkAttempt
+}
+
+//the keys of a previous attempt of a job are archived as <training id>/attempts/<attempt>/<key>
+func attemptArchivePath(trainingID string, attempt int) string {
+	return fmt.Sprintf("%s/%s/%d/", trainingID, zkAttempts, attempt)
+}
+
+//keptAcrossAttempts tells the keys which describe the job rather than an attempt of it, they are not archived
+func keptAcrossAttempts(trainingID string, key string) bool {
+	return key == attemptPath(trainingID) || key == checkpointPath(trainingID) || key == resumesFromPath(trainingID) ||
+		strings.HasPrefix(key, trainingID+"/"+zkAttempts+"/") || strings.HasPrefix(key, jobConfigPath(trainingID)) ||
+		strings.HasPrefix(key, leaderElectionPath(trainingID)) || strings.HasPrefix(key, outcomeNotificationsPath(trainingID))
+}
+
+//loadAttempt reads the number of the current attempt of the job, along with the raw value for a compare and swap
+func (jm *JobMonitor) loadAttempt(logr *logger.LocLoggingEntry) (int, string, error) {
+	response, err := jm.EtcdClient.Get(attemptPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return 1, "", err
+	}
+	attempt, err := strconv.Atoi(response[0].Value)
+	if err != nil || attempt < 1 {
+		return 1, response[0].Value, fmt.Errorf("invalid attempt %q of %s", response[0].Value, jm.TrainingID)
+	}
+	return attempt, response[0].Value, nil
+}
+
+//archivePreviousAttempt starts a new attempt of a job the trainer requeued: one whose previous attempt was torn down
+//completely, or which is deployed with a later Config.Attempt than the one in etcd. The statuses, processed offsets, teardown record and audit
+//trail of the previous attempt are moved under its attempt number, so that the new attempt starts from a clean status
+//stream instead of picking up the terminal state of the previous one. The teardown record is removed last, together
+//with the attempt number moving on, so that a job monitor dying midway archives again after its restart
+func (jm *JobMonitor) archivePreviousAttempt(logr *logger.LocLoggingEntry) error {
+	attempt, previous, err := jm.loadAttempt(logr)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&jm.attempt, int32(attempt))
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil {
+		return err
+	}
+	requeued := jm.deployedAttempt > attempt || (jm.deployedAttempt == 0 && rec != nil && rec.reached(teardownPodsGone))
+	if !requeued {
+		return nil
+	}
+	next := attempt + 1
+	if jm.deployedAttempt > next {
+		next = jm.deployedAttempt
+	}
+
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	response, err := etcd.Get(ctx, jobBasePath(jm.TrainingID), clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	// whatever got written after the previous attempt was torn down already belongs to the new one
+	cutoff := response.Header.Revision
+	var teardownRevision int64
+	for _, kv := range response.Kvs {
+		if string(kv.Key) == teardownPath(jm.TrainingID) {
+			cutoff, teardownRevision = kv.ModRevision, kv.ModRevision
+		}
+	}
+
+	archive := attemptArchivePath(jm.TrainingID, attempt)
+	archived := 0
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		if keptAcrossAttempts(jm.TrainingID, key) || kv.ModRevision > cutoff {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+		_, err = etcd.Put(ctx, archive+strings.TrimPrefix(key, jobBasePath(jm.TrainingID)), string(kv.Value))
+		if err == nil && key != teardownPath(jm.TrainingID) {
+			_, err = etcd.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).Then(clientv3.OpDelete(key)).Commit()
+		}
+		cancel()
+		if err != nil {
+			return err
+		}
+		archived++
+	}
+
+	var attemptUnchanged clientv3.Cmp
+	if previous == "" {
+		attemptUnchanged = clientv3.Compare(clientv3.Version(attemptPath(jm.TrainingID)), "=", 0)
+	} else {
+		attemptUnchanged = clientv3.Compare(clientv3.Value(attemptPath(jm.TrainingID)), "=", previous)
+	}
+	conditions := []clientv3.Cmp{attemptUnchanged}
+	ops := []clientv3.Op{clientv3.OpPut(attemptPath(jm.TrainingID), strconv.Itoa(next))}
+	if teardownRevision > 0 {
+		conditions = append(conditions, clientv3.Compare(clientv3.ModRevision(teardownPath(jm.TrainingID)), "=", teardownRevision))
+		ops = append(ops, clientv3.OpDelete(teardownPath(jm.TrainingID)))
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	txn, err := etcd.Txn(ctx).If(conditions...).Then(ops...).Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return fmt.Errorf("the attempt or the teardown of %s changed while archiving attempt %d", jm.TrainingID, attempt)
+	}
+
+	atomic.StoreInt32(&jm.attempt, int32(next))
+	jm.resetAttemptState()
+	logr.Infof("(archivePreviousAttempt) %s was requeued, archived the %d keys of attempt %d under %s", jm.TrainingID, archived, attempt, archive)
+	jm.audit(logr, auditRequeue, "requeued, attempt %d archived under %s", attempt, archive)
+	return nil
+}
+
+//Attempt ... the attempt of the job being monitored, 1 unless the trainer requeued it
+func (jm *JobMonitor) Attempt() int {
+	if attempt := atomic.LoadInt32(&jm.attempt); attempt > 0 {
+		return int(attempt)
+	}
+	return 1
+}
+
+//attemptSummary is the attempt of the job and, if known, out of how many, e.g. "2/3"
+func (jm *JobMonitor) attemptSummary() string {
+	if jm.maxAttempts > 0 {
+		return fmt.Sprintf("%d/%d", jm.Attempt(), jm.maxAttempts)
+	}
+	return strconv.Itoa(jm.Attempt())
+}
+
+//resetAttemptState forgets what the job monitor knows about the previous attempt of the job
+func (jm *JobMonitor) resetAttemptState() {
+	atomic.StoreInt32(&jm.terminalStatus, 0)
+	atomic.StoreInt32(&jm.trainerTerminal, 0)
+	atomic.StoreInt32(&jm.publishedStatus, 0)
+	atomic.StoreInt32(&jm.haltRequested, 0)
+	atomic.StoreInt32(&jm.earlyStopped, 0)
+	atomic.StoreUint64(&jm.numTerminalLearners, 0)
+	jm.processedMu.Lock()
+	jm.processed = make(map[int]int)
+	jm.persistedOffsets = make(map[int]string)
+	jm.processedMu.Unlock()
+	jm.learnerStatusMu.Lock()
+	jm.learnerStatuses = nil
+	jm.learnerTimestamps = nil
+	jm.learnerPhases = nil
+	jm.learnerStatusMu.Unlock()
+	jm.heartbeats.mu.Lock()
+	jm.heartbeats.expired = nil
+	jm.heartbeats.dead = nil
+	jm.heartbeats.mu.Unlock()
+	jm.elasticity.mu.Lock()
+	jm.elasticity.members, jm.elasticity.seen = nil, nil
+	jm.elasticity.mu.Unlock()
+	jm.summaries.mu.Lock()
+	jm.summaries.latest, jm.summaries.changed, jm.summaries.aggregated = nil, false, ""
+	jm.summaries.mu.Unlock()
+	jm.earlyStopping.mu.Lock()
+	jm.earlyStopping.plateaus = nil
+	jm.earlyStopping.mu.Unlock()
+	jm.initReported = ""
+}
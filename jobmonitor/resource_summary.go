@@ -0,0 +1,127 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"google.golang.org/grpc/metadata"
+
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// grpc metadata key carrying the resource summary of the job with every status update
+const resourceSummaryHeader = "resource-summary"
+
+// value of the service label the LCM puts on the learner pods
+const learnerServiceLabel = "dlaas-learner"
+
+//resourceSummary ... the scale of a job, compact enough to go along with every status update
+type resourceSummary struct {
+	LearnersRequested int
+	LearnersRunning   int
+	GpuType           string
+	TotalGpus         float32
+}
+
+func (r resourceSummary) String() string {
+	summary := fmt.Sprintf("learners=%d/%d", r.LearnersRunning, r.LearnersRequested)
+	if r.TotalGpus > 0 {
+		summary = fmt.Sprintf("%s;gpus=%g;gpu_type=%s", summary, r.TotalGpus, r.GpuType)
+	}
+	return summary
+}
+
+//getTrainingJob reads the training spec of a job from the trainer, or a client connected for the call if it is nil
+func getTrainingJob(trainer grpc_trainer_v2.TrainerClient, trainingID string, userID string, logr *logger.LocLoggingEntry) (job *grpc_trainer_v2.Job, err error) {
+	span, logr := startSpan(logr, spanTrainerGet, spanKindClient, map[string]string{"training_id": trainingID})
+	defer func() { endSpan(span, err) }()
+	if trainer == nil {
+		connection, err := client.NewTrainer()
+		if err != nil {
+			failedTrainerConnectivityCounter.Add(1)
+			return nil, err
+		}
+		defer connection.Close()
+		trainer = connection.Client()
+	}
+
+	if err := simulatedTrainerOutage(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if value := traceparent(logr); value != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, traceparentHeader, value)
+	}
+	response, err := trainer.GetTrainingJob(ctx, &grpc_trainer_v2.GetRequest{TrainingId: trainingID, UserId: userID})
+	if err != nil {
+		return nil, err
+	}
+	return response.Job, nil
+}
+
+//trainingResources returns the resources of the training spec, read from the trainer once
+func (jm *JobMonitor) trainingResources(logr *logger.LocLoggingEntry) *grpc_trainer_v2.ResourceRequirements {
+	jm.resourcesMu.Lock()
+	defer jm.resourcesMu.Unlock()
+	if jm.resources != nil {
+		return jm.resources
+	}
+	job, err := getTrainingJob(jm.lifecycle.Trainer, jm.TrainingID, jm.UserID, logr)
+	if err != nil {
+		logr.WithError(err).Warnf("failed to read the training spec of %s from the trainer", jm.TrainingID)
+		return nil
+	}
+	jm.resources = job.GetTraining().GetResources()
+	return jm.resources
+}
+
+//learnerPods lists the learner pods of the job, none if they can't be listed
+func (jm *JobMonitor) learnerPods(logr *logger.LocLoggingEntry) []v1core.Pod {
+	if jm.k8sClient == nil {
+		return nil
+	}
+	selector := fmt.Sprintf("training_id==%s,service==%s", jm.TrainingID, learnerServiceLabel)
+	pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logr.WithError(err).Warnf("failed to list the learner pods of %s", jm.TrainingID)
+		return nil
+	}
+	return pods.Items
+}
+
+//resourceSummary puts together the resource summary of the job from the training spec and the learner pods of the job
+func (jm *JobMonitor) resourceSummary(pods []v1core.Pod, logr *logger.LocLoggingEntry) resourceSummary {
+	summary := resourceSummary{LearnersRequested: jm.learnerCount()}
+	for _, pod := range pods {
+		if pod.Status.Phase == v1core.PodRunning {
+			summary.LearnersRunning++
+		}
+	}
+	if resources := jm.trainingResources(logr); resources != nil {
+		summary.GpuType = resources.GetGpuType()
+		summary.TotalGpus = resources.GetGpus() * float32(summary.LearnersRequested)
+	}
+	return summary
+}
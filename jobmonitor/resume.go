@@ -0,0 +1,70 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+const (
+	zkCheckpoint  = "checkpoint"
+	zkResumesFrom = "resumes_from"
+)
+
+// grpc metadata key carrying the training a job was resumed from
+const resumesFromHeader = "resumes-from"
+
+//learners write the location of the last checkpoint they stored to this key
+func checkpointPath(trainingID string) string {
+	return trainingID + "/" + zkCheckpoint
+}
+
+//the training a job resumes from, recorded for everyone looking at the etcd tree of the job
+func resumesFromPath(trainingID string) string {
+	return trainingID + "/" + zkResumesFrom
+}
+
+//inheritCheckpoint copies the last checkpoint pointer of the job this one resumes from into the tree of this job, where
+//the learners pick it up. An existing pointer is never overwritten, it is either from an earlier run of the job monitor
+//or it was already written by the learners of this job
+func (jm *JobMonitor) inheritCheckpoint(logr *logger.LocLoggingEntry) {
+	if jm.ResumesFrom == "" {
+		return
+	}
+	if _, err := jm.EtcdClient.PutIfKeyMissing(resumesFromPath(jm.TrainingID), jm.ResumesFrom, logr); err != nil {
+		logr.WithError(err).Warnf("failed to record that %s resumes from %s", jm.TrainingID, jm.ResumesFrom)
+	}
+
+	response, err := jm.EtcdClient.Get(checkpointPath(jm.ResumesFrom), logr)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to read the last checkpoint of %s, %s starts without it", jm.ResumesFrom, jm.TrainingID)
+		return
+	}
+	if len(response) == 0 || response[0].Value == "" {
+		logr.Warnf("%s has no checkpoint to resume %s from", jm.ResumesFrom, jm.TrainingID)
+		return
+	}
+
+	copied, err := jm.EtcdClient.PutIfKeyMissing(checkpointPath(jm.TrainingID), response[0].Value, logr)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to copy the checkpoint %s of %s to %s", response[0].Value, jm.ResumesFrom, jm.TrainingID)
+		return
+	}
+	if copied {
+		logr.Infof("resuming %s from checkpoint %s of %s", jm.TrainingID, response[0].Value, jm.ResumesFrom)
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/spf13/viper"
+)
+
+//ResyncResult ... what Resync did for a job
+type ResyncResult struct {
+	TrainingID string `json:"training_id"`
+	// the status of the job as the job monitor has it, and as the trainer had it before the resync
+	Status        string `json:"status,omitempty"`
+	TrainerStatus string `json:"trainer_status,omitempty"`
+	// the number of updates sent to the trainer, 0 if it was in sync already
+	Pushed int    `json:"pushed"`
+	Error  string `json:"error,omitempty"`
+}
+
+//authoritativeStatus is the status of the job as the job monitor has it: the final status of the teardown record once
+//there is one, the overall status in etcd otherwise
+func (jm *JobMonitor) authoritativeStatus(logr *logger.LocLoggingEntry) (*client.TrainingStatusUpdate, []ReasonCode, error) {
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if rec != nil {
+		return rec.statusUpdate(), rec.Reasons, nil
+	}
+	value, found, err := jm.quorumGet(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_NOT_STARTED, Timestamp: client.CurrentTimestampAsString()}, nil, nil
+	}
+	return parseStatus(value, logr), nil, nil
+}
+
+//statusHistory are the statuses the job moved through since the given time according to its audit trail, oldest
+//first, without the status it is in now
+func statusHistory(events []auditEvent, since time.Time, current grpc_trainer_v2.Status) []*client.TrainingStatusUpdate {
+	var history []*client.TrainingStatusUpdate
+	last := ""
+	for _, event := range events {
+		if (event.Kind != auditTransition && event.Kind != auditFinalStatus) || event.Status == "" || event.Status == last {
+			continue
+		}
+		last = event.Status
+		if time.Unix(0, event.At).Before(since) {
+			continue
+		}
+		history = append(history, &client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status(grpc_trainer_v2.Status_value[event.Status]),
+			Timestamp: strconv.FormatInt(event.At/int64(time.Millisecond), 10)})
+	}
+	if n := len(history); n > 0 && history[n-1].Status == current {
+		history = history[:n-1]
+	}
+	return history
+}
+
+//Resync repairs the view the trainer has of the job, e.g. after the trainer was restored from a backup. Unless the
+//trainer already shows the status the job monitor has, the statuses the job moved through within history are sent
+//again, oldest first, followed by the current status with its message and error code. The updates carry ReasonResync.
+//The terminal status the trainer was seen with before is forgotten, the trainer may not have it anymore, and updates
+//which are stale nonetheless aren't counted as pushed. Only the leading job monitor of a job resyncs it
+func (jm *JobMonitor) Resync(history time.Duration, logr *logger.LocLoggingEntry) ResyncResult {
+	result := ResyncResult{TrainingID: jm.TrainingID}
+	if !jm.leading() {
+		result.Error = errNotLeader.Error()
+		return result
+	}
+	atomic.StoreInt32(&jm.trainerTerminal, 0)
+	current, reasons, err := jm.authoritativeStatus(logr)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = current.Status.String()
+	if job, err := getTrainingJob(jm.lifecycle.Trainer, jm.TrainingID, jm.UserID, logr); err == nil {
+		trainerStatus := job.GetTrainingStatus().GetStatus()
+		result.TrainerStatus = trainerStatus.String()
+		if trainerStatus == current.Status {
+			return result
+		}
+	} else {
+		logr.WithError(err).Warnf("(Resync) could not get the status of %s from the trainer, resyncing it anyhow", jm.TrainingID)
+	}
+
+	var updates []*client.TrainingStatusUpdate
+	if events, err := jm.auditEvents(logr); err == nil {
+		updates = statusHistory(events, jm.timeSource().Now().Add(-history), current.Status)
+	} else {
+		logr.WithError(err).Warnf("(Resync) could not read the audit trail of %s, resyncing its current status only", jm.TrainingID)
+	}
+	for _, update := range updates {
+		err := jm.updateStatusInTrainer(update, []ReasonCode{ReasonResync}, logr)
+		if err == errStaleUpdate {
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Pushed++
+	}
+	err = jm.updateStatusInTrainer(current, append([]ReasonCode{ReasonResync}, reasons...), logr)
+	if err != nil && err != errStaleUpdate {
+		result.Error = err.Error()
+		return result
+	}
+	if err == nil {
+		result.Pushed++
+	}
+	logr.Infof("(Resync) the trainer had %s as %s, sent %d updates to bring it to %s", jm.TrainingID, result.TrainerStatus, result.Pushed, result.Status)
+	jm.audit(logr, auditResync, "the trainer had %s, resynced it to %s with %d updates", result.TrainerStatus, result.Status, result.Pushed)
+	return result
+}
+
+//ResyncJobs ... resyncs all the jobs monitored by this process, see Resync, one after the other so that the trainer
+//recovering from a restore isn't flooded. history 0 means jobmonitor.resync.history
+func ResyncJobs(history time.Duration, logr *logger.LocLoggingEntry) []ResyncResult {
+	if history <= 0 {
+		history = viper.GetDuration(resyncHistoryKey)
+	}
+	monitoredJobsMu.RLock()
+	jobs := make([]*JobMonitor, 0, len(monitoredJobs))
+	for _, jm := range monitoredJobs {
+		jobs = append(jobs, jm)
+	}
+	monitoredJobsMu.RUnlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].TrainingID < jobs[j].TrainingID })
+
+	results := make([]ResyncResult, 0, len(jobs))
+	for _, jm := range jobs {
+		results = append(results, jm.Resync(history, jm.componentLogger(logr, componentAPI)))
+	}
+	logr.Infof("(ResyncJobs) resynced the %d monitored jobs with the trainer, going back %v", len(jobs), history)
+	return results
+}
+
+//ResyncHandler ... serves ResyncJobs as JSON, e.g. POST /jobs/resync?history=6h
+func ResyncHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		var history time.Duration
+		if value := r.URL.Query().Get("history"); value != "" {
+			var err error
+			if history, err = time.ParseDuration(value); err != nil || history < 0 {
+				http.Error(w, fmt.Sprintf("invalid history %s", value), http.StatusBadRequest)
+				return
+			}
+		}
+		results := ResyncJobs(history, logger.LocLogger(jobLogEntry("", "").WithField(logkeyComponent, componentAPI)))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Jobs []ResyncResult `json:"jobs"`
+		}{results})
+	})
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/spf13/viper"
+)
+
+// the shortest span the write rate of a learner is measured over, so that learners read in quick succession (e.g. in
+// watch mode) aren't rated on the few statuses of a fraction of a second
+const learnerWriteRateWindow = time.Minute
+
+//learnerWrite ... the statuses a learner wrote between two looks at it
+type learnerWrite struct {
+	from, at time.Time
+	n        int
+}
+
+//learnerWriteRates ... the status write rates of the learners of a job, and the learners which got quarantined for
+//writing at a pathological rate (e.g. a bugged retry loop)
+type learnerWriteRates struct {
+	mu          sync.Mutex
+	lastSeen    map[int]time.Time
+	writes      map[int][]learnerWrite
+	rates       map[int]float64
+	quarantined map[int]bool
+}
+
+//observeLearnerWrites records that the learner wrote n statuses since it was last looked at, and returns its write rate
+//in statuses per minute, over the writes of the last learnerWriteRateWindow and over at least that window. The first
+//observation of a learner only sets the baseline, as a restarted job monitor sees all the statuses written so far at
+//once
+func (jm *JobMonitor) observeLearnerWrites(learner int, n int) (float64, bool) {
+	w := &jm.writeRates
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.lastSeen == nil {
+		w.lastSeen = make(map[int]time.Time)
+		w.writes = make(map[int][]learnerWrite)
+		w.rates = make(map[int]float64)
+	}
+	now := jm.timeSource().Now()
+	last, seen := w.lastSeen[learner]
+	w.lastSeen[learner] = now
+	if !seen {
+		return 0, false
+	}
+
+	writes := w.writes[learner]
+	keep := 0
+	for keep < len(writes) && now.Sub(writes[keep].at) >= learnerWriteRateWindow {
+		keep++
+	}
+	writes = append(writes[keep:], learnerWrite{from: last, at: now, n: n})
+	w.writes[learner] = writes
+
+	total := 0
+	for _, write := range writes {
+		total += write.n
+	}
+	span := now.Sub(writes[0].from)
+	if span < learnerWriteRateWindow {
+		span = learnerWriteRateWindow
+	}
+	rate := float64(total) / span.Minutes()
+	w.rates[learner] = rate
+	jm.metrics.learnerWriteRateGauge.With("learner", strconv.Itoa(learner)).Set(rate)
+	return rate, true
+}
+
+func (jm *JobMonitor) isQuarantined(learner int) bool {
+	jm.writeRates.mu.Lock()
+	defer jm.writeRates.mu.Unlock()
+	return jm.writeRates.quarantined[learner]
+}
+
+//quarantinedLearners returns the quarantined learners with the write rate they got quarantined for
+func (jm *JobMonitor) quarantinedLearners() map[int]float64 {
+	jm.writeRates.mu.Lock()
+	defer jm.writeRates.mu.Unlock()
+	quarantined := make(map[int]float64)
+	for learner := range jm.writeRates.quarantined {
+		quarantined[learner] = jm.writeRates.rates[learner]
+	}
+	return quarantined
+}
+
+//checkLearnerWriteRate quarantines a learner which writes more statuses than jobmonitor.learners.write_rate.max per
+//minute: only the terminal statuses of its stream are processed from then on, which protects the trainer from a single
+//bad actor while the job still finishes with the learner, and the job carries a note about it in its status message.
+//It returns true if the learner is quarantined
+func (jm *JobMonitor) checkLearnerWriteRate(learner int, written int, logr *logger.LocLoggingEntry) bool {
+	rate, ok := jm.observeLearnerWrites(learner, written)
+	max := viper.GetFloat64(runawayWriteRateKey)
+	if !ok || max <= 0 || rate <= max {
+		return false
+	}
+
+	jm.writeRates.mu.Lock()
+	if jm.writeRates.quarantined == nil {
+		jm.writeRates.quarantined = make(map[int]bool)
+	}
+	jm.writeRates.quarantined[learner] = true
+	jm.writeRates.mu.Unlock()
+
+	jm.metrics.runawayLearnerCounter.Add(1)
+	message := fmt.Sprintf("learner %d wrote %.0f statuses per minute (at most %.0f are expected), only its final status is processed from now on", learner, rate, max)
+	logr.Errorf("(checkLearnerWriteRate) ALERT runaway learner in %s: %s", jm.TrainingID, message)
+
+	// flag it on the job, keeping the overall status it has
+	response, err := jm.EtcdClient.Get(overallJobStatusPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		logr.WithError(err).Warnf("(checkLearnerWriteRate) could not read the overall status of %s to flag the runaway learner", jm.TrainingID)
+		return true
+	}
+	err = jm.updateStatusInTrainer(&client.TrainingStatusUpdate{
+		Status:        parseStatus(response[0].Value, logr).Status,
+		Timestamp:     client.CurrentTimestampAsString(),
+		StatusMessage: message,
+	}, []ReasonCode{ReasonRunawayLearner}, logr)
+	if err != nil && err != errStaleUpdate {
+		logr.WithError(err).Warnf("(checkLearnerWriteRate) failed to flag the runaway learner %d of %s", learner, jm.TrainingID)
+	}
+	return true
+}
+
+//processQuarantinedStatuses skips the statuses a quarantined learner wrote since the last call, except for a terminal
+//one which is processed, so that a quarantined learner doesn't leave its job waiting for the learner forever
+func (jm *JobMonitor) processQuarantinedStatuses(i int, seqName string, statuses []string, vocabulary *statusVocabulary, logr *logger.LocLoggingEntry) {
+	for j := jm.processedOffset(i); j < len(statuses); j++ {
+		status := statuses[j]
+		if translated, _, ok := vocabulary.translate(status); ok {
+			status = translated
+		}
+		if update := parseStatus(status, logr); isTerminalStatus(update.Status) {
+			jm.recordLearnerStatus(i, update.Status)
+			jm.recordLearnerTimestamp(i, update.Timestamp)
+			jm.recordLearnerPhase(i, update.Status, update.Timestamp)
+			jm.processUpdateLearnerStatus(seqName, status, logr)
+		}
+		jm.advanceProcessedOffset(i)
+	}
+	jm.persistProcessedOffset(i, logr)
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/spf13/viper"
+)
+
+// kinds of jobs deployed by the LCM
+const (
+	JobKindTraining     = "training"
+	JobKindBatchScoring = "batch-scoring"
+)
+
+const (
+	zkScorer  = "scorer"
+	zkResults = "results"
+)
+
+//a batch-scoring job has a single scorer instead of learners, it writes its statuses (QUEUED, SCORING, COMPLETED...)
+//to this value sequence, with the same encoding the learners use for theirs
+func scorerStatusPath(trainingID string) string {
+	return fmt.Sprintf("%s/%s/%s/", trainingID, zkScorer, zkStatus)
+}
+
+//the scorer writes the number of records it scored to this key
+func scorerResultsPath(trainingID string) string {
+	return fmt.Sprintf("%s/%s/%s", trainingID, zkScorer, zkResults)
+}
+
+//maps the status vocabulary of the scorer to the statuses the trainer knows about
+var scoringStatusMap = map[string]grpc_trainer_v2.Status{
+	"QUEUED":    grpc_trainer_v2.Status_PENDING,
+	"SCORING":   grpc_trainer_v2.Status_PROCESSING,
+	"COMPLETED": grpc_trainer_v2.Status_COMPLETED,
+	"FAILED":    grpc_trainer_v2.Status_FAILED,
+	"HALTED":    grpc_trainer_v2.Status_HALTED,
+}
+
+func (jm *JobMonitor) isBatchScoring() bool {
+	return jm.JobKind == JobKindBatchScoring
+}
+
+//monitorScoringJob polls the status sequence of the scorer, at a shorter interval than the learners of a training
+//since scoring jobs are short lived, and drives the overall status through the same path as a single learner would
+func (jm *JobMonitor) monitorScoringJob(logr *logger.LocLoggingEntry) {
+	vocabulary := statusVocabularyFromConfig().withInbound(scoringStatusMap)
+	processed := 0
+	ticker := jm.timeSource().NewTicker(viper.GetDuration(scoringPollIntervalKey))
+	defer ticker.Stop()
+	for range ticker.C() {
+		seqName := scorerStatusPath(jm.TrainingID)
+		statuses, err := jm.sequenceValues(seqName, logr)
+		if err != nil {
+			logr.WithError(err).Errorf("Job Monitor could not connect to ETCD to get the status of the scorer of %s", jm.TrainingID)
+			jm.metrics.failedETCDConnectivityCounter.Add(1)
+			continue
+		}
+
+		for ; processed < len(statuses); processed++ {
+			translated, status, ok := vocabulary.translate(statuses[processed])
+			if !ok {
+				logr.Warnf("ignoring unknown scorer status %s of %s", statuses[processed], jm.TrainingID)
+				continue
+			}
+			if err := jm.processUpdateLearnerStatus(seqName, translated, logr); err != nil {
+				logr.WithError(err).Errorf("failed to process the scorer status %s of %s", statuses[processed], jm.TrainingID)
+			}
+			if isTerminalStatus(status) {
+				return
+			}
+		}
+	}
+}
+
+//reportScoringResults adds the number of scored records to the final status of a completed scoring job
+func (jm *JobMonitor) reportScoringResults(statusUpdate *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) {
+	response, err := jm.EtcdClient.Get(scorerResultsPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		logr.WithError(err).Warnf("no result count reported by the scorer of %s", jm.TrainingID)
+		return
+	}
+	results, err := strconv.ParseInt(strings.TrimSpace(response[0].Value), 10, 64)
+	if err != nil {
+		logr.WithError(err).Warnf("invalid result count %s reported by the scorer of %s", response[0].Value, jm.TrainingID)
+		return
+	}
+	jm.metrics.scoredResultsGauge.Set(float64(results))
+	statusUpdate.StatusMessage = fmt.Sprintf("%s (scored %d records)", statusUpdate.StatusMessage, results)
+}
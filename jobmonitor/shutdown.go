@@ -0,0 +1,93 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+//Stop ... stops monitoring the job, e.g. on SIGTERM of the pod: the monitoring loops, watches and teardown retries
+//end, the trainer updates in flight, the queued transition events and the ended spans are waited for until ctx is
+//done, the leadership is handed over to the standby, then the pending audit events are written and the etcd clients
+//closed. A teardown which wasn't finished is resumed by the next job monitor of the job
+func (jm *JobMonitor) Stop(ctx context.Context, logr *logger.LocLoggingEntry) error {
+	jm.finish()
+
+	drained := make(chan struct{})
+	go func() {
+		jm.inFlight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+		logr.WithError(err).Warnf("(Stop) gave up waiting for the trainer updates of %s in flight", jm.TrainingID)
+	}
+
+	if flushErr := events.flush(ctx); flushErr != nil {
+		err = flushErr
+		logr.WithError(err).Warnf("(Stop) gave up waiting for the transition events of %s to be published", jm.TrainingID)
+	}
+	if flushErr := flushTraces(ctx); flushErr != nil {
+		logr.WithError(flushErr).Warnf("(Stop) failed to export the spans of %s", jm.TrainingID)
+	}
+	jm.resignLeadership(logr)
+	jm.flushAudit(logr)
+	jm.closeWatchClient()
+	if jm.EtcdClient != nil {
+		jm.EtcdClient.Close(logr)
+	}
+	return err
+}
+
+//Done ... is closed once the job monitor stopped monitoring the job, because its workload is verified gone or Stop was
+//called
+func (jm *JobMonitor) Done() <-chan struct{} {
+	if jm.ctx == nil {
+		return nil
+	}
+	return jm.ctx.Done()
+}
+
+//context is canceled once the job monitor stops monitoring the job
+func (jm *JobMonitor) context() context.Context {
+	if jm.ctx == nil {
+		return context.Background()
+	}
+	return jm.ctx
+}
+
+//closeWatchClient closes the etcd client of the watches, it's connected again if needed. The shared client of a
+//Controller is kept
+func (jm *JobMonitor) closeWatchClient() {
+	jm.etcdMu.Lock()
+	defer jm.etcdMu.Unlock()
+	if jm.etcd != nil && !jm.etcd.shared {
+		jm.etcd.Close()
+		jm.etcd = nil
+	}
+}
+
+func (jm *JobMonitor) finish() {
+	if jm.cancel != nil {
+		jm.cancel()
+	}
+}
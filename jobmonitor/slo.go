@@ -0,0 +1,156 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/go-kit/kit/metrics"
+	"github.com/spf13/viper"
+)
+
+// causes of a job outcome, as far as the error budget is concerned
+const (
+	causeNone        = "none"
+	causeUser        = "user"
+	causePlatform    = "platform"
+	causeMaintenance = "maintenance"
+)
+
+//error codes of failures the platform is to blame for, the rest are considered caused by the user (e.g. the training
+//code exiting with an error)
+var platformErrorCodes = []string{
+	client.ErrCodeInsufficientResources,
+	client.ErrCodeEtcdConnection,
+	client.ErrCodeK8SConnection,
+	client.ErrFailedPodReasonUnknown,
+	errCodeEvicted,
+}
+
+type jobOutcome struct {
+	at    time.Time
+	cause string
+}
+
+//outcomeBudget ... the outcomes of the jobs finished by this process over the configured rolling windows, exported as
+//the ratio of jobs failed by the platform per window. In multi-job mode it covers all jobs of the deployment
+type outcomeBudget struct {
+	mu            sync.Mutex
+	outcomes      []jobOutcome
+	windows       []time.Duration
+	platformCodes map[string]bool
+	failures      metrics.Counter
+	ratio         metrics.Gauge
+}
+
+var (
+	jobOutcomes     *outcomeBudget
+	jobOutcomesOnce sync.Once
+)
+
+//outcomesOf returns the process wide outcome budget, its metrics are emitted through the metrics provider of the first
+//job asking for it
+func outcomesOf(provider MetricsProvider) *outcomeBudget {
+	jobOutcomesOnce.Do(func() {
+		jobOutcomes = newOutcomeBudget(provider, viper.GetStringSlice(sloWindowsKey), viper.GetStringSlice(sloPlatformErrorCodesKey))
+	})
+	return jobOutcomes
+}
+
+func newOutcomeBudget(provider MetricsProvider, windows []string, extraPlatformCodes []string) *outcomeBudget {
+	b := &outcomeBudget{platformCodes: make(map[string]bool)}
+	for _, code := range append(platformErrorCodes, extraPlatformCodes...) {
+		b.platformCodes[code] = true
+	}
+	for _, w := range windows {
+		if d, err := time.ParseDuration(w); err == nil && d > 0 {
+			b.windows = append(b.windows, d)
+		}
+	}
+	provider = metricsOrNoop(provider)
+	b.failures = provider.NewCounter("jobmonitor.slo.failures")
+	b.ratio = provider.NewGauge("jobmonitor.slo.platform_failure_ratio")
+	return b
+}
+
+//cause classifies the final status of a job
+func (b *outcomeBudget) cause(statusUpdate *client.TrainingStatusUpdate) string {
+	if statusUpdate.Status != grpc_trainer_v2.Status_FAILED {
+		return causeNone
+	}
+	if b.platformCodes[statusUpdate.ErrorCode] {
+		// connectivity errors are expected while etcd or kubernetes are upgraded
+		if _, ok := activeMaintenanceWindow(time.Now()); ok && connectivityErrorCodes[statusUpdate.ErrorCode] {
+			return causeMaintenance
+		}
+		return causePlatform
+	}
+	return causeUser
+}
+
+//record adds the final status of a job to the budget and refreshes the ratios of all windows
+func (b *outcomeBudget) record(statusUpdate *client.TrainingStatusUpdate) {
+	b.recordAt(statusUpdate, time.Now())
+}
+
+func (b *outcomeBudget) recordAt(statusUpdate *client.TrainingStatusUpdate, now time.Time) {
+	cause := b.cause(statusUpdate)
+	if cause != causeNone {
+		b.failures.With("cause", cause).Add(1)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.outcomes = append(b.outcomes, jobOutcome{at: now, cause: cause})
+
+	var longest time.Duration
+	for _, w := range b.windows {
+		if w > longest {
+			longest = w
+		}
+	}
+	keep := 0
+	for keep < len(b.outcomes) && now.Sub(b.outcomes[keep].at) > longest {
+		keep++
+	}
+	b.outcomes = b.outcomes[keep:]
+
+	for _, w := range b.windows {
+		b.ratio.With("window", w.String()).Set(b.platformFailureRatio(w, now))
+	}
+}
+
+//platformFailureRatio is the fraction of the jobs finished in the window which failed because of the platform
+func (b *outcomeBudget) platformFailureRatio(window time.Duration, now time.Time) float64 {
+	total, platform := 0, 0
+	for _, o := range b.outcomes {
+		if now.Sub(o.at) > window {
+			continue
+		}
+		total++
+		if o.cause == causePlatform {
+			platform++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(platform) / float64(total)
+}
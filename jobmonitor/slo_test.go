@@ -0,0 +1,43 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcomeBudgetRatioPerWindow(t *testing.T) {
+	b := newOutcomeBudget(nil, []string{"1h", "24h"}, []string{"QUOTA"})
+	now := time.Now()
+
+	b.recordAt(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_FAILED, ErrorCode: client.ErrCodeK8SConnection}, now.Add(-2*time.Hour))
+	b.recordAt(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_FAILED, ErrorCode: "QUOTA"}, now.Add(-10*time.Minute))
+	b.recordAt(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_FAILED, ErrorCode: "user code exited with 1"}, now.Add(-5*time.Minute))
+	b.recordAt(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_COMPLETED}, now)
+
+	assert.InDelta(t, 1.0/3, b.platformFailureRatio(time.Hour, now), 0.001)
+	assert.InDelta(t, 2.0/4, b.platformFailureRatio(24*time.Hour, now), 0.001)
+
+	// outcomes older than the longest window are dropped
+	b.recordAt(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_HALTED}, now.Add(25*time.Hour))
+	assert.Len(t, b.outcomes, 1)
+}
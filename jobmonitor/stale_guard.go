@@ -0,0 +1,55 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/spf13/viper"
+)
+
+// what updateStatusInTrainer returns for the updates it doesn't send since they are stale, see staleUpdate
+var errStaleUpdate = errors.New("not sent, the trainer already shows a terminal status")
+
+//staleUpdate tells whether a non-terminal update would move the job back from a terminal status the trainer already
+//has, e.g. one an admin set or one sent by another path. The trainer is only asked with jobmonitor.trainer.stale_guard
+//set, and not again once it showed a terminal status. If the trainer can't be asked, the update is not stale
+func (jm *JobMonitor) staleUpdate(statusUpdate *client.TrainingStatusUpdate, logr *logger.LocLoggingEntry) bool {
+	if isTerminalStatus(statusUpdate.Status) || !viper.GetBool(staleGuardKey) {
+		return false
+	}
+	trainerStatus := grpc_trainer_v2.Status(atomic.LoadInt32(&jm.trainerTerminal))
+	if !isTerminalStatus(trainerStatus) {
+		job, err := getTrainingJob(jm.lifecycle.Trainer, jm.TrainingID, jm.UserID, logr)
+		if err != nil {
+			logr.WithError(err).Debugf("(staleUpdate) could not get the status of %s from the trainer, sending %s anyhow", jm.TrainingID, statusUpdate.Status)
+			return false
+		}
+		trainerStatus = job.GetTrainingStatus().GetStatus()
+		if !isTerminalStatus(trainerStatus) {
+			return false
+		}
+		atomic.StoreInt32(&jm.trainerTerminal, int32(trainerStatus))
+		jm.audit(logr, auditStaleUpdate, "the trainer shows %s, the job monitor no longer sends non-terminal updates", trainerStatus)
+	}
+	logr.Warnf("(staleUpdate) not sending %s for %s, the trainer already shows %s", statusUpdate.Status, jm.TrainingID, trainerStatus)
+	return true
+}
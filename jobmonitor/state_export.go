@@ -0,0 +1,247 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/lcmconfig"
+	"github.com/coreos/etcd/clientv3"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// names of the files inside a state archive
+const (
+	stateEtcdFile    = "etcd.json"
+	stateOffsetsFile = "offsets.json"
+	statePodsFile    = "pods.json"
+	stateInfoFile    = "info.json"
+)
+
+type stateInfo struct {
+	TrainingID string `json:"training_id"`
+	ExportedAt string `json:"exported_at"`
+	Revision   int64  `json:"etcd_revision"`
+}
+
+type etcdStateKV struct {
+	Key string `json:"key"`
+	// base64 in the archive, so that values which aren't UTF-8 are kept as they are
+	Value []byte `json:"value_bytes"`
+	// the value in archives from before value_bytes, read only
+	TextValue   string `json:"value,omitempty"`
+	ModRevision int64  `json:"mod_revision"`
+}
+
+//value returns the value of the key, from the text value of an archive written before value_bytes
+func (kv etcdStateKV) value() string {
+	if kv.Value == nil {
+		return kv.TextValue
+	}
+	return string(kv.Value)
+}
+
+type podDiagnostics struct {
+	Name       string                 `json:"name"`
+	Node       string                 `json:"node"`
+	Phase      string                 `json:"phase"`
+	Reason     string                 `json:"reason,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	Containers []containerDiagnostics `json:"containers,omitempty"`
+}
+
+type containerDiagnostics struct {
+	Name         string `json:"name"`
+	Ready        bool   `json:"ready"`
+	RestartCount int32  `json:"restart_count"`
+	State        string `json:"state"`
+	Reason       string `json:"reason,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+//ExportState ... writes a gzipped tar archive with everything the job monitor knows about the training: the etcd subtree
+//of the training, the processed status offsets and the diagnostics of the pods of the training. Meant to be attached
+//to support tickets and replayed in a dev environment with ImportState
+func (jm *JobMonitor) ExportState(w io.Writer, logr *logger.LocLoggingEntry) error {
+	etcd, err := newEtcdClient(jm.etcdConfig, logr)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+	return exportState(etcd, jm.TrainingID, jm.processedOffsets(), jm.k8sClient, w, logr)
+}
+
+//ExportState ... exports the state of a training without a running job monitor, see JobMonitor.ExportState.
+//offsets and k8sClient are optional
+func ExportState(trainingID string, offsets map[int]int, k8sClient kubernetes.Interface, w io.Writer, logr *logger.LocLoggingEntry) error {
+	etcd, err := newEtcdClient(defaultCoordinatorConfig(), logr)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+	return exportState(etcd, trainingID, offsets, k8sClient, w, logr)
+}
+
+func exportState(etcd *etcdClient, trainingID string, offsets map[int]int, k8sClient kubernetes.Interface, w io.Writer, logr *logger.LocLoggingEntry) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	resp, err := etcd.Get(ctx, jobBasePath(trainingID), clientv3.WithPrefix())
+	if err != nil {
+		logr.WithError(err).Errorf("failed to read the etcd subtree of training %s", trainingID)
+		return err
+	}
+	kvs := make([]etcdStateKV, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, etcdStateKV{Key: strings.TrimPrefix(string(kv.Key), jobBasePath(trainingID)), Value: kv.Value, ModRevision: kv.ModRevision})
+	}
+
+	if k8sClient == nil {
+		if k8sConfig, err := lcmconfig.GetKubernetesConfig(); err == nil {
+			k8sClient, _ = kubernetes.NewForConfig(k8sConfig)
+		}
+	}
+	var pods []podDiagnostics
+	if k8sClient != nil {
+		pods, err = collectPodDiagnostics(k8sClient, trainingID)
+		if err != nil {
+			logr.WithError(err).Warnf("failed to collect pod diagnostics of training %s, exporting without them", trainingID)
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	info := stateInfo{TrainingID: trainingID, ExportedAt: time.Now().UTC().Format(time.RFC3339), Revision: resp.Header.Revision}
+	for name, content := range map[string]interface{}{stateInfoFile: info, stateEtcdFile: kvs, stateOffsetsFile: offsets, statePodsFile: pods} {
+		if err := writeTarJSON(tw, name, content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+//ImportState ... replays the etcd subtree of an archive written by ExportState under the given training id (which may
+//differ from the exported one), so the job monitor can be run against it in a dev environment. The keys are written in
+//one transaction, all of them or none
+func ImportState(trainingID string, r io.Reader, logr *logger.LocLoggingEntry) error {
+	etcd, err := newEtcdClient(defaultCoordinatorConfig(), logr)
+	if err != nil {
+		return err
+	}
+	defer etcd.Close()
+	return importState(etcd, trainingID, r, logr)
+}
+
+func importState(etcd *etcdClient, trainingID string, r io.Reader, logr *logger.LocLoggingEntry) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	var kvs []etcdStateKV
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Name != stateEtcdFile {
+			continue
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, &kvs); err != nil {
+			return err
+		}
+	}
+	if kvs == nil {
+		return fmt.Errorf("archive does not contain %s", stateEtcdFile)
+	}
+
+	puts := make([]clientv3.Op, 0, len(kvs))
+	for _, kv := range kvs {
+		puts = append(puts, clientv3.OpPut(jobBasePath(trainingID)+kv.Key, kv.value()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	defer cancel()
+	if _, err := etcd.Txn(ctx).Then(puts...).Commit(); err != nil {
+		// e.g. more keys than the --max-txn-ops of etcd
+		logr.WithError(err).Errorf("failed to import the %d keys of training %s, none were written", len(kvs), trainingID)
+		return err
+	}
+	logr.Infof("imported %d keys into training %s", len(kvs), trainingID)
+	return nil
+}
+
+func collectPodDiagnostics(k8sClient kubernetes.Interface, trainingID string) ([]podDiagnostics, error) {
+	selector := "training_id==" + trainingID
+	pods, err := k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	diagnostics := make([]podDiagnostics, 0, len(pods.Items))
+	for _, pod := range pods.Items {
+		d := podDiagnostics{Name: pod.ObjectMeta.Name, Node: pod.Spec.NodeName, Phase: string(pod.Status.Phase),
+			Reason: pod.Status.Reason, Message: pod.Status.Message}
+		for _, cs := range pod.Status.ContainerStatuses {
+			c := containerDiagnostics{Name: cs.Name, Ready: cs.Ready, RestartCount: cs.RestartCount}
+			switch {
+			case cs.State.Waiting != nil:
+				c.State, c.Reason, c.Message = "waiting", cs.State.Waiting.Reason, cs.State.Waiting.Message
+			case cs.State.Terminated != nil:
+				c.State, c.Reason, c.Message = "terminated", cs.State.Terminated.Reason, cs.State.Terminated.Message
+			case cs.State.Running != nil:
+				c.State = "running"
+			}
+			d.Containers = append(d.Containers, c)
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics, nil
+}
+
+func writeTarJSON(tw *tar.Writer, name string, content interface{}) error {
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
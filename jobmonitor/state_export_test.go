@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+//stateOf returns the keys of the training in etcd, relative to it, and their values
+func stateOf(t *testing.T, etcd *etcdClient, trainingID string) map[string]string {
+	resp, err := etcd.Get(context.Background(), jobBasePath(trainingID), clientv3.WithPrefix())
+	assert.NoError(t, err)
+	state := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		state[strings.TrimPrefix(string(kv.Key), jobBasePath(trainingID))] = string(kv.Value)
+	}
+	return state
+}
+
+func TestExportImportState(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	memory := newMemoryEtcd()
+	etcd := memory.client()
+	defer etcd.Close()
+	ctx := context.Background()
+	etcd.Put(ctx, overallJobStatusPath("training-exported"), "PROCESSING")
+	etcd.Put(ctx, indvidualJobStatusPath("training-exported", 1)+"0000000000000000001", "DOWNLOADING")
+	etcd.Put(ctx, processedOffsetPath("training-exported", 1), "1")
+	// e.g. a batch of the audit trail, which isn't UTF-8
+	etcd.Put(ctx, auditPath("training-exported")+"0000000000000000042", "\x1f\x8b\x00\xff")
+	etcd.Put(ctx, jobBasePath("training-exported")+"empty", "")
+	etcd.Put(ctx, overallJobStatusPath("training-exportedelsewhere"), "FAILED")
+
+	var archive bytes.Buffer
+	assert.NoError(t, exportState(etcd, "training-exported", map[int]int{1: 1}, fake.NewSimpleClientset(), &archive, logr))
+	assert.NoError(t, importState(etcd, "training-imported", bytes.NewReader(archive.Bytes()), logr))
+	exported := stateOf(t, etcd, "training-exported")
+	assert.Len(t, exported, 5)
+	assert.Equal(t, exported, stateOf(t, etcd, "training-imported"))
+
+	// archives from before value_bytes have the values as text
+	var legacy bytes.Buffer
+	gz := gzip.NewWriter(&legacy)
+	tw := tar.NewWriter(gz)
+	assert.NoError(t, writeTarJSON(tw, stateEtcdFile, []map[string]interface{}{{"key": "status", "value": "COMPLETED", "mod_revision": 3}}))
+	tw.Close()
+	gz.Close()
+	assert.NoError(t, importState(etcd, "training-legacy", &legacy, logr))
+	assert.Equal(t, map[string]string{"status": "COMPLETED"}, stateOf(t, etcd, "training-legacy"))
+
+	assert.Error(t, importState(etcd, "training-broken", strings.NewReader("not an archive"), logr))
+	assert.Empty(t, stateOf(t, etcd, "training-broken"))
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+)
+
+// max number of parsed status values kept, the cache starts over once it is full
+const statusCacheSize = 1024
+
+//statusCache ... remembers the parsed form of raw status values. The same values get parsed over and over, e.g. the
+//overall status is re-read for every learner update, and the parse result only depends on the raw value (which
+//includes the timestamp of the write), so the raw value is the key
+type statusCache struct {
+	mu     sync.Mutex
+	parsed map[string]client.TrainingStatusUpdate
+}
+
+var parsedStatuses = &statusCache{parsed: make(map[string]client.TrainingStatusUpdate)}
+
+//parseStatus is client.GetStatus, served from the cache if the value was parsed before. The caller owns the result
+func parseStatus(value string, logr *logger.LocLoggingEntry) *client.TrainingStatusUpdate {
+	parsedStatuses.mu.Lock()
+	cached, ok := parsedStatuses.parsed[value]
+	parsedStatuses.mu.Unlock()
+	if ok {
+		return &cached
+	}
+
+	statusUpdate := client.GetStatus(value, logr)
+	parsedStatuses.mu.Lock()
+	defer parsedStatuses.mu.Unlock()
+	if len(parsedStatuses.parsed) >= statusCacheSize {
+		parsedStatuses.parsed = make(map[string]client.TrainingStatusUpdate)
+	}
+	parsedStatuses.parsed[value] = *statusUpdate
+	return statusUpdate
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+//statusVocabulary ... maps the status names written by learners (or a scorer) to the statuses the monitor works with
+//internally, and those to the statuses sent to the status service. Deployments with an extended status enum or a
+//different status service adapt the monitor through config, e.g.
+//
+//	jobmonitor.status.inbound:  {"RUNNING": "PROCESSING", "UPLOADING": "STORING"}
+//	jobmonitor.status.outbound: {"PROCESSING": "RUNNING"}
+type statusVocabulary struct {
+	inbound  map[string]grpc_trainer_v2.Status
+	outbound map[grpc_trainer_v2.Status]grpc_trainer_v2.Status
+}
+
+var (
+	configuredVocabulary     *statusVocabulary
+	configuredVocabularyOnce sync.Once
+)
+
+//statusVocabularyFromConfig returns the vocabulary of the process, read from the config on first use
+func statusVocabularyFromConfig() *statusVocabulary {
+	configuredVocabularyOnce.Do(func() {
+		configuredVocabulary = newStatusVocabulary(nil, nil)
+		if !trainerKnowsQueued {
+			configuredVocabulary.inbound["QUEUED"] = grpc_trainer_v2.Status_PENDING
+		}
+		if !trainerKnowsCancelled {
+			configuredVocabulary.inbound["CANCELLED"] = grpc_trainer_v2.Status_HALTED
+		}
+		for name, internal := range viper.GetStringMapString(statusInboundKey) {
+			status, ok := statusByName(internal)
+			if !ok {
+				log.Warnf("ignoring mapping of status %s to unknown status %s", name, internal)
+				continue
+			}
+			configuredVocabulary.inbound[strings.ToUpper(name)] = status
+		}
+		for internal, name := range viper.GetStringMapString(statusOutboundKey) {
+			from, ok := statusByName(internal)
+			to, known := statusByName(name)
+			if !ok || !known {
+				log.Warnf("ignoring outbound mapping of status %s to %s, both must be known to the status service", internal, name)
+				continue
+			}
+			configuredVocabulary.outbound[from] = to
+		}
+	})
+	return configuredVocabulary
+}
+
+func newStatusVocabulary(inbound map[string]grpc_trainer_v2.Status, outbound map[grpc_trainer_v2.Status]grpc_trainer_v2.Status) *statusVocabulary {
+	v := &statusVocabulary{
+		inbound:  make(map[string]grpc_trainer_v2.Status, len(inbound)),
+		outbound: make(map[grpc_trainer_v2.Status]grpc_trainer_v2.Status, len(outbound)),
+	}
+	for name, status := range inbound {
+		v.inbound[name] = status
+	}
+	for from, to := range outbound {
+		v.outbound[from] = to
+	}
+	return v
+}
+
+//withInbound returns a copy of the vocabulary which additionally maps the given status names
+func (v *statusVocabulary) withInbound(inbound map[string]grpc_trainer_v2.Status) *statusVocabulary {
+	extended := newStatusVocabulary(v.inbound, v.outbound)
+	for name, status := range inbound {
+		if _, configured := extended.inbound[name]; !configured {
+			extended.inbound[name] = status
+		}
+	}
+	return extended
+}
+
+//the status of the given name, case insensitive
+func statusByName(name string) (grpc_trainer_v2.Status, bool) {
+	value, ok := grpc_trainer_v2.Status_value[strings.ToUpper(strings.TrimSpace(name))]
+	return grpc_trainer_v2.Status(value), ok
+}
+
+func (v *statusVocabulary) status(name string) (grpc_trainer_v2.Status, bool) {
+	if status, ok := v.inbound[strings.ToUpper(strings.TrimSpace(name))]; ok {
+		return status, true
+	}
+	return statusByName(name)
+}
+
+//translate rewrites a status value, either a plain status name or a JSON object with a status field, into the
+//equivalent value in the internal vocabulary. It returns false for statuses it doesn't know
+func (v *statusVocabulary) translate(value string) (string, grpc_trainer_v2.Status, bool) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return "", grpc_trainer_v2.Status_NOT_STARTED, false
+		}
+		name, _ := fields["status"].(string)
+		status, ok := v.status(name)
+		if !ok {
+			return "", status, false
+		}
+		if name == status.String() {
+			return value, status, true
+		}
+		fields["status"] = status.String()
+		translated, err := json.Marshal(fields)
+		if err != nil {
+			return "", status, false
+		}
+		return string(translated), status, true
+	}
+	status, ok := v.status(value)
+	if !ok {
+		return "", status, false
+	}
+	return status.String(), status, true
+}
+
+//outboundStatus is the status to report to the status service for the internal status
+func (v *statusVocabulary) outboundStatus(status grpc_trainer_v2.Status) grpc_trainer_v2.Status {
+	if mapped, ok := v.outbound[status]; ok {
+		return mapped
+	}
+	return status
+}
@@ -0,0 +1,556 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+	pb "github.com/coreos/etcd/etcdserver/etcdserverpb"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// how often a transaction is tried again when the keys it read changed before it could commit
+const storeCommitAttempts = 10
+
+//kvStore is a coordination store other than etcd, which the etcd client API of the job monitor is served from. A store
+//keeps for every key its value, a version and the revisions it was created and last modified at, the revisions growing
+//with every commit across the store
+type kvStore interface {
+	//read returns the keys in the ranges of ops, like clientv3.OpGet(key, clientv3.WithPrefix()), by key, along with
+	//the revision of the store they were read at
+	read(ctx context.Context, ranges []clientv3.Op) ([]*mvccpb.KeyValue, int64, error)
+	//commit makes the writes of c at once, if the keys it expects are still as they were read. It returns the
+	//revision of the commit, or false when an expected key had changed
+	commit(ctx context.Context, c storeCommit) (int64, bool, error)
+	//wait returns once the keys in the range of op may have changed after revision rev, or when ctx is done
+	wait(ctx context.Context, op clientv3.Op, rev int64) error
+	close() error
+}
+
+//storeCommit ... what a transaction writes, given the keys it read
+type storeCommit struct {
+	// the keys the transaction compared, as read, nil for a key which was missing
+	expected map[string]*mvccpb.KeyValue
+	puts     []storeWrite
+	// the keys removed, as read
+	deletes []*mvccpb.KeyValue
+}
+
+//storeWrite ... the new value of a key, with its version, and what it was read as, nil for a new key
+type storeWrite struct {
+	kv   *mvccpb.KeyValue
+	prev *mvccpb.KeyValue
+}
+
+func (c storeCommit) empty() bool {
+	return len(c.puts) == 0 && len(c.deletes) == 0
+}
+
+//storeBackends ... the stores the job monitor can coordinate through besides etcd, by the scheme of their endpoints,
+//e.g. zookeeper://zk-0:2181/ffdl
+var storeBackends = map[string]func(coord.Config, *logger.LocLoggingEntry) (kvStore, error){
+	"zookeeper": openZookeeperStore,
+	"consul":    openConsulStore,
+	"redis":     openRedisStore,
+	"rediss":    openRedisStore,
+}
+
+//storeScheme returns the scheme of the store the endpoints are for, or "" for etcd
+func storeScheme(endpoints []string) (string, error) {
+	scheme := ""
+	for i, endpoint := range endpoints {
+		s := ""
+		if at := strings.Index(endpoint, "://"); at > 0 {
+			if _, ok := storeBackends[endpoint[:at]]; ok {
+				s = endpoint[:at]
+			}
+		}
+		if i > 0 && s != scheme {
+			return "", fmt.Errorf("the coordinator endpoints %s are for different stores", strings.Join(endpoints, ","))
+		}
+		scheme = s
+	}
+	return scheme, nil
+}
+
+//openStoreClient connects the store of coordConfig if it isn't etcd, and returns an etcd client served by it,
+//namespaced like the one of etcd. It returns nil for etcd
+func openStoreClient(coordConfig coord.Config, logr *logger.LocLoggingEntry) (*etcdClient, error) {
+	scheme, err := storeScheme(coordConfig.Endpoints)
+	if err != nil || scheme == "" {
+		return nil, err
+	}
+	store, err := storeBackends[scheme](coordConfig, logr)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to connect to %s at %s", scheme, strings.Join(coordConfig.Endpoints, ","))
+		return nil, err
+	}
+	return newStoreClient(scheme, store, coordConfig.Prefix), nil
+}
+
+//newStoreClient returns an etcd client served by store. Leases aren't supported, so neither is leader election
+func newStoreClient(name string, store kvStore, prefix string) *etcdClient {
+	cli := clientv3.NewCtxClient(context.Background())
+	cli.KV = namespace.NewKV(&storeKV{name: name, store: store}, prefix)
+	cli.Watcher = namespace.NewWatcher(&storeWatcher{name: name, store: store, watches: make(map[*storeWatch]bool)}, prefix)
+	cli.Lease = storeLease{name: name}
+	return &etcdClient{Client: cli}
+}
+
+//newCoordinator connects the coordinator of cfg: the one of ffdl-lcm for etcd, or one served by the store the
+//endpoints are for
+func newCoordinator(cfg coord.Config, logr *logger.LocLoggingEntry) (coord.Coordinator, error) {
+	if scheme, err := storeScheme(cfg.Endpoints); err != nil {
+		return nil, err
+	} else if scheme == "" {
+		return coord.NewCoordinator(cfg, logr)
+	}
+	cli, err := openStoreClient(cfg, logr)
+	if err != nil {
+		return nil, err
+	}
+	return kvCoordinator{kv: cli.KV, client: cli}, nil
+}
+
+//storeKV ... serves clientv3.KV from a store. Each operation reads the keys it touches, is run against them like the
+//in-memory etcd would, and its writes are committed on the condition that the keys it compared didn't change since;
+//it is run again otherwise
+type storeKV struct {
+	name  string
+	store kvStore
+}
+
+//opRanges returns the ranges of keys op reads or writes
+func opRanges(op clientv3.Op) []clientv3.Op {
+	if !op.IsTxn() {
+		return []clientv3.Op{clientv3.OpGet(string(op.KeyBytes()), clientv3.WithRange(string(op.RangeBytes())))}
+	}
+	cmps, thenOps, elseOps := op.Txn()
+	var ranges []clientv3.Op
+	for _, cmp := range cmps {
+		ranges = append(ranges, clientv3.OpGet(string(cmp.Key)))
+	}
+	for _, op := range append(thenOps, elseOps...) {
+		ranges = append(ranges, opRanges(op)...)
+	}
+	return ranges
+}
+
+//opCompared adds the keys the comparisons of op are on to keys
+func opCompared(op clientv3.Op, keys map[string]bool) {
+	if !op.IsTxn() {
+		return
+	}
+	cmps, thenOps, elseOps := op.Txn()
+	for _, cmp := range cmps {
+		keys[string(cmp.Key)] = true
+	}
+	for _, op := range append(thenOps, elseOps...) {
+		opCompared(op, keys)
+	}
+}
+
+//changes returns what op did to the keys read, run against them in scratch
+func changes(op clientv3.Op, read []*mvccpb.KeyValue, scratch *memoryEtcd) storeCommit {
+	c := storeCommit{expected: make(map[string]*mvccpb.KeyValue)}
+	before := make(map[string]*mvccpb.KeyValue, len(read))
+	for _, kv := range read {
+		before[string(kv.Key)] = kv
+	}
+	compared := make(map[string]bool)
+	opCompared(op, compared)
+	for key := range compared {
+		c.expected[key] = before[key]
+	}
+	for key, kv := range scratch.kvs {
+		if prev := before[key]; prev != kv {
+			c.puts = append(c.puts, storeWrite{kv: kv, prev: prev})
+		}
+	}
+	for key, kv := range before {
+		if _, ok := scratch.kvs[key]; !ok {
+			c.deletes = append(c.deletes, kv)
+		}
+	}
+	sort.Slice(c.puts, func(i, j int) bool { return string(c.puts[i].kv.Key) < string(c.puts[j].kv.Key) })
+	sort.Slice(c.deletes, func(i, j int) bool { return string(c.deletes[i].Key) < string(c.deletes[j].Key) })
+	return c
+}
+
+//setRevision sets the revision of the headers of resp to rev, the one its writes were committed at
+func setRevision(resp *pb.ResponseOp, rev int64) {
+	switch r := resp.Response.(type) {
+	case *pb.ResponseOp_ResponseRange:
+		r.ResponseRange.Header.Revision = rev
+	case *pb.ResponseOp_ResponsePut:
+		r.ResponsePut.Header.Revision = rev
+	case *pb.ResponseOp_ResponseDeleteRange:
+		r.ResponseDeleteRange.Header.Revision = rev
+	case *pb.ResponseOp_ResponseTxn:
+		r.ResponseTxn.Header.Revision = rev
+		for _, resp := range r.ResponseTxn.Responses {
+			setRevision(resp, rev)
+		}
+	}
+}
+
+//Do ... see clientv3.KV
+func (s *storeKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	if op.IsGet() && op.Rev() > 0 {
+		return clientv3.OpResponse{}, fmt.Errorf("%s can't be read at a revision", s.name)
+	}
+	ranges := opRanges(op)
+	for attempt := 0; attempt < storeCommitAttempts; attempt++ {
+		read, rev, err := s.store.read(ctx, ranges)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		scratch := newMemoryEtcd()
+		scratch.revision = rev
+		for _, kv := range read {
+			scratch.kvs[string(kv.Key)] = kv
+		}
+		resp, err := scratch.do(op)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		c := changes(op, read, scratch)
+		if c.empty() {
+			setRevision(resp, rev)
+			return opResponse(resp), nil
+		}
+		committed, ok, err := s.store.commit(ctx, c)
+		if err != nil {
+			return clientv3.OpResponse{}, err
+		}
+		if ok {
+			setRevision(resp, committed)
+			return opResponse(resp), nil
+		}
+	}
+	return clientv3.OpResponse{}, fmt.Errorf("the keys of a transaction kept changing in %s, gave up after %d attempts", s.name, storeCommitAttempts)
+}
+
+//Put ... see clientv3.KV
+func (s *storeKV) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpPut(key, val, opts...))
+	return resp.Put(), err
+}
+
+//Get ... see clientv3.KV
+func (s *storeKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpGet(key, opts...))
+	return resp.Get(), err
+}
+
+//Delete ... see clientv3.KV
+func (s *storeKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	resp, err := s.Do(ctx, clientv3.OpDelete(key, opts...))
+	return resp.Del(), err
+}
+
+//Compact ... see clientv3.KV, the stores keep the latest revision of each key only
+func (s *storeKV) Compact(ctx context.Context, rev int64, opts ...clientv3.CompactOption) (*clientv3.CompactResponse, error) {
+	return nil, fmt.Errorf("%s can't be compacted", s.name)
+}
+
+//Txn ... see clientv3.KV
+func (s *storeKV) Txn(ctx context.Context) clientv3.Txn {
+	return &opTxn{kv: s, ctx: ctx}
+}
+
+//storeWatcher ... the watches of a client of a store. A watch reads its range again whenever the store tells it may
+//have changed, and reports the difference: a key written several times in between is seen once, with its latest
+//value, and a deleted key at the revision it was found missing at
+type storeWatcher struct {
+	name    string
+	store   kvStore
+	mu      sync.Mutex
+	watches map[*storeWatch]bool
+	closed  bool
+}
+
+type storeWatch struct {
+	op     clientv3.Op
+	cancel context.CancelFunc
+}
+
+//putEvent returns the event of a write of kv, with a copy of it for the namespace to take its prefix off
+func putEvent(kv *mvccpb.KeyValue) *clientv3.Event {
+	written := *kv
+	return &clientv3.Event{Type: mvccpb.PUT, Kv: &written}
+}
+
+//watchEvents returns the events taking the keys of a range from before to after, read at revision rev, in the order
+//of their revisions
+func watchEvents(before map[string]*mvccpb.KeyValue, after []*mvccpb.KeyValue, rev int64) []*clientv3.Event {
+	var events []*clientv3.Event
+	seen := make(map[string]bool, len(after))
+	for _, kv := range after {
+		seen[string(kv.Key)] = true
+		if prev, ok := before[string(kv.Key)]; !ok || prev.ModRevision != kv.ModRevision {
+			events = append(events, putEvent(kv))
+		}
+	}
+	for key := range before {
+		if !seen[key] {
+			events = append(events, &clientv3.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(key), ModRevision: rev}})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Kv.ModRevision != events[j].Kv.ModRevision {
+			return events[i].Kv.ModRevision < events[j].Kv.ModRevision
+		}
+		return string(events[i].Kv.Key) < string(events[j].Kv.Key)
+	})
+	return events
+}
+
+//Watch ... see clientv3.Watcher. The watch starts at the revision given with clientv3.WithRev, replaying the keys
+//written since but not the ones deleted, or after the current one. The channel is closed if the store can't be read
+func (w *storeWatcher) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ctx, cancel := context.WithCancel(ctx)
+	watch := &storeWatch{op: clientv3.OpGet(key, opts...), cancel: cancel}
+	out := make(chan clientv3.WatchResponse)
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		cancel()
+		close(out)
+		return out
+	}
+	w.watches[watch] = true
+	w.mu.Unlock()
+
+	send := func(resp clientv3.WatchResponse) bool {
+		select {
+		case out <- resp:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// the keys are read before returning, so the watch sees whatever is written after
+	ranges := opRanges(watch.op)
+	read, rev, err := w.store.read(ctx, ranges)
+	go func() {
+		defer func() {
+			w.mu.Lock()
+			delete(w.watches, watch)
+			w.mu.Unlock()
+			cancel()
+			close(out)
+		}()
+		if err != nil {
+			return
+		}
+		known := make(map[string]*mvccpb.KeyValue, len(read))
+		var replayed []*clientv3.Event
+		for _, kv := range read {
+			if start := watch.op.Rev(); start > 0 && kv.ModRevision >= start {
+				replayed = append(replayed, putEvent(kv))
+			}
+			known[string(kv.Key)] = kv
+		}
+		if len(replayed) > 0 {
+			sort.SliceStable(replayed, func(i, j int) bool { return replayed[i].Kv.ModRevision < replayed[j].Kv.ModRevision })
+			if !send(clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: rev}, Events: replayed}) {
+				return
+			}
+		}
+		for {
+			waitCtx, cancelWait := context.WithTimeout(ctx, etcdProgressNotificationInterval)
+			err := w.store.wait(waitCtx, watch.op, rev)
+			idle := waitCtx.Err() == context.DeadlineExceeded
+			cancelWait()
+			if ctx.Err() != nil {
+				return
+			}
+			if idle {
+				// like etcd, tell an idle watch how far it is
+				if !send(clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: rev}}) {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+			read, current, err := w.store.read(ctx, ranges)
+			if err != nil {
+				return
+			}
+			events := watchEvents(known, read, current)
+			known = make(map[string]*mvccpb.KeyValue, len(read))
+			for _, kv := range read {
+				known[string(kv.Key)] = kv
+			}
+			if current > rev {
+				rev = current
+			}
+			if len(events) > 0 && !send(clientv3.WatchResponse{Header: pb.ResponseHeader{Revision: rev}, Events: events}) {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+//Close ... see clientv3.Watcher, ends the watches of the client and disconnects it from the store
+func (w *storeWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	for watch := range w.watches {
+		watch.cancel()
+	}
+	return w.store.close()
+}
+
+//storeLease ... the stores have no etcd leases, so what needs them, like the leader election, needs etcd
+type storeLease struct {
+	clientv3.Lease
+	name string
+}
+
+func (l storeLease) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	return nil, fmt.Errorf("%s has no leases, they need an etcd coordinator", l.name)
+}
+
+func (storeLease) Close() error {
+	return nil
+}
+
+//kvCoordinator ... a coordinator served by an etcd client API, of the in-memory etcd or of a store. It closes client,
+//if it has one
+type kvCoordinator struct {
+	kv     clientv3.KV
+	client *etcdClient
+}
+
+func (c kvCoordinator) Put(key string, value string, logr *logger.LocLoggingEntry) error {
+	_, err := c.kv.Put(context.Background(), key, value)
+	return err
+}
+
+func (c kvCoordinator) PutIfKeyMissing(key string, value string, logr *logger.LocLoggingEntry) (bool, error) {
+	resp, err := c.kv.Txn(context.Background()).If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, value)).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (c kvCoordinator) CompareAndSwap(key string, value string, prevValue string, logr *logger.LocLoggingEntry) (bool, error) {
+	resp, err := c.kv.Txn(context.Background()).If(clientv3.Compare(clientv3.Value(key), "=", prevValue)).
+		Then(clientv3.OpPut(key, value)).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+func (c kvCoordinator) Get(key string, logr *logger.LocLoggingEntry) ([]coord.EtcdKVGetResponse, error) {
+	resp, err := c.kv.Get(context.Background(), key)
+	if err != nil {
+		return nil, err
+	}
+	var kvs []coord.EtcdKVGetResponse
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, coord.EtcdKVGetResponse{Key: string(kv.Key), Value: string(kv.Value)})
+	}
+	return kvs, nil
+}
+
+//NewValueSequence ... a coord.ValueSequence reads from a real etcd, the job monitor reads the sequences through
+//sequenceValues instead
+func (c kvCoordinator) NewValueSequence(prefix string, logr *logger.LocLoggingEntry) *coord.ValueSequence {
+	panic("the coordinator has no value sequences, see sequenceValues")
+}
+
+func (c kvCoordinator) sequenceValues(prefix string, logr *logger.LocLoggingEntry) ([]string, error) {
+	resp, err := c.kv.Get(context.Background(), prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, kv := range resp.Kvs {
+		values = append(values, string(kv.Value))
+	}
+	return values, nil
+}
+
+func (c kvCoordinator) Close(logr *logger.LocLoggingEntry) {
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+//inRanges tells whether key is in one of the ranges
+func inRanges(key []byte, ranges []clientv3.Op) bool {
+	for _, r := range ranges {
+		if inRange(key, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortKeyValues(kvs []*mvccpb.KeyValue) {
+	sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+}
+
+//waitTimeout returns how long a long poll of a store may take under ctx, at most max
+func waitTimeout(ctx context.Context, max time.Duration) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < max {
+			return left
+		}
+	}
+	return max
+}
+
+//listPrefix returns a prefix the keys in the range of op share, to list them by. Only the ones inRange are in it, as
+//the range of a prefix [key, end) may end on another byte than its last
+func listPrefix(op clientv3.Op) string {
+	key, end := op.KeyBytes(), op.RangeBytes()
+	if len(end) == 0 {
+		return string(key)
+	}
+	if len(end) == 1 && end[0] == 0 {
+		return ""
+	}
+	n := 0
+	for n < len(key) && n < len(end) && key[n] == end[n] {
+		n++
+	}
+	return string(key[:n])
+}
@@ -0,0 +1,572 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/go-zookeeper/zk"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+//checkStoreClient runs the calls the job monitor makes through a client served by a store
+func checkStoreClient(t *testing.T, cli *etcdClient) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := kvCoordinator{kv: cli.KV}
+
+	assert.NoError(t, c.Put("training-1/status", "PENDING", logr))
+	created, err := c.PutIfKeyMissing("training-1/learners/1/status/000001", "DOWNLOADING", logr)
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = c.PutIfKeyMissing("training-1/learners/1/status/000001", "FAILED", logr)
+	assert.NoError(t, err)
+	assert.False(t, created)
+	swapped, err := c.CompareAndSwap("training-1/status", "PROCESSING", "PENDING", logr)
+	assert.NoError(t, err)
+	assert.True(t, swapped)
+	swapped, err = c.CompareAndSwap("training-1/status", "FAILED", "PENDING", logr)
+	assert.NoError(t, err)
+	assert.False(t, swapped)
+	_, err = cli.Put(ctx, "training-1/learners/1/status/000002", "PROCESSING")
+	assert.NoError(t, err)
+	_, err = cli.Put(ctx, "training-2/status", "\x00\xff")
+	assert.NoError(t, err)
+
+	values, err := c.sequenceValues("training-1/learners/1/status/", logr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"DOWNLOADING", "PROCESSING"}, values)
+	status, err := cli.Get(ctx, "training-1/status")
+	assert.NoError(t, err)
+	if assert.Len(t, status.Kvs, 1) {
+		assert.Equal(t, "PROCESSING", string(status.Kvs[0].Value))
+		assert.Equal(t, int64(2), status.Kvs[0].Version)
+		assert.True(t, status.Kvs[0].ModRevision > status.Kvs[0].CreateRevision)
+		assert.True(t, status.Header.Revision >= status.Kvs[0].ModRevision)
+	}
+	binary, err := cli.Get(ctx, "training-2/status")
+	assert.NoError(t, err)
+	if assert.Len(t, binary.Kvs, 1) {
+		assert.Equal(t, []byte("\x00\xff"), binary.Kvs[0].Value)
+	}
+	all, err := cli.Get(ctx, "training-", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	assert.NoError(t, err)
+	var keys []string
+	for _, kv := range all.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	assert.Equal(t, []string{"training-1/learners/1/status/000001", "training-1/learners/1/status/000002", "training-1/status", "training-2/status"}, keys)
+	counted, err := cli.Get(ctx, "training-1/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), counted.Count)
+
+	// a transaction on a revision sees the writes of the others in between
+	txn, err := cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("training-1/status"), "=", status.Kvs[0].ModRevision)).
+		Then(clientv3.OpPut("training-1/status", "COMPLETED")).Else(clientv3.OpGet("training-1/status")).Commit()
+	assert.NoError(t, err)
+	assert.True(t, txn.Succeeded)
+	txn, err = cli.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision("training-1/status"), "=", status.Kvs[0].ModRevision)).
+		Then(clientv3.OpPut("training-1/status", "FAILED")).Else(clientv3.OpGet("training-1/status")).Commit()
+	assert.NoError(t, err)
+	assert.False(t, txn.Succeeded)
+	if assert.Len(t, txn.Responses, 1) && assert.Len(t, txn.Responses[0].GetResponseRange().Kvs, 1) {
+		assert.Equal(t, "COMPLETED", string(txn.Responses[0].GetResponseRange().Kvs[0].Value))
+	}
+
+	// writers racing on a key lose no update
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < 4; {
+				resp, err := cli.Get(ctx, "counter")
+				if !assert.NoError(t, err) {
+					return
+				}
+				count, prev := 0, ""
+				if len(resp.Kvs) > 0 {
+					prev = string(resp.Kvs[0].Value)
+					count, _ = strconv.Atoi(prev)
+				}
+				var swapped bool
+				if prev == "" {
+					swapped, err = c.PutIfKeyMissing("counter", strconv.Itoa(count+1), logr)
+				} else {
+					swapped, err = c.CompareAndSwap("counter", strconv.Itoa(count+1), prev, logr)
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				if swapped {
+					done++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	counter, err := cli.Get(ctx, "counter")
+	assert.NoError(t, err)
+	if assert.Len(t, counter.Kvs, 1) {
+		assert.Equal(t, "20", string(counter.Kvs[0].Value))
+	}
+
+	// a watch sees the writes after it started, and replays the ones since the revision it is resumed from
+	start, err := cli.Get(ctx, "training-1/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	events := cli.Watch(ctx, "training-1/", clientv3.WithPrefix(), clientv3.WithRev(start.Header.Revision+1))
+	put, err := cli.Put(ctx, "training-1/learners/1/status/000003", "STORING")
+	assert.NoError(t, err)
+	_, err = cli.Put(ctx, "training-2/status", "PENDING")
+	assert.NoError(t, err)
+	_, err = cli.Delete(ctx, "training-1/learners/1/status/000001")
+	assert.NoError(t, err)
+	var seen []string
+	for len(seen) < 2 {
+		resp, ok := <-events
+		if !assert.True(t, ok, "the watch was closed") {
+			break
+		}
+		for _, ev := range resp.Events {
+			seen = append(seen, fmt.Sprintf("%s %s %s", ev.Type, ev.Kv.Key, ev.Kv.Value))
+		}
+	}
+	assert.Equal(t, []string{"PUT training-1/learners/1/status/000003 STORING", "DELETE training-1/learners/1/status/000001 "}, seen)
+	resumed := cli.Watch(ctx, "training-1/learners/", clientv3.WithPrefix(), clientv3.WithRev(put.Header.Revision))
+	select {
+	case resp := <-resumed:
+		if assert.Len(t, resp.Events, 1) {
+			assert.Equal(t, "training-1/learners/1/status/000003", string(resp.Events[0].Kv.Key))
+		}
+	case <-ctx.Done():
+		t.Errorf("the resumed watch replayed nothing")
+	}
+
+	deleted, err := cli.Delete(ctx, "training-1/", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted.Deleted)
+	left, err := cli.Get(ctx, "training-", clientv3.WithPrefix())
+	assert.NoError(t, err)
+	if assert.Len(t, left.Kvs, 1) {
+		assert.Equal(t, "training-2/status", string(left.Kvs[0].Key))
+	}
+
+	_, err = cli.Grant(ctx, 10)
+	assert.Error(t, err)
+	_, err = cli.Get(ctx, "training-2/status", clientv3.WithRev(1))
+	assert.Error(t, err)
+}
+
+func TestStoreScheme(t *testing.T) {
+	scheme, err := storeScheme([]string{"https://etcd-0:2379", "etcd-1:2379"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", scheme)
+	scheme, err = storeScheme([]string{"zookeeper://zk-0:2181/ffdl", "zookeeper://zk-1:2181/ffdl"})
+	assert.NoError(t, err)
+	assert.Equal(t, "zookeeper", scheme)
+	scheme, err = storeScheme([]string{"rediss://redis:6380/1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "rediss", scheme)
+	_, err = storeScheme([]string{"consul://consul:8500", "https://etcd-0:2379"})
+	assert.Error(t, err)
+}
+
+//fakeConsul ... the KV store and transactions of a Consul agent
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries map[string]consulKV
+	// the index the entries were deleted at
+	deleted map[string]uint64
+	changed chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{entries: make(map[string]consulKV), deleted: make(map[string]uint64), changed: make(chan struct{})}
+}
+
+//treeIndex returns the index of the entries under prefix, holding the lock
+func (f *fakeConsul) treeIndex(prefix string) uint64 {
+	index := uint64(1)
+	for key, kv := range f.entries {
+		if strings.HasPrefix(key, prefix) && kv.ModifyIndex > index {
+			index = kv.ModifyIndex
+		}
+	}
+	for key, at := range f.deleted {
+		if strings.HasPrefix(key, prefix) && at > index {
+			index = at
+		}
+	}
+	return index
+}
+
+//apply runs the operations of a transaction on entries at index, or returns the one which failed
+func (f *fakeConsul) apply(ops []consulTxnOp, entries map[string]consulKV, deleted map[string]uint64, index uint64) ([]consulTxnOp, error) {
+	var results []consulTxnOp
+	for i, op := range ops {
+		kv := op.KV
+		current, exists := entries[kv.Key]
+		switch kv.Verb {
+		case "get-tree":
+			var keys []string
+			for key := range entries {
+				if strings.HasPrefix(key, kv.Key) {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				results = append(results, consulTxnOp{KV: entries[key]})
+			}
+		case "check-index":
+			if !exists || current.ModifyIndex != kv.Index {
+				return nil, fmt.Errorf("op %d: index of %s is stale", i, kv.Key)
+			}
+		case "check-not-exists":
+			if exists {
+				return nil, fmt.Errorf("op %d: %s exists", i, kv.Key)
+			}
+		case "cas", "set":
+			if kv.Verb == "cas" && ((kv.Index == 0 && exists) || (kv.Index != 0 && current.ModifyIndex != kv.Index)) {
+				return nil, fmt.Errorf("op %d: failed to set %s, index is stale", i, kv.Key)
+			}
+			kv.Verb, kv.Index, kv.ModifyIndex, kv.CreateIndex = "", 0, index, index
+			if exists {
+				kv.CreateIndex = current.CreateIndex
+			}
+			entries[kv.Key] = kv
+			results = append(results, consulTxnOp{KV: consulKV{Key: kv.Key, Flags: kv.Flags, CreateIndex: kv.CreateIndex, ModifyIndex: index}})
+		case "delete":
+			delete(entries, kv.Key)
+			deleted[kv.Key] = index
+		default:
+			return nil, fmt.Errorf("op %d: unknown verb %s", i, kv.Verb)
+		}
+	}
+	return results, nil
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPut && r.URL.Path == "/v1/txn":
+		var ops []consulTxnOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil || len(ops) > consulTxnOps {
+			http.Error(w, "bad transaction", http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		entries := make(map[string]consulKV)
+		for key, kv := range f.entries {
+			entries[key] = kv
+		}
+		deleted := make(map[string]uint64)
+		for key, at := range f.deleted {
+			deleted[key] = at
+		}
+		results, err := f.apply(ops, entries, deleted, f.index+1)
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]interface{}{"Errors": []map[string]interface{}{{"OpIndex": 0, "What": err.Error()}}})
+			return
+		}
+		for _, op := range ops {
+			if op.KV.Verb != "get-tree" && op.KV.Verb != "check-index" && op.KV.Verb != "check-not-exists" {
+				f.index++
+				f.entries, f.deleted = entries, deleted
+				close(f.changed)
+				f.changed = make(chan struct{})
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(consulTxnResponse{Results: results})
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, exists := f.entries[key]; exists {
+			fmt.Fprint(w, "false")
+			return
+		}
+		f.index++
+		f.entries[key] = consulKV{Key: key, CreateIndex: f.index, ModifyIndex: f.index}
+		fmt.Fprint(w, "true")
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		timeout := time.After(wait)
+		for {
+			f.mu.Lock()
+			current, changed := f.treeIndex(prefix), f.changed
+			f.mu.Unlock()
+			if current > index {
+				w.Header().Set("X-Consul-Index", strconv.FormatUint(current, 10))
+				return
+			}
+			select {
+			case <-changed:
+			case <-timeout:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulStore(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	consul := newFakeConsul()
+	server := httptest.NewServer(consul)
+	defer server.Close()
+
+	cli, err := newEtcdClient(coord.Config{Endpoints: []string{"consul://" + strings.TrimPrefix(server.URL, "http://") + "/ffdl-test"}, Prefix: "jobmonitor/"}, logr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cli.Close()
+	checkStoreClient(t, cli)
+
+	consul.mu.Lock()
+	defer consul.mu.Unlock()
+	assert.Contains(t, consul.entries, "ffdl-test/kv/jobmonitor/training-2/status")
+	assert.Contains(t, consul.entries, "ffdl-test/rev")
+	assert.Equal(t, consul.index, consul.entries["ffdl-test/rev"].ModifyIndex)
+}
+
+//fakeZnode ... a node of fakeZookeeper
+type fakeZnode struct {
+	data []byte
+	stat zk.Stat
+}
+
+//fakeZookeeper ... the nodes of a ZooKeeper ensemble, and the watches on them
+type fakeZookeeper struct {
+	mu      sync.Mutex
+	zxid    int64
+	nodes   map[string]*fakeZnode
+	watches map[string][]chan zk.Event
+}
+
+func newFakeZookeeper() *fakeZookeeper {
+	return &fakeZookeeper{nodes: map[string]*fakeZnode{"/": {}}, watches: make(map[string][]chan zk.Event)}
+}
+
+func (f *fakeZookeeper) Get(p string) ([]byte, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	stat := node.stat
+	return append([]byte(nil), node.data...), &stat, nil
+}
+
+func (f *fakeZookeeper) Children(p string) ([]string, *zk.Stat, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	node, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for child := range f.nodes {
+		if child != "/" && path.Dir(child) == p {
+			children = append(children, path.Base(child))
+		}
+	}
+	stat := node.stat
+	return children, &stat, nil
+}
+
+func (f *fakeZookeeper) ExistsW(p string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	watch := make(chan zk.Event, 1)
+	f.watches[p] = append(f.watches[p], watch)
+	node, ok := f.nodes[p]
+	if !ok {
+		return false, nil, watch, nil
+	}
+	stat := node.stat
+	return true, &stat, watch, nil
+}
+
+func (f *fakeZookeeper) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	_, err := f.Multi(&zk.CreateRequest{Path: p, Data: data, Acl: acl, Flags: flags})
+	return p, err
+}
+
+//apply runs an operation of a multi on nodes at zxid, returning the nodes it changed
+func (f *fakeZookeeper) apply(op interface{}, nodes map[string]*fakeZnode, zxid int64) (*zk.Stat, []string, error) {
+	switch op := op.(type) {
+	case *zk.CreateRequest:
+		if _, ok := nodes[op.Path]; ok {
+			return nil, nil, zk.ErrNodeExists
+		}
+		if _, ok := nodes[path.Dir(op.Path)]; !ok {
+			return nil, nil, zk.ErrNoNode
+		}
+		nodes[op.Path] = &fakeZnode{data: op.Data, stat: zk.Stat{Czxid: zxid, Mzxid: zxid}}
+		return nil, []string{op.Path}, nil
+	case *zk.SetDataRequest:
+		node, ok := nodes[op.Path]
+		if !ok {
+			return nil, nil, zk.ErrNoNode
+		}
+		if op.Version != -1 && op.Version != node.stat.Version {
+			return nil, nil, zk.ErrBadVersion
+		}
+		stat := node.stat
+		stat.Mzxid, stat.Version = zxid, stat.Version+1
+		nodes[op.Path] = &fakeZnode{data: op.Data, stat: stat}
+		return &stat, []string{op.Path}, nil
+	case *zk.DeleteRequest:
+		node, ok := nodes[op.Path]
+		if !ok {
+			return nil, nil, zk.ErrNoNode
+		}
+		if op.Version != -1 && op.Version != node.stat.Version {
+			return nil, nil, zk.ErrBadVersion
+		}
+		for child := range nodes {
+			if path.Dir(child) == op.Path && child != "/" {
+				return nil, nil, zk.ErrNotEmpty
+			}
+		}
+		delete(nodes, op.Path)
+		return nil, []string{op.Path}, nil
+	case *zk.CheckVersionRequest:
+		node, ok := nodes[op.Path]
+		if !ok {
+			return nil, nil, zk.ErrNoNode
+		}
+		if op.Version != node.stat.Version {
+			return nil, nil, zk.ErrBadVersion
+		}
+		return nil, nil, nil
+	}
+	return nil, nil, zk.ErrAPIError
+}
+
+func (f *fakeZookeeper) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nodes := make(map[string]*fakeZnode, len(f.nodes))
+	for p, node := range f.nodes {
+		nodes[p] = node
+	}
+	responses := make([]zk.MultiResponse, len(ops))
+	var changed []string
+	for i, op := range ops {
+		stat, touched, err := f.apply(op, nodes, f.zxid+1)
+		if err != nil {
+			for j := i + 1; j < len(ops); j++ {
+				responses[j].Error = zk.ErrUnknown
+			}
+			responses[i].Error = err
+			return responses, err
+		}
+		responses[i].Stat = stat
+		changed = append(changed, touched...)
+	}
+	f.zxid++
+	f.nodes = nodes
+	for _, p := range changed {
+		for _, watch := range f.watches[p] {
+			watch <- zk.Event{Type: zk.EventNodeDataChanged, Path: p}
+		}
+		delete(f.watches, p)
+	}
+	return responses, nil
+}
+
+func (f *fakeZookeeper) Close() {}
+
+func TestZookeeperStore(t *testing.T) {
+	fake := newFakeZookeeper()
+	store := newZookeeperStore(fake, "/ffdl/test", "jobmonitor/", zk.WorldACL(zk.PermAll))
+	if !assert.NoError(t, store.createRoot()) {
+		return
+	}
+	cli := newStoreClient("zookeeper", store, "jobmonitor/")
+	defer cli.Close()
+	checkStoreClient(t, cli)
+
+	data, _, err := fake.Get("/ffdl/test/jobmonitor%2Ftraining-2/%2Fstatus")
+	assert.NoError(t, err)
+	assert.Equal(t, "PENDING", string(data))
+	for _, key := range []string{"jobmonitor/a/b", "jobmonitor/a", "jobmonitor/", "a/b/c", "", "a%b/.."} {
+		first, rest := store.splitKey(key)
+		unnamedFirst, err := zookeeperUnname(zookeeperName(first))
+		assert.NoError(t, err)
+		unnamedRest, err := zookeeperUnname(zookeeperName(rest))
+		assert.NoError(t, err)
+		assert.Equal(t, key, unnamedFirst+unnamedRest)
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	logr := logger.LocLogger(log.NewEntry(log.New()))
+	server, err := miniredis.Run()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Select(2)
+
+	cli, err := newEtcdClient(coord.Config{Endpoints: []string{"redis://" + server.Addr() + "/2"}, Prefix: "jobmonitor/"}, logr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cli.Close()
+	checkStoreClient(t, cli)
+
+	assert.True(t, server.Exists("ffdl:kv:jobmonitor/training-2/status"))
+	assert.False(t, server.Exists("ffdl:kv:jobmonitor/training-1/status"))
+	members, err := server.ZMembers("ffdl:keys")
+	assert.NoError(t, err)
+	assert.Contains(t, members, "jobmonitor/training-2/status")
+	assert.NotContains(t, members, "jobmonitor/training-1/status")
+	resp, err := cli.Get(context.Background(), "training-2/status")
+	assert.NoError(t, err)
+	rev, err := server.Get("ffdl:rev")
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(resp.Header.Revision, 10), rev)
+}
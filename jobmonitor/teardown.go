@@ -0,0 +1,342 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/cenkalti/backoff"
+	"github.com/spf13/viper"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const zkTeardown = "teardown"
+
+// states of the teardown state machine of a job, kept in etcd so that any combination of monitor crashes and retries
+// converges to exactly one effective teardown and a single final trainer update. The steps are executed in the order
+// requested, trainer_final, lcm_acked, pods_gone: the final trainer update has to go out before the LCM is asked to
+// kill the job, since the kill also takes down the pod of the job monitor.
+const (
+	teardownRequested    = "requested"
+	teardownTrainerFinal = "trainer_final"
+	teardownLcmAcked     = "lcm_acked"
+	teardownPodsGone     = "pods_gone"
+)
+
+var teardownStateOrder = map[string]int{teardownRequested: 0, teardownTrainerFinal: 1, teardownLcmAcked: 2, teardownPodsGone: 3}
+
+// how often a move of the teardown reads its record again after it changed meanwhile
+const teardownSwapAttempts = 5
+
+//teardownRecord is the value of the teardown key of a training. It carries the final status, so that a restarted
+//monitor can finish the teardown without re-deriving it
+type teardownRecord struct {
+	State         string       `json:"state"`
+	Status        string       `json:"status"`
+	Timestamp     string       `json:"timestamp,omitempty"`
+	ErrorCode     string       `json:"error_code,omitempty"`
+	StatusMessage string       `json:"status_message,omitempty"`
+	Reasons       []ReasonCode `json:"reasons,omitempty"`
+	// the failure alert went out, see alertOnFailure
+	Alerted bool `json:"alerted,omitempty"`
+}
+
+func (r *teardownRecord) reached(state string) bool {
+	return teardownStateOrder[r.State] >= teardownStateOrder[state]
+}
+
+func (r *teardownRecord) statusUpdate() *client.TrainingStatusUpdate {
+	return &client.TrainingStatusUpdate{
+		Status:        grpc_trainer_v2.Status(grpc_trainer_v2.Status_value[r.Status]),
+		Timestamp:     r.Timestamp,
+		ErrorCode:     r.ErrorCode,
+		StatusMessage: r.StatusMessage,
+	}
+}
+
+func (r *teardownRecord) encode() string {
+	value, _ := json.Marshal(r)
+	return string(value)
+}
+
+func teardownPath(trainingID string) string {
+	return trainingID + "/" + zkTeardown
+}
+
+//loadTeardown reads the teardown record of the job, it returns nil if no teardown was requested yet
+func (jm *JobMonitor) loadTeardown(logr *logger.LocLoggingEntry) (*teardownRecord, string, error) {
+	response, err := jm.EtcdClient.Get(teardownPath(jm.TrainingID), logr)
+	if err != nil || len(response) == 0 {
+		return nil, "", err
+	}
+	rec := &teardownRecord{}
+	if err := json.Unmarshal([]byte(response[0].Value), rec); err != nil {
+		return nil, "", err
+	}
+	return rec, response[0].Value, nil
+}
+
+//requestTeardown records the teardown request with its final status, unless there already is one, in which case the
+//existing record wins. Without a statusUpdate the record has no final status, which is then left to whoever sends it
+func (jm *JobMonitor) requestTeardown(statusUpdate *client.TrainingStatusUpdate, reasons []ReasonCode, logr *logger.LocLoggingEntry) (*teardownRecord, error) {
+	rec := &teardownRecord{State: teardownRequested, Reasons: reasons}
+	if statusUpdate != nil {
+		rec.Status, rec.Timestamp = statusUpdate.Status.String(), statusUpdate.Timestamp
+		rec.ErrorCode, rec.StatusMessage = statusUpdate.ErrorCode, statusUpdate.StatusMessage
+	}
+	created, err := jm.EtcdClient.PutIfKeyMissing(teardownPath(jm.TrainingID), rec.encode(), logr)
+	if err != nil {
+		return rec, err
+	}
+	if created {
+		return rec, nil
+	}
+	existing, _, err := jm.loadTeardown(logr)
+	if err != nil || existing == nil {
+		return rec, err
+	}
+	logr.Infof("(requestTeardown) teardown of %s was already requested with status %s and is at %s", jm.TrainingID, existing.Status, existing.State)
+	return existing, nil
+}
+
+//advanceTeardown moves the teardown to the given state, it never moves it backwards. A record which changed since it
+//was read, e.g. by another state change or the claim of the failure alert, is read again, and only the swap which
+//moved the teardown acts on its new state
+func (jm *JobMonitor) advanceTeardown(to string, logr *logger.LocLoggingEntry) {
+	for attempt := 0; attempt < teardownSwapAttempts; attempt++ {
+		rec, old, err := jm.loadTeardown(logr)
+		if err != nil {
+			logr.WithError(err).Warnf("failed to read the teardown of %s, not moving it to %s", jm.TrainingID, to)
+			return
+		}
+		if rec == nil || rec.reached(to) {
+			return
+		}
+		rec.State = to
+		swapped, err := jm.EtcdClient.CompareAndSwap(teardownPath(jm.TrainingID), rec.encode(), old, logr)
+		if err != nil {
+			logr.WithError(err).Warnf("failed to move teardown of %s to %s", jm.TrainingID, to)
+			return
+		}
+		if !swapped {
+			continue
+		}
+		jm.auditStatus(logr, auditTeardown, to, "teardown reached %s", to)
+		if to == teardownPodsGone {
+			jm.unregister()
+			forgetPrometheusSeries(jm.TrainingID, jm.UserID)
+			jm.finish()
+			jm.closeWatchClient()
+		}
+		return
+	}
+	logr.Warnf("the teardown record of %s keeps changing, failed to move it to %s", jm.TrainingID, to)
+}
+
+//sendFinalStatus sends the terminal status of the job to the trainer, exactly once across monitor restarts
+func (jm *JobMonitor) sendFinalStatus(statusUpdate *client.TrainingStatusUpdate, reasons []ReasonCode, logr *logger.LocLoggingEntry) error {
+	jm.markTerminal(statusUpdate.Status)
+	if statusUpdate.Status == grpc_trainer_v2.Status_FAILED {
+		statusUpdate = jm.withLearnerLogs(statusUpdate, logr)
+	}
+	rec, err := jm.requestTeardown(statusUpdate, reasons, logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(sendFinalStatus) failed to record teardown of %s, it will not be resumed after a restart", jm.TrainingID)
+	}
+	if rec.reached(teardownTrainerFinal) {
+		logr.Infof("(sendFinalStatus) final status %s of %s was already sent to the trainer", rec.Status, jm.TrainingID)
+		return nil
+	}
+
+	jm.auditStatus(logr, auditFinalStatus, rec.Status, "%s (error code %s): %s", rec.Status, rec.ErrorCode, rec.StatusMessage)
+	jm.publishFinalStatus(rec.statusUpdate().Status, rec.ErrorCode, logr)
+	if watermarks := jm.watermarkSummary(); watermarks != "" {
+		logr.Infof("(sendFinalStatus) peak memory usage of the learners of %s: %s", jm.TrainingID, watermarks)
+	}
+	// the kill following the final status takes the job monitor down, so don't leave anything pending
+	jm.flushAudit(logr)
+	terminalSlots.acquire(rec.Status == grpc_trainer_v2.Status_FAILED.String(), jm.priority)
+	err = jm.updateStatusInTrainer(rec.statusUpdate(), rec.Reasons, logr)
+	terminalSlots.release()
+	if err == nil {
+		jm.advanceTeardown(teardownTrainerFinal, logr)
+		go jm.alertOnFailure(rec, logr)
+		if jm.outcomes != nil {
+			jm.outcomes.record(rec.statusUpdate())
+		}
+		jm.recordOutcome(rec, logr)
+	}
+	return err
+}
+
+//killDeployedJob asks the LCM to kill the job, unless it already acknowledged that. If the kill fails, or the workload
+//is still around afterwards, the teardown keeps being retried in the background until the workload is verified gone.
+//The teardown record survives monitor restarts, see resumePendingTeardown
+func (jm *JobMonitor) killDeployedJob(logr *logger.LocLoggingEntry) error {
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(killDeployedJob) failed to read the teardown record of %s", jm.TrainingID)
+	}
+	if rec == nil {
+		// callers are expected to send the final status first. Record the teardown anyhow so it gets resumed, but
+		// without a status, the job monitor doesn't know how the job ended
+		logr.Errorf("(killDeployedJob) %s is killed without its final status having been sent, recording the teardown without one", jm.TrainingID)
+		rec, _ = jm.requestTeardown(nil, nil, logr)
+	}
+	if rec.reached(teardownPodsGone) {
+		return nil
+	}
+
+	if !rec.reached(teardownLcmAcked) {
+		jm.writeKillReason(rec, logr)
+		terminalSlots.acquire(jm.hasFailed(), jm.priority)
+		err = jm.kill(logr)
+		terminalSlots.release()
+		if err != nil {
+			logr.WithError(err).Errorf("(killDeployedJob) failed to kill the deployed job %s, retrying in the background", jm.TrainingID)
+			go jm.retryTeardown(logr)
+			return err
+		}
+		jm.advanceTeardown(teardownLcmAcked, logr)
+	}
+
+	// under resource pressure the pods of the higher priority jobs come first, the workload is verified gone later
+	if !jm.deferVerification() && jm.isWorkloadGone(logr) {
+		jm.advanceTeardown(teardownPodsGone, logr)
+		return nil
+	}
+	go jm.retryTeardown(logr)
+	return nil
+}
+
+//resumePendingTeardown picks up a teardown that a previous incarnation of the job monitor could not finish
+func (jm *JobMonitor) resumePendingTeardown(logr *logger.LocLoggingEntry) {
+	rec, _, err := jm.loadTeardown(logr)
+	if err != nil || rec == nil {
+		return
+	}
+	if rec.Status != "" {
+		// the job already is terminal, don't let learner writes arriving now touch it
+		jm.markTerminal(rec.statusUpdate().Status)
+	}
+	if rec.reached(teardownPodsGone) {
+		return
+	}
+	logr.Warnf("(resumePendingTeardown) found a teardown of %s at state %s, resuming it", jm.TrainingID, rec.State)
+	go func() {
+		// a teardown recorded without a final status only resumes the kill
+		if rec.Status != "" && !rec.reached(teardownTrainerFinal) {
+			if err := jm.sendFinalStatus(rec.statusUpdate(), rec.Reasons, logr); err != nil {
+				logr.WithError(err).Errorf("(resumePendingTeardown) failed to send the final status of %s", jm.TrainingID)
+			}
+		}
+		jm.killDeployedJob(logr)
+	}()
+}
+
+func (jm *JobMonitor) retryTeardown(logr *logger.LocLoggingEntry) {
+	if !atomic.CompareAndSwapInt32(&jm.teardownRetrying, 0, 1) {
+		return
+	}
+	defer atomic.StoreInt32(&jm.teardownRetrying, 0)
+	jm.deferDuringMaintenance("the teardown retries", logr)
+	jm.waitOutHigherPriorityJobs(logr)
+
+	// retry until the workload is gone
+	retryBackoff := jm.exponentialBackoff(0, 5*time.Minute)
+
+	err := retryNotify(jm.timeSource(), func() error {
+		if jm.isWorkloadGone(logr) {
+			return nil
+		}
+		if err := jm.kill(logr); err != nil {
+			return err
+		}
+		jm.advanceTeardown(teardownLcmAcked, logr)
+		if !jm.isWorkloadGone(logr) {
+			return fmt.Errorf("pods of training %s are still present after the kill request", jm.TrainingID)
+		}
+		return nil
+	}, backoff.WithContext(retryBackoff, jm.context()), func(err error, t time.Duration) {
+		logr.WithError(err).Warnf("(retryTeardown) teardown of %s not finished yet, retrying in %v", jm.TrainingID, t)
+	})
+	if err != nil {
+		// the job monitor got stopped, the teardown record lets the next one resume the teardown
+		logr.WithError(err).Warnf("(retryTeardown) stopped retrying the teardown of %s", jm.TrainingID)
+		return
+	}
+
+	logr.Infof("(retryTeardown) verified that workload of %s is gone", jm.TrainingID)
+	jm.advanceTeardown(teardownLcmAcked, logr)
+	jm.advanceTeardown(teardownPodsGone, logr)
+}
+
+//teardownDeferral returns how long the kill of a job that reached the given status is held back, so that users can
+//kubectl exec into the learner pods for post-mortem debugging. Only FAILED jobs of opted in jobs or users are deferred
+func (jm *JobMonitor) teardownDeferral(status grpc_trainer_v2.Status) time.Duration {
+	if status != grpc_trainer_v2.Status_FAILED {
+		return 0
+	}
+	window := jm.DeferFailedTeardown
+	if window <= 0 && jm.hasJobConfig(deferTeardownWindowKey) {
+		window = jm.configDuration(deferTeardownWindowKey)
+	}
+	if window <= 0 {
+		for _, user := range viper.GetStringSlice(deferTeardownUsersKey) {
+			if user == jm.UserID {
+				window = viper.GetDuration(deferTeardownWindowKey)
+				break
+			}
+		}
+	}
+	if max := viper.GetDuration(deferTeardownMaxKey); window > max {
+		window = max
+	}
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+//the workload is gone once no pods labelled with the training id remain, apart from the pod of the job monitor itself
+func (jm *JobMonitor) isWorkloadGone(logr *logger.LocLoggingEntry) bool {
+	if jm.k8sClient == nil {
+		return true
+	}
+	selector := "training_id==" + jm.TrainingID
+	pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logr.WithError(err).Warnf("failed to list pods of training %s while verifying teardown", jm.TrainingID)
+		return false
+	}
+	self, _ := os.Hostname()
+	for _, pod := range pods.Items {
+		if pod.ObjectMeta.Name != self {
+			return false
+		}
+	}
+	return !jm.auxiliaryPodsRemaining(logr)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+//terminalLimiter caps the number of terminal processings (final trainer updates and LCM kills) which run at the same
+//time across all jobs monitored by this process, so that a storm of jobs terminating during a cluster incident does not
+//overwhelm the LCM and the trainer. Waiting FAILED jobs are let in before all others, since they hold on to resources
+//which are not doing any useful work anymore. While prioritized tells so, the jobs of the lowest priority are let in
+//first, see priorityTeardown
+type terminalLimiter struct {
+	mu          sync.Mutex
+	limit       func() int
+	prioritized func() bool
+	inFlight    int
+	waiting     []terminalWaiter
+}
+
+//terminalWaiter ... a job waiting for a slot, in the order the jobs queued up
+type terminalWaiter struct {
+	ready    chan struct{}
+	failed   bool
+	priority int
+}
+
+var terminalSlots = &terminalLimiter{limit: func() int { return viper.GetInt(terminalConcurrencyKey) }, prioritized: priorityTeardown}
+
+//acquire blocks until a slot is available, a limit <= 0 means no cap
+func (l *terminalLimiter) acquire(failed bool, priority int) {
+	l.mu.Lock()
+	if limit := l.limit(); limit <= 0 || l.inFlight < limit {
+		l.inFlight++
+		l.mu.Unlock()
+		return
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, terminalWaiter{ready: ready, failed: failed, priority: priority})
+	l.mu.Unlock()
+	// the releasing goroutine hands its slot over to us
+	<-ready
+}
+
+//state returns the slots in use and the number of FAILED and other jobs waiting for one
+func (l *terminalLimiter) state() (inFlight int, failed int, others int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, w := range l.waiting {
+		if w.failed {
+			failed++
+		} else {
+			others++
+		}
+	}
+	return l.inFlight, failed, others
+}
+
+func (l *terminalLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) == 0 {
+		l.inFlight--
+		return
+	}
+	prioritized := l.prioritized != nil && l.prioritized()
+	next := 0
+	for i, w := range l.waiting {
+		best := l.waiting[next]
+		if prioritized && w.priority != best.priority {
+			if w.priority < best.priority {
+				next = i
+			}
+			continue
+		}
+		if w.failed && !best.failed {
+			next = i
+		}
+	}
+	ready := l.waiting[next].ready
+	l.waiting = append(l.waiting[:next], l.waiting[next+1:]...)
+	close(ready)
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTerminalLimiterPrefersFailedJobs(t *testing.T) {
+	l := &terminalLimiter{limit: func() int { return 1 }}
+	l.acquire(false, 0)
+
+	order := make(chan string, 2)
+	go func() {
+		l.acquire(false, 0)
+		order <- "completed"
+		l.release()
+	}()
+	// make sure the completed job queues up first
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		l.acquire(true, 0)
+		order <- "failed"
+		l.release()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	l.release()
+	assert.Equal(t, "failed", <-order)
+	assert.Equal(t, "completed", <-order)
+	assert.Equal(t, 0, l.inFlight)
+}
+
+func TestTerminalLimiterByPriority(t *testing.T) {
+	prioritized := true
+	l := &terminalLimiter{limit: func() int { return 1 }, prioritized: func() bool { return prioritized }}
+	l.acquire(false, 0)
+
+	order := make(chan string, 3)
+	queue := func(name string, failed bool, priority int) {
+		go func() {
+			l.acquire(failed, priority)
+			order <- name
+			l.release()
+		}()
+		// queue the jobs up in order
+		time.Sleep(50 * time.Millisecond)
+	}
+	queue("failed-high", true, 1)
+	queue("completed-low", false, -1)
+	queue("failed-low", true, -1)
+
+	l.release()
+	assert.Equal(t, "failed-low", <-order)
+	assert.Equal(t, "completed-low", <-order)
+	assert.Equal(t, "failed-high", <-order)
+	assert.Equal(t, 0, l.inFlight)
+}
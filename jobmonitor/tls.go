@@ -0,0 +1,136 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var cipherSuitesByName = map[string]uint16{
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	"TLS_RSA_WITH_AES_128_CBC_SHA256":         tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+}
+
+//the FIPS 140-2 approved suites, the only ones offered in FIPS mode unless restricted further by config
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+//applyTLSConfig restricts cfg to the configured TLS versions and cipher suites. It covers the connections made by the
+//job monitor itself (etcd, metrics and webhooks); the trainer and LCM clients are set up by their own packages, under a
+//boringcrypto build crypto/tls/fipsonly restricts those as well
+func applyTLSConfig(cfg *tls.Config) error {
+	fips := viper.GetBool(tlsFIPSKey)
+
+	minVersion, ok := tlsVersionsByName[viper.GetString(tlsMinVersionKey)]
+	if !ok {
+		return fmt.Errorf("unsupported %s %s", tlsMinVersionKey, viper.GetString(tlsMinVersionKey))
+	}
+	if fips && minVersion < tls.VersionTLS12 {
+		minVersion = tls.VersionTLS12
+	}
+	cfg.MinVersion = minVersion
+
+	var suites []uint16
+	for _, name := range viper.GetStringSlice(tlsCipherSuitesKey) {
+		suite, ok := cipherSuitesByName[strings.TrimSpace(name)]
+		if !ok {
+			return fmt.Errorf("unsupported cipher suite %s in %s", name, tlsCipherSuitesKey)
+		}
+		if fips && !isFIPSCipherSuite(suite) {
+			return fmt.Errorf("cipher suite %s is not allowed in FIPS mode", name)
+		}
+		suites = append(suites, suite)
+	}
+	if len(suites) == 0 && fips {
+		suites = fipsCipherSuites
+	}
+	cfg.CipherSuites = suites
+	if fips {
+		cfg.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+	return nil
+}
+
+func isFIPSCipherSuite(suite uint16) bool {
+	for _, s := range fipsCipherSuites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+//httpClients ... the clients handed out by httpClient by their TLS settings and timeout, each one keeps its idle
+//connections for the next request instead of leaving them behind
+var httpClients struct {
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+//httpClient returns a client for the HTTP endpoints the job monitor talks to (metrics collectors, webhooks), using
+//the configured TLS settings. The client is shared by all the callers with the same settings
+func httpClient() (*http.Client, error) {
+	cfg := &tls.Config{}
+	if err := applyTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%d %v %v %v", cfg.MinVersion, cfg.CipherSuites, cfg.CurvePreferences, ctxTimeout())
+	httpClients.mu.Lock()
+	defer httpClients.mu.Unlock()
+	if client, ok := httpClients.clients[key]; ok {
+		return client, nil
+	}
+	if httpClients.clients == nil {
+		httpClients.clients = make(map[string]*http.Client)
+	}
+	client := &http.Client{Timeout: ctxTimeout(), Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: cfg}}
+	httpClients.clients[key] = client
+	return client, nil
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc/metadata"
+)
+
+// the log fields carrying the trace context, so that the log lines of a trace can be found next to its spans
+const (
+	logkeyTraceID = "trace_id"
+	logkeySpanID  = "span_id"
+)
+
+// grpc metadata key carrying the W3C trace context to the trainer and the LCM
+const traceparentHeader = "traceparent"
+
+// the spans of the pipeline of a status, from the learner writing it to the kill of the job
+const (
+	spanLearnerStatus  = "learner_status"
+	spanCompareAndSwap = "etcd.compare_and_swap"
+	spanTrainerUpdate  = "trainer.update"
+	spanTrainerGet     = "trainer.get"
+	spanKillRequest    = "lcm.kill"
+)
+
+// the kinds and status codes of spans in OTLP
+const (
+	spanKindInternal    = 1
+	spanKindClient      = 3
+	otlpStatusCodeError = 2
+)
+
+// the resource and instrumentation scope the spans are exported under
+const (
+	tracingServiceName = "jobmonitor"
+	tracingScopeName   = "github.com/AISphere/ffdl-job-monitor"
+)
+
+// the spans are exported in batches of at most tracingBatchSize, at least every tracingExportInterval, and at most
+// tracingQueueSize spans wait for their export
+const (
+	tracingBatchSize      = 256
+	tracingQueueSize      = 4096
+	tracingExportInterval = 5 * time.Second
+)
+
+//traceSpan ... an OpenTelemetry span of the job monitor. A nil span is a span which isn't recorded, either because
+//tracing is off or because its trace isn't sampled. The OpenTelemetry SDK and its OTLP exporters need a far newer Go and
+//grpc than the etcd client of the job monitor builds with, so the spans are kept and exported as OTLP/JSON here
+type traceSpan struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]string
+	err        string
+	end        time.Time
+}
+
+//tracingEnabled tells whether spans are exported, see jobmonitor.tracing.endpoint
+func tracingEnabled() bool {
+	return viper.GetString(tracingEndpointKey) != ""
+}
+
+//traceSampled samples traces by their id like the TraceIdRatioBased sampler of OpenTelemetry, so that all the spans of
+//a trace get the same decision without it being passed along
+func traceSampled(traceID [16]byte) bool {
+	rate := viper.GetFloat64(tracingSampleRateKey)
+	if rate >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>1) < rate*float64(math.MaxInt64)
+}
+
+//traceContextOf returns the trace and span the log lines of logr belong to, if any
+func traceContextOf(logr *logger.LocLoggingEntry) ([16]byte, [8]byte, bool) {
+	var traceID [16]byte
+	var spanID [8]byte
+	if logr == nil || logr.Logger == nil {
+		return traceID, spanID, false
+	}
+	t, _ := logr.Logger.Data[logkeyTraceID].(string)
+	s, _ := logr.Logger.Data[logkeySpanID].(string)
+	if len(t) != 2*len(traceID) || len(s) != 2*len(spanID) {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(t)); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(s)); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+//tracing ... the span batcher of the process, set up with the first span and shut down by ShutdownTracing
+var tracing struct {
+	mu      sync.Mutex
+	batcher *spanBatcher
+}
+
+//spanBatcher ... exports the ended spans in batches of at most tracingBatchSize, at least every tracingExportInterval.
+//Spans ended while its queue is full are dropped, tracing must not hold up the monitoring
+type spanBatcher struct {
+	export  func(ctx context.Context, batch []*traceSpan) error
+	pending chan *traceSpan
+	flushes chan spanFlush
+}
+
+//spanFlush ... asks the batcher to export the spans queued so far, and to stop afterwards if stop is set
+type spanFlush struct {
+	ctx  context.Context
+	stop bool
+	done chan error
+}
+
+func newSpanBatcher(export func(ctx context.Context, batch []*traceSpan) error) *spanBatcher {
+	b := &spanBatcher{export: export, pending: make(chan *traceSpan, tracingQueueSize), flushes: make(chan spanFlush)}
+	go b.run(logger.LocLogger(jobLogEntry("", "").WithField(logkeyComponent, componentJobMonitor)))
+	return b
+}
+
+//batcher returns the span batcher of the process, setting it up if there is none yet
+func batcher() *spanBatcher {
+	tracing.mu.Lock()
+	defer tracing.mu.Unlock()
+	if tracing.batcher == nil {
+		endpoint := viper.GetString(tracingEndpointKey)
+		tracing.batcher = newSpanBatcher(func(ctx context.Context, batch []*traceSpan) error {
+			return exportSpans(ctx, endpoint, batch)
+		})
+	}
+	return tracing.batcher
+}
+
+func (b *spanBatcher) queue(span *traceSpan) {
+	select {
+	case b.pending <- span:
+	default:
+	}
+}
+
+func (b *spanBatcher) run(logr *logger.LocLoggingEntry) {
+	ticker := time.NewTicker(tracingExportInterval)
+	defer ticker.Stop()
+	var batch []*traceSpan
+	export := func(ctx context.Context) error {
+		var err error
+		for len(batch) > 0 {
+			n := len(batch)
+			if n > tracingBatchSize {
+				n = tracingBatchSize
+			}
+			if exportErr := b.export(ctx, batch[:n]); exportErr != nil {
+				logr.WithError(exportErr).Debugf("(exportSpans) dropped %d spans", n)
+				err = exportErr
+			}
+			batch = batch[n:]
+		}
+		batch = nil
+		return err
+	}
+	for {
+		select {
+		case span := <-b.pending:
+			if batch = append(batch, span); len(batch) >= tracingBatchSize {
+				export(context.Background())
+			}
+		case <-ticker.C:
+			export(context.Background())
+		case flush := <-b.flushes:
+			for queued := true; queued; {
+				select {
+				case span := <-b.pending:
+					batch = append(batch, span)
+				default:
+					queued = false
+				}
+			}
+			flush.done <- export(flush.ctx)
+			if flush.stop {
+				return
+			}
+		}
+	}
+}
+
+//flush exports the spans ended so far, or gives up once ctx is done
+func (b *spanBatcher) flush(ctx context.Context, stop bool) error {
+	flush := spanFlush{ctx: ctx, stop: stop, done: make(chan error, 1)}
+	select {
+	case b.flushes <- flush:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-flush.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//flushTraces exports the spans ended so far, or gives up once ctx is done
+func flushTraces(ctx context.Context) error {
+	tracing.mu.Lock()
+	b := tracing.batcher
+	tracing.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+	return b.flush(ctx, false)
+}
+
+//ShutdownTracing ... exports the spans ended so far and stops the span batcher of the process, to be called once the
+//process stops monitoring jobs. A span ended afterwards sets up a new one
+func ShutdownTracing(ctx context.Context) error {
+	tracing.mu.Lock()
+	b := tracing.batcher
+	tracing.batcher = nil
+	tracing.mu.Unlock()
+	if b == nil {
+		return nil
+	}
+	return b.flush(ctx, true)
+}
+
+//startSpan starts a span as a child of the span logr belongs to, or a new trace if it belongs to none. The returned
+//logger carries the trace context of the new span: passing it down makes the spans started further down its children,
+//and puts the trace id on their log lines. The span has to be ended with endSpan. Spans are timed on the wall clock,
+//not on the clock of the job monitor, as they end up next to the spans of other services
+func startSpan(logr *logger.LocLoggingEntry, name string, kind int, attributes map[string]string) (*traceSpan, *logger.LocLoggingEntry) {
+	if !tracingEnabled() {
+		return nil, logr
+	}
+	span := &traceSpan{name: name, kind: kind, start: time.Now(), attributes: attributes}
+	if traceID, parentID, ok := traceContextOf(logr); ok {
+		span.traceID, span.parentID = traceID, parentID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	rand.Read(span.spanID[:])
+	logr = logr.WithFields(log.Fields{logkeyTraceID: hex.EncodeToString(span.traceID[:]), logkeySpanID: hex.EncodeToString(span.spanID[:])})
+	if !traceSampled(span.traceID) {
+		return nil, logr
+	}
+	return span, logr
+}
+
+//endSpan ends the span, failed if err is set, and queues it for export with the next batch
+func endSpan(span *traceSpan, err error) {
+	if span == nil {
+		return
+	}
+	span.end = time.Now()
+	if err != nil {
+		span.err = err.Error()
+	}
+	batcher().queue(span)
+}
+
+//traceparent is the W3C trace context of the span logr belongs to, empty if it belongs to none
+func traceparent(logr *logger.LocLoggingEntry) string {
+	traceID, spanID, ok := traceContextOf(logr)
+	if !ok {
+		return ""
+	}
+	flags := "00"
+	if traceSampled(traceID) {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", hex.EncodeToString(traceID[:]), hex.EncodeToString(spanID[:]), flags)
+}
+
+//propagateTrace adds the trace context of logr to the grpc metadata of a call
+func propagateTrace(logr *logger.LocLoggingEntry, md metadata.MD) {
+	if value := traceparent(logr); value != "" {
+		md.Set(traceparentHeader, value)
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]otlpAttribute, 0, len(attributes))
+	for _, key := range keys {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = attributes[key]
+		result = append(result, attribute)
+	}
+	return result
+}
+
+//otlpSpan ... a span as OTLP/JSON encodes it
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func (span *traceSpan) otlp() otlpSpan {
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(span.traceID[:]),
+		SpanID:            hex.EncodeToString(span.spanID[:]),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		Attributes:        otlpAttributes(span.attributes),
+	}
+	if span.parentID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+	}
+	if span.err != "" {
+		s.Status.Code, s.Status.Message = otlpStatusCodeError, span.err
+	}
+	return s
+}
+
+//exportSpans posts the spans to endpoint as an OTLP/JSON ExportTraceServiceRequest, e.g. to
+//http://otel-collector:4318/v1/traces
+func exportSpans(ctx context.Context, endpoint string, batch []*traceSpan) error {
+	encoded := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		encoded = append(encoded, span.otlp())
+	}
+	type scopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	type resourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []scopeSpans `json:"scopeSpans"`
+	}
+	resource := resourceSpans{ScopeSpans: []scopeSpans{{Spans: encoded}}}
+	resource.Resource.Attributes = otlpAttributes(map[string]string{"service.name": tracingServiceName})
+	resource.ScopeSpans[0].Scope.Name = tracingScopeName
+	body, err := json.Marshal(struct {
+		ResourceSpans []resourceSpans `json:"resourceSpans"`
+	}{[]resourceSpans{resource}})
+	if err != nil {
+		return err
+	}
+
+	client, err := httpClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the collector at %s answered %s", endpoint, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+// unix nanos until which the trainer is treated as unreachable, 0 when no outage is simulated
+var simulatedTrainerOutageUntil int64
+
+//SimulateTrainerOutage ... makes every call to the trainer fail for d (ending a simulated outage if d is 0), so that
+//staging can rehearse how the job monitor rides out a trainer outage and catches up once it is over
+func SimulateTrainerOutage(d time.Duration) {
+	until := int64(0)
+	if d > 0 {
+		until = time.Now().Add(d).UnixNano()
+	}
+	atomic.StoreInt64(&simulatedTrainerOutageUntil, until)
+}
+
+//simulatedTrainerOutage returns an error while a simulated trainer outage is going on
+func simulatedTrainerOutage() error {
+	until := atomic.LoadInt64(&simulatedTrainerOutageUntil)
+	if until == 0 || time.Now().UnixNano() >= until {
+		return nil
+	}
+	return fmt.Errorf("trainer unreachable (simulated outage until %s)", time.Unix(0, until).Format(time.RFC3339))
+}
+
+//ServeDebugControls ... serves the debug controls of the job monitor on addr. It must only be enabled in staging:
+//  POST /debug/trainer-outage?minutes=N   the trainer is unreachable for the next N minutes
+//  DELETE /debug/trainer-outage           ends a simulated outage
+func ServeDebugControls(addr string, logr *logger.LocLoggingEntry) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/trainer-outage", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			minutes, err := strconv.Atoi(r.URL.Query().Get("minutes"))
+			if err != nil || minutes <= 0 {
+				http.Error(w, "minutes must be a positive number", http.StatusBadRequest)
+				return
+			}
+			logr.Warnf("(debug) simulating a trainer outage of %d minutes", minutes)
+			SimulateTrainerOutage(time.Duration(minutes) * time.Minute)
+		case http.MethodDelete:
+			logr.Warnf("(debug) ending the simulated trainer outage")
+			SimulateTrainerOutage(0)
+		default:
+			http.Error(w, "use POST or DELETE", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	logr.Warnf("(debug) serving the debug controls on %s, this must not be enabled in production", addr)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logr.WithError(err).Errorf("(debug) failed to serve the debug controls on %s", addr)
+		}
+	}()
+}
@@ -0,0 +1,176 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/ghodss/yaml"
+	"github.com/spf13/viper"
+)
+
+//transitionGraph ... the statuses a job may move to, each with the statuses it may move there from, e.g.
+//
+//	jobmonitor.status.transitions:
+//	  DOWNLOADING: [PENDING, NOT_STARTED]
+//	  PROCESSING:  [PROCESSING, DOWNLOADING, PENDING]
+//
+//A status without an entry can't be moved to at all
+type transitionGraph map[string][]string
+
+var (
+	configuredTransitions     transitionGraph
+	configuredTransitionsOnce sync.Once
+)
+
+//the states the trainer grew after the original six, looked up by name so that the job monitor keeps working with
+//trainers which don't have them yet. Those have QUEUED taken for PENDING and CANCELLED for HALTED, see
+//statusVocabularyFromConfig
+var (
+	statusQueued, trainerKnowsQueued       = statusByName("QUEUED")
+	statusCancelled, trainerKnowsCancelled = statusByName("CANCELLED")
+)
+
+//isWaitingStatus tells the statuses of a job which didn't start running yet
+func isWaitingStatus(status grpc_trainer_v2.Status) bool {
+	return status == grpc_trainer_v2.Status_NOT_STARTED || status == grpc_trainer_v2.Status_PENDING ||
+		(trainerKnowsQueued && status == statusQueued)
+}
+
+//defaultTransitions is the transition graph used unless jobmonitor.status.transitions or
+//jobmonitor.status.transitions_file configure another one
+func defaultTransitions() transitionGraph {
+	allowDOWNLOADING := []string{grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
+	allowPROCESSING := []string{grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String()}
+	allowSTORING := []string{grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
+	allowCOMPLETED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
+	allowFAILED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
+	allowHALTED := []string{grpc_trainer_v2.Status_STORING.String(), grpc_trainer_v2.Status_PROCESSING.String(), grpc_trainer_v2.Status_DOWNLOADING.String(), grpc_trainer_v2.Status_PENDING.String(), grpc_trainer_v2.Status_NOT_STARTED.String()}
+
+	graph := transitionGraph{
+		grpc_trainer_v2.Status_DOWNLOADING.String(): allowDOWNLOADING,
+		grpc_trainer_v2.Status_PROCESSING.String():  allowPROCESSING,
+		grpc_trainer_v2.Status_STORING.String():     allowSTORING,
+		grpc_trainer_v2.Status_COMPLETED.String():   allowCOMPLETED,
+		grpc_trainer_v2.Status_FAILED.String():      allowFAILED,
+		grpc_trainer_v2.Status_HALTED.String():      allowHALTED,
+	}
+	if trainerKnowsQueued {
+		// a queued job waits for its turn before it gets deployed, it moves on wherever a job which didn't start can
+		for to, froms := range graph {
+			for _, from := range froms {
+				if from == grpc_trainer_v2.Status_NOT_STARTED.String() {
+					graph[to] = append(froms, statusQueued.String())
+					break
+				}
+			}
+		}
+		graph[statusQueued.String()] = []string{grpc_trainer_v2.Status_NOT_STARTED.String()}
+	}
+	if trainerKnowsCancelled {
+		// users can cancel a job at any point a halt could stop it
+		graph[statusCancelled.String()] = append([]string(nil), graph[grpc_trainer_v2.Status_HALTED.String()]...)
+	}
+	return graph
+}
+
+//initTransitionMap returns the transition graph of the process, read from the config on first use. A configured
+//graph which doesn't validate is logged and replaced by the built-in one, a job monitor with a broken graph would
+//drop the statuses of every job
+func initTransitionMap() map[string]([]string) {
+	configuredTransitionsOnce.Do(func() {
+		logr := logger.LocLogger(jobLogEntry("", "").WithField(logkeyComponent, componentJobMonitor))
+		graph, source, err := transitionsFromConfig()
+		if err != nil {
+			logr.WithError(err).Errorf("the transitions configured in %s are invalid, using the built-in ones", source)
+			graph = nil
+		}
+		if graph == nil {
+			graph = defaultTransitions()
+		} else {
+			logr.Infof("using the transitions configured in %s", source)
+		}
+		configuredTransitions = graph
+	})
+	return configuredTransitions
+}
+
+//transitionsFromConfig reads the transition graph from the file jobmonitor.status.transitions_file names, or else
+//from jobmonitor.status.transitions, and validates it. The graph is nil if neither is set
+func transitionsFromConfig() (transitionGraph, string, error) {
+	if file := viper.GetString(transitionsFileKey); file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, file, err
+		}
+		raw := make(map[string][]string)
+		if err := yaml.Unmarshal(content, &raw); err != nil {
+			return nil, file, err
+		}
+		graph, err := parseTransitions(raw)
+		return graph, file, err
+	}
+	raw := viper.GetStringMapStringSlice(transitionsKey)
+	if len(raw) == 0 {
+		return nil, transitionsKey, nil
+	}
+	graph, err := parseTransitions(raw)
+	return graph, transitionsKey, err
+}
+
+//parseTransitions normalizes the status names of a configured transition graph and validates it: all the statuses have
+//to be known, terminal statuses can't be left again, and every terminal status has to be reachable, else a job could
+//never end
+func parseTransitions(raw map[string][]string) (transitionGraph, error) {
+	graph := make(transitionGraph, len(raw))
+	var problems []string
+	for to, froms := range raw {
+		toStatus, ok := statusByName(to)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unknown status %s", to))
+			continue
+		}
+		for _, from := range froms {
+			fromStatus, ok := statusByName(from)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown status %s in the transitions to %s", from, toStatus))
+				continue
+			}
+			if isTerminalStatus(fromStatus) {
+				problems = append(problems, fmt.Sprintf("%s is terminal, it can't move on to %s", fromStatus, toStatus))
+				continue
+			}
+			graph[toStatus.String()] = append(graph[toStatus.String()], fromStatus.String())
+		}
+	}
+	for _, terminal := range []grpc_trainer_v2.Status{grpc_trainer_v2.Status_COMPLETED, grpc_trainer_v2.Status_FAILED, grpc_trainer_v2.Status_HALTED} {
+		if len(graph[terminal.String()]) == 0 {
+			problems = append(problems, fmt.Sprintf("no transition leads to %s", terminal))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return graph, nil
+}
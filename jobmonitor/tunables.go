@@ -0,0 +1,88 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+)
+
+//durationTunable ... a timing setting operators tune for their cluster, e.g. shorter intervals for a small test cluster
+type durationTunable struct {
+	def, min, max time.Duration
+}
+
+//intTunable ... a retry count operators tune for their cluster
+type intTunable struct {
+	def, min, max int
+}
+
+var durationTunables = map[string]durationTunable{
+	learnerPollIntervalKey:       {def: 1 * time.Minute, min: 1 * time.Second, max: 1 * time.Hour},
+	learnerGraceKey:              {def: 60 * time.Second, min: 0, max: 1 * time.Hour},
+	killDelayKey:                 {def: 10 * time.Second, min: 0, max: 10 * time.Minute},
+	requestTimeoutKey:            {def: 10 * time.Second, min: 1 * time.Second, max: 5 * time.Minute},
+	imagePullThresholdKey:        {def: 2 * time.Minute, min: 0, max: 1 * time.Hour},
+	insuffResourcesMaxPendingKey: {def: 0, min: 0, max: 7 * 24 * time.Hour},
+	outcomeWebhookHorizonKey:     {def: 24 * time.Hour, min: 1 * time.Minute, max: 7 * 24 * time.Hour},
+	nodeFailureGraceKey:          {def: 2 * time.Minute, min: 0, max: 1 * time.Hour},
+	heartbeatTimeoutKey:          {def: 1 * time.Minute, min: 0, max: 1 * time.Hour},
+	lostLearnerThresholdKey:      {def: 5 * time.Minute, min: 0, max: 1 * time.Hour},
+	unwiredLearnerThresholdKey:   {def: 10 * time.Minute, min: 0, max: 24 * time.Hour},
+	haltTimeoutKey:               {def: 10 * time.Minute, min: 0, max: 24 * time.Hour},
+	learnerRestartBackoffKey:     {def: 30 * time.Second, min: 0, max: 1 * time.Hour},
+	metricsForwardIntervalKey:    {def: 1 * time.Minute, min: 0, max: 1 * time.Hour},
+	trainerRetryMaxElapsedKey:    {def: 10 * time.Minute, min: 1 * time.Minute, max: 24 * time.Hour},
+	scoringPollIntervalKey:       {def: 10 * time.Second, min: 1 * time.Second, max: 1 * time.Hour},
+}
+
+var intTunables = map[string]intTunable{
+	insuffResourcesRetriesKey:    {def: 10, min: 1, max: 1000},
+	nodeFailureMaxReschedulesKey: {def: 1, min: 0, max: 100},
+	learnerRestartMaxKey:         {def: 0, min: 0, max: 100},
+	logTailLinesKey:              {def: 50, min: 0, max: 10000},
+}
+
+//ValidateTunables ... resets the timing and retry settings which are out of their range, or not a number at all, to
+//their default, so that a typo in the config of a cluster doesn't leave its jobs with a busy loop or unmonitored. It
+//writes the global config, so a process calls it once at start, before it runs any job monitor
+func ValidateTunables(logr *logger.LocLoggingEntry) {
+	for key, t := range durationTunables {
+		if d := viper.GetDuration(key); d < t.min || d > t.max {
+			logr.Warnf("%s %q is not between %v and %v, using %v", key, viper.GetString(key), t.min, t.max, t.def)
+			viper.Set(key, t.def)
+		}
+	}
+	for key, t := range intTunables {
+		if i := viper.GetInt(key); i < t.min || i > t.max {
+			logr.Warnf("%s %q is not between %d and %d, using %d", key, viper.GetString(key), t.min, t.max, t.def)
+			viper.Set(key, t.def)
+		}
+	}
+}
+
+//ctxTimeout is the timeout of a single request to etcd, the trainer or a webhook
+func ctxTimeout() time.Duration {
+	return viper.GetDuration(requestTimeoutKey)
+}
+
+//insuffResourcesRetries is the number of pod checks a job gets to have all its pods scheduled
+func insuffResourcesRetries() int {
+	return viper.GetInt(insuffResourcesRetriesKey)
+}
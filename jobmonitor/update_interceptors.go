@@ -0,0 +1,62 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"google.golang.org/grpc/metadata"
+)
+
+//UpdateInterceptor ... deployment specific code which gets to change the updates of the trainer before they are sent,
+//e.g. to strip internal host names from the status messages or to add tenant fields. md is the grpc metadata sent
+//along with req, the interceptor may add to it or remove from it
+type UpdateInterceptor func(req *grpc_trainer_v2.UpdateRequest, md metadata.MD)
+
+var (
+	updateInterceptors   []UpdateInterceptor
+	updateInterceptorsMu sync.RWMutex
+)
+
+//RegisterUpdateInterceptor ... adds an interceptor of the trainer updates of all the jobs monitored by the process.
+//The interceptors run in the order they were registered, typically from the init() of site specific code linked into
+//the job monitor or the process embedding it
+func RegisterUpdateInterceptor(interceptor UpdateInterceptor) {
+	updateInterceptorsMu.Lock()
+	defer updateInterceptorsMu.Unlock()
+	updateInterceptors = append(updateInterceptors, interceptor)
+}
+
+//interceptUpdate runs the interceptors on the update. An interceptor which panics is skipped, the update goes out
+//with whatever the interceptors did to it until then
+func interceptUpdate(req *grpc_trainer_v2.UpdateRequest, md metadata.MD, logr *logger.LocLoggingEntry) {
+	updateInterceptorsMu.RLock()
+	interceptors := updateInterceptors
+	updateInterceptorsMu.RUnlock()
+	for i, interceptor := range interceptors {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logr.Errorf("(interceptUpdate) update interceptor %d of %s panicked: %v", i, req.TrainingId, r)
+				}
+			}()
+			interceptor(req, md)
+		}()
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-trainer/client"
+	"github.com/AISphere/ffdl-trainer/trainer/grpc_trainer_v2"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const zkHaltRequest = "halt_request"
+
+// how often the learners of a job halting gracefully are checked for having stopped
+const gracefulHaltCheckInterval = 5 * time.Second
+
+//a user asks for the job to stop while keeping what it has so far by writing either a plain reason or
+//{"reason": "good enough", "requested_by": "user-1"} to this key
+func haltRequestPath(trainingID string) string {
+	return trainingID + "/" + zkHaltRequest
+}
+
+type haltRequest struct {
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requested_by"`
+}
+
+func parseHaltRequest(value string) haltRequest {
+	value = strings.TrimSpace(value)
+	var req haltRequest
+	if !strings.HasPrefix(value, "{") || json.Unmarshal([]byte(value), &req) != nil {
+		req = haltRequest{Reason: value}
+	}
+	return req
+}
+
+func (r haltRequest) String() string {
+	by := r.RequestedBy
+	if by == "" {
+		by = "its user"
+	}
+	if r.Reason == "" {
+		return "on request of " + by
+	}
+	return fmt.Sprintf("on request of %s: %s", by, r.Reason)
+}
+
+//watchHaltRequest halts the job gracefully once its halt request key is set, see haltGracefully. A request written
+//before the job monitor came up is acted on as well
+func (jm *JobMonitor) watchHaltRequest(logr *logger.LocLoggingEntry) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		logr.WithError(err).Warnf("(watchHaltRequest) could not connect to etcd, halt requests of %s are not watched", jm.TrainingID)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout())
+	resp, err := etcd.Get(ctx, haltRequestPath(jm.TrainingID))
+	cancel()
+	if err != nil {
+		jm.metrics.failedETCDConnectivityCounter.Add(1)
+		logr.WithError(err).Warnf("(watchHaltRequest) could not read etcd, halt requests of %s are not watched", jm.TrainingID)
+		return
+	}
+	if len(resp.Kvs) > 0 {
+		go jm.haltGracefully(parseHaltRequest(string(resp.Kvs[0].Value)), logr)
+	}
+
+	ctx, cancel = context.WithCancel(jm.context())
+	defer cancel()
+	jm.keepWatching(ctx, "halt-request", haltRequestPath(jm.TrainingID), false, resp.Header.Revision+1, 0, func(ev *clientv3.Event) {
+		if ev.Type != mvccpb.DELETE {
+			go jm.haltGracefully(parseHaltRequest(string(ev.Kv.Value)), logr)
+		}
+	}, logr)
+}
+
+//haltGracefully stops the job without losing what it has: the learner pods get the jobmonitor.halt.annotation
+//annotation, which the learners see through the downward API and take as their cue to store their results and stop.
+//Once all of them wrote a terminal status, or after jobmonitor.halt.timeout, the job gets a HALTED final status and
+//is torn down. A learner halting by itself ends the job through its status as usual. Only the first request counts
+func (jm *JobMonitor) haltGracefully(req haltRequest, logr *logger.LocLoggingEntry) {
+	if !atomic.CompareAndSwapInt32(&jm.haltRequested, 0, 1) {
+		return
+	}
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	logr.Infof("(haltGracefully) halting %s %s, asking its learners to stop", jm.TrainingID, req)
+	jm.audit(logr, auditUserHalt, "halt requested %s", req)
+	jm.annotateLearnerPods(viper.GetString(haltAnnotationKey), jm.timeSource().Now().UTC().Format(time.RFC3339), logr)
+
+	timeout := jm.configDuration(haltTimeoutKey)
+	deadline := jm.timeSource().Now().Add(timeout)
+	for !jm.learnersStopped() {
+		if _, terminal := jm.terminalLatch(); terminal {
+			return
+		}
+		if !jm.timeSource().Now().Before(deadline) {
+			logr.Warnf("(haltGracefully) the learners of %s did not stop within %v, halting it anyhow", jm.TrainingID, timeout)
+			break
+		}
+		select {
+		case <-jm.context().Done():
+			return
+		case <-jm.timeSource().After(gracefulHaltCheckInterval):
+		}
+	}
+	if _, terminal := jm.terminalLatch(); terminal {
+		return
+	}
+	jm.sendFinalStatus(&client.TrainingStatusUpdate{Status: grpc_trainer_v2.Status_HALTED, Timestamp: client.CurrentTimestampAsString(),
+		StatusMessage: "the job was halted " + req.String()}, []ReasonCode{ReasonUserHalt}, logr)
+	jm.killDeployedJob(logr)
+}
+
+//learnersStopped tells whether all the learners of the job wrote a terminal status
+func (jm *JobMonitor) learnersStopped() bool {
+	jm.learnerStatusMu.Lock()
+	defer jm.learnerStatusMu.Unlock()
+	for _, i := range jm.learnerNumbers() {
+		if !isTerminalStatus(jm.learnerStatuses[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//annotateLearnerPods sets the annotation on all the learner pods of the job
+func (jm *JobMonitor) annotateLearnerPods(annotation string, value string, logr *logger.LocLoggingEntry) {
+	patch, _ := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": map[string]string{annotation: value}}})
+	for _, pod := range jm.learnerPods(logr) {
+		if _, err := jm.k8sClient.Core().Pods(pod.Namespace).Patch(pod.Name, types.StrategicMergePatchType, patch); err != nil {
+			jm.metrics.failedK8sConnectivityCounter.Add(1)
+			logr.WithError(err).Warnf("(annotateLearnerPods) failed to annotate pod %s of %s with %s", pod.Name, jm.TrainingID, annotation)
+		}
+	}
+}
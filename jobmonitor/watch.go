@@ -0,0 +1,217 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/go-kit/kit/metrics"
+)
+
+// etcd sends a progress notification on an otherwise idle watch every 10 minutes
+const etcdProgressNotificationInterval = 10 * time.Minute
+
+// number of progress notifications to count before dropping a log line (e.g., 6 * 10 minutes = log every hour)
+const etcdProgressNotificationLogFrequency = 6
+
+// a watch which did not hear anything from etcd for this long is considered silent
+const etcdWatchSilenceThreshold = 2*etcdProgressNotificationInterval + time.Minute
+
+//watchLiveness tracks the progress notifications of a single etcd watch, so that a watch which silently stopped
+//delivering anything can be told apart from a job which just has nothing to report
+type watchLiveness struct {
+	name string
+	// progress notifications received on this watch
+	notifications uint32
+	// unix nanos of the last response (event or progress notification) received on this watch
+	lastHeard int64
+	// revision the watch resumes from
+	revision int64
+	silence  metrics.Gauge
+	silent   metrics.Counter
+	clock    Clock
+}
+
+func (jm *JobMonitor) newWatchLiveness(name string) *watchLiveness {
+	w := &watchLiveness{
+		name:      name,
+		clock:     jm.timeSource(),
+		lastHeard: jm.timeSource().Now().UnixNano(),
+		silence:   jm.metrics.etcdWatchSilenceGauge.With("watch", name),
+		silent:    jm.metrics.silentETCDWatchCounter.With("watch", name),
+	}
+	jm.watchesMu.Lock()
+	defer jm.watchesMu.Unlock()
+	if jm.watches == nil {
+		jm.watches = make(map[string]*watchLiveness)
+	}
+	jm.watches[name] = w
+	return w
+}
+
+func (w *watchLiveness) heard() {
+	atomic.StoreInt64(&w.lastHeard, w.clock.Now().UnixNano())
+}
+
+func (w *watchLiveness) progressNotified(logr *logger.LocLoggingEntry) {
+	w.heard()
+	if n := atomic.AddUint32(&w.notifications, 1); n%etcdProgressNotificationLogFrequency == 0 {
+		logr.Debugf("watch %s received %d etcd progress notifications so far", w.name, n)
+	}
+}
+
+func (w *watchLiveness) silentFor(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&w.lastHeard)))
+}
+
+//check updates the silence gauge of the watch and alerts if the watch has been silent for longer than expected
+func (w *watchLiveness) check(logr *logger.LocLoggingEntry) bool {
+	silence := w.silentFor(w.clock.Now())
+	w.silence.Set(silence.Seconds())
+	if silence > etcdWatchSilenceThreshold {
+		w.silent.Add(1)
+		logr.Warnf("watch %s did not receive anything from etcd (not even a progress notification) for %v", w.name, silence)
+		return false
+	}
+	return true
+}
+
+//watchClient lazily connects the plain etcd client used for watches
+func (jm *JobMonitor) watchClient(logr *logger.LocLoggingEntry) (*etcdClient, error) {
+	jm.etcdMu.Lock()
+	defer jm.etcdMu.Unlock()
+	if jm.etcd == nil {
+		etcd, err := newEtcdClient(jm.etcdConfig, logr)
+		if err != nil {
+			return nil, err
+		}
+		jm.etcd = etcd
+	}
+	return jm.etcd, nil
+}
+
+//watch runs an etcd watch on key (with prefix semantics if asked for), starting at revision rev (0 meaning now), and
+//hands every event to handler until ctx is done or the watch fails. It returns the revision the watch has to be
+//resumed from to not miss any event
+func (jm *JobMonitor) watch(ctx context.Context, name string, key string, prefix bool, rev int64, handler func(*clientv3.Event), logr *logger.LocLoggingEntry) (int64, error) {
+	etcd, err := jm.watchClient(logr)
+	if err != nil {
+		return rev, err
+	}
+
+	opts := []clientv3.OpOption{clientv3.WithProgressNotify()}
+	if prefix {
+		opts = append(opts, clientv3.WithPrefix())
+	}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	liveness := jm.newWatchLiveness(name)
+	go func() {
+		ticker := jm.timeSource().NewTicker(etcdProgressNotificationInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C():
+				liveness.check(logr)
+			}
+		}
+	}()
+
+	for resp := range etcd.Watch(ctx, key, opts...) {
+		if resp.CompactRevision != 0 {
+			// the revisions we wanted to resume from are gone, all we can do is start at the oldest one still around
+			jm.metrics.failedETCDWatchCounter.Add(1)
+			return resp.CompactRevision, resp.Err()
+		}
+		if err := resp.Err(); err != nil {
+			jm.metrics.failedETCDWatchCounter.Add(1)
+			return rev, err
+		}
+		if resp.IsProgressNotify() {
+			liveness.progressNotified(logr)
+			// nothing happened on the watched keys up to the header revision
+			rev = resp.Header.Revision + 1
+			atomic.StoreInt64(&liveness.revision, rev)
+			continue
+		}
+		liveness.heard()
+		jm.leaveDegradedMode(degradedEtcdFailover, logr)
+		for _, ev := range resp.Events {
+			handler(ev)
+			rev = ev.Kv.ModRevision + 1
+		}
+		atomic.StoreInt64(&liveness.revision, rev)
+	}
+	if ctx.Err() != nil {
+		return rev, ctx.Err()
+	}
+	jm.metrics.failedETCDWatchCounter.Add(1)
+	return rev, fmt.Errorf("watch %s on %s was closed", name, key)
+}
+
+//keepWatching runs watchFromRevision, logging why it returned unless ctx is done
+func (jm *JobMonitor) keepWatching(ctx context.Context, name string, key string, prefix bool, rev int64, maxFailures int, handler func(*clientv3.Event), logr *logger.LocLoggingEntry) {
+	if err := jm.watchFromRevision(ctx, name, key, prefix, rev, maxFailures, handler, logr); err != nil && ctx.Err() == nil {
+		logr.WithError(err).Errorf("watch %s of %s ended, its events are not seen anymore", name, jm.TrainingID)
+	}
+}
+
+//watchFromRevision keeps a watch running until ctx is done. A dropped watch (e.g. during an etcd leader election or a
+//brief network partition) is re-established from the revision following the last event handed to handler, instead
+//of from "now", so that no status events are missed. If maxFailures is not 0, it gives up after that many drops in a
+//row which made no progress and returns the last error
+func (jm *JobMonitor) watchFromRevision(ctx context.Context, name string, key string, prefix bool, rev int64, maxFailures int, handler func(*clientv3.Event), logr *logger.LocLoggingEntry) error {
+	reconnectBackoff := jm.exponentialBackoff(0, 30*time.Second)
+	failures := 0
+	for {
+		nextRev, err := jm.watch(ctx, name, key, prefix, rev, handler, logr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == rpctypes.ErrCompacted {
+			logr.Warnf("watch %s could not be resumed from revision %d since it was compacted, resuming from %d. Events in between are lost", name, rev, nextRev)
+		}
+		if nextRev > rev {
+			reconnectBackoff.Reset()
+			failures = 0
+		} else if failures++; maxFailures > 0 && failures >= maxFailures {
+			return err
+		}
+		rev = nextRev
+
+		jm.enterDegradedMode(degradedEtcdFailover, fmt.Sprintf("watch %s was dropped: %v", name, err), logr)
+		wait := reconnectBackoff.NextBackOff()
+		logr.WithError(err).Warnf("watch %s was dropped, re-establishing it from revision %d in %v", name, rev, wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-jm.timeSource().After(wait):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AISphere/ffdl-commons/logger"
+)
+
+// grpc metadata key carrying the peak memory usage of the learners with the final status update of the job
+const watermarksHeader = "resource-watermarks"
+
+//learnerWatermark ... the peak memory and GPU memory usage a learner reported in its summary metrics
+type learnerWatermark struct {
+	Memory    float64
+	GPUMemory float64
+}
+
+//resourceWatermarks ... the watermarks of the learners of a job, by learner number
+type resourceWatermarks struct {
+	mu    sync.Mutex
+	peaks map[int]*learnerWatermark
+}
+
+//sampleWatermarks raises the watermarks of the learner to the memory usage in its current summary metrics. The metrics
+//are configured through jobmonitor.watermarks.memory.metric and jobmonitor.watermarks.gpu_memory.metric, learners
+//which don't report them have no watermarks
+func (jm *JobMonitor) sampleWatermarks(learner int, logr *logger.LocLoggingEntry) {
+	response, err := jm.EtcdClient.Get(learnerSummaryMetricsPath(jm.TrainingID, learner), logr)
+	if err != nil || len(response) == 0 {
+		return
+	}
+	memory, hasMemory := summaryMetric(response[0].Value, jm.configString(watermarkMemoryMetricKey))
+	gpuMemory, hasGPUMemory := summaryMetric(response[0].Value, jm.configString(watermarkGPUMemoryMetricKey))
+	if !hasMemory && !hasGPUMemory {
+		return
+	}
+
+	w := &jm.watermarks
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.peaks == nil {
+		w.peaks = make(map[int]*learnerWatermark)
+	}
+	peak, ok := w.peaks[learner]
+	if !ok {
+		peak = &learnerWatermark{}
+		w.peaks[learner] = peak
+	}
+	if memory > peak.Memory {
+		peak.Memory = memory
+	}
+	if gpuMemory > peak.GPUMemory {
+		peak.GPUMemory = gpuMemory
+	}
+}
+
+//watermarkSummary puts the watermarks of the learners together for the completion summary of the job, e.g.
+//"learner_1:memory=1.2e+10,gpu_memory=1.1e+10;learner_2:memory=9.8e+09", in the units the learners report them in.
+//It is empty if no learner reported its memory usage
+func (jm *JobMonitor) watermarkSummary() string {
+	w := &jm.watermarks
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	learners := make([]int, 0, len(w.peaks))
+	for learner := range w.peaks {
+		learners = append(learners, learner)
+	}
+	sort.Ints(learners)
+
+	summaries := make([]string, 0, len(learners))
+	for _, learner := range learners {
+		peak := w.peaks[learner]
+		var values []string
+		if peak.Memory > 0 {
+			values = append(values, fmt.Sprintf("memory=%g", peak.Memory))
+		}
+		if peak.GPUMemory > 0 {
+			values = append(values, fmt.Sprintf("gpu_memory=%g", peak.GPUMemory))
+		}
+		if len(values) > 0 {
+			summaries = append(summaries, fmt.Sprintf("learner_%d:%s", learner, strings.Join(values, ",")))
+		}
+	}
+	return strings.Join(summaries, ";")
+}
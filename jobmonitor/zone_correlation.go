@@ -0,0 +1,134 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/AISphere/ffdl-commons/config"
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/spf13/viper"
+
+	v1core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// node labels carrying the zone of a node, the beta one is set by older kubernetes versions
+var zoneLabels = []string{"topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"}
+
+//learnerFailedSince tells whether the learner pod failed, or its node stopped reporting, since the given time
+func learnerFailedSince(pod v1core.Pod, node *v1core.Node, since time.Time) bool {
+	if pod.Status.Phase == v1core.PodFailed {
+		return true
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		for _, terminated := range []*v1core.ContainerStateTerminated{status.State.Terminated, status.LastTerminationState.Terminated} {
+			if terminated != nil && terminated.ExitCode != 0 && !terminated.FinishedAt.Time.Before(since) {
+				return true
+			}
+		}
+	}
+	if node != nil {
+		for _, condition := range node.Status.Conditions {
+			if condition.Type == v1core.NodeReady && condition.Status != v1core.ConditionTrue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nodeZone(node *v1core.Node) string {
+	if node == nil {
+		return ""
+	}
+	for _, label := range zoneLabels {
+		if zone := node.ObjectMeta.Labels[label]; zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
+
+//correlatedFailureZone looks at the learners which failed within the correlation window, and returns their zone if
+//several of them failed and all of them were running in the same zone, which most likely means the zone has an outage
+func (jm *JobMonitor) correlatedFailureZone(logr *logger.LocLoggingEntry) string {
+	if jm.k8sClient == nil || jm.learnerCount() < 2 {
+		return ""
+	}
+	selector := fmt.Sprintf("training_id==%s,service==%s", jm.TrainingID, learnerServiceLabel)
+	pods, err := jm.k8sClient.Core().Pods(config.GetLearnerNamespace()).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		logr.WithError(err).Warnf("(correlatedFailureZone) failed to list the learner pods of %s", jm.TrainingID)
+		return ""
+	}
+
+	since := jm.timeSource().Now().Add(-viper.GetDuration(failureCorrelationWindowKey))
+	nodes := make(map[string]*v1core.Node)
+	zones := make(map[string]int)
+	failed := 0
+	for _, pod := range pods.Items {
+		name := pod.Spec.NodeName
+		if name == "" {
+			continue
+		}
+		node, ok := nodes[name]
+		if !ok {
+			if node, err = jm.k8sClient.Core().Nodes().Get(name, metav1.GetOptions{}); err != nil {
+				logr.WithError(err).Debugf("(correlatedFailureZone) failed to get the node %s", name)
+				node = nil
+			}
+			nodes[name] = node
+		}
+		if learnerFailedSince(pod, node, since) {
+			failed++
+			zones[nodeZone(node)]++
+		}
+	}
+
+	if failed < 2 || len(zones) != 1 {
+		return ""
+	}
+	for zone := range zones {
+		if zone != "" {
+			logr.Warnf("(correlatedFailureZone) %d learners of %s failed within %v, all of them in zone %s", failed, jm.TrainingID,
+				viper.GetDuration(failureCorrelationWindowKey), zone)
+			jm.metrics.zoneCorrelatedFailureCounter.Add(1)
+			return zone
+		}
+	}
+	return ""
+}
+
+//recheckFailureZone correlates the failures of the learners again once jobmonitor.failures.correlation.settle passed,
+//since the other learners of a zone going down may only fail after the first one did. The final status is sent by
+//then, so a zone found now is only logged and counted
+func (jm *JobMonitor) recheckFailureZone(logr *logger.LocLoggingEntry) {
+	settle := viper.GetDuration(failureCorrelationSettleKey)
+	if settle <= 0 || jm.k8sClient == nil || jm.learnerCount() < 2 {
+		return
+	}
+	select {
+	case <-jm.context().Done():
+		return
+	case <-jm.timeSource().After(settle):
+	}
+	if zone := jm.correlatedFailureZone(logr); zone != "" {
+		logr.Warnf("(recheckFailureZone) %s most likely failed because of an outage of zone %s, its final status was sent before that showed", jm.TrainingID, zone)
+	}
+}
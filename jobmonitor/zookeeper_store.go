@@ -0,0 +1,376 @@
+/*
+ * Copyright 2018. IBM Corporation
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package jobmonitor
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/AISphere/ffdl-commons/logger"
+	"github.com/AISphere/ffdl-lcm/coord"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/go-zookeeper/zk"
+)
+
+const (
+	// under the path of the endpoints, or this one if they have none
+	zookeeperDefaultRoot = "/ffdl"
+	// the node of a key without a slash, or with an empty first segment. It doesn't come out of zookeeperName
+	zookeeperNoName = "@"
+	// the node under the root which every commit writes to, so its modification is the revision of the store
+	zookeeperRevisionNode = "@rev"
+)
+
+//zookeeperConn ... the calls zookeeperStore makes on a *zk.Conn
+type zookeeperConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Multi(ops ...interface{}) ([]zk.MultiResponse, error)
+	Close()
+}
+
+//zookeeperStore ... keeps the keys in ZooKeeper, two levels under the root: a key is the node root/<first>/<rest>, the
+//first segment being the one after the prefix of the coordinator, e.g. with the prefix jobmonitor/ the key
+//jobmonitor/training-1/status is root/jobmonitor%2Ftraining-1/%2Fstatus. The revisions of a key are the zxids of its
+//node, and its version the one of the node plus one. Every commit writes the nodes of the first segments it changes
+//and root/@rev as well, which the watches and the revision of the store are taken from. ZooKeeper doesn't do TLS;
+//with a username the nodes are created with a digest ACL for it
+type zookeeperStore struct {
+	conn   zookeeperConn
+	root   string
+	prefix string
+	acl    []zk.ACL
+}
+
+//zookeeperLogger ... the log of the ZooKeeper client, at debug level
+type zookeeperLogger struct {
+	logr *logger.LocLoggingEntry
+}
+
+func (l zookeeperLogger) Printf(format string, args ...interface{}) {
+	l.logr.Debugf(format, args...)
+}
+
+func openZookeeperStore(coordConfig coord.Config, logr *logger.LocLoggingEntry) (kvStore, error) {
+	if coordConfig.Cert != "" {
+		return nil, fmt.Errorf("the ZooKeeper client doesn't do TLS, the coordinator certificate %s can't be used", coordConfig.Cert)
+	}
+	root := ""
+	var servers []string
+	for _, endpoint := range coordConfig.Endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, u.Host)
+		if root == "" && strings.Trim(u.Path, "/") != "" {
+			root = path.Clean(u.Path)
+		}
+	}
+	if root == "" {
+		root = zookeeperDefaultRoot
+	}
+	conn, _, err := zk.Connect(servers, ctxTimeout(), zk.WithLogger(zookeeperLogger{logr}))
+	if err != nil {
+		return nil, err
+	}
+	acl := zk.WorldACL(zk.PermAll)
+	if user := coordConfig.Username; user != "" {
+		if err := conn.AddAuth("digest", []byte(user+":"+coordConfig.Password)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		acl = zk.DigestACL(zk.PermAll, user, coordConfig.Password)
+	}
+	s := newZookeeperStore(conn, root, coordConfig.Prefix, acl)
+	if err := s.createRoot(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newZookeeperStore(conn zookeeperConn, root string, prefix string, acl []zk.ACL) *zookeeperStore {
+	return &zookeeperStore{conn: conn, root: root, prefix: prefix, acl: acl}
+}
+
+//createRoot creates the root and its revision node if they are missing
+func (s *zookeeperStore) createRoot() error {
+	at := ""
+	for _, name := range strings.Split(strings.Trim(s.root, "/"), "/") {
+		at += "/" + name
+		if err := s.ensure(at); err != nil {
+			return err
+		}
+	}
+	return s.ensure(s.root + "/" + zookeeperRevisionNode)
+}
+
+//ensure creates the node p if it is missing
+func (s *zookeeperStore) ensure(p string) error {
+	if _, err := s.conn.Create(p, nil, 0, s.acl); err != nil && err != zk.ErrNodeExists {
+		return err
+	}
+	return nil
+}
+
+//zookeeperName escapes s into the name of a node, keeping letters, digits, - and _
+func zookeeperName(s string) string {
+	if s == "" {
+		return zookeeperNoName
+	}
+	var name strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' {
+			name.WriteByte(c)
+		} else {
+			fmt.Fprintf(&name, "%%%02X", c)
+		}
+	}
+	return name.String()
+}
+
+func zookeeperUnname(name string) (string, error) {
+	if name == zookeeperNoName {
+		return "", nil
+	}
+	return url.PathUnescape(name)
+}
+
+//splitKey returns the first segment of key after the prefix, along with the prefix, and the rest of it, starting with
+//its slash
+func (s *zookeeperStore) splitKey(key string) (string, string) {
+	n := 0
+	if strings.HasPrefix(key, s.prefix) {
+		n = len(s.prefix)
+	}
+	if at := strings.Index(key[n:], "/"); at >= 0 {
+		return key[:n+at], key[n+at:]
+	}
+	return key, ""
+}
+
+func (s *zookeeperStore) group(first string) string {
+	return s.root + "/" + zookeeperName(first)
+}
+
+func (s *zookeeperStore) node(key string) string {
+	first, rest := s.splitKey(key)
+	return s.group(first) + "/" + zookeeperName(rest)
+}
+
+//isConflict tells whether a failed multi was rolled back for a node which changed since it was read
+func isConflict(err error) bool {
+	return err == zk.ErrBadVersion || err == zk.ErrNodeExists || err == zk.ErrNoNode || err == zk.ErrNotEmpty
+}
+
+func (s *zookeeperStore) get(key string) (*mvccpb.KeyValue, error) {
+	data, stat, err := s.conn.Get(s.node(key))
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mvccpb.KeyValue{Key: []byte(key), Value: data, CreateRevision: stat.Czxid, ModRevision: stat.Mzxid,
+		Version: int64(stat.Version) + 1}, nil
+}
+
+//children returns the names of the children of p, unescaped, none if it is missing
+func (s *zookeeperStore) children(p string) ([]string, error) {
+	names, _, err := s.conn.Children(p)
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var unnamed []string
+	for _, name := range names {
+		if name == zookeeperRevisionNode {
+			continue
+		}
+		if name, err := zookeeperUnname(name); err == nil {
+			unnamed = append(unnamed, name)
+		}
+	}
+	return unnamed, nil
+}
+
+//keys returns the keys in the range of op
+func (s *zookeeperStore) keys(op clientv3.Op) ([]string, error) {
+	if len(op.RangeBytes()) == 0 {
+		return []string{string(op.KeyBytes())}, nil
+	}
+	prefix := listPrefix(op)
+	var groups []string
+	if first, rest := s.splitKey(prefix); rest != "" {
+		groups = []string{first}
+	} else {
+		all, err := s.children(s.root)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range all {
+			if strings.HasPrefix(group, prefix) {
+				groups = append(groups, group)
+			}
+		}
+	}
+	var keys []string
+	for _, group := range groups {
+		rests, err := s.children(s.group(group))
+		if err != nil {
+			return nil, err
+		}
+		for _, rest := range rests {
+			if key := group + rest; inRange([]byte(key), op) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+//read takes the revision of the store before the keys, a key changed while they are read may be past it
+func (s *zookeeperStore) read(ctx context.Context, ranges []clientv3.Op) ([]*mvccpb.KeyValue, int64, error) {
+	_, stat, err := s.conn.Get(s.root + "/" + zookeeperRevisionNode)
+	if err != nil {
+		return nil, 0, err
+	}
+	var kvs []*mvccpb.KeyValue
+	seen := make(map[string]bool)
+	for _, r := range ranges {
+		keys, err := s.keys(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if err := ctx.Err(); err != nil {
+				return nil, 0, err
+			}
+			kv, err := s.get(key)
+			if err != nil {
+				return nil, 0, err
+			}
+			if kv != nil {
+				kvs = append(kvs, kv)
+			}
+		}
+	}
+	sortKeyValues(kvs)
+	return kvs, stat.Mzxid, nil
+}
+
+func (s *zookeeperStore) commit(ctx context.Context, c storeCommit) (int64, bool, error) {
+	var ops []interface{}
+	groups := make(map[string]bool)
+	for key, kv := range c.expected {
+		p := s.node(key)
+		if kv == nil {
+			// a node is missing if it can be created
+			ops = append(ops, &zk.CreateRequest{Path: p, Acl: s.acl}, &zk.DeleteRequest{Path: p, Version: -1})
+			first, _ := s.splitKey(key)
+			groups[first] = true
+		} else {
+			ops = append(ops, &zk.CheckVersionRequest{Path: p, Version: int32(kv.Version - 1)})
+		}
+	}
+	for _, put := range c.puts {
+		key := string(put.kv.Key)
+		if put.prev == nil {
+			ops = append(ops, &zk.CreateRequest{Path: s.node(key), Data: put.kv.Value, Acl: s.acl})
+		} else {
+			ops = append(ops, &zk.SetDataRequest{Path: s.node(key), Data: put.kv.Value, Version: int32(put.prev.Version - 1)})
+		}
+		first, _ := s.splitKey(key)
+		groups[first] = true
+	}
+	for _, kv := range c.deletes {
+		ops = append(ops, &zk.DeleteRequest{Path: s.node(string(kv.Key)), Version: -1})
+		first, _ := s.splitKey(string(kv.Key))
+		groups[first] = true
+	}
+	for group := range groups {
+		if err := s.ensure(s.group(group)); err != nil {
+			return 0, false, err
+		}
+		ops = append(ops, &zk.SetDataRequest{Path: s.group(group), Version: -1})
+	}
+	ops = append(ops, &zk.SetDataRequest{Path: s.root + "/" + zookeeperRevisionNode, Version: -1})
+	if err := ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	responses, err := s.conn.Multi(ops...)
+	if err == nil {
+		for _, resp := range responses {
+			if resp.Error != nil {
+				err = resp.Error
+				break
+			}
+		}
+	}
+	if err != nil {
+		for _, resp := range responses {
+			if isConflict(resp.Error) {
+				return 0, false, nil
+			}
+		}
+		if isConflict(err) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return responses[len(responses)-1].Stat.Mzxid, true, nil
+}
+
+//wait watches the node of the first segment the keys of the range have, or the revision node if they have several
+func (s *zookeeperStore) wait(ctx context.Context, op clientv3.Op, rev int64) error {
+	watched := s.root + "/" + zookeeperRevisionNode
+	if first, rest := s.splitKey(listPrefix(op)); rest != "" || len(op.RangeBytes()) == 0 {
+		watched = s.group(first)
+	}
+	_, stat, changed, err := s.conn.ExistsW(watched)
+	if err != nil {
+		return err
+	}
+	if stat != nil && stat.Mzxid > rev {
+		return nil
+	}
+	select {
+	case ev := <-changed:
+		return ev.Err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *zookeeperStore) close() error {
+	s.conn.Close()
+	return nil
+}
@@ -18,6 +18,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"strconv"
 
 	"github.com/AISphere/ffdl-commons/config"
@@ -25,39 +28,123 @@ import (
 	"github.com/AISphere/ffdl-commons/metricsmon"
 	"github.com/AISphere/ffdl-commons/util"
 	jobM "github.com/AISphere/ffdl-job-monitor/jobmonitor"
+	"github.com/go-kit/kit/metrics/statsd"
 
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 func main() {
+	exportState := flag.String("export-state", "", "write the monitor state of the training $TRAINING_ID into the given archive and exit")
+	importState := flag.String("import-state", "", "replay the monitor state archive into the training $TRAINING_ID and exit")
+	replayOutcome := flag.Bool("replay-outcome", false, "deliver the outcome notification of the training $TRAINING_ID (attempt $ATTEMPT, the latest if unset) again and exit")
+	controller := flag.Bool("controller", false, "monitor all the trainings registered under jobmonitor.controller.prefix instead of $TRAINING_ID")
+	preflight := flag.Bool("preflight", false, "check the connections to and the permissions in etcd, kubernetes, the trainer and the LCM, print the report as JSON and exit")
+	benchmark := flag.Bool("benchmark", false, "monitor simulated jobs against the configured etcd, print what it took as JSON and exit")
+	benchmarkInMemory := flag.Bool("benchmark-in-memory", false, "keep the etcd of -benchmark in memory instead of using the configured one")
+	benchmarkJobs := flag.Int("benchmark-jobs", 10, "number of simulated jobs of -benchmark")
+	benchmarkLearners := flag.Int("benchmark-learners", 2, "number of simulated learners of each job of -benchmark")
+	benchmarkStatuses := flag.Int("benchmark-statuses", 10, "number of statuses each simulated learner of -benchmark writes")
+	benchmarkInterval := flag.Duration("benchmark-interval", time.Second, "time between two statuses of a simulated learner of -benchmark")
+	benchmarkTimeout := flag.Duration("benchmark-timeout", 5*time.Minute, "how long -benchmark waits for the simulated jobs to be seen through")
+	flag.Parse()
+
 	config.InitViper()
 	logger.Config()
 
+	if *exportState != "" || *importState != "" {
+		os.Exit(runStateCommand(*exportState, *importState))
+	}
+	if *replayOutcome {
+		os.Exit(runReplayOutcome())
+	}
+	if *preflight {
+		os.Exit(runPreflight())
+	}
+	if *benchmark {
+		os.Exit(runBenchmark(jobM.BenchmarkConfig{Jobs: *benchmarkJobs, Learners: *benchmarkLearners, Statuses: *benchmarkStatuses,
+			Interval: *benchmarkInterval, Timeout: *benchmarkTimeout, InMemory: *benchmarkInMemory}))
+	}
+
 	statsdClient := metricsmon.NewStatsdClient("jobmonitor")
-	if config.CheckPushGatewayEnabled() {
-		metricsmon.StartStatsdMetricsPusher(statsdClient, 10*time.Second)
+	if *controller {
+		os.Exit(runController(statsdClient))
 	}
 	useNativeDistribution, _ := strconv.ParseBool(os.Getenv("USE_NATIVE_DISTRIBUTION"))
 	numLearners, _ := strconv.Atoi(os.Getenv("NUM_LEARNERS"))
 	trainingID := os.Getenv("TRAINING_ID")
 	userID := os.Getenv("USER_ID")
-	jobName := os.Getenv("JOB_NAME")
+	deferTeardown, _ := time.ParseDuration(os.Getenv("DEFER_TEARDOWN"))
+	attempt, _ := strconv.Atoi(os.Getenv("ATTEMPT"))
+	maxAttempts, _ := strconv.Atoi(os.Getenv("MAX_ATTEMPTS"))
 
-	logr := logger.LocLogger(jobM.InitLogger(trainingID, userID))
-	jm, err := jobM.NewJobMonitor(trainingID, userID, numLearners, jobName, useNativeDistribution, statsdClient, logr)
+	logr := initProcess(trainingID, userID)
+
+	//staging only, lets outages of the trainer be rehearsed
+	if addr := os.Getenv("DEBUG_CONTROLS_ADDR"); addr != "" {
+		jobM.ServeDebugControls(addr, logr)
+	}
+
+	switch jobM.MetricsTransport() {
+	case jobM.MetricsTransportPushgateway, jobM.MetricsTransportHTTP:
+		jobM.StartHTTPMetricsPusher(statsdClient, 10*time.Second, logr)
+	default:
+		if config.CheckPushGatewayEnabled() {
+			metricsmon.StartStatsdMetricsPusher(statsdClient, 10*time.Second)
+		}
+	}
+	jm, err := jobM.NewJobMonitorFromConfig(jobM.Config{
+		TrainingID:            trainingID,
+		UserID:                userID,
+		JobName:               os.Getenv("JOB_NAME"),
+		JobKind:               os.Getenv("JOB_KIND"),
+		NumLearners:           numLearners,
+		UseNativeDistribution: useNativeDistribution,
+		Labels:                jobM.ParseJobLabels(os.Getenv("JOB_LABELS")),
+		Framework:             os.Getenv("FRAMEWORK_NAME"),
+		FrameworkVersion:      os.Getenv("FRAMEWORK_VERSION"),
+		ResumesFrom:           os.Getenv("RESUMES_FROM"),
+		FromTrainer:           os.Getenv("NUM_LEARNERS") == "",
+		DeferFailedTeardown:   deferTeardown,
+		Metrics:               jobM.StatsdMetrics(statsdClient),
+		Attempt:               attempt,
+		MaxAttempts:           maxAttempts,
+	}, logr)
 
 	if err != nil {
 		logr.WithError(err).Errorf("failed to bring up job monitor for training %s, already must have signaled to kill the jm", trainingID)
 	} else {
 		logr.Infof("Job Monitor instantiated and ready to go. Starting to manage %s", jm.TrainingID)
 
+		jm.HandleDiagnosticSignal(syscall.SIGUSR2, logr)
+		if addr := jobM.HealthAddr(); addr != "" {
+			jobM.ServeHealth(addr, logr)
+		}
+		if addr := jobM.APIAddr(); addr != "" {
+			jobM.ServeAPI(addr, logr)
+		}
+		if addr := jobM.QueryAddr(); addr != "" {
+			jobM.ServeQueryService(addr, logr)
+		}
+		if addr := jobM.PrometheusAddr(); addr != "" {
+			jobM.ServePrometheus(addr, logr)
+		}
 		go jm.ManageDistributedJob(logr)
+		go func() {
+			// the new leader monitors the job now, restart as the standby
+			<-jm.LostLeadership()
+			logr.Warningln(" ###### job monitor lost the leadership, exiting ###### ")
+			os.Exit(1)
+		}()
 
 		util.HandleOSSignals(func() {
 			logr.Warningln(" ###### shutting down job monitor ###### ")
-			jm.EtcdClient.Close(logr)
-
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			jm.Stop(ctx, logr)
+			jobM.ShutdownTracing(ctx)
 		})
 
 		//This seems to be the only way to prevent the container from exiting.
@@ -68,3 +155,121 @@ func main() {
 	}
 
 }
+
+//export or import the etcd state of a training for support tickets, see jobmonitor.ExportState
+func runStateCommand(exportPath string, importPath string) int {
+	trainingID := os.Getenv("TRAINING_ID")
+	logr := initProcess(trainingID, os.Getenv("USER_ID"))
+
+	var err error
+	if exportPath != "" {
+		var f *os.File
+		if f, err = os.Create(exportPath); err == nil {
+			err = jobM.ExportState(trainingID, nil, nil, f, logr)
+			f.Close()
+		}
+	} else {
+		var f *os.File
+		if f, err = os.Open(importPath); err == nil {
+			err = jobM.ImportState(trainingID, f, logr)
+			f.Close()
+		}
+	}
+	if err != nil {
+		logr.WithError(err).Errorf("state command for training %s failed", trainingID)
+		return 1
+	}
+	return 0
+}
+
+//deliver the outcome notification of a training again, see jobmonitor.ReplayOutcome
+func runReplayOutcome() int {
+	trainingID := os.Getenv("TRAINING_ID")
+	attempt, _ := strconv.Atoi(os.Getenv("ATTEMPT"))
+	logr := initProcess(trainingID, os.Getenv("USER_ID"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+	if err := jobM.ReplayOutcome(ctx, trainingID, attempt, logr); err != nil {
+		logr.WithError(err).Errorf("failed to replay the outcome notification of training %s", trainingID)
+		return 1
+	}
+	return 0
+}
+
+//check the deployment of the job monitor, see jobmonitor.Preflight
+func runPreflight() int {
+	logr := initProcess("", "")
+	report := jobM.Preflight(logr)
+	logr.Infof("preflight: %s", report)
+	json.NewEncoder(os.Stdout).Encode(report)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+//measure the job monitor under the load of simulated jobs, see jobmonitor.RunBenchmark
+func runBenchmark(cfg jobM.BenchmarkConfig) int {
+	logr := initProcess("", "")
+	report, err := jobM.RunBenchmark(cfg, logr)
+	if err != nil {
+		logr.WithError(err).Errorf("the benchmark failed")
+		return 1
+	}
+	logr.Infof("benchmark: %s", report)
+	json.NewEncoder(os.Stdout).Encode(report)
+	return 0
+}
+
+//monitor many trainings in this process, see jobmonitor.Controller
+func runController(statsdClient *statsd.Statsd) int {
+	logr := initProcess("", "")
+	if config.CheckPushGatewayEnabled() {
+		metricsmon.StartStatsdMetricsPusher(statsdClient, 10*time.Second)
+	}
+	c, err := jobM.NewController(jobM.ControllerConfig{Metrics: jobM.StatsdMetrics(statsdClient)}, logr)
+	if err != nil {
+		logr.WithError(err).Errorf("failed to bring up the job monitor controller")
+		return 1
+	}
+	if addr := jobM.HealthAddr(); addr != "" {
+		jobM.ServeHealth(addr, logr)
+	}
+	if addr := jobM.APIAddr(); addr != "" {
+		jobM.ServeAPI(addr, logr)
+	}
+	if addr := jobM.QueryAddr(); addr != "" {
+		jobM.ServeQueryService(addr, logr)
+	}
+	if addr := jobM.PrometheusAddr(); addr != "" {
+		jobM.ServePrometheus(addr, logr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logr.Warningln(" ###### shutting down job monitor controller ###### ")
+		cancel()
+	}()
+	// returns once the job monitors of all the trainings are stopped
+	c.Run(ctx, logr)
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelShutdown()
+	jobM.ShutdownTracing(shutdownCtx)
+	return 0
+}
+
+//initProcess sets up the logger of the process and validates the tunables, once, before any job monitor reads them
+func initProcess(trainingID string, userID string) *logger.LocLoggingEntry {
+	logr := logger.LocLogger(jobM.InitLogger(trainingID, userID))
+	jobM.ValidateTunables(logr)
+	return logr
+}